@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/scanner"
+)
+
+// A transaction spending from several addresses tells anyone watching the chain that they have the
+// same owner. Some were linked already, because they appeared together in an earlier transaction
+// (spent together, or paid by the same one). analyzeClusters estimates how many groups of addresses
+// that weren't linked the sweep merges, so users who care can stop before revealing it.
+//
+// It's a simple estimate: addresses are linked if they share a transaction in their history. Chain
+// analysis goes much further, so it can only tell when the sweep reveals something new, not when
+// it's safe.
+
+// clusterAnalysis is what the inputs of a transaction reveal.
+type clusterAnalysis struct {
+	Addresses int  // distinct addresses spent from
+	Clusters  int  // groups of them that weren't linked before
+	Partial   bool // the history couldn't be checked, so some links may be missing
+}
+
+// analyzeClusters groups the outputs to spend by the transactions their addresses appeared in,
+// looking up their history with the given servers. Offline, only the transactions that created
+// the outputs are known.
+func analyzeClusters(servers []string, utxos []*scanner.Utxo) *clusterAnalysis {
+	clusters := newUnionFind(len(utxos))
+	firstSeen := make(map[string]int) // address or transaction to the first output seen with it
+
+	link := func(i int, key string) {
+		if first, ok := firstSeen[key]; ok {
+			clusters.union(first, i)
+		} else {
+			firstSeen[key] = i
+		}
+	}
+
+	addresses := make(map[string]bool)
+
+	for i, utxo := range utxos {
+		script := hex.EncodeToString(utxo.Script)
+		addresses[script] = true
+
+		link(i, "script:"+script)
+		link(i, "tx:"+utxo.TxID)
+	}
+
+	analysis := &clusterAnalysis{Addresses: len(addresses)}
+
+	histories, err := fetchHistories(servers, utxos)
+	if err != nil {
+		analysis.Partial = true
+	}
+
+	for i, history := range histories {
+		for _, ref := range history {
+			link(i, "tx:"+ref.TxHash)
+		}
+	}
+
+	analysis.Clusters = clusters.count()
+
+	return analysis
+}
+
+// fetchHistories returns the history of the address of each output, in order. Outputs of the same
+// address share it.
+func fetchHistories(servers []string, utxos []*scanner.Utxo) ([][]electrum.HistoryRef, error) {
+	if *historyDump != "" {
+		return nil, fmt.Errorf("scanning offline, there's no history to check")
+	}
+
+	if *chainBackend != backendElectrum {
+		return nil, fmt.Errorf("the %s backend has no history to check", *chainBackend)
+	}
+
+	if *lowBandwidth {
+		return nil, fmt.Errorf("histories are not downloaded with --low-bandwidth")
+	}
+
+	provider := electrum.NewServerProviderFrom(servers)
+	client := electrum.NewClient()
+
+	var err error
+	for attempt := 0; attempt < 3 && !client.IsConnected(); attempt++ {
+		err = client.Connect(provider.NextServer())
+	}
+
+	if !client.IsConnected() {
+		return nil, err
+	}
+	defer client.Disconnect()
+
+	byHash := make(map[string][]electrum.HistoryRef)
+	histories := make([][]electrum.HistoryRef, len(utxos))
+
+	for i, utxo := range utxos {
+		indexHash := electrum.GetIndexHash(utxo.Script)
+
+		history, ok := byHash[indexHash]
+		if !ok {
+			history, err = client.GetHistory(indexHash)
+			if err != nil {
+				return histories, err
+			}
+
+			byHash[indexHash] = history
+		}
+
+		histories[i] = history
+	}
+
+	return histories, nil
+}
+
+// describe summarizes the analysis for the confirmation summary.
+func (a *clusterAnalysis) describe() string {
+	var description string
+
+	switch {
+	case a.Addresses <= 1:
+		return "spends from a single address, reveals no links between your addresses"
+
+	case a.Clusters <= 1:
+		description = fmt.Sprintf("spends from %d addresses already linked on chain, reveals no new links", a.Addresses)
+
+	default:
+		description = fmt.Sprintf(
+			"merges %d groups of addresses that weren't linked on chain (%d addresses), revealing they have the same owner",
+			a.Clusters,
+			a.Addresses,
+		)
+	}
+
+	if a.Partial {
+		description += " (their history couldn't be checked, there may be fewer groups)"
+	}
+
+	return description
+}
+
+// unionFind groups the elements 0..n-1 into disjoint sets.
+type unionFind struct {
+	parent []int
+}
+
+func newUnionFind(n int) *unionFind {
+	parent := make([]int, n)
+	for i := range parent {
+		parent[i] = i
+	}
+
+	return &unionFind{parent}
+}
+
+func (u *unionFind) find(i int) int {
+	for u.parent[i] != i {
+		u.parent[i] = u.parent[u.parent[i]]
+		i = u.parent[i]
+	}
+
+	return i
+}
+
+func (u *unionFind) union(i, j int) {
+	u.parent[u.find(i)] = u.find(j)
+}
+
+// count returns how many sets there are.
+func (u *unionFind) count() int {
+	sets := 0
+	for i := range u.parent {
+		if u.find(i) == i {
+			sets++
+		}
+	}
+
+	return sets
+}
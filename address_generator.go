@@ -5,23 +5,46 @@ import (
 	"log"
 
 	"github.com/muun/libwallet"
+	"github.com/muun/recovery/keys"
 )
 
+// addressVersions are the address versions we generate for every derivation path. Version 1 was
+// only used by the earliest wallets, but their users may still have funds there.
+var addressVersions = []int{1, 2, 3, 4, 5}
+
+// addressLimits are the last indexes generated in each chain of addresses, counting from 0. Wallets
+// don't use a gap limit, so we derive fixed ranges.
+type addressLimits struct {
+	change           int64
+	external         int64
+	contacts         int64
+	contactAddresses int64 // in the chain of each contact
+}
+
+// fastLimits cover the addresses wallets actually use, with room to spare.
+var fastLimits = addressLimits{change: 2500, external: 2500, contacts: 100, contactAddresses: 200}
+
+// forensicLimits go much further, for wallets with funds where no wallet should have put them. They
+// take several times longer to derive and scan.
+var forensicLimits = addressLimits{change: 10000, external: 10000, contacts: 200, contactAddresses: 300}
+
 type signingDetails struct {
 	Address libwallet.MuunAddress
 }
 
 type AddressGenerator struct {
 	addrs   map[string]signingDetails
-	userKey *libwallet.HDPrivateKey
-	muunKey *libwallet.HDPrivateKey
+	userKey keys.PrivateKey
+	muunKey keys.PrivateKey
+	limits  addressLimits
 }
 
-func NewAddressGenerator(userKey, muunKey *libwallet.HDPrivateKey) *AddressGenerator {
+func NewAddressGenerator(userKey, muunKey keys.PrivateKey, limits addressLimits) *AddressGenerator {
 	return &AddressGenerator{
 		addrs:   make(map[string]signingDetails),
 		userKey: userKey,
 		muunKey: muunKey,
+		limits:  limits,
 	}
 }
 
@@ -29,12 +52,15 @@ func (g *AddressGenerator) Addresses() map[string]signingDetails {
 	return g.addrs
 }
 
-// Stream returns a channel that emits all addresses generated.
+// Stream returns a channel that emits all addresses generated. They're derived on the first call,
+// and reused after that.
 func (g *AddressGenerator) Stream() chan libwallet.MuunAddress {
 	ch := make(chan libwallet.MuunAddress)
 
 	go func() {
-		g.generate()
+		if len(g.addrs) == 0 {
+			g.generate()
+		}
 
 		for _, details := range g.Addresses() {
 			ch <- details.Address
@@ -49,7 +75,7 @@ func (g *AddressGenerator) Stream() chan libwallet.MuunAddress {
 func (g *AddressGenerator) generate() {
 	g.generateChangeAddrs()
 	g.generateExternalAddrs()
-	g.generateContactAddrs(100)
+	g.generateContactAddrs(g.limits.contacts)
 }
 
 func (g *AddressGenerator) generateChangeAddrs() {
@@ -57,7 +83,7 @@ func (g *AddressGenerator) generateChangeAddrs() {
 	changeUserKey, _ := g.userKey.DeriveTo(changePath)
 	changeMuunKey, _ := g.muunKey.DeriveTo(changePath)
 
-	g.deriveTree(changeUserKey, changeMuunKey, 2500, "change")
+	g.deriveTree(changeUserKey, changeMuunKey, g.limits.change, "change")
 }
 
 func (g *AddressGenerator) generateExternalAddrs() {
@@ -65,7 +91,7 @@ func (g *AddressGenerator) generateExternalAddrs() {
 	externalUserKey, _ := g.userKey.DeriveTo(externalPath)
 	externalMuunKey, _ := g.muunKey.DeriveTo(externalPath)
 
-	g.deriveTree(externalUserKey, externalMuunKey, 2500, "external")
+	g.deriveTree(externalUserKey, externalMuunKey, g.limits.external, "external")
 }
 
 func (g *AddressGenerator) generateContactAddrs(numContacts int64) {
@@ -77,11 +103,11 @@ func (g *AddressGenerator) generateContactAddrs(numContacts int64) {
 		partialMuunUserKey, _ := contactMuunKey.DerivedAt(i, false)
 
 		branch := fmt.Sprintf("contacts-%v", i)
-		g.deriveTree(partialContactUserKey, partialMuunUserKey, 200, branch)
+		g.deriveTree(partialContactUserKey, partialMuunUserKey, g.limits.contactAddresses, branch)
 	}
 }
 
-func (g *AddressGenerator) deriveTree(rootUserKey, rootMuunKey *libwallet.HDPrivateKey, count int64, name string) {
+func (g *AddressGenerator) deriveTree(rootUserKey, rootMuunKey keys.PrivateKey, count int64, name string) {
 
 	for i := int64(0); i <= count; i++ {
 		userKey, err := rootUserKey.DerivedAt(i, false)
@@ -95,40 +121,15 @@ func (g *AddressGenerator) deriveTree(rootUserKey, rootMuunKey *libwallet.HDPriv
 			continue
 		}
 
-		addrV2, err := libwallet.CreateAddressV2(userKey.PublicKey(), muunKey.PublicKey())
-		if err == nil {
-			g.addrs[addrV2.Address()] = signingDetails{
-				Address: addrV2,
-			}
-		} else {
-			log.Printf("failed to generate %v v2 for %v due to %v", name, i, err)
-		}
-
-		addrV3, err := libwallet.CreateAddressV3(userKey.PublicKey(), muunKey.PublicKey())
-		if err == nil {
-			g.addrs[addrV3.Address()] = signingDetails{
-				Address: addrV3,
-			}
-		} else {
-			log.Printf("failed to generate %v v3 for %v due to %v", name, i, err)
-		}
-
-		addrV4, err := libwallet.CreateAddressV4(userKey.PublicKey(), muunKey.PublicKey())
-		if err == nil {
-			g.addrs[addrV4.Address()] = signingDetails{
-				Address: addrV4,
-			}
-		} else {
-			log.Printf("failed to generate %v v4 for %v due to %v", name, i, err)
-		}
-
-		addrV5, err := libwallet.CreateAddressV5(userKey.PublicKey(), muunKey.PublicKey())
-		if err == nil {
-			g.addrs[addrV5.Address()] = signingDetails{
-				Address: addrV5,
+		for _, version := range addressVersions {
+			addr, err := keyBackend.CreateAddress(version, userKey.PublicKey(), muunKey.PublicKey())
+			if err == nil {
+				g.addrs[addr.Address()] = signingDetails{
+					Address: addr,
+				}
+			} else {
+				log.Printf("failed to generate %v v%v for %v due to %v", name, version, i, err)
 			}
-		} else {
-			log.Printf("failed to generate %v v5 for %v due to %v", name, i, err)
 		}
 	}
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// addressChunkSize is the number of characters the user types at a time when verifying.
+const addressChunkSize = 8
+
+// readVerifiedAddress reads the destination address and, if enabled, has the user confirm it
+// through a second, independent entry.
+func readVerifiedAddress() btcutil.Address {
+	addr := readAddress()
+
+	if !*verifyDestination {
+		return addr
+	}
+
+	if verifyAddressInChunks(addr.String()) {
+		say("\n{green ✓ Address verified}\n")
+		return addr
+	}
+
+	return readVerifiedAddress()
+}
+
+// verifyAddressInChunks asks the user to type the address again in small pieces, in a random
+// order, reading them from the destination wallet rather than the clipboard.
+//
+// Clipboard-hijacking malware replaces copied addresses with the attacker's. A user pasting the
+// address can't notice, but they can't paste it piece by piece in a shuffled order either, so the
+// second entry comes from the real source. If the two disagree, something is very wrong.
+func verifyAddressInChunks(address string) bool {
+	sayBlock(`
+		{yellow Let's verify the destination address}
+		Open your destination wallet, and type the characters of the address it shows as requested.
+		{white Don't copy and paste}, read them from the screen.
+	`)
+
+	var chunks []string
+	for start := 0; start < len(address); start += addressChunkSize {
+		end := start + addressChunkSize
+		if end > len(address) {
+			end = len(address)
+		}
+
+		chunks = append(chunks, address[start:end])
+	}
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for _, i := range random.Perm(len(chunks)) {
+		start := i*addressChunkSize + 1
+		end := start + len(chunks[i]) - 1
+
+		sayBlock("Characters {white %d} to {white %d}:\n", start, end)
+
+		var userInput string
+		ask(&userInput)
+
+		if !sameAddressChunk(address, chunks[i], strings.TrimSpace(userInput)) {
+			sayBlock(`
+				{red The characters don't match the address you entered.}
+				If you pasted the address, your clipboard may have been tampered with. Don't go ahead
+				until you understand why they differ. Please, enter your destination address again
+			`)
+
+			return false
+		}
+	}
+
+	return true
+}
+
+// sameAddressChunk compares pieces of an address, ignoring case for bech32 addresses.
+func sameAddressChunk(address, expected, actual string) bool {
+	if strings.HasPrefix(strings.ToLower(address), "bc1") {
+		return strings.EqualFold(expected, actual)
+	}
+
+	return expected == actual
+}
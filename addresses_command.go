@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/descriptors"
+)
+
+// addressesNetworks are the networks the addresses command derives for, by name.
+var addressesNetworks = map[string]*libwallet.Network{
+	"mainnet": libwallet.Mainnet(),
+	"testnet": libwallet.Testnet(),
+	"regtest": libwallet.Regtest(),
+}
+
+// runAddressesCommand prints the addresses of a descriptor with public keys. It's meant for
+// support: it needs no Emergency Kit or Recovery Code, and doesn't connect to the network.
+func runAddressesCommand(args []string) {
+	flags := flag.NewFlagSet("addresses", flag.ExitOnError)
+	networkName := flags.String("network", "mainnet", "the network of the keys: mainnet, testnet or regtest")
+	start := flags.Int64("start", 0, "the index of the first address")
+	count := flags.Int64("count", 20, "how many addresses to print")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	network, ok := addressesNetworks[*networkName]
+	if !ok {
+		exitWithError(fmt.Errorf("unknown network %q", *networkName))
+	}
+
+	addresses, err := descriptors.GenerateAddresses(flags.Arg(0), network, *start, *count)
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to derive addresses: %w", err))
+	}
+
+	for _, address := range addresses {
+		fmt.Printf("%s\t%s\n", address.DerivationPath(), address.Address())
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// maxApprovalAttempts is how many wrong secrets we accept before giving up.
+const maxApprovalAttempts = 3
+
+// Parameters for hashing approval secrets. They're never stored in plain text.
+const (
+	approvalScryptN      = 1 << 15
+	approvalScryptR      = 8
+	approvalScryptP      = 1
+	approvalHashLength   = 32
+	approvalSaltLength   = 16
+	approvalMinSecretLen = 8
+)
+
+// approvalPolicy requires a number of distinct people to approve a sweep before it's signed, for
+// organizations that keep their funds under dual control. It's read from a JSON file like:
+//
+//	{
+//	  "required": 2,
+//	  "approvers": [
+//	    {"name": "alice", "salt": "...", "secretHash": "..."},
+//	    {"name": "bob", "salt": "...", "secretHash": "..."}
+//	  ]
+//	}
+//
+// Entries are generated with the `approver` subcommand.
+type approvalPolicy struct {
+	Required  int        `json:"required"`
+	Approvers []approver `json:"approvers"`
+}
+
+// approver is a person allowed to approve a sweep, identified by a secret only they know.
+type approver struct {
+	Name       string `json:"name"`
+	Salt       string `json:"salt"`
+	SecretHash string `json:"secretHash"`
+}
+
+func loadApprovalPolicy(path string) (*approvalPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read approval policy: %w", err)
+	}
+
+	var policy approvalPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse approval policy in %s: %w", path, err)
+	}
+
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid approval policy in %s: %w", path, err)
+	}
+
+	return &policy, nil
+}
+
+func (p *approvalPolicy) validate() error {
+	if p.Required < 2 {
+		return fmt.Errorf("at least 2 approvals must be required, found %d", p.Required)
+	}
+
+	if len(p.Approvers) < p.Required {
+		return fmt.Errorf("%d approvals are required, but only %d approvers are listed", p.Required, len(p.Approvers))
+	}
+
+	names := make(map[string]bool)
+	hashes := make(map[string]bool)
+
+	for _, a := range p.Approvers {
+		if a.Name == "" {
+			return fmt.Errorf("approvers must have a name")
+		}
+
+		if names[a.Name] {
+			return fmt.Errorf("approver %s is listed twice", a.Name)
+		}
+
+		if _, err := hex.DecodeString(a.Salt); err != nil || a.Salt == "" {
+			return fmt.Errorf("approver %s has an invalid salt", a.Name)
+		}
+
+		if hash, err := hex.DecodeString(a.SecretHash); err != nil || len(hash) != approvalHashLength {
+			return fmt.Errorf("approver %s has an invalid secret hash", a.Name)
+		}
+
+		// The same secret under two names would let one person approve twice. Copied entries are
+		// caught here, the same secret under different salts when it's entered (see sharing):
+		if hashes[a.Salt+a.SecretHash] {
+			return fmt.Errorf("approver %s shares a secret with another approver", a.Name)
+		}
+
+		names[a.Name] = true
+		hashes[a.Salt+a.SecretHash] = true
+	}
+
+	return nil
+}
+
+// find returns the approver with a given name.
+func (p *approvalPolicy) find(name string) (*approver, bool) {
+	for i := range p.Approvers {
+		if p.Approvers[i].Name == name {
+			return &p.Approvers[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// sharing returns another approver with the same secret as the given one, if any.
+func (p *approvalPolicy) sharing(a *approver, secret string) (*approver, bool) {
+	for i := range p.Approvers {
+		other := &p.Approvers[i]
+
+		if other.Name != a.Name && other.matches(secret) {
+			return other, true
+		}
+	}
+
+	return nil, false
+}
+
+// matches returns whether a secret is this approver's.
+func (a *approver) matches(secret string) bool {
+	salt, _ := hex.DecodeString(a.Salt) // checked when loading
+	expected, _ := hex.DecodeString(a.SecretHash)
+
+	actual, err := hashApprovalSecret(secret, salt)
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(actual, expected) == 1
+}
+
+func newApprover(name, secret string) (*approver, error) {
+	salt := make([]byte, approvalSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	hash, err := hashApprovalSecret(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &approver{name, hex.EncodeToString(salt), hex.EncodeToString(hash)}, nil
+}
+
+func hashApprovalSecret(secret string, salt []byte) ([]byte, error) {
+	hash, err := scrypt.Key([]byte(secret), salt, approvalScryptN, approvalScryptR, approvalScryptP, approvalHashLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash secret: %w", err)
+	}
+
+	return hash, nil
+}
+
+// readApprovals asks approvers for their secrets, until the policy is satisfied. Each approver
+// counts once. Too many wrong secrets stop the Recovery Tool.
+func readApprovals(policy *approvalPolicy) {
+	sayBlock(`
+		{whiteUnderline Approval required}
+		This recovery needs the approval of %d people before the transaction is signed.
+	`, policy.Required)
+
+	approved := make(map[string]bool)
+	failures := 0
+
+	for len(approved) < policy.Required {
+		sayBlock(`
+			{yellow Approval %d of %d: enter your name}
+		`, len(approved)+1, policy.Required)
+
+		var name string
+		ask(&name)
+		name = strings.TrimSpace(name)
+
+		if approved[name] {
+			say("%s already approved. A different person must approve now\n", name)
+			continue
+		}
+
+		sayBlock(`
+			{yellow %s, enter your approval secret}
+		`, name)
+
+		secret := readPassphrase()
+
+		// We check the secret even if the name is unknown, not to reveal who the approvers are:
+		a, ok := policy.find(name)
+		if !ok {
+			a = &policy.Approvers[0]
+		}
+
+		if a.matches(secret) && ok {
+			// Entries with the same secret have different salts, and can only be told apart with
+			// the secret. One person knowing it could approve as each of them:
+			if other, shared := policy.sharing(a, secret); shared {
+				sayBlock(`
+					{red The secret of %s is also the one of %s}
+					Each approver needs a secret of their own. Recovery tool stopped. Nothing was signed
+				`, name, other.Name)
+				os.Exit(1)
+			}
+
+			approved[name] = true
+			say("{green ✓ Approved by %s}\n", name)
+			continue
+		}
+
+		failures++
+		if failures >= maxApprovalAttempts {
+			sayBlock(`
+				{red Too many failed approvals}
+				Recovery tool stopped. Nothing was signed
+			`)
+			os.Exit(1)
+		}
+
+		say("The name or secret is not valid. Please, try again\n")
+	}
+}
+
+// runApproverCommand creates an approver entry for an approval policy file.
+func runApproverCommand(args []string) {
+	if len(args) != 0 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	sayBlock(`
+		{yellow Enter the approver's name}
+	`)
+
+	var name string
+	ask(&name)
+
+	secret := readNewApprovalSecret()
+
+	a, err := newApprover(strings.TrimSpace(name), secret)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	entry, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		exitWithError(err)
+	}
+
+	sayBlock(`
+		Add this entry to the {white approvers} in your approval policy file:
+
+	`)
+
+	fmt.Println(string(entry))
+}
+
+func readNewApprovalSecret() string {
+	sayBlock(`
+		{yellow Enter the approval secret} (at least %d characters, no spaces)
+	`, approvalMinSecretLen)
+
+	secret := readPassphrase()
+
+	if len(secret) < approvalMinSecretLen {
+		say("The secret is too short. Please, try again\n")
+		return readNewApprovalSecret()
+	}
+
+	sayBlock(`
+		{yellow Enter the approval secret again}
+	`)
+
+	if readPassphrase() != secret {
+		say("The secrets don't match. Please, try again\n")
+		return readNewApprovalSecret()
+	}
+
+	return secret
+}
@@ -0,0 +1,349 @@
+// Package artifacts encodes the intermediate results the Recovery Tool passes between its stages,
+// using the protobuf schema in artifacts.proto.
+//
+// Artifacts are always wrapped in an Envelope, which carries the schema version and tells readers
+// what kind of artifact they're looking at.
+package artifacts
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// SchemaVersion is the version of artifacts.proto this package implements.
+const SchemaVersion = 1
+
+// ScanResults are the unspent outputs found by a scan.
+type ScanResults struct {
+	ScannedAt        int64 // unix seconds
+	ScannedAddresses uint32
+	Utxos            []*Utxo
+
+	WalletFingerprint string // of the user key, in hex
+	CaseID            string
+}
+
+// Utxo is an unspent output in ScanResults.
+type Utxo struct {
+	TxID           string
+	OutputIndex    uint32
+	Amount         int64
+	Address        string
+	AddressVersion uint32
+	DerivationPath string
+	Script         []byte
+}
+
+// UnsignedTx is a proposed sweep, before signing.
+type UnsignedTx struct {
+	Tx          []byte
+	Destination string
+	Amount      int64
+	Fee         int64
+}
+
+// SigningPackage is everything a signer needs to check a sweep before signing it.
+type SigningPackage struct {
+	UserKey string
+	MuunKey string
+	Scan    *ScanResults
+	Tx      *UnsignedTx
+}
+
+// SignedTx is a sweep ready to be broadcast.
+type SignedTx struct {
+	Tx []byte
+}
+
+// Field numbers of the Envelope artifacts.
+const (
+	envelopeVersionField     = 1
+	envelopeScanResultsField = 2
+	envelopeUnsignedTxField  = 3
+	envelopeSigningPkgField  = 4
+	envelopeSignedTxField    = 5
+)
+
+// Marshal wraps an artifact in an Envelope, and encodes it.
+func Marshal(artifact interface{}) ([]byte, error) {
+	var field protowire.Number
+	var payload []byte
+
+	switch a := artifact.(type) {
+	case *ScanResults:
+		field, payload = envelopeScanResultsField, a.marshal()
+	case *UnsignedTx:
+		field, payload = envelopeUnsignedTxField, a.marshal()
+	case *SigningPackage:
+		field, payload = envelopeSigningPkgField, a.marshal()
+	case *SignedTx:
+		field, payload = envelopeSignedTxField, a.marshal()
+	default:
+		return nil, fmt.Errorf("unknown artifact type %T", artifact)
+	}
+
+	var b []byte
+	b = appendVarint(b, envelopeVersionField, SchemaVersion)
+	b = appendBytes(b, field, payload)
+
+	return b, nil
+}
+
+// Unmarshal decodes an Envelope, and returns the artifact inside: a *ScanResults, *UnsignedTx,
+// *SigningPackage or *SignedTx.
+func Unmarshal(data []byte) (interface{}, error) {
+	var version uint64
+	var artifact interface{}
+
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error {
+		var err error
+
+		switch num {
+		case envelopeVersionField:
+			version = varint
+		case envelopeScanResultsField:
+			r := &ScanResults{}
+			artifact, err = r, r.unmarshal(value)
+		case envelopeUnsignedTxField:
+			t := &UnsignedTx{}
+			artifact, err = t, t.unmarshal(value)
+		case envelopeSigningPkgField:
+			p := &SigningPackage{}
+			artifact, err = p, p.unmarshal(value)
+		case envelopeSignedTxField:
+			t := &SignedTx{}
+			artifact, err = t, t.unmarshal(value)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact: %w", err)
+	}
+
+	if version == 0 || version > SchemaVersion {
+		return nil, fmt.Errorf("unsupported artifact schema version %d", version)
+	}
+
+	if artifact == nil {
+		return nil, fmt.Errorf("invalid artifact: it's empty, or of a kind we don't know")
+	}
+
+	return artifact, nil
+}
+
+func (r *ScanResults) marshal() []byte {
+	var b []byte
+	b = appendVarint(b, 1, uint64(r.ScannedAt))
+	b = appendVarint(b, 2, uint64(r.ScannedAddresses))
+
+	for _, utxo := range r.Utxos {
+		b = appendBytes(b, 3, utxo.marshal())
+	}
+
+	b = appendString(b, 4, r.WalletFingerprint)
+	b = appendString(b, 5, r.CaseID)
+
+	return b
+}
+
+func (r *ScanResults) unmarshal(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error {
+		switch num {
+		case 1:
+			r.ScannedAt = int64(varint)
+		case 2:
+			r.ScannedAddresses = uint32(varint)
+		case 3:
+			utxo := &Utxo{}
+			if err := utxo.unmarshal(value); err != nil {
+				return err
+			}
+			r.Utxos = append(r.Utxos, utxo)
+		case 4:
+			r.WalletFingerprint = string(value)
+		case 5:
+			r.CaseID = string(value)
+		}
+
+		return nil
+	})
+}
+
+func (u *Utxo) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, u.TxID)
+	b = appendVarint(b, 2, uint64(u.OutputIndex))
+	b = appendVarint(b, 3, uint64(u.Amount))
+	b = appendString(b, 4, u.Address)
+	b = appendVarint(b, 5, uint64(u.AddressVersion))
+	b = appendString(b, 6, u.DerivationPath)
+	b = appendBytes(b, 7, u.Script)
+
+	return b
+}
+
+func (u *Utxo) unmarshal(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error {
+		switch num {
+		case 1:
+			u.TxID = string(value)
+		case 2:
+			u.OutputIndex = uint32(varint)
+		case 3:
+			u.Amount = int64(varint)
+		case 4:
+			u.Address = string(value)
+		case 5:
+			u.AddressVersion = uint32(varint)
+		case 6:
+			u.DerivationPath = string(value)
+		case 7:
+			u.Script = value
+		}
+
+		return nil
+	})
+}
+
+func (t *UnsignedTx) marshal() []byte {
+	var b []byte
+	b = appendBytes(b, 1, t.Tx)
+	b = appendString(b, 2, t.Destination)
+	b = appendVarint(b, 3, uint64(t.Amount))
+	b = appendVarint(b, 4, uint64(t.Fee))
+
+	return b
+}
+
+func (t *UnsignedTx) unmarshal(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error {
+		switch num {
+		case 1:
+			t.Tx = value
+		case 2:
+			t.Destination = string(value)
+		case 3:
+			t.Amount = int64(varint)
+		case 4:
+			t.Fee = int64(varint)
+		}
+
+		return nil
+	})
+}
+
+func (p *SigningPackage) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, p.UserKey)
+	b = appendString(b, 2, p.MuunKey)
+
+	if p.Scan != nil {
+		b = appendBytes(b, 3, p.Scan.marshal())
+	}
+
+	if p.Tx != nil {
+		b = appendBytes(b, 4, p.Tx.marshal())
+	}
+
+	return b
+}
+
+func (p *SigningPackage) unmarshal(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error {
+		switch num {
+		case 1:
+			p.UserKey = string(value)
+		case 2:
+			p.MuunKey = string(value)
+		case 3:
+			p.Scan = &ScanResults{}
+			return p.Scan.unmarshal(value)
+		case 4:
+			p.Tx = &UnsignedTx{}
+			return p.Tx.unmarshal(value)
+		}
+
+		return nil
+	})
+}
+
+func (t *SignedTx) marshal() []byte {
+	return appendBytes(nil, 1, t.Tx)
+}
+
+func (t *SignedTx) unmarshal(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error {
+		if num == 1 {
+			t.Tx = value
+		}
+
+		return nil
+	})
+}
+
+// Encoding helpers. Like generated code, they omit fields with default values.
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	return appendBytes(b, num, []byte(v))
+}
+
+// consumeFields calls `fn` for each field in a message, with its value: the bytes of
+// length-delimited fields, or the number of varint fields. Fields of other types are skipped, as
+// are unknown fields (`fn` ignores them), so newer writers don't break older readers.
+func consumeFields(data []byte, fn func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var value []byte
+		var varint uint64
+
+		switch typ {
+		case protowire.VarintType:
+			varint, n = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+
+		if err := fn(num, typ, value, varint); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/muun/recovery/electrum"
+)
+
+// backendSupport is what every configured server (see --servers) supports. Features that need
+// something one of them lacks are turned off at startup, with a notice, instead of failing halfway
+// through the recovery. Without configured servers, we rotate through public ones and every
+// feature copes with their failures as it always did.
+var backendSupport = electrum.Capabilities{
+	Batching:     true,
+	FeeEstimates: true,
+	Mempool:      true,
+	HeaderProofs: true,
+}
+
+// probeBackends asks each configured server what it supports, and tells the user which features
+// are turned off as a result. Servers that can't be reached are left to the usual rotation.
+// Backends other than Electrum servers support none of these features (see --backend).
+func probeBackends(servers []string) {
+	if *historyDump != "" {
+		return // scanning offline, there's no backend to ask
+	}
+
+	source := "your servers"
+
+	if *chainBackend != backendElectrum {
+		source = "the " + *chainBackend + " backend"
+		servers = nil
+
+		backendSupport.FeeEstimates = false
+		backendSupport.Mempool = false
+		backendSupport.HeaderProofs = false
+	}
+
+	for _, server := range servers {
+		client := electrum.NewClient()
+		if err := client.Connect(server); err != nil {
+			say("{yellow Couldn't reach %s} to check what it supports: %v\n", server, err)
+			continue
+		}
+
+		capabilities := client.ProbeCapabilities()
+		client.Disconnect()
+
+		if !capabilities.Batching {
+			say("{yellow %s doesn't support batching}, scanning with it will be slower\n", server)
+		}
+
+		backendSupport.Batching = backendSupport.Batching && capabilities.Batching
+		backendSupport.FeeEstimates = backendSupport.FeeEstimates && capabilities.FeeEstimates
+		backendSupport.Mempool = backendSupport.Mempool && capabilities.Mempool
+		backendSupport.HeaderProofs = backendSupport.HeaderProofs && capabilities.HeaderProofs
+	}
+
+	if !backendSupport.FeeEstimates {
+		say("{yellow Fee estimates are not supported} by %s, you'll choose the fee without them\n", source)
+	}
+
+	if !backendSupport.Mempool {
+		say("{yellow Following your funds is not supported} by %s, changes while you decide won't be shown\n", source)
+	}
+
+	if !backendSupport.HeaderProofs && *exportEvidence != "" {
+		say("{yellow Proofs of the funds are not supported} by %s, --export-evidence is turned off\n", source)
+		*exportEvidence = ""
+	}
+}
@@ -0,0 +1,261 @@
+// Package bip38 encrypts and decrypts single private keys with a passphrase, as described in
+// BIP-38. Encrypted keys start with 6P, and are common in paper wallets.
+//
+// Keys encrypted by their owner, and those made with EC multiplication (by a third party that never
+// saw the private key, from an "intermediate code") can be decrypted. Encryption uses the former.
+package bip38
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/base58"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Encrypted keys are base58check, with a 2-byte prefix. The first byte goes in the version byte.
+const (
+	prefixVersion   = 0x01
+	prefixPlain     = 0x42
+	prefixECMult    = 0x43
+	encryptedLength = 38 // after the version byte
+)
+
+// Flags in the third byte.
+const (
+	flagPlain      = 0xc0 // set for keys encrypted without EC multiplication
+	flagCompressed = 0x20
+	flagLotAndSeq  = 0x04 // EC multiplied keys only
+)
+
+// Parameters of scrypt, fixed by the BIP.
+const (
+	scryptN, scryptR, scryptP             = 16384, 8, 8
+	seedScryptN, seedScryptR, seedScryptP = 1024, 1, 1
+)
+
+// ErrWrongPassphrase means the passphrase doesn't decrypt the key. Keys are checked against a hash
+// of their address, so a wrong passphrase is always detected.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// IsEncrypted returns whether a string looks like a BIP-38 encrypted key.
+func IsEncrypted(encoded string) bool {
+	payload, version, err := base58.CheckDecode(encoded)
+	return err == nil && version == prefixVersion && len(payload) == encryptedLength &&
+		(payload[0] == prefixPlain || payload[0] == prefixECMult)
+}
+
+// Encrypt encrypts a private key with a passphrase, without EC multiplication. The key is checked
+// against its address in `params` when decrypted.
+func Encrypt(key *btcec.PrivateKey, compressed bool, passphrase string, params *chaincfg.Params) (string, error) {
+	flag := byte(flagPlain)
+	if compressed {
+		flag |= flagCompressed
+	}
+
+	addressHash, err := addressChecksum(key.PubKey(), compressed, params)
+	if err != nil {
+		return "", err
+	}
+
+	derived, err := scrypt.Key(normalize(passphrase), addressHash, scryptN, scryptR, scryptP, 64)
+	if err != nil {
+		return "", err
+	}
+
+	secret := paddedBytes(key.D)
+	half1, half2 := derived[:32], derived[32:]
+
+	block, err := aes.NewCipher(half2)
+	if err != nil {
+		return "", err
+	}
+
+	encrypted := make([]byte, 32)
+	block.Encrypt(encrypted[:16], xor(secret[:16], half1[:16]))
+	block.Encrypt(encrypted[16:], xor(secret[16:], half1[16:]))
+
+	payload := append([]byte{prefixPlain, flag}, addressHash...)
+	payload = append(payload, encrypted...)
+
+	return base58.CheckEncode(payload, prefixVersion), nil
+}
+
+// Decrypt decrypts a key, and returns it in WIF, for the network in `params`.
+func Decrypt(encoded string, passphrase string, params *chaincfg.Params) (*btcutil.WIF, error) {
+	payload, version, err := base58.CheckDecode(encoded)
+	if err != nil || version != prefixVersion || len(payload) != encryptedLength {
+		return nil, fmt.Errorf("not a BIP-38 encrypted key")
+	}
+
+	flag := payload[1]
+	compressed := flag&flagCompressed != 0
+	addressHash := payload[2:6]
+
+	var key *btcec.PrivateKey
+
+	switch payload[0] {
+	case prefixPlain:
+		key, err = decryptPlain(payload, passphrase)
+	case prefixECMult:
+		key, err = decryptECMult(payload, passphrase)
+	default:
+		return nil, fmt.Errorf("not a BIP-38 encrypted key")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := addressChecksum(key.PubKey(), compressed, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(expected, addressHash) {
+		return nil, ErrWrongPassphrase
+	}
+
+	return btcutil.NewWIF(key, params, compressed)
+}
+
+func decryptPlain(payload []byte, passphrase string) (*btcec.PrivateKey, error) {
+	addressHash, encrypted := payload[2:6], payload[6:38]
+
+	derived, err := scrypt.Key(normalize(passphrase), addressHash, scryptN, scryptR, scryptP, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	half1, half2 := derived[:32], derived[32:]
+
+	block, err := aes.NewCipher(half2)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	block.Decrypt(secret[:16], encrypted[:16])
+	block.Decrypt(secret[16:], encrypted[16:])
+
+	return privateKey(xor(secret, half1))
+}
+
+func decryptECMult(payload []byte, passphrase string) (*btcec.PrivateKey, error) {
+	flag, addressHash, ownerEntropy := payload[1], payload[2:6], payload[6:14]
+	encryptedPart1, encryptedPart2 := payload[14:22], payload[22:38]
+
+	ownerSalt := ownerEntropy
+	if flag&flagLotAndSeq != 0 {
+		ownerSalt = ownerEntropy[:4]
+	}
+
+	passFactor, err := scrypt.Key(normalize(passphrase), ownerSalt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&flagLotAndSeq != 0 {
+		passFactor = doubleSHA256(append(passFactor, ownerEntropy...))
+	}
+
+	passKey, err := privateKey(passFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	passPoint := passKey.PubKey().SerializeCompressed()
+
+	seedSalt := append(append([]byte{}, addressHash...), ownerEntropy...)
+
+	derived, err := scrypt.Key(passPoint, seedSalt, seedScryptN, seedScryptR, seedScryptP, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	half1, half2 := derived[:32], derived[32:]
+
+	block, err := aes.NewCipher(half2)
+	if err != nil {
+		return nil, err
+	}
+
+	// The second part has the end of the first one, and the end of the seed:
+	decrypted2 := make([]byte, 16)
+	block.Decrypt(decrypted2, encryptedPart2)
+	decrypted2 = xor(decrypted2, half1[16:])
+
+	decrypted1 := make([]byte, 16)
+	block.Decrypt(decrypted1, append(append([]byte{}, encryptedPart1...), decrypted2[:8]...))
+	decrypted1 = xor(decrypted1, half1[:16])
+
+	seedB := append(decrypted1, decrypted2[8:]...)
+	factorB := doubleSHA256(seedB)
+
+	d := new(big.Int).Mul(new(big.Int).SetBytes(passFactor), new(big.Int).SetBytes(factorB))
+	d.Mod(d, btcec.S256().N)
+
+	return privateKey(paddedBytes(d))
+}
+
+// addressChecksum is the first 4 bytes of the double SHA-256 of the address of a key.
+func addressChecksum(publicKey *btcec.PublicKey, compressed bool, params *chaincfg.Params) ([]byte, error) {
+	serialized := publicKey.SerializeUncompressed()
+	if compressed {
+		serialized = publicKey.SerializeCompressed()
+	}
+
+	address, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(serialized), params)
+	if err != nil {
+		return nil, err
+	}
+
+	return doubleSHA256([]byte(address.EncodeAddress()))[:4], nil
+}
+
+func privateKey(secret []byte) (*btcec.PrivateKey, error) {
+	d := new(big.Int).SetBytes(secret)
+	if d.Sign() == 0 || d.Cmp(btcec.S256().N) >= 0 {
+		return nil, ErrWrongPassphrase // not a valid key, so it wasn't decrypted right
+	}
+
+	key, _ := btcec.PrivKeyFromBytes(btcec.S256(), secret)
+	return key, nil
+}
+
+// normalize applies the Unicode normalization the BIP requires, so passphrases with accents match
+// however they were typed.
+func normalize(passphrase string) []byte {
+	return norm.NFC.Bytes([]byte(passphrase))
+}
+
+func doubleSHA256(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+
+	return second[:]
+}
+
+func paddedBytes(n *big.Int) []byte {
+	padded := make([]byte, 32)
+	raw := n.Bytes()
+
+	return append(padded[:32-len(raw)], raw...)
+}
+
+func xor(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+
+	return result
+}
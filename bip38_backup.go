@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/bip38"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/scanner"
+)
+
+// With --export-bip38, the private keys of every address with funds are saved to a text file, each
+// encrypted with BIP-38 using a passphrase the user chooses, for a password-protected paper backup.
+// Each line is an address:
+//
+//	<address> v<version> <derivation path> <user key> <Muun key>
+//
+// Version 1 addresses are controlled by the user key alone, and have "-" for the Muun key. The rest
+// need both keys, in the scripts described by the descriptors of the migration assistant.
+
+// bip38BackupHeader explains the file to whoever finds it, years from now.
+const bip38BackupHeader = `# Private keys of a Muun wallet, encrypted with BIP-38. Made by the Recovery Tool on %s%s.
+#
+# Each line is an address with funds: the address, its version, its derivation path, and the
+# user and Muun keys that control it. Version 1 addresses need the user key alone. Versions 2 to 4
+# are 2-of-2 multisig with the user key first, and version 5 is taproot (MuSig2).
+#
+# Anyone with this file and its passphrase can take the funds.
+`
+
+// writeBIP38Backup asks for a passphrase, and saves the encrypted keys of the addresses of some
+// UTXOs to a file.
+func writeBIP38Backup(path string, generations []*keyGeneration, utxos []*scanner.Utxo) {
+	sayBlock(`
+		{whiteUnderline Encrypted key backup}
+		The keys of each address with funds will be encrypted with BIP-38, with a passphrase you
+		choose. {red Anyone with the file and the passphrase can take your funds.}
+	`)
+
+	passphrase := readNewPassphrase()
+
+	say("► Encrypting the keys...\n")
+
+	tag := ""
+	if described := currentTag().describe(); described != "" {
+		tag = ", for " + described
+	}
+
+	lines := []string{fmt.Sprintf(bip38BackupHeader, time.Now().UTC().Format("2006-01-02 UTC"), tag)}
+	saved := make(map[string]bool)
+
+	for _, utxo := range utxos {
+		if saved[utxo.Address.Address()] {
+			continue
+		}
+
+		generation := generationOf(generations, utxo)
+		if generation == nil {
+			exitWithError(fmt.Errorf("no kit controls %s", utxo.Address.Address()))
+		}
+
+		line, err := bip38BackupLine(generation, utxo.Address, passphrase)
+		if err != nil {
+			exitWithError(fmt.Errorf("failed to encrypt the keys of %s: %w", utxo.Address.Address(), err))
+		}
+
+		lines = append(lines, line)
+		saved[utxo.Address.Address()] = true
+	}
+
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		exitWithError(fmt.Errorf("failed to save the encrypted keys: %w", err))
+	}
+
+	recordCaseEvent(currentTag(), "bip38-backup", "Saved the encrypted keys of %d addresses to %s", len(saved), path)
+
+	say("{green ✓} Encrypted keys of %d addresses saved to {white %s}\n\n", len(saved), path)
+}
+
+func bip38BackupLine(generation *keyGeneration, address libwallet.MuunAddress, passphrase string) (string, error) {
+	path := address.DerivationPath()
+
+	userKey, err := encryptKeyAt(generation.UserKey, path, passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	muunKey := "-"
+	if address.Version() != libwallet.AddressVersionV1 {
+		if muunKey, err = encryptKeyAt(generation.MuunKey, path, passphrase); err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%s v%d %s %s %s", address.Address(), address.Version(), path, userKey, muunKey), nil
+}
+
+// encryptKeyAt derives a key to a path, and encrypts it with BIP-38. Muun keys are compressed.
+func encryptKeyAt(key keys.PrivateKey, path string, passphrase string) (string, error) {
+	derived, err := key.DeriveTo(path)
+	if err != nil {
+		return "", err
+	}
+
+	ecKey, err := derived.ECPrivateKey()
+	if err != nil {
+		return "", err
+	}
+
+	return bip38.Encrypt(ecKey, true, passphrase, &chainParams)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/utils"
+)
+
+// satelliteOrderURL is the Blockstream Satellite API endpoint to queue data for transmission.
+const satelliteOrderURL = "https://api.blockstream.space/order"
+
+// satelliteBidPerByte is our bid for transmission, in millisatoshis per byte. The API rejects
+// bids below its minimum rate, this is comfortably above it.
+const satelliteBidPerByte = 100
+
+// broadcastTransports are the ways we can get a transaction to the network. Electrum servers are
+// the norm, or the backend chosen with --backend; the others are alternatives for censored or
+// degraded networks.
+var broadcastTransports = map[string]func(tx *wire.MsgTx) error{
+	"electrum":  broadcastTx,
+	"esplora":   broadcastViaEsplora,
+	"bitcoind":  broadcastViaBitcoind,
+	"nostr":     broadcastViaNostr,
+	"satellite": broadcastViaSatellite,
+}
+
+// broadcastWithFallback tries each transport in order, until one succeeds. If a node is configured
+// with --bitcoind, it must accept the transaction first. The outcome is reported with --json.
+func broadcastWithFallback(tx *wire.MsgTx, transports []string) (err error) {
+	defer func() { emitBroadcast(tx, err) }()
+
+	if err := checkMempoolAcceptance(tx); err != nil {
+		return err
+	}
+
+	var errs []string
+
+	for _, name := range transports {
+		transport, ok := broadcastTransports[name]
+		if !ok {
+			return fmt.Errorf("unknown broadcast transport %q", name)
+		}
+
+		err := transport(tx)
+		if err == nil {
+			return nil
+		}
+
+		say("{yellow Couldn't send the transaction via %s}: %v\n", name, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+	}
+
+	return utils.WrapError(utils.ErrBroadcastFailed, fmt.Errorf("all transports failed: %s", strings.Join(errs, "; ")))
+}
+
+// parseBroadcastTransports validates a comma-separated list of transports.
+func parseBroadcastTransports(list string) ([]string, error) {
+	var transports []string
+
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+
+		if _, ok := broadcastTransports[name]; !ok {
+			return nil, fmt.Errorf("unknown broadcast transport %q, use electrum, esplora, bitcoind, nostr or satellite", name)
+		}
+
+		transports = append(transports, name)
+	}
+
+	return transports, nil
+}
+
+// broadcastViaNostr publishes the transaction to Nostr relays. It succeeds if any relay accepts it.
+func broadcastViaNostr(tx *wire.MsgTx) error {
+	txHex, err := encodeTxHex(tx)
+	if err != nil {
+		return err
+	}
+
+	event, err := newNostrTxEvent(txHex)
+	if err != nil {
+		return err
+	}
+
+	relays := defaultNostrRelays
+	if *nostrRelays != "" {
+		relays = strings.Split(*nostrRelays, ",")
+	}
+
+	accepted := 0
+
+	for _, relay := range relays {
+		if err := publishNostrEvent(strings.TrimSpace(relay), event); err != nil {
+			say("{yellow !} %v\n", err)
+			continue
+		}
+
+		accepted++
+	}
+
+	if accepted == 0 {
+		return fmt.Errorf("no relay accepted the transaction")
+	}
+
+	say("{green ✓} Published to %d Nostr relays\n", accepted)
+
+	return nil
+}
+
+// broadcastViaSatellite queues the transaction for transmission by Blockstream Satellite. The
+// order must be paid with the Lightning invoice we show, and the transaction then reaches every
+// satellite receiver, some of which relay to the network.
+func broadcastViaSatellite(tx *wire.MsgTx) error {
+	txHex, err := encodeTxHex(tx)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+
+	form.WriteField("bid", fmt.Sprint(len(txHex)*satelliteBidPerByte))
+	form.WriteField("message", txHex)
+	form.Close()
+
+	if err := utils.CheckNetwork(); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+
+	res, err := client.Post(satelliteOrderURL, form.FormDataContentType(), &body)
+	if err != nil {
+		return fmt.Errorf("failed to reach Blockstream Satellite: %w", err)
+	}
+	defer res.Body.Close()
+
+	var order struct {
+		UUID             string `json:"uuid"`
+		LightningInvoice struct {
+			PayReq string `json:"payreq"`
+		} `json:"lightning_invoice"`
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Blockstream Satellite responded with status %s", res.Status)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&order); err != nil || order.LightningInvoice.PayReq == "" {
+		return fmt.Errorf("unexpected response from Blockstream Satellite")
+	}
+
+	sayBlock(`
+		Your transaction was queued for satellite transmission (order {white %s}).
+		{yellow Pay this Lightning invoice} for it to be sent:
+
+		%s
+
+	`, order.UUID, order.LightningInvoice.PayReq)
+
+	return nil
+}
+
+func encodeTxHex(tx *wire.MsgTx) (string, error) {
+	var buf bytes.Buffer
+	if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		return "", fmt.Errorf("error while encoding tx: %w", err)
+	}
+
+	return hex.EncodeToString(buf.Bytes()), nil
+}
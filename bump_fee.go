@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/scanner"
+)
+
+// A sweep sent with too low a fee can wait in the mempool for days. The sweeps we sign signal they
+// can be replaced (see replaceableSequence), and bump-fee replaces one with a higher fee:
+//
+//	recovery-tool --fee-rate 20 bump-fee <transaction ID> [optional: path to Emergency Kit PDF]
+//
+// The replacement spends the same outputs and pays the same destination, with the higher fee taken
+// from what it receives. It needs the keys again, to sign. Only sweeps with a single output, from
+// funds all in the wallet, can be bumped: the funds of a fee input (see --fee-input) would need its
+// key too, and a test sweep has its change too. Sweeps to Lightning can't be bumped either, as the
+// swap expects the exact amount it asked for: the swap file (see --swap-file) tells them apart.
+//
+// Signing the replacement is guarded like in a recovery (see signingGuards).
+//
+// Nodes only accept the replacement if it pays more than the original, by at least its own size
+// at 1 sat/vbyte (the minimum relay fee), and at a higher rate.
+
+// minRelayFeeRate is the rate at which a replacement must pay for its own size, on top of the fee
+// of the transaction it replaces, in sats/vbyte.
+const minRelayFeeRate = 1
+
+// checkFeeRate fails early on a negative --fee-rate. 0 means the rate is asked for.
+func checkFeeRate() {
+	if *feeRate < 0 {
+		exitWithError(fmt.Errorf("invalid fee rate %d, it must be a whole number of sats/vbyte", *feeRate))
+	}
+}
+
+// runBumpFeeCommand replaces a sweep stuck in the mempool with one paying a higher fee.
+func runBumpFeeCommand(args []string) {
+	flags := flag.NewFlagSet("bump-fee", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	txID := flags.Arg(0)
+	if _, err := chainhash.NewHashFromStr(txID); err != nil || len(txID) != 2*chainhash.HashSize {
+		exitWithError(fmt.Errorf("invalid transaction ID %q", txID))
+	}
+
+	transports, err := parseBroadcastTransports(*broadcastVia)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	guards := loadSigningGuards()
+
+	say(`
+		{blue Muun Recovery Tool v%s}
+
+		This will replace transaction {white %s} with one paying a higher fee.
+
+		You will need {yellow your Recovery Code} and {yellow your Emergency Kit PDF}.
+	`, version, txID)
+
+	utxoScanner := newUtxoScanner(preferredServers(nil))
+
+	original, err := utxoScanner.GetTransaction(txID)
+	if err != nil {
+		exitWithError(fmt.Errorf("couldn't find transaction %s: %w", txID, err))
+	}
+
+	if len(original.TxOut) != 1 {
+		exitWithError(fmt.Errorf("transaction %s has %d outputs, only sweeps with a single output can be bumped", txID, len(original.TxOut)))
+	}
+
+	inputs, err := loadSpentOutputs(utxoScanner, original)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if err := checkNotSwap(original, inputs); err != nil {
+		exitWithError(err)
+	}
+
+	generations := readGuardedKeys(flags.Arg(1), true)
+
+	utxos, err := matchSignInputs(original, inputs, generations)
+	if err != nil {
+		exitWithError(fmt.Errorf("transaction %s can't be bumped: %w", txID, err))
+	}
+
+	checkReplaceable(original, utxos)
+
+	replacement, fee := buildFeeBump(original, utxos, lockTimeAtTip(utxoScanner))
+
+	sent := sats.Amount(replacement.TxOut[0].Value)
+
+	address, ok := scriptToAddress(replacement.TxOut[0].PkScript)
+	if !ok {
+		address = fmt.Sprintf("script %x", replacement.TxOut[0].PkScript)
+	}
+
+	readConfirmation(sent, fee, address, "")
+
+	guards.approve(address, address, sent, fee, "signing the replacement")
+
+	var rawTx bytes.Buffer
+	if err := replacement.Serialize(&rawTx); err != nil {
+		exitWithError(err)
+	}
+
+	sweeper := &Sweeper{Generations: generations, Presence: guards.presence}
+
+	signedTx, err := sweeper.signTx(utxos, rawTx.Bytes())
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to sign the replacement: %w", err))
+	}
+
+	leaveOfflineWindow(true)
+
+	if err := validateTx(signedTx, utxos); err != nil {
+		exitWithError(err)
+	}
+
+	emitSignedTx(signedTx)
+
+	sayBlock("Sending the replacement...")
+
+	if err := broadcastWithFallback(signedTx, transports); err != nil {
+		exitWithError(err)
+	}
+
+	recordCaseEvent(currentTag(), "bump-fee", "Replaced transaction %s with %s, paying a fee of %d sats", txID, signedTx.TxHash(), fee)
+	archiveSentTx(signedTx, "replacement of "+txID)
+
+	sayBlock(`
+		Replacement sent! You can check the status here: https://blockstream.info/tx/%v
+		(it will appear in Blockstream after a short delay)
+
+	`, signedTx.TxHash())
+}
+
+// checkReplaceable stops if the transaction was confirmed, or its funds were spent by another one,
+// and warns if it doesn't signal it can be replaced. If the servers can't tell, we go ahead: a
+// replacement of a confirmed transaction is rejected anyway.
+func checkReplaceable(tx *wire.MsgTx, utxos []*scanner.Utxo) {
+	var inputScripts []string
+	for _, utxo := range utxos {
+		inputScripts = append(inputScripts, hex.EncodeToString(utxo.Script))
+	}
+
+	status, err := checkTxStatus(tx, inputScripts)
+	if err != nil {
+		say("{yellow Couldn't check the transaction is still unconfirmed}: %v\n", err)
+	}
+
+	switch status {
+	case txConfirmed:
+		exitWithError(fmt.Errorf("transaction %s is already confirmed, there's no need to bump its fee", tx.TxHash()))
+	case txReplaced:
+		exitWithError(fmt.Errorf("the funds of transaction %s were spent by another transaction, it can't be replaced", tx.TxHash()))
+	}
+
+	if !signalsReplacement(tx) {
+		say("{yellow !} The transaction doesn't signal it can be replaced (BIP-125). Only nodes that accept any replacement will relay the new one\n")
+	}
+}
+
+// checkNotSwap fails if a transaction sends to a Lightning swap, or refunds one. A replacement would
+// send the swap less than it asked for, and it would never be claimed. Refunds spend a lockup,
+// which isn't an address of the wallet.
+func checkNotSwap(tx *wire.MsgTx, inputs []signInput) error {
+	if address, ok := scriptToAddress(tx.TxOut[0].PkScript); ok && isSwapLockup(address) {
+		return fmt.Errorf("transaction %s sends to a Lightning swap, it can't be bumped", tx.TxHash())
+	}
+
+	for _, input := range inputs {
+		if isSwapLockup(input.Address) {
+			return fmt.Errorf("transaction %s refunds a Lightning swap, it can't be bumped", tx.TxHash())
+		}
+	}
+
+	return nil
+}
+
+// signalsReplacement tells whether a transaction can be replaced according to BIP-125: it's enough
+// for one input to signal it.
+func signalsReplacement(tx *wire.MsgTx) bool {
+	for _, txIn := range tx.TxIn {
+		if txIn.Sequence < wire.MaxTxInSequenceNum-1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// buildFeeBump shows the fee of the original transaction, asks for the new rate (unless given with
+// --fee-rate), and returns the unsigned replacement with its fee.
+func buildFeeBump(original *wire.MsgTx, utxos []*scanner.Utxo, lockTime uint32) (*wire.MsgTx, sats.Amount) {
+	spent, err := scanner.Total(utxos)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	originalFee, err := spent.Sub(sats.Amount(original.TxOut[0].Value))
+	if err != nil {
+		exitWithError(fmt.Errorf("transaction %s sends more than it spends", original.TxHash()))
+	}
+
+	replacement := original.Copy()
+	replacement.LockTime = lockTime
+
+	for _, txIn := range replacement.TxIn {
+		txIn.SignatureScript = nil
+		txIn.Witness = nil
+		txIn.Sequence = replaceableSequence
+	}
+
+	var rawTx bytes.Buffer
+	if err := replacement.Serialize(&rawTx); err != nil {
+		exitWithError(err)
+	}
+
+	placeholderTx, err := withPlaceholderSignatures(rawTx.Bytes(), utxos)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	vsize := virtualSize(placeholderTx)
+	originalSize := virtualSize(original)
+
+	// The replacement must pay for its own relay, on top of what the original paid, and at a
+	// higher rate:
+	minFee := originalFee + sats.Amount(minRelayFeeRate*vsize)
+	if ratedFee := sats.Amount((int64(originalFee)/originalSize + 1) * vsize); ratedFee > minFee {
+		minFee = ratedFee
+	}
+
+	sayBlock(`
+		{whiteUnderline Transaction to replace}
+		  {white Fee}: %v sats, %.1f sats/vbyte
+		  {white Sends}: %v sats
+		The replacement must pay at least {white %d sats/vbyte}.
+	`, originalFee, float64(originalFee)/float64(originalSize), original.TxOut[0].Value, (int64(minFee)+vsize-1)/vsize)
+
+	minRemaining := dustThresholdFor(original.TxOut[0].PkScript)
+
+	fee := readFee(spent, vsize, minRemaining)
+	for fee < minFee {
+		if *feeRate > 0 {
+			exitWithError(fmt.Errorf("the fee rate of %d sats/vbyte given with --fee-rate is too low to replace the transaction", *feeRate))
+		}
+
+		say("The fee is too low to replace the transaction. Please, try again\n")
+		fee = readFee(spent, vsize, minRemaining)
+	}
+
+	replacement.TxOut[0].Value = int64(spent - fee)
+
+	return replacement, fee
+}
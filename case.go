@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/utils"
+)
+
+// Support teams handling several recoveries at once need to tell which wallet each file belongs
+// to. Every artifact the Recovery Tool writes is tagged with the fingerprint of the wallet's user
+// key (the one in the Emergency Kit descriptors), its wallet ID (see keys.WalletID), the build that wrote it (see provenance.go) and,
+// if given with --case-id, the case it's part of. With a case ID, each step is also recorded in a journal, that `recovery-tool case status`
+// summarizes.
+//
+// Journals hold no secrets, but they do reveal amounts and addresses: they're only readable by the
+// user, like the artifacts themselves. With --db, they're kept encrypted in the state database
+// instead.
+
+var caseIDRe = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+// caseTag identifies the wallet and case an artifact belongs to, and the build that made it.
+type caseTag struct {
+	Wallet   string           `json:"wallet,omitempty"`   // fingerprint of the user key, in hex
+	WalletID string           `json:"walletId,omitempty"` // see keys.WalletID
+	CaseID   string           `json:"caseId,omitempty"`
+	Build    *buildProvenance `json:"build,omitempty"`
+}
+
+// caseEvent is a line in a case journal.
+type caseEvent struct {
+	Time   time.Time `json:"time"`
+	Wallet string    `json:"wallet,omitempty"`
+	Event  string    `json:"event"`
+	Detail string    `json:"detail"`
+}
+
+// walletFingerprint is the fingerprint of the first wallet whose keys were decrypted.
+var walletFingerprint string
+
+// walletID is the ID of the same wallet, to key what's kept about it between runs.
+var walletID string
+
+func checkCaseID() {
+	if *caseID != "" && !caseIDRe.MatchString(*caseID) {
+		exitWithError(fmt.Errorf("invalid case ID %q, use letters, numbers, '.', '-' and '_'", *caseID))
+	}
+}
+
+// identifyWallet sets the wallet fingerprint and ID for tags and logs, unless they were already
+// set by a previous kit: with several Emergency Kits, the first one names the wallet.
+func identifyWallet(userKey, muunKey keys.PrivateKey) {
+	if walletFingerprint != "" {
+		return
+	}
+
+	walletFingerprint = hex.EncodeToString(userKey.PublicKey().Fingerprint())
+	walletID = keys.WalletID(chainParams.Name, userKey.PublicKey(), muunKey.PublicKey())
+
+	if *caseID != "" {
+		utils.SetLogContext(fmt.Sprintf("wallet %s, case %s", walletFingerprint, *caseID))
+	} else {
+		utils.SetLogContext("wallet " + walletFingerprint)
+	}
+}
+
+// currentTag returns the tag for artifacts written by this run.
+func currentTag() caseTag {
+	return caseTag{Wallet: walletFingerprint, WalletID: walletID, CaseID: *caseID, Build: currentProvenance()}
+}
+
+// describe returns a line for users, or "" if the tag is empty.
+func (t caseTag) describe() string {
+	switch {
+	case t.Wallet != "" && t.CaseID != "":
+		return fmt.Sprintf("wallet %s, case %s", t.Wallet, t.CaseID)
+	case t.Wallet != "":
+		return "wallet " + t.Wallet
+	case t.CaseID != "":
+		return "case " + t.CaseID
+	}
+
+	return ""
+}
+
+func caseJournalPath(id string) (string, error) {
+	if !caseIDRe.MatchString(id) {
+		return "", fmt.Errorf("invalid case ID %q, use letters, numbers, '.', '-' and '_'", id)
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate case journals: %w", err)
+	}
+
+	return filepath.Join(configDir, "muun-recovery", "cases", id+".jsonl"), nil
+}
+
+// recordCaseEvent appends an event to the journal of the tagged case, if there's one. Failing to
+// record is reported, but it's not a reason to stop a recovery.
+func recordCaseEvent(tag caseTag, event string, format string, v ...interface{}) {
+	if tag.CaseID == "" {
+		return
+	}
+
+	err := appendCaseEvent(tag.CaseID, &caseEvent{
+		Time:   time.Now().UTC(),
+		Wallet: tag.Wallet,
+		Event:  event,
+		Detail: fmt.Sprintf(format, v...),
+	})
+
+	if err != nil {
+		say("{yellow Couldn't record this step in case %s}: %v\n", tag.CaseID, err)
+	}
+}
+
+func appendCaseEvent(id string, event *caseEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if stateDB != nil {
+		return stateDB.AppendCaseEvent(id, line)
+	}
+
+	path, err := caseJournalPath(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create case journals directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open case journal: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write case journal: %w", err)
+	}
+
+	return nil
+}
+
+func loadCaseEvents(id string) ([]*caseEvent, error) {
+	if stateDB != nil {
+		return loadStateDBCaseEvents(id)
+	}
+
+	path, err := caseJournalPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("there's no case %s on this computer", id)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open case journal: %w", err)
+	}
+	defer file.Close()
+
+	var events []*caseEvent
+
+	lines := bufio.NewScanner(file)
+	for lines.Scan() {
+		var event caseEvent
+		if err := json.Unmarshal(lines.Bytes(), &event); err != nil {
+			continue // a line cut short by a crash shouldn't hide the rest
+		}
+
+		events = append(events, &event)
+	}
+
+	if err := lines.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read case journal: %w", err)
+	}
+
+	return events, nil
+}
+
+func loadStateDBCaseEvents(id string) ([]*caseEvent, error) {
+	lines, err := stateDB.CaseEvents(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("there's no case %s in %s", id, stateDB.Path())
+	}
+
+	var events []*caseEvent
+
+	for _, line := range lines {
+		var event caseEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, fmt.Errorf("invalid case journal in %s: %w", stateDB.Path(), err)
+		}
+
+		events = append(events, &event)
+	}
+
+	return events, nil
+}
+
+// runCaseCommand summarizes what was done in a case, from its journal.
+func runCaseCommand(args []string) {
+	flags := flag.NewFlagSet("case", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 || flags.Arg(0) != "status" {
+		printUsage()
+		os.Exit(0)
+	}
+
+	id := flags.Arg(1)
+
+	events, err := loadCaseEvents(id)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if len(events) == 0 {
+		sayBlock("Nothing was recorded in case {white %s} yet\n\n", id)
+		return
+	}
+
+	var wallets []string
+	seen := make(map[string]bool)
+
+	for _, event := range events {
+		if event.Wallet != "" && !seen[event.Wallet] {
+			seen[event.Wallet] = true
+			wallets = append(wallets, event.Wallet)
+		}
+	}
+
+	first, last := events[0], events[len(events)-1]
+
+	sayBlock(`
+		{whiteUnderline Case %s}
+		  {white Wallets}: %s
+		  {white Started}: %s
+		  {white Last activity}: %s
+
+	`, id, strings.Join(wallets, ", "), utils.FormatTime(first.Time), utils.FormatTime(last.Time))
+
+	for _, event := range events {
+		say("%s  {white %-12s} %s\n", utils.FormatTime(event.Time), event.Event, event.Detail)
+	}
+
+	fmt.Fprintln(userOutput)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/scanner"
+)
+
+// The blockchain is queried through one of these backends, set with --backend:
+//
+// Electrum servers are the default: public ones are rotated (or those given with --servers), and
+// every feature works with them.
+//
+// Esplora is an HTTP API (--esplora, blockstream.info's by default). It gets through networks that
+// only let web traffic out, and can be self-hosted.
+//
+// bitcoind is the user's own Bitcoin Core node (--bitcoind), so no third party is trusted at all.
+// It scans with scantxoutset, which takes a few minutes and only sees confirmed funds.
+//
+// Following funds while deciding, proofs of the funds and fee estimates need Electrum servers, and
+// are turned off with the others.
+const (
+	backendElectrum = "electrum"
+	backendEsplora  = "esplora"
+	backendBitcoind = "bitcoind"
+)
+
+// checkBackend fails early when --backend is unknown, or combined with options that need Electrum
+// servers. Transactions are sent through the backend, unless --broadcast-via says otherwise.
+func checkBackend() {
+	switch *chainBackend {
+	case backendElectrum:
+		return
+
+	case backendEsplora:
+	case backendBitcoind:
+		if *bitcoindURL == "" {
+			exitWithError(fmt.Errorf("--backend bitcoind needs the RPC URL of your node, with --bitcoind"))
+		}
+
+	default:
+		exitWithError(fmt.Errorf("invalid backend %q, use %s, %s or %s", *chainBackend, backendElectrum, backendEsplora, backendBitcoind))
+	}
+
+	if *historyDump != "" {
+		exitWithError(fmt.Errorf("--history-dump scans offline, it can't be combined with --backend"))
+	}
+
+	if *serveElectrum != "" || *rebroadcastPath != "" {
+		exitWithError(fmt.Errorf("--serve-electrum and --rebroadcast-schedule need Electrum servers, they can't be combined with --backend %s", *chainBackend))
+	}
+
+	broadcastViaSet := false
+	flag.Visit(func(f *flag.Flag) {
+		broadcastViaSet = broadcastViaSet || f.Name == "broadcast-via"
+	})
+
+	if !broadcastViaSet {
+		*broadcastVia = *chainBackend
+	}
+}
+
+// newChainBackend creates the backend chosen with --backend, or returns nil for Electrum servers,
+// which the Scanner uses by default.
+func newChainBackend() scanner.ChainBackend {
+	switch *chainBackend {
+	case backendEsplora:
+		backend, err := scanner.NewEsploraBackend(*esploraURL)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		return backend
+
+	case backendBitcoind:
+		return newBitcoindBackend()
+	}
+
+	return nil
+}
+
+// newBitcoindBackend connects to the node given with --bitcoind.
+func newBitcoindBackend() *scanner.BitcoindBackend {
+	backend, err := scanner.NewBitcoindBackend(*bitcoindURL)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	return backend
+}
+
+// broadcastViaEsplora sends the transaction through the Esplora API given with --esplora.
+func broadcastViaEsplora(tx *wire.MsgTx) error {
+	backend, err := scanner.NewEsploraBackend(*esploraURL)
+	if err != nil {
+		return err
+	}
+
+	return backend.Broadcast(tx)
+}
+
+// broadcastViaBitcoind sends the transaction through the node given with --bitcoind.
+func broadcastViaBitcoind(tx *wire.MsgTx) error {
+	if *bitcoindURL == "" {
+		return fmt.Errorf("sending through your node needs its RPC URL, with --bitcoind")
+	}
+
+	backend, err := scanner.NewBitcoindBackend(*bitcoindURL)
+	if err != nil {
+		return err
+	}
+
+	return backend.Broadcast(tx)
+}
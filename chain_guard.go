@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/utils"
+)
+
+// foreignAddressPrefixes are the beginnings of addresses of other chains, that a user may paste by
+// mistake. Lowercase, since bech32 addresses can be written in either case.
+var foreignAddressPrefixes = []struct {
+	prefix string
+	chain  string
+}{
+	{"bitcoincash:", "Bitcoin Cash"},
+	{"ltc1", "Litecoin"},
+	{"tltc1", "Litecoin testnet"},
+	{"tb1", "Bitcoin testnet"},
+	{"bcrt1", "Bitcoin regtest"},
+}
+
+// foreignVersionBytes are the base58 version bytes of other chains. Bitcoin Cash legacy addresses
+// use the same ones as Bitcoin, and can't be told apart.
+var foreignVersionBytes = map[byte]string{
+	0x6f: "Bitcoin testnet", // P2PKH
+	0xc4: "Bitcoin testnet", // P2SH
+	0x30: "Litecoin",        // P2PKH
+	0x32: "Litecoin",        // P2SH
+	0x1e: "Dogecoin",        // P2PKH
+	0x16: "Dogecoin",        // P2SH
+}
+
+// foreignChainOf returns the name of the chain an address belongs to, if it's recognizably not a
+// Bitcoin mainnet address. Otherwise, it returns an empty string.
+func foreignChainOf(address string) string {
+	lower := strings.ToLower(address)
+
+	for _, foreign := range foreignAddressPrefixes {
+		if strings.HasPrefix(lower, foreign.prefix) {
+			return foreign.chain
+		}
+	}
+
+	// Bitcoin Cash addresses are often written without their prefix:
+	if len(lower) == 42 && (lower[0] == 'q' || lower[0] == 'p') {
+		return "Bitcoin Cash"
+	}
+
+	if _, version, err := base58.CheckDecode(address); err == nil {
+		return foreignVersionBytes[version]
+	}
+
+	return ""
+}
+
+// checkServerNetworks makes sure the servers chosen by the user follow the Bitcoin chain. A scan
+// against another chain would report no funds, instead of failing.
+func checkServerNetworks(servers []string) {
+	for _, server := range servers {
+		client := electrum.NewClient()
+
+		err := client.Connect(server)
+		client.Disconnect()
+
+		if errors.Is(err, utils.ErrWrongNetwork) {
+			exitWithError(fmt.Errorf("%w. Your Emergency Kit is for Bitcoin, use a Bitcoin server", err))
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/muun/recovery/scanner"
+)
+
+// feeTargets are the confirmation targets we show fee estimates for, in blocks.
+var feeTargets = []struct {
+	blocks int
+	label  string
+}{
+	{1, "next block"},
+	{6, "within an hour"},
+	{144, "within a day"},
+}
+
+// chainStatus is what we show about the blockchain while the user decides on the fee. It's kept
+// current by following new blocks with the Watcher.
+type chainStatus struct {
+	Tip      int
+	FeeRates []float64 // in sats/vbyte, for each of feeTargets, 0 if unknown
+
+	watcher *scanner.Watcher
+	utxos   []*scanner.Utxo
+}
+
+// newChainStatus reads the latest block and fee estimates. Without a Watcher, it knows nothing.
+func newChainStatus(watcher *scanner.Watcher, utxos []*scanner.Utxo) *chainStatus {
+	status := &chainStatus{watcher: watcher, utxos: utxos}
+
+	if watcher != nil {
+		status.Tip = watcher.Tip()
+
+		for _, target := range feeTargets {
+			if !backendSupport.FeeEstimates {
+				status.FeeRates = append(status.FeeRates, 0)
+				continue
+			}
+
+			status.FeeRates = append(status.FeeRates, watcher.EstimateFeeRate(target.blocks))
+		}
+	}
+
+	return status
+}
+
+// print shows the latest block, the confirmations of the funds and the fee estimates.
+func (c *chainStatus) print() {
+	if c.Tip == 0 {
+		return
+	}
+
+	minConfirmations, unconfirmed := -1, 0
+
+	for _, utxo := range c.utxos {
+		if utxo.Height <= 0 {
+			unconfirmed++
+			continue
+		}
+
+		confirmations := c.Tip - utxo.Height + 1
+		if minConfirmations == -1 || confirmations < minConfirmations {
+			minConfirmations = confirmations
+		}
+	}
+
+	var confirmations string
+
+	switch {
+	case unconfirmed == len(c.utxos):
+		confirmations = "none yet"
+	case unconfirmed > 0:
+		confirmations = fmt.Sprintf("at least %d, except %d unconfirmed outputs", minConfirmations, unconfirmed)
+	default:
+		confirmations = fmt.Sprintf("at least %d", minConfirmations)
+	}
+
+	var estimates []string
+	for i, rate := range c.FeeRates {
+		if rate > 0 {
+			estimates = append(estimates, fmt.Sprintf("%.0f sats/vbyte %s", rate, feeTargets[i].label))
+		}
+	}
+
+	if len(estimates) == 0 {
+		estimates = append(estimates, "not available")
+	}
+
+	sayBlock(`
+		{whiteUnderline Network status}
+		  {white Latest block}: %d
+		  {white Confirmations}: %s
+		  {white Suggested fees}: %s
+	`, c.Tip, confirmations, strings.Join(estimates, ", "))
+}
+
+// refresh returns the current status if new blocks were mined since this one was read, or nil.
+func (c *chainStatus) refresh() *chainStatus {
+	if c.watcher == nil || c.Tip == 0 || c.watcher.Tip() <= c.Tip {
+		return nil
+	}
+
+	return newChainStatus(c.watcher, c.utxos)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/scanner"
+)
+
+// checkMinConfirmations validates --min-confirmations, warning when unconfirmed funds are allowed.
+func checkMinConfirmations() {
+	if *minConfirmations < 0 {
+		exitWithError(fmt.Errorf("--min-confirmations can't be negative"))
+	}
+
+	if *minConfirmations == 0 {
+		sayBlock(`
+			{yellow Unconfirmed funds will be sent too}. Until they confirm, whoever sent them can
+			replace their payment, and your transaction would be invalid.
+		`)
+	}
+}
+
+// pendingFunds are the outputs that don't have enough confirmations to be sent yet.
+type pendingFunds struct {
+	Utxos []*scanner.Utxo
+	Tip   int // the latest block, 0 if unknown
+}
+
+// holdUnconfirmed splits outputs into those with at least --min-confirmations, which can be sent,
+// and the rest.
+func holdUnconfirmed(utxoScanner *scanner.Scanner, utxos []*scanner.Utxo) ([]*scanner.Utxo, *pendingFunds) {
+	pending := &pendingFunds{}
+
+	if *minConfirmations <= 0 {
+		return utxos, pending
+	}
+
+	// Confirmations are counted from the latest block, which we only need beyond the first one:
+	if *minConfirmations > 1 {
+		tip, err := utxoScanner.GetTipHeight()
+		if err != nil {
+			exitWithError(err)
+		}
+
+		pending.Tip = tip
+	}
+
+	var confirmed []*scanner.Utxo
+
+	for _, utxo := range utxos {
+		if confirmations(utxo, pending.Tip) >= *minConfirmations {
+			confirmed = append(confirmed, utxo)
+		} else {
+			pending.Utxos = append(pending.Utxos, utxo)
+		}
+	}
+
+	return confirmed, pending
+}
+
+// confirmations returns the confirmations of an output, given the latest block. If it's unknown,
+// confirmed outputs count as having one.
+func confirmations(utxo *scanner.Utxo, tip int) int {
+	switch {
+	case utxo.Height <= 0:
+		return 0
+	case tip == 0:
+		return 1
+	default:
+		return tip - utxo.Height + 1
+	}
+}
+
+// print lists the pending outputs, explaining why they're left out.
+func (p *pendingFunds) print() {
+	if len(p.Utxos) == 0 {
+		return
+	}
+
+	var total sats.Amount
+
+	sayBlock(`
+		{yellow Waiting for confirmations}
+		These funds need %d confirmations before they can be sent, and were left out:
+
+	`, *minConfirmations)
+
+	for _, utxo := range p.Utxos {
+		var err error
+		if total, err = total.Add(utxo.Amount); err != nil {
+			exitWithError(err)
+		}
+
+		say("• {white %d} sats in %s (%d confirmations)\n", utxo.Amount, utxo.Address.Address(), confirmations(utxo, p.Tip))
+	}
+
+	say("\n— {white %d} sats waiting. Run the Recovery Tool again once they're confirmed to send them too\n", total)
+}
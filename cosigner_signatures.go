@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/scanner"
+	"github.com/muun/recovery/utils"
+)
+
+// The second key of a wallet may be kept apart from the first: in another tool, with someone
+// else, in another jurisdiction. With --cosigner-sigs, its signatures are made there and imported
+// instead, and the Recovery Tool only signs with the user key:
+//
+//	recovery-tool sign --tx raw.hex --from-chain --cosigner-sigs cosigned.psbt
+//
+// Each --cosigner-sigs is a PSBT signed by the cosigner (such as one from --psbt-out, in binary or
+// base64), or a file with signatures in hex, one per line (one file per input works too). Files
+// don't need to say which input a signature is for: each is checked against every input, and
+// used for the one it's valid for. Every input must have one, as the second key doesn't sign.
+//
+// Signatures must be SIGHASH_ALL, for the transaction exactly as given. Taproot inputs are spent
+// with a MuSig2 signature made by both keys together, so they can't be signed this way.
+
+// cosignerSigsFlag collects the repeated --cosigner-sigs options.
+type cosignerSigsFlag []string
+
+func (f *cosignerSigsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *cosignerSigsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// loadCosignerSignatures reads the signatures in the given files, PSBTs or hex.
+func loadCosignerSignatures(paths []string) ([][]byte, error) {
+	var signatures [][]byte
+
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cosigner signatures: %w", err)
+		}
+
+		found, err := parseCosignerSignatures(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cosigner signatures in %s: %w", path, err)
+		}
+
+		if len(found) == 0 {
+			return nil, fmt.Errorf("there are no signatures in %s", path)
+		}
+
+		signatures = append(signatures, found...)
+	}
+
+	return signatures, nil
+}
+
+// psbtMagic starts every PSBT, and psbtMagicBase64 those encoded in base64.
+var psbtMagic, psbtMagicBase64 = []byte("psbt\xff"), []byte("cHNidP")
+
+// decodePSBT decodes a PSBT, in binary or base64, and tells whether the data is one at all.
+func decodePSBT(data []byte) (*psbt.Packet, bool, error) {
+	isBase64 := bytes.HasPrefix(bytes.TrimSpace(data), psbtMagicBase64)
+
+	if !bytes.HasPrefix(data, psbtMagic) && !isBase64 {
+		return nil, false, nil
+	}
+
+	if isBase64 {
+		data = bytes.TrimSpace(data)
+	}
+
+	packet, err := psbt.NewFromRawBytes(bytes.NewReader(data), isBase64)
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid PSBT: %w", err)
+	}
+
+	return packet, true, nil
+}
+
+// parseCosignerSignatures returns the partial signatures of a PSBT, or the hex ones of a text file.
+func parseCosignerSignatures(data []byte) ([][]byte, error) {
+	packet, isPSBT, err := decodePSBT(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if isPSBT {
+		var signatures [][]byte
+		for _, input := range packet.Inputs {
+			for _, partialSig := range input.PartialSigs {
+				signatures = append(signatures, partialSig.Signature)
+			}
+		}
+
+		return signatures, nil
+	}
+
+	var signatures [][]byte
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		signature, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d is not a signature in hex: %w", i+1, err)
+		}
+
+		signatures = append(signatures, signature)
+	}
+
+	return signatures, nil
+}
+
+// matchCosignerSignatures returns the cosigner signature for each input of the transaction, in
+// order, picking from the given ones those valid for the input's Muun key. Single-key inputs need
+// none, and have nil.
+func matchCosignerSignatures(tx *wire.MsgTx, utxos []*scanner.Utxo, generations []*keyGeneration, signatures [][]byte) ([][]byte, error) {
+	sigHashes := txscript.NewTxSigHashes(tx)
+	matched := make([][]byte, len(utxos))
+
+	var missing []string
+
+	for i, utxo := range utxos {
+		version := utxo.Address.Version()
+
+		if version == libwallet.AddressVersionV1 {
+			continue
+		}
+
+		if version == libwallet.AddressVersionV5 {
+			return nil, fmt.Errorf("input %d spends %s, a taproot address, which needs both keys to sign together", i, utxo.Address.Address())
+		}
+
+		generation := generationOf(generations, utxo)
+		if generation == nil {
+			return nil, fmt.Errorf("no kit controls %s", utxo.Address.Address())
+		}
+
+		userPub, muunPub, err := inputPublicKeys(utxo, generation)
+		if err != nil {
+			return nil, err
+		}
+
+		script, err := multisigScript(userPub, muunPub)
+		if err != nil {
+			return nil, err
+		}
+
+		var sigHash []byte
+		if version == libwallet.AddressVersionV2 {
+			sigHash, err = txscript.CalcSignatureHash(script, txscript.SigHashAll, tx, i)
+		} else {
+			sigHash, err = txscript.CalcWitnessSigHash(script, sigHashes, txscript.SigHashAll, tx, i, int64(utxo.Amount))
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute the sighash of input %d: %w", i, err)
+		}
+
+		muunKey, err := btcec.ParsePubKey(muunPub, btcec.S256())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rawSignature := range signatures {
+			if isValidSignature(rawSignature, sigHash, muunKey) {
+				matched[i] = rawSignature
+				break
+			}
+		}
+
+		if matched[i] == nil {
+			missing = append(missing, fmt.Sprintf("%d (%s)", i, utxo.Address.Address()))
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no cosigner signature is valid for inputs %s", strings.Join(missing, ", "))
+	}
+
+	return matched, nil
+}
+
+// isValidSignature tells whether a DER signature, followed by SIGHASH_ALL, signs a hash with a key.
+func isValidSignature(rawSignature, sigHash []byte, key *btcec.PublicKey) bool {
+	if len(rawSignature) < 2 || txscript.SigHashType(rawSignature[len(rawSignature)-1]) != txscript.SigHashAll {
+		return false
+	}
+
+	signature, err := btcec.ParseDERSignature(rawSignature[:len(rawSignature)-1], btcec.S256())
+	if err != nil {
+		return false
+	}
+
+	return signature.Verify(sigHash, key)
+}
+
+// buildCosignedTx signs a transaction with the user key alone, completing each input with the
+// cosigner signature given for it (see matchCosignerSignatures).
+func buildCosignedTx(utxos []*scanner.Utxo, sweepTx []byte, userKey keys.PrivateKey, muunKey keys.PublicKey,
+	cosignerSignatures [][]byte) (_ *wire.MsgTx, err error) {
+
+	defer utils.RecoverPanic(&err)
+
+	libwalletUserKey, ok1 := keys.LibwalletPrivateKey(userKey)
+	libwalletMuunKey, ok2 := keys.LibwalletPublicKey(muunKey)
+
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("can't sign with keys from a backend other than libwallet")
+	}
+
+	inputList := &libwallet.InputList{}
+	for i, utxo := range utxos {
+		inputList.Add(&input{
+			utxo,
+			cosignerSignatures[i],
+		})
+	}
+
+	// Only taproot inputs use nonces, and there are none (see matchCosignerSignatures):
+	pstx, err := libwallet.NewPartiallySignedTransaction(inputList, sweepTx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	signedTx, err := pstx.Sign(libwalletUserKey, libwalletMuunKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wireTx := wire.NewMsgTx(0)
+	err = wireTx.BtcDecode(bytes.NewReader(signedTx.Bytes), 0, wire.WitnessEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signed tx: %w", err)
+	}
+
+	return wireTx, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/muun/recovery/sats"
+	"golang.org/x/crypto/ed25519"
+)
+
+// In assisted recoveries, a second organization (the user's custodian, or a support team) oversees
+// what's sent. With --custodian-key, the Recovery Tool only signs once the holder of that key signs
+// a challenge covering the destination and the amounts. The challenge is a single line the user
+// relays, and the custodian signs with `custodian sign`, after reviewing it. A fresh nonce makes
+// every challenge different, so a signature can't be reused for another sweep.
+
+// custodianChallengeVersion is the version of the challenge format.
+const custodianChallengeVersion = 1
+
+// custodianKeyVersion is the version of the custodian key file format.
+const custodianKeyVersion = 1
+
+// custodianSigningDomain is signed along with each challenge, so the custodian's key can't be
+// tricked into approving anything else.
+const custodianSigningDomain = "muun recovery custodian approval\n"
+
+// custodianChallenge describes the sweep the custodian approves.
+type custodianChallenge struct {
+	Version     int         `json:"version"`
+	CaseID      string      `json:"caseId,omitempty"`
+	Network     string      `json:"network"`
+	Address     string      `json:"address"`     // where the transaction sends to
+	Destination string      `json:"destination"` // as shown to the user, for swaps and peg-ins
+	Amount      sats.Amount `json:"amount"`
+	Fee         sats.Amount `json:"fee"`
+	Nonce       string      `json:"nonce"` // hex
+}
+
+// custodianKeyFile keeps the custodian's key pair, made with `custodian keygen`.
+type custodianKeyFile struct {
+	Version    int    `json:"version"`
+	PublicKey  string `json:"publicKey"`  // hex
+	PrivateKey string `json:"privateKey"` // hex, the seed
+}
+
+// loadCustodianKey parses the key given with --custodian-key, if any. It returns nil without it.
+func loadCustodianKey() ed25519.PublicKey {
+	if *custodianKeyHex == "" {
+		return nil
+	}
+
+	key, err := hex.DecodeString(*custodianKeyHex)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		exitWithError(fmt.Errorf("invalid --custodian-key, it must be %d bytes in hex", ed25519.PublicKeySize))
+	}
+
+	return ed25519.PublicKey(key)
+}
+
+// readCustodianApproval shows a challenge for the sweep, and waits for the custodian's signature.
+// Too many invalid signatures stop the Recovery Tool.
+func readCustodianApproval(key ed25519.PublicKey, address string, destination string, amount, fee sats.Amount) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		exitWithError(err)
+	}
+
+	challenge := &custodianChallenge{
+		Version:     custodianChallengeVersion,
+		CaseID:      *caseID,
+		Network:     chainParams.Name,
+		Address:     address,
+		Destination: destination,
+		Amount:      amount,
+		Fee:         fee,
+		Nonce:       hex.EncodeToString(nonce),
+	}
+
+	encoded, err := encodeCustodianChallenge(challenge)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	sayBlock(`
+		{whiteUnderline Custodian approval required}
+		Send this challenge to your custodian. They'll review it and sign it, by running:
+		  recovery-tool custodian sign <challenge>
+
+		%s
+	`, encoded)
+
+	for failures := 0; ; {
+		sayBlock(`
+			{yellow Enter the signature your custodian sent you}
+		`)
+
+		var userInput string
+		ask(&userInput)
+
+		signature, err := hex.DecodeString(strings.TrimSpace(userInput))
+		if err == nil && ed25519.Verify(key, custodianMessage(encoded), signature) {
+			recordCaseEvent(currentTag(), "custodian", "The custodian approved sending %d sats to %s", amount, address)
+			say("{green ✓ Approved by the custodian}\n")
+			return
+		}
+
+		failures++
+		if failures >= maxApprovalAttempts {
+			sayBlock(`
+				{red Too many invalid signatures}
+				Recovery tool stopped. Nothing was signed
+			`)
+			os.Exit(1)
+		}
+
+		say("This is not the custodian's signature for this challenge. Please, try again\n")
+	}
+}
+
+// encodeCustodianChallenge encodes a challenge as a single line, easy to copy and paste.
+func encodeCustodianChallenge(challenge *custodianChallenge) (string, error) {
+	data, err := json.Marshal(challenge)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode challenge: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCustodianChallenge(encoded string) (*custodianChallenge, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid challenge: %w", err)
+	}
+
+	var challenge custodianChallenge
+	if err := json.Unmarshal(data, &challenge); err != nil {
+		return nil, fmt.Errorf("invalid challenge: %w", err)
+	}
+
+	if challenge.Version != custodianChallengeVersion {
+		return nil, fmt.Errorf("unsupported challenge version %d", challenge.Version)
+	}
+
+	return &challenge, nil
+}
+
+// custodianMessage is what the custodian signs for an encoded challenge.
+func custodianMessage(encoded string) []byte {
+	return []byte(custodianSigningDomain + encoded)
+}
+
+// runCustodianCommand runs the custodian's side: making their key, and signing challenges.
+func runCustodianCommand(args []string) {
+	if len(args) == 0 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	switch args[0] {
+	case "keygen":
+		runCustodianKeygen(args[1:])
+	case "sign":
+		runCustodianSign(args[1:])
+	default:
+		printUsage()
+		os.Exit(0)
+	}
+}
+
+func runCustodianKeygen(args []string) {
+	flags := flag.NewFlagSet("custodian keygen", flag.ExitOnError)
+	outPath := flags.String("out", "custodian.key", "save the key pair to this file")
+	flags.Parse(args)
+
+	if _, err := os.Stat(*outPath); err == nil {
+		exitWithError(fmt.Errorf("%s already exists, it won't be overwritten", *outPath))
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	keyFile := &custodianKeyFile{
+		Version:    custodianKeyVersion,
+		PublicKey:  hex.EncodeToString(publicKey),
+		PrivateKey: hex.EncodeToString(privateKey.Seed()),
+	}
+
+	data, err := json.MarshalIndent(keyFile, "", "  ")
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if err := ioutil.WriteFile(*outPath, data, 0600); err != nil {
+		exitWithError(fmt.Errorf("failed to save the key: %w", err))
+	}
+
+	say(`
+		{blue Muun Recovery Tool v%s}
+
+		{green ✓} Custodian key saved to {white %s}. Keep it safe, it approves recoveries.
+		Give the user this public key, to run the Recovery Tool with:
+		  --custodian-key %s
+
+	`, version, *outPath, keyFile.PublicKey)
+}
+
+func runCustodianSign(args []string) {
+	flags := flag.NewFlagSet("custodian sign", flag.ExitOnError)
+	keyPath := flags.String("key", "custodian.key", "the key pair made with custodian keygen")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	privateKey, err := loadCustodianKeyFile(*keyPath)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	encoded := strings.TrimSpace(flags.Arg(0))
+
+	challenge, err := decodeCustodianChallenge(encoded)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	caseID := challenge.CaseID
+	if caseID == "" {
+		caseID = "none"
+	}
+
+	say(`
+		{blue Muun Recovery Tool v%s}
+
+		{whiteUnderline Recovery to approve}
+		  {white Case}: %s
+		  {white Network}: %s
+		  {white Amount}: %v sats
+		  {white Fee}: %v sats
+		  {white Address}: %s
+		  {white Destination}: %s
+	`, version, caseID, challenge.Network, challenge.Amount, challenge.Fee, challenge.Address, challenge.Destination)
+
+	if !readYesNo("Approve it?") {
+		sayBlock("Not approved, nothing was signed\n\n")
+		return
+	}
+
+	signature := ed25519.Sign(privateKey, custodianMessage(encoded))
+
+	sayBlock(`
+		Send this signature back to the user:
+
+		%s
+
+	`, hex.EncodeToString(signature))
+}
+
+func loadCustodianKeyFile(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read custodian key: %w", err)
+	}
+
+	var keyFile custodianKeyFile
+	if err := json.Unmarshal(data, &keyFile); err != nil {
+		return nil, fmt.Errorf("failed to parse custodian key in %s: %w", path, err)
+	}
+
+	if keyFile.Version != custodianKeyVersion {
+		return nil, fmt.Errorf("unsupported custodian key version %d in %s", keyFile.Version, path)
+	}
+
+	seed, err := hex.DecodeString(keyFile.PrivateKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid custodian key in %s", path)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -0,0 +1,60 @@
+package descriptors
+
+import "strings"
+
+// Checksum computes the checksum of an output descriptor, as specified in BIP-380.
+func Checksum(descriptor string) string {
+	const inputCharset = "0123456789()[],'/*abcdefgh@:$%{}IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	const checksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+	polyMod := func(c uint64, val int) uint64 {
+		c0 := c >> 35
+		c = ((c & 0x7ffffffff) << 5) ^ uint64(val)
+
+		generators := []uint64{0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd}
+		for i, generator := range generators {
+			if c0&(1<<uint(i)) != 0 {
+				c ^= generator
+			}
+		}
+
+		return c
+	}
+
+	var c uint64 = 1
+	cls := 0
+	clsCount := 0
+
+	for _, ch := range descriptor {
+		pos := strings.IndexRune(inputCharset, ch)
+		if pos == -1 {
+			return ""
+		}
+
+		c = polyMod(c, pos&31)
+		cls = cls*3 + (pos >> 5)
+
+		if clsCount++; clsCount == 3 {
+			c = polyMod(c, cls)
+			cls = 0
+			clsCount = 0
+		}
+	}
+
+	if clsCount > 0 {
+		c = polyMod(c, cls)
+	}
+
+	for i := 0; i < 8; i++ {
+		c = polyMod(c, 0)
+	}
+
+	c ^= 1
+
+	checksum := make([]byte, 8)
+	for i := range checksum {
+		checksum[i] = checksumCharset[(c>>(5*(7-uint(i))))&31]
+	}
+
+	return string(checksum)
+}
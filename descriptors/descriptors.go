@@ -0,0 +1,185 @@
+// Package descriptors derives the addresses of a Muun wallet from its output descriptors, given
+// with extended public keys. It needs no private keys, Emergency Kit or Recovery Code, so support
+// can reproduce a user's addresses from what the user shares with them.
+//
+// Descriptors are those of the Muun address versions, with the user key first and the Muun key
+// second. The earliest wallets were single-key, and only have the user key:
+//
+//	pkh(USER)                     version 1
+//	sh(multi(2,USER,MUUN))        version 2
+//	sh(wsh(multi(2,USER,MUUN)))   version 3
+//	wsh(multi(2,USER,MUUN))       version 4
+//	tr(musig(USER,MUUN))          version 5
+//
+// Each key is an xpub, optionally preceded by its origin, and followed by a path ending in `/*`,
+// such as `[1a2b3c4d/1'/1']xpub.../1/*`. The checksum is optional, but verified when present.
+package descriptors
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/keys"
+)
+
+// maxIndex is the largest non-hardened child index.
+const maxIndex = hdkeychain.HardenedKeyStart - 1
+
+// scriptFormats are the descriptor wrappers of each address version.
+var scriptFormats = []struct {
+	version int
+	prefix  string
+	suffix  string
+	keys    int
+}{
+	{1, "pkh(", ")", 1},
+	{2, "sh(multi(2,", "))", 2},
+	{3, "sh(wsh(multi(2,", ")))", 2},
+	{4, "wsh(multi(2,", "))", 2},
+	{5, "tr(musig(", "))", 2},
+}
+
+// keyRegexp matches a key expression: an optional origin, the xpub, and its derivation steps.
+var keyRegexp = regexp.MustCompile(`^(?:\[[0-9a-fA-F]{8}((?:/[0-9]+['h]?)*)\])?([1-9A-HJ-NP-Za-km-z]+)((?:/[0-9]+)*)/\*$`)
+
+// Descriptor is a parsed descriptor.
+type Descriptor struct {
+	Version int
+	UserKey keys.PublicKey // at the path before the final `/*`
+	MuunKey keys.PublicKey // nil for version 1
+
+	network *libwallet.Network
+}
+
+// Parse parses a descriptor for a network.
+func Parse(descriptor string, network *libwallet.Network) (*Descriptor, error) {
+	text, checksum := descriptor, ""
+	if i := strings.LastIndex(descriptor, "#"); i != -1 {
+		text, checksum = descriptor[:i], descriptor[i+1:]
+	}
+
+	if checksum != "" && Checksum(text) != checksum {
+		return nil, fmt.Errorf("invalid checksum, expected #%s", Checksum(text))
+	}
+
+	// Descriptors copied from Emergency Kits have spaces after commas:
+	text = strings.Join(strings.Fields(text), "")
+
+	for _, format := range scriptFormats {
+		if !strings.HasPrefix(text, format.prefix) || !strings.HasSuffix(text, format.suffix) {
+			continue
+		}
+
+		keyExprs := strings.Split(text[len(format.prefix):len(text)-len(format.suffix)], ",")
+		if len(keyExprs) != format.keys {
+			return nil, fmt.Errorf("expected %d keys, found %d", format.keys, len(keyExprs))
+		}
+
+		userKey, err := parseKey(keyExprs[0], network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user key: %w", err)
+		}
+
+		var muunKey keys.PublicKey
+		if format.keys == 2 {
+			if muunKey, err = parseKey(keyExprs[1], network); err != nil {
+				return nil, fmt.Errorf("invalid muun key: %w", err)
+			}
+		}
+
+		return &Descriptor{format.version, userKey, muunKey, network}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported descriptor, it's not one of a Muun wallet")
+}
+
+// parseKey parses a key expression into the key at the path before the final `/*`.
+func parseKey(expr string, network *libwallet.Network) (keys.PublicKey, error) {
+	match := keyRegexp.FindStringSubmatch(expr)
+	if match == nil {
+		return nil, fmt.Errorf("%q is not an xpub followed by a path ending in /*", expr)
+	}
+
+	origin, encoded, steps := match[1], match[2], match[3]
+
+	extendedKey, err := hdkeychain.NewKeyFromString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", encoded, err)
+	}
+
+	if extendedKey.IsPrivate() {
+		return nil, fmt.Errorf("private keys are not needed, use the xpub instead")
+	}
+
+	if !extendedKey.IsForNet(network.ToParams()) {
+		return nil, fmt.Errorf("%s is not a key for %s", encoded, network.Name())
+	}
+
+	originPath := "m" + strings.Replace(origin, "h", "'", -1)
+
+	key, err := keys.NewLibwalletBackend(network).ParsePublicKey(encoded, originPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, step := range strings.Split(steps, "/")[1:] {
+		index, err := strconv.ParseInt(step, 10, 64)
+		if err != nil || index > maxIndex {
+			return nil, fmt.Errorf("invalid derivation step %s", step)
+		}
+
+		if key, err = key.DerivedAt(index); err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+// Addresses derives `count` addresses of the descriptor, starting at index `start`.
+func (d *Descriptor) Addresses(start, count int64) ([]libwallet.MuunAddress, error) {
+	if start < 0 || count < 0 || start+count-1 > maxIndex {
+		return nil, fmt.Errorf("indexes must be between 0 and %d", maxIndex)
+	}
+
+	backend := keys.NewLibwalletBackend(d.network)
+
+	var addresses []libwallet.MuunAddress
+
+	for index := start; index < start+count; index++ {
+		userKey, err := d.UserKey.DerivedAt(index)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive user key %d: %w", index, err)
+		}
+
+		var muunKey keys.PublicKey
+		if d.MuunKey != nil {
+			if muunKey, err = d.MuunKey.DerivedAt(index); err != nil {
+				return nil, fmt.Errorf("failed to derive muun key %d: %w", index, err)
+			}
+		}
+
+		address, err := backend.CreateAddress(d.Version, userKey, muunKey)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses = append(addresses, address)
+	}
+
+	return addresses, nil
+}
+
+// GenerateAddresses derives `count` addresses of a descriptor, starting at index `start`.
+func GenerateAddresses(descriptor string, network *libwallet.Network, start, count int64) ([]libwallet.MuunAddress, error) {
+	parsed, err := Parse(descriptor, network)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsed.Addresses(start, count)
+}
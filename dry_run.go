@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/scanner"
+)
+
+// With --dry-run (or --scan-only), the recovery stops once the funds are found: the keys are
+// decrypted and the addresses scanned as usual, then we show what could be sent, and what it would
+// cost, without asking for a destination or building a transaction. It's a way to confirm the
+// Recovery Code and Emergency Kit are right before sweeping for real.
+
+// dryRunTargets are the confirmation targets we show the fee for, in blocks.
+var dryRunTargets = []int{1, 6, 144}
+
+func init() {
+	flag.BoolVar(dryRun, "scan-only", false, "an alias of --dry-run")
+}
+
+// checkDryRunOptions fails early when --dry-run is combined with options that only make sense
+// when sending.
+func checkDryRunOptions() {
+	if !*dryRun {
+		return
+	}
+
+	switch {
+	case *testSweep > 0:
+		exitWithError(fmt.Errorf("--dry-run doesn't send anything, it can't be combined with --test-sweep"))
+	case *migrate:
+		exitWithError(fmt.Errorf("--dry-run can't be combined with --migrate"))
+	case *lightning || *liquid:
+		exitWithError(fmt.Errorf("--dry-run doesn't send anything, it can't be combined with --lightning or --liquid"))
+	case *exportChunks != "" || *exportSnapshot != "" || *psbtOut != "":
+		exitWithError(fmt.Errorf("--dry-run doesn't build a transaction, it can't be combined with --export-chunks, --export-snapshot or --psbt-out"))
+	case len(payments) > 0:
+		exitWithError(fmt.Errorf("--dry-run doesn't send anything, it can't be combined with --output"))
+	case *serveElectrum != "":
+		exitWithError(fmt.Errorf("--dry-run can't be combined with --serve-electrum"))
+	}
+}
+
+// runDryRun scans the wallet, and shows the funds that could be sent with the estimated fee.
+func runDryRun(generations []*keyGeneration, servers []string, hints *scanHints) {
+	sayBlock(`
+		Starting scan of all possible addresses. This will take a few minutes.
+	`)
+
+	utxoScanner, report := scanFunds(generations, servers, hints)
+
+	utxos, pending := holdUnconfirmed(utxoScanner, report.UtxosFound)
+	emitUtxos(utxos, pending)
+
+	if len(utxos) == 0 {
+		pending.print()
+
+		if len(pending.Utxos) > 0 {
+			sayBlock("No funds can be sent yet\n\n")
+		} else {
+			sayBlock("No funds were discovered\n\n")
+		}
+
+		recordCaseEvent(currentTag(), "dry-run", "Scanned the wallet, no funds to send, nothing sent")
+		return
+	}
+
+	sayBlock("{whiteUnderline Recoverable funds}\n\n")
+	printAddressBalances(utxos, generations)
+	pending.print()
+
+	total, err := scanner.Total(utxos)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	var versions []int
+	for _, utxo := range utxos {
+		versions = append(versions, utxo.Address.Version())
+	}
+
+	vsize, err := sweepSize(versions, 1)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	whatIf := &feeWhatIf{vsize: vsize, total: total}
+
+	if backendSupport.FeeEstimates {
+		say("\n► Asking for fee estimates...\n")
+		whatIf.estimates = fetchFeeEstimates(servers)
+	}
+
+	printDryRunFees(whatIf)
+
+	recordCaseEvent(currentTag(), "dry-run", "Scanned the wallet, %d sats in %d outputs could be sent, nothing sent", total, len(utxos))
+
+	sayBlock(`
+		{white Nothing was signed or sent}. Run again without --dry-run to send the funds.
+
+	`)
+}
+
+// printAddressBalances lists the funds in each address, in the order they were found.
+func printAddressBalances(utxos []*scanner.Utxo, generations []*keyGeneration) {
+	var addresses []string
+	byAddress := make(map[string][]*scanner.Utxo)
+
+	for _, utxo := range utxos {
+		address := utxo.Address.Address()
+		if _, ok := byAddress[address]; !ok {
+			addresses = append(addresses, address)
+		}
+
+		byAddress[address] = append(byAddress[address], utxo)
+	}
+
+	for _, address := range addresses {
+		outputs := byAddress[address]
+
+		balance, err := scanner.Total(outputs)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		label := fmt.Sprintf("%d outputs", len(outputs))
+		if len(outputs) == 1 {
+			label = "1 output"
+		}
+
+		if generation := generationOf(generations, outputs[0]); len(generations) > 1 && generation != nil {
+			label += ", " + generation.Name
+		}
+
+		say("• {white %d} sats in %s (%s)\n", balance, address, label)
+	}
+
+	total, err := scanner.Total(utxos)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	say("\n— {white %d} sats total, in %d addresses\n", total, len(addresses))
+}
+
+// printDryRunFees shows the size of the sweep, and the fee and amount sent at the estimated rates.
+func printDryRunFees(whatIf *feeWhatIf) {
+	sayBlock("Sending them all would take a transaction of {white %d vbytes}\n", whatIf.vsize)
+
+	shown := 0
+
+	for _, target := range dryRunTargets {
+		estimate, ok := whatIf.estimates[target]
+		if !ok {
+			continue
+		}
+
+		rate := int64(estimate + 0.999)
+		fee, remaining, ok := whatIf.remaining(rate)
+
+		emitFeeEstimate(target, rate, fee, whatIf.vsize, ok)
+
+		if ok {
+			say("• To confirm in %s, at %d sats/vbyte: a fee of {white %d} sats, {white %d} sats arrive\n", describeBlocks(target), rate, fee, remaining)
+		} else {
+			say("• To confirm in %s, at %d sats/vbyte: a fee of {white %d} sats, {red too high} to send what's left\n", describeBlocks(target), rate, fee)
+		}
+
+		shown++
+	}
+
+	if shown == 0 {
+		say("{yellow !} No fee estimates available. At 1 sat/vbyte, the fee would be {white %d} sats\n", sats.Amount(whatIf.vsize))
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/recovery/payto"
+	"github.com/muun/recovery/sats"
+)
+
+// Nodes don't relay transactions with outputs worth less than what it'd cost to spend them, at
+// their -dustrelayfee. How much that is depends on the output script: spending a segwit output
+// takes fewer virtual bytes, so smaller amounts are fine. We compute the threshold the way Bitcoin
+// Core does (see GetDustThreshold in its policy.cpp).
+
+// dustRelayFee is Bitcoin Core's default -dustrelayfee, in sats per 1000 virtual bytes.
+const dustRelayFee = 3000
+
+// The size of an input spending an output, for the dust threshold: the outpoint, the sequence, and
+// a signature script with a signature and a public key. Witness data is discounted.
+const (
+	dustSpendSize        = 32 + 4 + 1 + 107 + 4
+	dustWitnessSpendSize = 32 + 4 + 1 + 107/4 + 4
+)
+
+// dustThresholdFor returns the smallest amount nodes relay in an output with the given script.
+func dustThresholdFor(script []byte) sats.Amount {
+	// Outputs that can't be spent are never dust, they're meant to hold nothing:
+	if len(script) > 0 && script[0] == txscript.OP_RETURN {
+		return 0
+	}
+
+	size := wire.NewTxOut(0, script).SerializeSize()
+
+	if txscript.IsWitnessProgram(script) {
+		size += dustWitnessSpendSize
+	} else {
+		size += dustSpendSize
+	}
+
+	return sats.Amount(size * dustRelayFee / 1000)
+}
+
+// dustThresholdForAddress returns the dust threshold of the outputs paying to an address, or that of
+// the largest standard outputs if we can't pay to it.
+func dustThresholdForAddress(address btcutil.Address) sats.Amount {
+	script, err := payto.Script(address)
+	if err != nil {
+		return dustThreshold
+	}
+
+	return dustThresholdFor(script)
+}
+
+// checkNotDust returns an error if an output with the given amount and script wouldn't be relayed.
+func checkNotDust(amount sats.Amount, script []byte, output string) error {
+	threshold := dustThresholdFor(script)
+
+	if amount < threshold {
+		return fmt.Errorf(
+			"%s would be %d sats, below the dust threshold of %d sats for %s outputs, and nodes wouldn't relay it",
+			output, amount, threshold, describeScriptType(script),
+		)
+	}
+
+	return nil
+}
+
+// describeScriptType names the type of an output script.
+func describeScriptType(script []byte) string {
+	if isTaprootScript(script) {
+		return "P2TR"
+	}
+
+	switch txscript.GetScriptClass(script) {
+	case txscript.PubKeyHashTy:
+		return "P2PKH"
+	case txscript.ScriptHashTy:
+		return "P2SH"
+	case txscript.WitnessV0PubKeyHashTy:
+		return "P2WPKH"
+	case txscript.WitnessV0ScriptHashTy:
+		return "P2WSH"
+	case txscript.NullDataTy:
+		return "OP_RETURN"
+	default:
+		return "non-standard"
+	}
+}
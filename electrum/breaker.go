@@ -0,0 +1,108 @@
+package electrum
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/muun/recovery/utils"
+)
+
+// DefaultBreakerThreshold is the number of consecutive failures after which a host is avoided.
+const DefaultBreakerThreshold = 3
+
+// DefaultBreakerCooldown is how long a host is avoided, before we give it another chance.
+const DefaultBreakerCooldown = 2 * time.Minute
+
+// DefaultBreaker is shared by all Clients and ServerProviders, so a host failing for one of them
+// is avoided by the rest.
+var DefaultBreaker = NewCircuitBreaker(DefaultBreakerThreshold, DefaultBreakerCooldown)
+
+// CircuitBreaker tracks failures per host, and trips when a host fails repeatedly. While tripped,
+// the host is avoided. After a cooldown, a single trial connection is allowed: if it succeeds the
+// host is used again, if it fails the host is avoided for another cooldown.
+//
+// Failures are connection problems and timeouts, not errors reported by the server. It's
+// thread-safe.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	mu        sync.Mutex
+	hosts     map[string]*breakerState
+	log       utils.Logger
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// NewCircuitBreaker creates a CircuitBreaker that trips after `threshold` consecutive failures.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		hosts:     make(map[string]*breakerState),
+		log:       utils.NewLogger("Electrum/breaker"),
+	}
+}
+
+// Allow returns whether a server can be used. Once the cooldown of a tripped host is over, it
+// allows a single caller through for a trial.
+func (b *CircuitBreaker) Allow(server string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.hosts[hostOf(server)]
+	if !ok || state.failures < b.threshold {
+		return true
+	}
+
+	if state.trial || time.Now().Before(state.openUntil) {
+		return false
+	}
+
+	state.trial = true
+	return true
+}
+
+// Success records a successful exchange with a server, closing its circuit.
+func (b *CircuitBreaker) Success(server string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.hosts, hostOf(server))
+}
+
+// Failure records a failed exchange with a server, tripping its circuit if it failed too often.
+func (b *CircuitBreaker) Failure(server string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	host := hostOf(server)
+
+	state, ok := b.hosts[host]
+	if !ok {
+		state = &breakerState{}
+		b.hosts[host] = state
+	}
+
+	state.failures++
+	state.trial = false
+
+	if state.failures >= b.threshold {
+		state.openUntil = time.Now().Add(b.cooldown)
+		b.log.Printf("Avoiding %s for %v after %d failures", host, b.cooldown, state.failures)
+	}
+}
+
+// hostOf extracts the host of a server address, since several ports usually share the same fate.
+func hostOf(server string) string {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return server
+	}
+
+	return host
+}
@@ -0,0 +1,76 @@
+package electrum
+
+import (
+	"sync"
+)
+
+// probeScript is a script nobody pays to, for probing script methods without revealing any of ours.
+var probeScript = []byte("muun recovery capability probe")
+
+// probeTxID is the coinbase of block 1, a transaction every server has, with a merkle proof.
+const probeTxID = "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098"
+
+// Capabilities are the optional parts of the protocol a server supports.
+type Capabilities struct {
+	Batching     bool // batch requests, for faster scans
+	FeeEstimates bool // `blockchain.estimatefee`
+	Mempool      bool // script subscriptions, reporting unconfirmed transactions as they arrive
+	HeaderProofs bool // block headers and merkle proofs
+}
+
+var disabledBatching = struct {
+	sync.Mutex
+	servers map[string]bool
+}{servers: make(map[string]bool)}
+
+// DisableBatching stops clients from sending batch requests to a server, for servers that claim
+// to support them but don't. It's thread-safe.
+func DisableBatching(server string) {
+	disabledBatching.Lock()
+	defer disabledBatching.Unlock()
+
+	disabledBatching.servers[server] = true
+}
+
+func batchingDisabled(server string) bool {
+	disabledBatching.Lock()
+	defer disabledBatching.Unlock()
+
+	return disabledBatching.servers[server]
+}
+
+// ProbeCapabilities tries the optional methods on the connected server. Errors mean the method is
+// not supported: servers answer them like any other request, so the connection can still be used.
+// Servers that don't support batching are never sent batches again, see DisableBatching.
+func (c *Client) ProbeCapabilities() *Capabilities {
+	capabilities := &Capabilities{}
+	indexHash := GetIndexHash(probeScript)
+
+	if c.SupportsBatching() {
+		_, err := c.ListUnspentBatch([]string{indexHash, indexHash})
+		capabilities.Batching = err == nil
+
+		if err != nil {
+			DisableBatching(c.Server)
+		}
+	}
+
+	// Servers answer -1 when they can't estimate yet, which is still support:
+	if _, err := c.EstimateFee(6); err == nil {
+		capabilities.FeeEstimates = true
+	}
+
+	if _, err := c.SubscribeScriptHash(indexHash); err == nil {
+		_, err = c.GetHistory(indexHash)
+		capabilities.Mempool = err == nil
+
+		c.UnsubscribeScriptHash(indexHash) // older servers don't support it, it's harmless
+	}
+
+	if _, err := c.GetBlockHeader(1); err == nil {
+		_, err = c.GetMerkle(probeTxID, 1)
+		capabilities.HeaderProofs = err == nil
+	}
+
+	return capabilities
+}
@@ -16,7 +16,8 @@ import (
 )
 
 const defaultLoggerTag = "Electrum/?"
-const connectionTimeout = time.Second * 30
+const connectionTimeout = time.Second * 30 // to connect and complete the TLS handshake
+const requestTimeout = time.Second * 60    // to send a request and receive the response
 const messageDelim = byte('\n')
 
 var implsWithBatching = []string{"ElectrumX"}
@@ -33,7 +34,11 @@ type Client struct {
 	ProtoVersion  string
 	nextRequestID int
 	conn          net.Conn
-	log           *utils.Logger
+	reader        *bufio.Reader
+	notifications map[string]string
+	tip           *Tip
+	breaker       *CircuitBreaker
+	log           utils.Logger
 }
 
 // Request models the structure of all Electrum protocol requests.
@@ -79,6 +84,55 @@ type GetTransactionResponse struct {
 	Result string `json:"result"`
 }
 
+// GetHistoryResponse models a `blockchain.scripthash.get_history` response.
+type GetHistoryResponse struct {
+	ID     int          `json:"id"`
+	Result []HistoryRef `json:"result"`
+}
+
+// GetMerkleResponse models a `blockchain.transaction.get_merkle` response.
+type GetMerkleResponse struct {
+	ID     int         `json:"id"`
+	Result MerkleProof `json:"result"`
+}
+
+// GetBlockHeaderResponse models a `blockchain.block.header` response.
+type GetBlockHeaderResponse struct {
+	ID     int    `json:"id"`
+	Result string `json:"result"`
+}
+
+// SubscribeHeadersResponse models a `blockchain.headers.subscribe` response.
+type SubscribeHeadersResponse struct {
+	ID     int `json:"id"`
+	Result Tip `json:"result"`
+}
+
+// EstimateFeeResponse models a `blockchain.estimatefee` response.
+type EstimateFeeResponse struct {
+	ID     int     `json:"id"`
+	Result float64 `json:"result"`
+}
+
+// SubscribeResponse models the structure of a `blockchain.scripthash.subscribe` response.
+type SubscribeResponse struct {
+	ID     int     `json:"id"`
+	Result *string `json:"result"` // null when the script has no history.
+}
+
+// UnsubscribeResponse models the structure of a `blockchain.scripthash.unsubscribe` response.
+type UnsubscribeResponse struct {
+	ID     int  `json:"id"`
+	Result bool `json:"result"`
+}
+
+// Notification models a message pushed by the server for an active subscription.
+type Notification struct {
+	ID     *int          `json:"id"` // always absent, used to tell notifications from responses.
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
 // BroadcastResponse models the structure of a `blockchain.transaction.broadcast` response.
 type BroadcastResponse struct {
 	ID     int    `json:"id"`
@@ -93,6 +147,27 @@ type UnspentRef struct {
 	Height int    `json:"height"`
 }
 
+// HistoryRef models an item in the `GetHistoryResponse` results. The height is 0 or negative for
+// transactions in the mempool.
+type HistoryRef struct {
+	TxHash string `json:"tx_hash"`
+	Height int    `json:"height"`
+}
+
+// MerkleProof models the `GetMerkleResponse` result: the hashes of the siblings of a transaction in
+// its block's merkle tree, from the bottom up, and its position in the block.
+type MerkleProof struct {
+	BlockHeight int      `json:"block_height"`
+	Merkle      []string `json:"merkle"`
+	Pos         int      `json:"pos"`
+}
+
+// Tip is the latest block, as reported by `blockchain.headers.subscribe`.
+type Tip struct {
+	Height int    `json:"height"`
+	Hex    string `json:"hex"` // the block header
+}
+
 // ServerFeatures contains the relevant information from `ServerFeatures` results.
 type ServerFeatures struct {
 	ID            int    `json:"id"`
@@ -110,7 +185,9 @@ type Param = interface{}
 // NewClient creates an initialized Client instance.
 func NewClient() *Client {
 	return &Client{
-		log: utils.NewLogger(defaultLoggerTag),
+		notifications: make(map[string]string),
+		breaker:       DefaultBreaker,
+		log:           utils.NewLogger(defaultLoggerTag),
 	}
 }
 
@@ -125,6 +202,7 @@ func (c *Client) Connect(server string) error {
 
 	err := c.establishConnection()
 	if err != nil {
+		c.breaker.Failure(server)
 		c.Disconnect()
 		return c.log.Errorf("Connect failed: %w", err)
 	}
@@ -136,6 +214,13 @@ func (c *Client) Connect(server string) error {
 		return c.log.Errorf("Identifying server failed: %w", err)
 	}
 
+	// Servers for other chains speak the same protocol, and would happily tell us we have no funds:
+	err = c.checkNetwork()
+	if err != nil {
+		c.Disconnect()
+		return c.log.Errorf("Checking network failed: %w", err)
+	}
+
 	c.log.Printf("Identified as %s (%s)", c.ServerImpl, c.ProtoVersion)
 
 	return nil
@@ -155,11 +240,16 @@ func (c *Client) Disconnect() error {
 	}
 
 	c.conn = nil
+	c.reader = nil
 	return nil
 }
 
 // SupportsBatching returns whether this client can process batch requests.
 func (c *Client) SupportsBatching() bool {
+	if batchingDisabled(c.Server) {
+		return false
+	}
+
 	for _, implName := range implsWithBatching {
 		if strings.HasPrefix(c.ServerImpl, implName) {
 			return true
@@ -213,16 +303,44 @@ func (c *Client) ServerPeers() ([]string, error) {
 	var peers []string
 
 	for _, entry := range res {
-		// Get ready for some hot casting action. Not for the faint of heart.
-		addr := entry.([]interface{})[1].(string)
-		port := entry.([]interface{})[2].([]interface{})[1].(string)[1:]
+		peer, ok := parsePeerEntry(entry)
+		if !ok {
+			c.log.Printf("Ignoring malformed peer entry: %v", entry)
+			continue
+		}
 
-		peers = append(peers, addr+":"+port)
+		peers = append(peers, peer)
 	}
 
 	return peers, nil
 }
 
+// parsePeerEntry extracts the address and first port from a `server.peers.subscribe` entry.
+func parsePeerEntry(entry interface{}) (string, bool) {
+	// Get ready for some hot casting action. Not for the faint of heart.
+	fields, ok := entry.([]interface{})
+	if !ok || len(fields) < 3 {
+		return "", false
+	}
+
+	addr, ok := fields[1].(string)
+	if !ok {
+		return "", false
+	}
+
+	features, ok := fields[2].([]interface{})
+	if !ok || len(features) < 2 {
+		return "", false
+	}
+
+	port, ok := features[1].(string)
+	if !ok || len(port) < 2 {
+		return "", false
+	}
+
+	return addr + ":" + port[1:], true
+}
+
 // rawServerPeers calls the `server.peers.subscribe` method and returns this monstrosity:
 // 		[ "<ip>", "<domain>", ["<version>", "s<SSL port>", "t<TLS port>"] ]
 // Ports can be in any order, or absent if the protocol is not supported
@@ -259,6 +377,117 @@ func (c *Client) Broadcast(rawTx string) (string, error) {
 	return response.Result, nil
 }
 
+// Ping calls the `server.ping` method. Besides keeping the connection alive, it gives the client a
+// chance to receive pending notifications.
+func (c *Client) Ping() error {
+	request := Request{
+		Method: "server.ping",
+		Params: []Param{},
+	}
+
+	var response ErrorResponse
+
+	err := c.call(&request, &response)
+	if err != nil {
+		return c.log.Errorf("Ping failed: %w", err)
+	}
+
+	return nil
+}
+
+// SubscribeScriptHash calls `blockchain.scripthash.subscribe` and returns the current status of the
+// script, which is empty if the script has no history. Changes will be reported as notifications.
+func (c *Client) SubscribeScriptHash(indexHash string) (string, error) {
+	request := Request{
+		Method: "blockchain.scripthash.subscribe",
+		Params: []Param{indexHash},
+	}
+
+	var response SubscribeResponse
+
+	err := c.call(&request, &response)
+	if err != nil {
+		return "", c.log.Errorf("SubscribeScriptHash failed: %w", err)
+	}
+
+	if response.Result == nil {
+		return "", nil
+	}
+
+	return *response.Result, nil
+}
+
+// UnsubscribeScriptHash calls `blockchain.scripthash.unsubscribe` (protocol 1.4.2+), and returns
+// whether the subscription existed.
+func (c *Client) UnsubscribeScriptHash(indexHash string) (bool, error) {
+	request := Request{
+		Method: "blockchain.scripthash.unsubscribe",
+		Params: []Param{indexHash},
+	}
+
+	var response UnsubscribeResponse
+
+	err := c.call(&request, &response)
+	if err != nil {
+		return false, c.log.Errorf("UnsubscribeScriptHash failed: %w", err)
+	}
+
+	return response.Result, nil
+}
+
+// SubscribeHeaders calls `blockchain.headers.subscribe` and returns the latest block. New blocks
+// will be reported as notifications, see `Tip`.
+func (c *Client) SubscribeHeaders() (*Tip, error) {
+	request := Request{
+		Method: "blockchain.headers.subscribe",
+		Params: []Param{},
+	}
+
+	var response SubscribeHeadersResponse
+
+	err := c.call(&request, &response)
+	if err != nil {
+		return nil, c.log.Errorf("SubscribeHeaders failed: %w", err)
+	}
+
+	c.tip = &response.Result
+
+	return c.tip, nil
+}
+
+// Tip returns the latest block received since subscribing with `SubscribeHeaders`, or nil if not
+// subscribed. Notifications arrive along with responses, so call `Ping` first to get up to date.
+func (c *Client) Tip() *Tip {
+	return c.tip
+}
+
+// EstimateFee calls `blockchain.estimatefee` and returns the fee rate (in BTC/kB) needed to confirm
+// within a number of blocks, or -1 if the server can't tell.
+func (c *Client) EstimateFee(blocks int) (float64, error) {
+	request := Request{
+		Method: "blockchain.estimatefee",
+		Params: []Param{blocks},
+	}
+
+	var response EstimateFeeResponse
+
+	err := c.call(&request, &response)
+	if err != nil {
+		return 0, c.log.Errorf("EstimateFee failed: %w", err)
+	}
+
+	return response.Result, nil
+}
+
+// ScriptHashNotifications returns the latest status received for each subscribed script that
+// changed since the last call, keyed by index hash.
+func (c *Client) ScriptHashNotifications() map[string]string {
+	notifications := c.notifications
+	c.notifications = make(map[string]string)
+
+	return notifications
+}
+
 // GetTransaction calls the `blockchain.transaction.get` endpoint and returns the transaction hex.
 func (c *Client) GetTransaction(txID string) (string, error) {
 	request := Request{
@@ -292,6 +521,57 @@ func (c *Client) ListUnspent(indexHash string) ([]UnspentRef, error) {
 	return response.Result, nil
 }
 
+// GetHistory calls `blockchain.scripthash.get_history` and returns the transactions of a script,
+// both confirmed and in the mempool.
+func (c *Client) GetHistory(indexHash string) ([]HistoryRef, error) {
+	request := Request{
+		Method: "blockchain.scripthash.get_history",
+		Params: []Param{indexHash},
+	}
+	var response GetHistoryResponse
+
+	err := c.call(&request, &response)
+	if err != nil {
+		return nil, c.log.Errorf("GetHistory failed: %w", err)
+	}
+
+	return response.Result, nil
+}
+
+// GetMerkle calls `blockchain.transaction.get_merkle` and returns the merkle proof of a confirmed
+// transaction, mined at the given height.
+func (c *Client) GetMerkle(txID string, height int) (*MerkleProof, error) {
+	request := Request{
+		Method: "blockchain.transaction.get_merkle",
+		Params: []Param{txID, height},
+	}
+	var response GetMerkleResponse
+
+	err := c.call(&request, &response)
+	if err != nil {
+		return nil, c.log.Errorf("GetMerkle failed: %w", err)
+	}
+
+	return &response.Result, nil
+}
+
+// GetBlockHeader calls `blockchain.block.header` and returns the hex-encoded header of the block
+// at a height.
+func (c *Client) GetBlockHeader(height int) (string, error) {
+	request := Request{
+		Method: "blockchain.block.header",
+		Params: []Param{height},
+	}
+	var response GetBlockHeaderResponse
+
+	err := c.call(&request, &response)
+	if err != nil {
+		return "", c.log.Errorf("GetBlockHeader failed: %w", err)
+	}
+
+	return response.Result, nil
+}
+
 // ListUnspentBatch is like `ListUnspent`, but using batching.
 func (c *Client) ListUnspentBatch(indexHashes []string) ([][]UnspentRef, error) {
 	requests := make([]*Request, len(indexHashes))
@@ -326,21 +606,38 @@ func (c *Client) ListUnspentBatch(indexHashes []string) ([][]UnspentRef, error)
 }
 
 func (c *Client) establishConnection() error {
+	if err := utils.CheckNetwork(); err != nil {
+		return err
+	}
+
 	// TODO: check if insecure is necessary
 	config := &tls.Config{
 		InsecureSkipVerify: true,
 	}
 
-	dialer := &net.Dialer{
-		Timeout: connectionTimeout,
+	// We dial and handshake separately, to count the transfer below TLS, handshakes included (see
+	// utils.CountTransfer), and to go through the proxy, if any (see utils.UseProxy):
+	rawConn, err := utils.Dial("tcp", c.Server, connectionTimeout)
+	if err != nil {
+		return err
 	}
 
-	conn, err := tls.DialWithDialer(dialer, "tcp", c.Server, config)
-	if err != nil {
+	// Servers behind a shared host need the name, as tls.DialWithDialer would send it:
+	if host, _, err := net.SplitHostPort(c.Server); err == nil && net.ParseIP(host) == nil {
+		config.ServerName = host
+	}
+
+	conn := tls.Client(utils.CountTransfer(rawConn), config)
+
+	conn.SetDeadline(time.Now().Add(connectionTimeout))
+	if err := conn.Handshake(); err != nil {
+		rawConn.Close()
 		return err
 	}
+	conn.SetDeadline(time.Time{})
 
 	c.conn = conn
+	c.reader = bufio.NewReader(conn)
 	return nil
 }
 
@@ -456,21 +753,67 @@ func (c *Client) callRaw(request []byte) ([]byte, error) {
 
 	request = append(request, messageDelim)
 
-	_, err := c.conn.Write(request)
+	// A server that accepts connections but never answers must not stall us:
+	err := c.conn.SetDeadline(time.Now().Add(requestTimeout))
 	if err != nil {
 		return nil, c.log.Errorf("Send failed %s: %w", string(request), err)
 	}
 
-	reader := bufio.NewReader(c.conn)
-
-	response, err := reader.ReadBytes(messageDelim)
+	_, err = c.conn.Write(request)
 	if err != nil {
-		return nil, c.log.Errorf("Receive failed: %w", err)
+		c.breaker.Failure(c.Server)
+		return nil, c.log.Errorf("Send failed %s: %w", string(request), err)
 	}
 
-	c.log.Printf("Received %s", string(response))
+	// Servers can push notifications at any time, so we keep reading until we find a response:
+	for {
+		response, err := c.reader.ReadBytes(messageDelim)
+		if err != nil {
+			c.breaker.Failure(c.Server)
+			return nil, c.log.Errorf("Receive failed: %w", err)
+		}
+
+		c.log.Printf("Received %s", string(response))
+
+		if !c.handleNotification(response) {
+			c.breaker.Success(c.Server)
+			return response, nil
+		}
+	}
+}
+
+// handleNotification stores the message if it's a notification, and returns whether it was one.
+func (c *Client) handleNotification(message []byte) bool {
+	if len(message) == 0 || message[0] != '{' {
+		return false // batch responses are arrays, never notifications
+	}
+
+	var notification Notification
+
+	err := json.Unmarshal(message, &notification)
+	if err != nil || notification.ID != nil || notification.Method == "" {
+		return false
+	}
 
-	return response, nil
+	if notification.Method == "blockchain.scripthash.subscribe" && len(notification.Params) == 2 {
+		indexHash, _ := notification.Params[0].(string)
+		status, _ := notification.Params[1].(string) // null when the history is empty
+
+		c.notifications[indexHash] = status
+	}
+
+	if notification.Method == "blockchain.headers.subscribe" && len(notification.Params) == 1 {
+		if header, ok := notification.Params[0].(map[string]interface{}); ok {
+			height, _ := header["height"].(float64)
+			hex, _ := header["hex"].(string)
+
+			if c.tip == nil || int(height) > c.tip.Height {
+				c.tip = &Tip{Height: int(height), Hex: hex}
+			}
+		}
+	}
+
+	return true
 }
 
 func (c *Client) incRequestID() int {
@@ -480,10 +823,16 @@ func (c *Client) incRequestID() int {
 
 // GetIndexHash returns the script parameter to use with Electrum, given a Bitcoin address.
 func GetIndexHash(script []byte) string {
+	indexHash := GetRawIndexHash(script)
+	return hex.EncodeToString(indexHash[:])
+}
+
+// GetRawIndexHash is like `GetIndexHash`, but returns the hash bytes without hex-encoding.
+func GetRawIndexHash(script []byte) [32]byte {
 	indexHash := sha256.Sum256(script)
 	reverse(&indexHash)
 
-	return hex.EncodeToString(indexHash[:])
+	return indexHash
 }
 
 // reverse the order of the provided byte array, in place.
@@ -0,0 +1,37 @@
+package electrum
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/muun/recovery/utils"
+)
+
+// mainnetGenesisHash identifies the Bitcoin chain. Servers report the genesis block of the chain
+// they follow in `server.features`.
+var mainnetGenesisHash = chaincfg.MainNetParams.GenesisHash.String()
+
+// otherChains names the chains a server may follow instead, by genesis hash, for clearer errors.
+// Bitcoin Cash shares its genesis block with Bitcoin, and can't be told apart this way.
+var otherChains = map[string]string{
+	chaincfg.TestNet3Params.GenesisHash.String():                       "testnet",
+	chaincfg.RegressionNetParams.GenesisHash.String():                  "regtest",
+	"00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6": "signet",
+	"12a765e31ffd4059bada1e25190f6e98c99d9714d334efa41a195a7e7e04bfe2": "Litecoin",
+}
+
+// checkNetwork fails if the server follows a chain other than Bitcoin. Servers that don't report
+// their genesis block get the benefit of the doubt.
+func (c *Client) checkNetwork() error {
+	features, err := c.ServerFeatures()
+	if err != nil || features.GenesisHash == "" || features.GenesisHash == mainnetGenesisHash {
+		return nil
+	}
+
+	chain, ok := otherChains[features.GenesisHash]
+	if !ok {
+		chain = fmt.Sprintf("an unknown chain (genesis block %s)", features.GenesisHash)
+	}
+
+	return utils.WrapError(utils.ErrWrongNetwork, fmt.Errorf("%s is a server for %s, not Bitcoin", c.Server, chain))
+}
@@ -0,0 +1,142 @@
+package electrum
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultPeerTTL is how long a server seen in a previous run is trusted to still be there.
+const DefaultPeerTTL = 7 * 24 * time.Hour
+
+// PeerCache remembers servers that worked in previous runs, along with their capabilities, so we
+// can skip the slow trial-and-error of finding good servers on every invocation.
+//
+// Entries expire after a TTL, after which we go back to discovering servers from the public list.
+// It's thread-safe.
+//
+// Electrum servers are the only peers we discover. The other backends are Esplora and bitcoind,
+// which are given by URL, and there's no P2P or Neutrino backend whose DNS seeds and handshakes a
+// cache could spare. One would need its own cache, keyed by service bits rather than protocol.
+type PeerCache struct {
+	path    string
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*PeerInfo
+}
+
+// PeerInfo describes a server we successfully used.
+type PeerInfo struct {
+	Server   string    `json:"server"`
+	Impl     string    `json:"impl"`
+	Protocol string    `json:"protocol"`
+	Batching bool      `json:"batching"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// DefaultPeerCachePath returns the location of the peer cache in the user's cache directory.
+func DefaultPeerCachePath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(cacheDir, "muun-recovery", "peers.json"), nil
+}
+
+// LoadPeerCache reads a PeerCache from disk. A missing file results in an empty cache.
+func LoadPeerCache(path string, ttl time.Duration) (*PeerCache, error) {
+	cache := &PeerCache{
+		path:    path,
+		ttl:     ttl,
+		entries: make(map[string]*PeerInfo),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []*PeerInfo
+	if err := json.Unmarshal(data, &infos); err != nil {
+		return nil, err
+	}
+
+	for _, info := range infos {
+		cache.entries[info.Server] = info
+	}
+
+	return cache, nil
+}
+
+// Record notes that a connected Client is working correctly.
+func (c *PeerCache) Record(client *Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[client.Server] = &PeerInfo{
+		Server:   client.Server,
+		Impl:     client.ServerImpl,
+		Protocol: client.ProtoVersion,
+		Batching: client.SupportsBatching(),
+		LastSeen: time.Now().UTC(),
+	}
+}
+
+// Fresh returns the servers seen within the TTL, with batching servers and recent sightings first.
+func (c *PeerCache) Fresh() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var fresh []*PeerInfo
+	for _, info := range c.entries {
+		if time.Since(info.LastSeen) < c.ttl {
+			fresh = append(fresh, info)
+		}
+	}
+
+	sort.Slice(fresh, func(i, j int) bool {
+		if fresh[i].Batching != fresh[j].Batching {
+			return fresh[i].Batching
+		}
+		return fresh[i].LastSeen.After(fresh[j].LastSeen)
+	})
+
+	servers := make([]string, len(fresh))
+	for i, info := range fresh {
+		servers[i] = info.Server
+	}
+
+	return servers
+}
+
+// Save writes the cache to disk, dropping expired entries.
+func (c *PeerCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var infos []*PeerInfo
+	for _, info := range c.entries {
+		if time.Since(info.LastSeen) < c.ttl {
+			infos = append(infos, info)
+		}
+	}
+
+	data, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(c.path, data, 0600)
+}
@@ -3,19 +3,75 @@ package electrum
 import "sync/atomic"
 
 // ServerProvider manages a rotating server list, from which callers can pull server addresses.
+// Servers whose circuit is tripped are skipped.
 type ServerProvider struct {
 	nextIndex int32
+	servers   []string
+	breaker   *CircuitBreaker
 }
 
 // NewServerProvider returns an initialized ServerProvider.
 func NewServerProvider() *ServerProvider {
-	return &ServerProvider{-1}
+	return &ServerProvider{-1, PublicServers, DefaultBreaker}
 }
 
-// NextServer returns an address from the rotating list. It's thread-safe.
+// NewServerProviderFrom returns a ServerProvider that tries the `preferred` servers before
+// moving on to the public list.
+func NewServerProviderFrom(preferred []string) *ServerProvider {
+	var servers []string
+	seen := make(map[string]bool)
+
+	candidates := append(append([]string{}, preferred...), PublicServers...)
+
+	for _, server := range candidates {
+		if !seen[server] {
+			servers = append(servers, server)
+			seen[server] = true
+		}
+	}
+
+	return &ServerProvider{-1, servers, DefaultBreaker}
+}
+
+// NewServerProviderWithout returns a ServerProvider like NewServerProviderFrom, that never returns
+// the `excluded` servers. If every server is excluded, none are.
+func NewServerProviderWithout(preferred []string, excluded []string) *ServerProvider {
+	provider := NewServerProviderFrom(preferred)
+
+	skip := make(map[string]bool)
+	for _, server := range excluded {
+		skip[server] = true
+	}
+
+	var servers []string
+	for _, server := range provider.servers {
+		if !skip[server] {
+			servers = append(servers, server)
+		}
+	}
+
+	if len(servers) > 0 {
+		provider.servers = servers
+	}
+
+	return provider
+}
+
+// NextServer returns an address from the rotating list, skipping servers that have been failing.
+// If all of them are, it returns the next one anyway. It's thread-safe.
 func (p *ServerProvider) NextServer() string {
-	index := int(atomic.AddInt32(&p.nextIndex, 1))
-	return PublicServers[index%len(PublicServers)]
+	var server string
+
+	for i := 0; i < len(p.servers); i++ {
+		index := int(atomic.AddInt32(&p.nextIndex, 1))
+		server = p.servers[index%len(p.servers)]
+
+		if p.breaker.Allow(server) {
+			return server
+		}
+	}
+
+	return server
 }
 
 // PublicServers list.
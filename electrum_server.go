@@ -0,0 +1,759 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/libwallet/btcsuitew/btcutilw"
+	"github.com/muun/recovery/descriptors"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/payto"
+)
+
+// With --serve-electrum, once the recovery is over, the Recovery Tool keeps running as a minimal
+// Electrum server on this computer, so the wallet the funds were migrated or swept to can be tracked
+// right away by software that only talks to Electrum servers.
+//
+// It only answers for the scripts of the recovered wallet (the ranges we scanned) and the
+// destination, forwarding the requests to a server of the chosen backend. Other scripts are
+// refused, so the local wallet can't leak unrelated addresses through it. There's no TLS: it only
+// listens on loopback addresses.
+
+// electrumServerProtocol is the version of the Electrum protocol we speak.
+const electrumServerProtocol = "1.4"
+
+// electrumServerPollInterval is how often we ask the backend for new blocks and script changes.
+const electrumServerPollInterval = 30 * time.Second
+
+// electrumServerMaxHeaders is how many headers we return for a `blockchain.block.headers` request.
+// The protocol lets servers return fewer than asked for, clients ask again for the rest.
+const electrumServerMaxHeaders = 100
+
+// electrumServerRelayFee is the minimum relay fee we report, in BTC/kB, as Bitcoin Core's default.
+const electrumServerRelayFee = 0.00001
+
+// electrumServerMaxMessage is the largest request we accept, enough to broadcast any transaction.
+const electrumServerMaxMessage = 8 << 20
+
+// walletServer answers Electrum requests about the recovered wallet, forwarding them to the
+// backend.
+type walletServer struct {
+	scripts map[string]bool // index hashes we answer for
+
+	mu       sync.Mutex // guards everything below, the client isn't thread-safe
+	provider *electrum.ServerProvider
+	upstream *electrum.Client
+	tip      *electrum.Tip
+	statuses map[string]string // the latest status of each subscribed script
+	sessions map[*walletSession]bool
+}
+
+// walletSession is a connection of a local wallet.
+type walletSession struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	headers bool            // subscribed to new blocks
+	scripts map[string]bool // subscribed scripts
+}
+
+type serverRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type serverResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+	Error   *serverError    `json:"error,omitempty"`
+}
+
+type serverError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type serverNotification struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+// checkElectrumServerOptions fails early when --serve-electrum isn't a local address, or is
+// combined with options that never get to serve.
+func checkElectrumServerOptions() {
+	if *serveElectrum == "" {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(*serveElectrum)
+	if err != nil {
+		exitWithError(fmt.Errorf("invalid --serve-electrum address, use host:port (such as 127.0.0.1:50001): %w", err))
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		exitWithError(fmt.Errorf("--serve-electrum only listens on this computer (such as 127.0.0.1:50001), not on %s", host))
+	}
+
+	conflicts := []struct {
+		option string
+		set    bool
+	}{
+		{"--history-dump", *historyDump != ""},
+		{"--export-snapshot", *exportSnapshot != ""},
+		{"--export-chunks", *exportChunks != ""},
+	}
+
+	for _, conflict := range conflicts {
+		if conflict.set {
+			exitWithError(fmt.Errorf("--serve-electrum can't be combined with %s", conflict.option))
+		}
+	}
+}
+
+// serveRecoveredWallet runs the Electrum server for the scripts of the recovered wallet and the
+// destination (nil if there's none worth serving), until the Recovery Tool is stopped.
+func serveRecoveredWallet(listenAddress string, generations []*keyGeneration, destination btcutil.Address, servers []string) {
+	scripts, err := walletIndexHashes(generations, destination)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to serve the wallet at %s: %w", listenAddress, err))
+	}
+	defer listener.Close()
+
+	server := &walletServer{
+		scripts:  scripts,
+		provider: electrum.NewServerProviderFrom(servers),
+		upstream: electrum.NewClient(),
+		statuses: make(map[string]string),
+		sessions: make(map[*walletSession]bool),
+	}
+
+	sayBlock(`
+		{whiteUnderline Serving your wallet}
+		Other wallets can track it through the Electrum server at {white tcp://%s} (without TLS,
+		or SSL), which only answers for the %d scripts of your wallet and destination.
+	`, listenAddress, len(scripts))
+
+	printWatchOnlyDescriptors(generations)
+
+	sayBlock("Press {white Ctrl-C} to stop serving\n\n")
+
+	go server.poll()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			exitWithError(fmt.Errorf("failed to serve the wallet: %w", err))
+		}
+
+		go server.serve(conn)
+	}
+}
+
+// walletIndexHashes returns the index hashes of the scripts we scanned for every generation, and
+// the destination's.
+func walletIndexHashes(generations []*keyGeneration, destination btcutil.Address) (map[string]bool, error) {
+	hashes := make(map[string]bool)
+
+	addScript := func(address btcutil.Address) error {
+		script, err := payto.Script(address)
+		if err != nil {
+			return err
+		}
+
+		hashes[electrum.GetIndexHash(script)] = true
+		return nil
+	}
+
+	for _, generation := range generations {
+		for muunAddress := range generation.generator.Stream() {
+			rawAddress := muunAddress.Address()
+
+			address, err := btcutilw.DecodeAddress(rawAddress, &chainParams)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode address %s: %w", rawAddress, err)
+			}
+
+			if err := addScript(address); err != nil {
+				return nil, fmt.Errorf("failed to craft script for %s: %w", rawAddress, err)
+			}
+		}
+	}
+
+	if destination != nil {
+		if err := addScript(destination); err != nil {
+			return nil, fmt.Errorf("failed to craft script for %s: %w", destination, err)
+		}
+	}
+
+	return hashes, nil
+}
+
+// printWatchOnlyDescriptors prints the descriptors of the wallet without private keys, for wallets
+// that track the recovered one. Like those in the migration, they're only for the main generation.
+func printWatchOnlyDescriptors(generations []*keyGeneration) {
+	userKey, err1 := generations[0].UserKey.DeriveTo(keys.KitKeyPath)
+	muunKey, err2 := generations[0].MuunKey.DeriveTo(keys.KitKeyPath)
+
+	if err1 != nil || err2 != nil {
+		return // the wallet can still be served, its user just won't see the descriptors
+	}
+
+	sayBlock("To track it, import these descriptors (watch-only, they have no private keys):\n")
+
+	for _, v := range migrationVersions {
+		for _, branch := range []string{"0", "1"} {
+			text := fmt.Sprintf(
+				v.format,
+				userKey.PublicKey().String()+"/"+branch+"/*",
+				muunKey.PublicKey().String()+"/"+branch+"/*",
+			)
+
+			fmt.Fprintln(userOutput, text+"#"+descriptors.Checksum(text))
+		}
+	}
+}
+
+// serve answers the requests of a local wallet, until it disconnects.
+func (s *walletServer) serve(conn net.Conn) {
+	session := &walletSession{conn: conn, scripts: make(map[string]bool)}
+
+	s.mu.Lock()
+	s.sessions[session] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, session)
+		s.mu.Unlock()
+
+		conn.Close()
+	}()
+
+	reader := bufio.NewScanner(conn)
+	reader.Buffer(make([]byte, 64*1024), electrumServerMaxMessage)
+
+	for reader.Scan() {
+		message := bytes.TrimSpace(reader.Bytes())
+		if len(message) == 0 {
+			continue
+		}
+
+		var response interface{}
+
+		if message[0] == '[' {
+			var requests []serverRequest
+			if err := json.Unmarshal(message, &requests); err != nil {
+				response = invalidRequest()
+			} else {
+				var responses []*serverResponse
+				for i := range requests {
+					responses = append(responses, s.handle(session, &requests[i]))
+				}
+
+				response = responses
+			}
+		} else {
+			var request serverRequest
+			if err := json.Unmarshal(message, &request); err != nil {
+				response = invalidRequest()
+			} else {
+				response = s.handle(session, &request)
+			}
+		}
+
+		if err := session.send(response); err != nil {
+			return
+		}
+	}
+}
+
+func invalidRequest() *serverResponse {
+	return &serverResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &serverError{-32600, "invalid request"}}
+}
+
+// handle answers a request, forwarding it to the backend if needed.
+func (s *walletServer) handle(session *walletSession, request *serverRequest) *serverResponse {
+	result, err := s.result(session, request)
+
+	response := &serverResponse{JSONRPC: "2.0", ID: request.ID, Result: result}
+	if err != nil {
+		response.Result = nil
+		response.Error = &serverError{1, err.Error()}
+	}
+
+	return response
+}
+
+func (s *walletServer) result(session *walletSession, request *serverRequest) (interface{}, error) {
+	switch request.Method {
+	case "server.version":
+		return []string{"Muun Recovery Tool " + version, electrumServerProtocol}, nil
+
+	case "server.banner":
+		return "Muun Recovery Tool, serving the recovered wallet only", nil
+
+	case "server.donation_address":
+		return "", nil
+
+	case "server.features":
+		return map[string]interface{}{
+			"genesis_hash":   chainParams.GenesisHash.String(),
+			"hash_function":  "sha256",
+			"server_version": "Muun Recovery Tool " + version,
+			"protocol_min":   electrumServerProtocol,
+			"protocol_max":   electrumServerProtocol,
+			"pruning":        nil,
+			"hosts":          map[string]interface{}{},
+		}, nil
+
+	case "server.peers.subscribe":
+		return []interface{}{}, nil
+
+	case "server.ping":
+		return nil, nil
+
+	case "blockchain.relayfee":
+		return electrumServerRelayFee, nil
+	}
+
+	if strings.HasPrefix(request.Method, "blockchain.scripthash.") {
+		return s.scriptResult(session, request)
+	}
+
+	switch request.Method {
+	case "blockchain.headers.subscribe":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		session.headers = true
+
+		if s.tip == nil {
+			if err := s.ensureUpstream(); err != nil {
+				return nil, err
+			}
+		}
+
+		return s.tip, nil
+
+	case "blockchain.block.header":
+		var height, checkpoint int
+		if err := parseParams(request.Params, &height, &checkpoint); err != nil {
+			return nil, err
+		}
+
+		if checkpoint != 0 {
+			return nil, fmt.Errorf("checkpoints are not supported")
+		}
+
+		var header string
+		err := s.forward(func(client *electrum.Client) (err error) {
+			header, err = client.GetBlockHeader(height)
+			return err
+		})
+
+		return header, err
+
+	case "blockchain.block.headers":
+		var start, count, checkpoint int
+		if err := parseParams(request.Params, &start, &count, &checkpoint); err != nil {
+			return nil, err
+		}
+
+		if checkpoint != 0 {
+			return nil, fmt.Errorf("checkpoints are not supported")
+		}
+
+		return s.headers(start, count)
+
+	case "blockchain.estimatefee":
+		var blocks int
+		if err := parseParams(request.Params, &blocks); err != nil {
+			return nil, err
+		}
+
+		var rate float64
+		err := s.forward(func(client *electrum.Client) (err error) {
+			rate, err = client.EstimateFee(blocks)
+			return err
+		})
+
+		return rate, err
+
+	case "blockchain.transaction.get":
+		var txID string
+		var verbose bool
+		if err := parseParams(request.Params, &txID, &verbose); err != nil {
+			return nil, err
+		}
+
+		if verbose {
+			return nil, fmt.Errorf("verbose transactions are not supported")
+		}
+
+		var txHex string
+		err := s.forward(func(client *electrum.Client) (err error) {
+			txHex, err = client.GetTransaction(txID)
+			return err
+		})
+
+		return txHex, err
+
+	case "blockchain.transaction.get_merkle":
+		var txID string
+		var height int
+		if err := parseParams(request.Params, &txID, &height); err != nil {
+			return nil, err
+		}
+
+		var proof *electrum.MerkleProof
+		err := s.forward(func(client *electrum.Client) (err error) {
+			proof, err = client.GetMerkle(txID, height)
+			return err
+		})
+
+		return proof, err
+
+	case "blockchain.transaction.broadcast":
+		var txHex string
+		if err := parseParams(request.Params, &txHex); err != nil {
+			return nil, err
+		}
+
+		var txID string
+		err := s.forward(func(client *electrum.Client) (err error) {
+			txID, err = client.Broadcast(txHex)
+			return err
+		})
+
+		return txID, err
+	}
+
+	return nil, fmt.Errorf("%s is not supported by the Recovery Tool", request.Method)
+}
+
+// scriptResult answers the `blockchain.scripthash.*` requests, for scripts of the wallet only.
+func (s *walletServer) scriptResult(session *walletSession, request *serverRequest) (interface{}, error) {
+	var indexHash string
+	if err := parseParams(request.Params, &indexHash); err != nil {
+		return nil, err
+	}
+
+	if !s.scripts[indexHash] {
+		return nil, fmt.Errorf("the Recovery Tool only serves the scripts of the recovered wallet")
+	}
+
+	switch request.Method {
+	case "blockchain.scripthash.subscribe":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if err := s.ensureUpstream(); err != nil {
+			return nil, err
+		}
+
+		status, err := s.upstream.SubscribeScriptHash(indexHash)
+		if err != nil {
+			s.upstream.Disconnect()
+			return nil, err
+		}
+
+		session.scripts[indexHash] = true
+		s.statuses[indexHash] = status
+
+		return nullableStatus(status), nil
+
+	case "blockchain.scripthash.unsubscribe":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		subscribed := session.scripts[indexHash]
+		delete(session.scripts, indexHash)
+
+		return subscribed, nil
+
+	case "blockchain.scripthash.get_history", "blockchain.scripthash.get_mempool":
+		var history []electrum.HistoryRef
+		err := s.forward(func(client *electrum.Client) (err error) {
+			history, err = client.GetHistory(indexHash)
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		result := []electrum.HistoryRef{} // an empty history is [], not null
+		for _, ref := range history {
+			if request.Method == "blockchain.scripthash.get_history" || ref.Height <= 0 {
+				result = append(result, ref)
+			}
+		}
+
+		return result, nil
+
+	case "blockchain.scripthash.listunspent":
+		var unspent []electrum.UnspentRef
+		err := s.forward(func(client *electrum.Client) (err error) {
+			unspent, err = client.ListUnspent(indexHash)
+			return err
+		})
+
+		if unspent == nil {
+			unspent = []electrum.UnspentRef{}
+		}
+
+		return unspent, err
+
+	case "blockchain.scripthash.get_balance":
+		var unspent []electrum.UnspentRef
+		err := s.forward(func(client *electrum.Client) (err error) {
+			unspent, err = client.ListUnspent(indexHash)
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		var confirmed, unconfirmed int64
+		for _, ref := range unspent {
+			if ref.Height > 0 {
+				confirmed += ref.Value
+			} else {
+				unconfirmed += ref.Value
+			}
+		}
+
+		return map[string]int64{"confirmed": confirmed, "unconfirmed": unconfirmed}, nil
+	}
+
+	return nil, fmt.Errorf("%s is not supported by the Recovery Tool", request.Method)
+}
+
+// headers returns up to electrumServerMaxHeaders consecutive headers, concatenated.
+func (s *walletServer) headers(start, count int) (interface{}, error) {
+	if count > electrumServerMaxHeaders {
+		count = electrumServerMaxHeaders
+	}
+
+	var concatenated strings.Builder
+	found := 0
+
+	err := s.forward(func(client *electrum.Client) error {
+		for ; found < count; found++ {
+			header, err := client.GetBlockHeader(start + found)
+			if err != nil {
+				if found > 0 {
+					return nil // past the tip, return what we have
+				}
+
+				return err
+			}
+
+			concatenated.WriteString(header)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"count": found,
+		"hex":   concatenated.String(),
+		"max":   electrumServerMaxHeaders,
+	}, nil
+}
+
+// forward runs a request on the backend, connecting first if needed.
+func (s *walletServer) forward(request func(client *electrum.Client) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ensureUpstream(); err != nil {
+		return err
+	}
+
+	if err := request(s.upstream); err != nil {
+		// Electrum errors (such as a rejected transaction) leave the connection usable, but we
+		// can't tell them apart from broken connections. Reconnecting is cheap:
+		s.upstream.Disconnect()
+		return err
+	}
+
+	return nil
+}
+
+// ensureUpstream connects to the backend if we're not connected, subscribing again to new blocks
+// and every script the local wallets follow. Must be called with the lock held.
+func (s *walletServer) ensureUpstream() error {
+	if s.upstream.IsConnected() {
+		return nil
+	}
+
+	var err error
+	for attempt := 0; attempt < 3 && !s.upstream.IsConnected(); attempt++ {
+		err = s.upstream.Connect(s.provider.NextServer())
+	}
+
+	if !s.upstream.IsConnected() {
+		return fmt.Errorf("failed to connect to the backend: %w", err)
+	}
+
+	tip, err := s.upstream.SubscribeHeaders()
+	if err != nil {
+		s.upstream.Disconnect()
+		return err
+	}
+
+	s.updateTip(tip)
+
+	// Scripts may have changed while we were disconnected:
+	for indexHash := range s.subscribedScripts() {
+		status, err := s.upstream.SubscribeScriptHash(indexHash)
+		if err != nil {
+			s.upstream.Disconnect()
+			return err
+		}
+
+		s.updateStatus(indexHash, status)
+	}
+
+	return nil
+}
+
+// poll keeps asking the backend for notifications, and relays them to the local wallets.
+func (s *walletServer) poll() {
+	for range time.Tick(electrumServerPollInterval) {
+		s.mu.Lock()
+
+		if err := s.ensureUpstream(); err == nil {
+			// Notifications arrive along with responses:
+			if err := s.upstream.Ping(); err != nil {
+				s.upstream.Disconnect()
+			} else {
+				s.updateTip(s.upstream.Tip())
+
+				for indexHash, status := range s.upstream.ScriptHashNotifications() {
+					s.updateStatus(indexHash, status)
+				}
+			}
+		}
+
+		s.mu.Unlock()
+	}
+}
+
+// updateTip notifies the sessions subscribed to new blocks, if there's a new one. Must be called
+// with the lock held.
+func (s *walletServer) updateTip(tip *electrum.Tip) {
+	if tip == nil || (s.tip != nil && tip.Height <= s.tip.Height) {
+		return
+	}
+
+	s.tip = tip
+
+	for session := range s.sessions {
+		if session.headers {
+			session.notify("blockchain.headers.subscribe", tip)
+		}
+	}
+}
+
+// updateStatus notifies the sessions subscribed to a script, if its status changed. Must be called
+// with the lock held.
+func (s *walletServer) updateStatus(indexHash string, status string) {
+	if previous, ok := s.statuses[indexHash]; ok && previous == status {
+		return
+	}
+
+	s.statuses[indexHash] = status
+
+	for session := range s.sessions {
+		if session.scripts[indexHash] {
+			session.notify("blockchain.scripthash.subscribe", indexHash, nullableStatus(status))
+		}
+	}
+}
+
+// subscribedScripts returns the scripts any session follows. Must be called with the lock held.
+func (s *walletServer) subscribedScripts() map[string]bool {
+	scripts := make(map[string]bool)
+
+	for session := range s.sessions {
+		for indexHash := range session.scripts {
+			scripts[indexHash] = true
+		}
+	}
+
+	return scripts
+}
+
+func (session *walletSession) notify(method string, params ...interface{}) {
+	session.send(&serverNotification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (session *walletSession) send(message interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+
+	// A wallet that stops reading must not block the others:
+	if err := session.conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return err
+	}
+
+	_, err = session.conn.Write(append(data, '\n'))
+	return err
+}
+
+// nullableStatus returns the status of a script as Electrum sends it: null for no history.
+func nullableStatus(status string) interface{} {
+	if status == "" {
+		return nil
+	}
+
+	return status
+}
+
+// parseParams decodes the positional parameters of a request. Missing trailing ones are left as
+// they are, being optional.
+func parseParams(params []json.RawMessage, targets ...interface{}) error {
+	for i, param := range params {
+		if i >= len(targets) {
+			break
+		}
+
+		if err := json.Unmarshal(param, targets[i]); err != nil {
+			return fmt.Errorf("invalid parameter %d: %w", i, err)
+		}
+	}
+
+	if len(params) == 0 && len(targets) > 0 {
+		return fmt.Errorf("missing parameters")
+	}
+
+	return nil
+}
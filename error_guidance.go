@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/muun/recovery/utils"
+)
+
+// Failures from Electrum servers and the network reach us as error messages written for developers.
+// When one of the common ones ends the recovery, we explain it in plain language first, and say
+// what to do about it. The original error is still shown, for support.
+
+// errorGuide explains one kind of failure.
+type errorGuide struct {
+	matches func(err error) bool
+	title   string
+	advice  string // what to do next, several lines are fine
+}
+
+// errorGuides are tried in order, and the first one that matches explains the error. To explain a
+// new kind of failure, add it here.
+var errorGuides = []errorGuide{
+	{
+		matches: messageContains("txn-mempool-conflict", "missing-inputs", "bad-txns-inputs-missingorspent"),
+		title:   "Your funds are already being spent by another transaction",
+		advice: `
+			If you ran the Recovery Tool before, it may be your own earlier transaction: check your
+			destination address in a block explorer before trying again.
+			If you didn't, contact us right away.
+		`,
+	},
+	{
+		matches: taggedWith(utils.ErrFundsSpent),
+		title:   "Your funds were spent by another transaction",
+		advice: `
+			Nothing was sent. If you ran the Recovery Tool before, check your destination address in a
+			block explorer: the funds may already be there. If not, contact us right away.
+		`,
+	},
+	{
+		matches: messageContains("min relay fee not met", "mempool min fee not met", "insufficient fee"),
+		title:   "The fee is too low for the network to accept the transaction",
+		advice: `
+			Nothing was sent. Run the Recovery Tool again and choose a higher fee rate. Running
+			"recovery-tool fees" compares the rates, and how long they take to confirm.
+		`,
+	},
+	{
+		matches: messageContains("x509:", "tls:", "certificate"),
+		title:   "A secure connection to the servers couldn't be established",
+		advice: `
+			Check that the date and time of your computer are right. Networks that intercept
+			connections, common at work, in schools and on public Wi-Fi, cause this too: try another
+			network, or choose servers you trust with --servers.
+		`,
+	},
+	{
+		matches: messageContains("banned", "blacklisted", "rate limit", "too many requests", "excessive resource usage"),
+		title:   "The servers are refusing connections from your network",
+		advice: `
+			This usually happens after too many requests from the same address. Wait an hour and try
+			again, or use another network.
+		`,
+	},
+	{
+		matches: messageContains("pruned", "block not available", "history too large"),
+		title:   "The server doesn't keep the old data we need",
+		advice: `
+			Some servers discard old blocks, or can't list the history of busy addresses. Try again, and
+			other servers will be picked. You can also choose servers with full history with --servers.
+		`,
+	},
+	{
+		matches: taggedWith(utils.ErrBackendUnavailable),
+		title:   "No server could be reached",
+		advice: `
+			Check your internet connection. Firewalls, proxies and VPNs can block the connections we
+			need: try another network if you're behind one. You can also choose servers with --servers.
+		`,
+	},
+	{
+		matches: taggedWith(utils.ErrInvalidRecoveryCode),
+		title:   "The Recovery Code doesn't seem to be the one of this Emergency Kit",
+		advice: `
+			Check it for typos, character by character, and run the Recovery Tool again. Make sure the
+			Recovery Code and the Emergency Kit belong to the same wallet.
+		`,
+	},
+	{
+		matches: taggedWith(utils.ErrKeyMismatch, utils.ErrDecryptionFailed, utils.ErrWrongDerivationPath),
+		title:   "Your Emergency Kit seems to be damaged",
+		advice: `
+			Part of the kit couldn't be decrypted, or doesn't match the rest of it. If you typed the keys
+			in, check them for typos. If you have another copy of the kit, try with that one.
+		`,
+	},
+}
+
+// guideFor returns the guide that explains an error, if any.
+func guideFor(err error) (*errorGuide, bool) {
+	if err == nil {
+		return nil, false
+	}
+
+	for i := range errorGuides {
+		if errorGuides[i].matches(err) {
+			return &errorGuides[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// taggedWith matches errors tagged with any of the sentinels.
+func taggedWith(sentinels ...error) func(err error) bool {
+	return func(err error) bool {
+		for _, sentinel := range sentinels {
+			if errors.Is(err, sentinel) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// messageContains matches errors whose message has any of the fragments, ignoring case. Servers
+// word the same failures differently, so guides match on the parts they tend to share.
+func messageContains(fragments ...string) func(err error) bool {
+	return func(err error) bool {
+		message := strings.ToLower(err.Error())
+
+		for _, fragment := range fragments {
+			if strings.Contains(message, strings.ToLower(fragment)) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/scanner"
+)
+
+// evidenceBundleVersion is the version of the evidence bundle file format.
+const evidenceBundleVersion = 1
+
+// evidenceBundle proves that the outputs selected for a sweep exist, so that an offline signer or
+// an auditor can check them without trusting the computer that scanned for them. See
+// scanner.InputEvidence.
+type evidenceBundle struct {
+	Version int `json:"version"`
+	caseTag
+	CreatedAt time.Time       `json:"createdAt"`
+	Inputs    []evidenceInput `json:"inputs"`
+}
+
+// evidenceInput is the InputEvidence of an output, hex-encoded.
+type evidenceInput struct {
+	TxID        string      `json:"txId"`
+	OutputIndex int         `json:"outputIndex"`
+	Amount      sats.Amount `json:"amount"`
+	Script      string      `json:"script"`
+	BlockHeight int         `json:"blockHeight"`
+	Tx          string      `json:"tx"`
+	BlockHeader string      `json:"blockHeader"`
+	MerkleProof []string    `json:"merkleProof"`
+	Position    int         `json:"position"`
+}
+
+// writeEvidenceBundle collects the evidence of the outputs to sweep, and saves it.
+func writeEvidenceBundle(path string, utxoScanner *scanner.Scanner, utxos []*scanner.Utxo) {
+	sayBlock("Collecting proof of the funds...\n")
+
+	bundle := &evidenceBundle{
+		Version:   evidenceBundleVersion,
+		caseTag:   currentTag(),
+		CreatedAt: time.Now().UTC(),
+		Inputs:    []evidenceInput{},
+	}
+
+	for _, utxo := range utxos {
+		evidence, err := utxoScanner.GetInputEvidence(utxo)
+		if err != nil {
+			exitWithError(fmt.Errorf("failed to collect proof of %s:%d: %w", utxo.TxID, utxo.OutputIndex, err))
+		}
+
+		input, err := newEvidenceInput(evidence)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		bundle.Inputs = append(bundle.Inputs, input)
+	}
+
+	if err := bundle.save(path); err != nil {
+		exitWithError(err)
+	}
+
+	recordCaseEvent(bundle.caseTag, "evidence", "Saved proof of %d outputs to %s", len(bundle.Inputs), path)
+
+	say("{green ✓} Proof of %d outputs saved to {white %s}\n\n", len(bundle.Inputs), path)
+}
+
+func newEvidenceInput(evidence *scanner.InputEvidence) (evidenceInput, error) {
+	txHex, err := encodeTxHex(evidence.Tx)
+	if err != nil {
+		return evidenceInput{}, err
+	}
+
+	var header bytes.Buffer
+	if err := evidence.Header.Serialize(&header); err != nil {
+		return evidenceInput{}, fmt.Errorf("failed to encode block header: %w", err)
+	}
+
+	input := evidenceInput{
+		TxID:        evidence.Utxo.TxID,
+		OutputIndex: evidence.Utxo.OutputIndex,
+		Amount:      evidence.Utxo.Amount,
+		Script:      hex.EncodeToString(evidence.Utxo.Script),
+		BlockHeight: evidence.Utxo.Height,
+		Tx:          txHex,
+		BlockHeader: hex.EncodeToString(header.Bytes()),
+		MerkleProof: []string{},
+		Position:    evidence.Position,
+	}
+
+	for _, hash := range evidence.MerkleProof {
+		input.MerkleProof = append(input.MerkleProof, hash.String())
+	}
+
+	return input, nil
+}
+
+func loadEvidenceBundle(path string) (*evidenceBundle, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read evidence bundle: %w", err)
+	}
+
+	var bundle evidenceBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("failed to parse evidence bundle in %s: %w", path, err)
+	}
+
+	if bundle.Version != evidenceBundleVersion {
+		return nil, fmt.Errorf("unsupported evidence bundle version %d in %s", bundle.Version, path)
+	}
+
+	return &bundle, nil
+}
+
+func (b *evidenceBundle) save(path string) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode evidence bundle: %w", err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write evidence bundle: %w", err)
+	}
+
+	return nil
+}
+
+// verify decodes and checks the evidence of every input.
+func (b *evidenceBundle) verify() ([]*scanner.InputEvidence, error) {
+	var verified []*scanner.InputEvidence
+
+	for _, input := range b.Inputs {
+		evidence, err := input.decode()
+		if err != nil {
+			return nil, fmt.Errorf("invalid proof of %s:%d: %w", input.TxID, input.OutputIndex, err)
+		}
+
+		if err := evidence.Verify(); err != nil {
+			return nil, err
+		}
+
+		verified = append(verified, evidence)
+	}
+
+	return verified, nil
+}
+
+func (i evidenceInput) decode() (*scanner.InputEvidence, error) {
+	script, err := hex.DecodeString(i.Script)
+	if err != nil {
+		return nil, fmt.Errorf("bad script: %w", err)
+	}
+
+	rawTx, err := hex.DecodeString(i.Tx)
+	if err != nil {
+		return nil, fmt.Errorf("bad transaction: %w", err)
+	}
+
+	tx := wire.NewMsgTx(0)
+	if err := tx.Deserialize(bytes.NewReader(rawTx)); err != nil {
+		return nil, fmt.Errorf("bad transaction: %w", err)
+	}
+
+	rawHeader, err := hex.DecodeString(i.BlockHeader)
+	if err != nil {
+		return nil, fmt.Errorf("bad block header: %w", err)
+	}
+
+	header := &wire.BlockHeader{}
+	if err := header.Deserialize(bytes.NewReader(rawHeader)); err != nil {
+		return nil, fmt.Errorf("bad block header: %w", err)
+	}
+
+	evidence := &scanner.InputEvidence{
+		Utxo: &scanner.Utxo{
+			TxID:        i.TxID,
+			OutputIndex: i.OutputIndex,
+			Amount:      i.Amount,
+			Script:      script,
+			Height:      i.BlockHeight,
+		},
+		Tx:       tx,
+		Header:   header,
+		Position: i.Position,
+	}
+
+	for _, sibling := range i.MerkleProof {
+		hash, err := chainhash.NewHashFromStr(sibling)
+		if err != nil {
+			return nil, fmt.Errorf("bad merkle proof: %w", err)
+		}
+
+		evidence.MerkleProof = append(evidence.MerkleProof, hash)
+	}
+
+	return evidence, nil
+}
+
+// runVerifyEvidenceCommand checks an evidence bundle saved with --export-evidence. It works
+// offline, and needs no keys.
+func runVerifyEvidenceCommand(args []string) {
+	flags := flag.NewFlagSet("verify-evidence", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	bundle, err := loadEvidenceBundle(flags.Arg(0))
+	if err != nil {
+		exitWithError(err)
+	}
+
+	verified, err := bundle.verify()
+	if err != nil {
+		exitWithError(fmt.Errorf("the evidence doesn't check out: %w", err))
+	}
+
+	sayBlock(`
+		{green ✓ All proofs verified}
+
+		{whiteUnderline Outputs}
+	`)
+
+	var total sats.Amount
+
+	for _, evidence := range verified {
+		if total, err = total.Add(evidence.Utxo.Amount); err != nil {
+			exitWithError(err)
+		}
+
+		say("• {white %d} sats in %s:%d\n", evidence.Utxo.Amount, evidence.Utxo.TxID, evidence.Utxo.OutputIndex)
+		say("  mined in block %d, {white %s}\n", evidence.Utxo.Height, evidence.Header.BlockHash())
+	}
+
+	sayBlock(`
+		{white Total}: %d sats
+
+		The proofs show these outputs were mined in the blocks above. Compare the block hashes with
+		your own node or a block explorer, to be sure the blocks are part of the Bitcoin blockchain.
+		This doesn't show the outputs are still unspent.
+
+	`, total)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/bip38"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/payto"
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/scanner"
+	"github.com/muun/recovery/utils"
+)
+
+// When the funds are mostly dust, the fee can take all of them. With `--fee-input`, the user adds
+// an output from another wallet, controlled by a single key they give us, which pays the fee: all
+// the recovered funds reach the destination, and the rest of the external output goes back to the
+// address it came from.
+//
+// The external key signs its own input after the kits sign theirs. This can't be done for taproot
+// outputs (version 5 addresses): libwallet's signatures for them commit to every input, and it only
+// knows about its own.
+
+// feeInput is an output from another wallet, used to pay the fee of the sweep.
+type feeInput struct {
+	Utxo *scanner.Utxo // Address is nil, it's not from the wallet
+	key  *btcec.PrivateKey
+}
+
+// readFeeInput asks for the private key of the external funds, and finds its largest output.
+func readFeeInput(servers []string) *feeInput {
+	sayBlock(`
+		{yellow Enter the private key (WIF, or encrypted with BIP-38) of the funds to pay the fee with}
+		It must be a native segwit (bc1q...) address from another wallet.
+	`)
+
+	wif, err := readFeeInputKey()
+	if errors.Is(err, bip38.ErrWrongPassphrase) {
+		say("That's not the passphrase of the key. Please, try again\n")
+		return readFeeInput(servers)
+	}
+
+	if err != nil || !wif.IsForNet(&chainParams) || !wif.CompressPubKey {
+		say("That's not a valid mainnet private key. Please, try again\n")
+		return readFeeInput(servers)
+	}
+
+	pubKeyHash := btcutil.Hash160(wif.SerializePubKey())
+
+	address, err := btcutil.NewAddressWitnessPubKeyHash(pubKeyHash, &chainParams)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	script, err := payto.Script(address)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	say("► Looking for funds in %s\n", address.EncodeAddress())
+
+	utxo, err := findLargestUtxo(servers, script)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if utxo == nil {
+		exitWithError(fmt.Errorf("no funds found in %s to pay the fee with", address.EncodeAddress()))
+	}
+
+	say("{green ✓} The fee will be paid from {white %d} sats in %s\n", utxo.Amount, address.EncodeAddress())
+
+	return &feeInput{utxo, wif.PrivKey}
+}
+
+// readFeeInputKey reads the private key of the fee input. Keys encrypted with BIP-38 (6P...), as
+// found in paper wallets, are decrypted with their passphrase.
+func readFeeInputKey() (*btcutil.WIF, error) {
+	key := readPassphrase()
+	if !bip38.IsEncrypted(key) {
+		return btcutil.DecodeWIF(key)
+	}
+
+	sayBlock(`
+		{yellow Enter the passphrase of the encrypted key}
+	`)
+
+	return bip38.Decrypt(key, readPassphrase(), &chainParams)
+}
+
+// findLargestUtxo lists the unspent outputs of a script, and returns the largest one.
+func findLargestUtxo(servers []string, script []byte) (*scanner.Utxo, error) {
+	refs, err := listUnspentRefs(servers, script)
+	if err != nil {
+		return nil, utils.WrapError(utils.ErrBackendUnavailable, fmt.Errorf("failed to look up the funds: %w", err))
+	}
+
+	var largest *scanner.Utxo
+
+	for _, ref := range refs {
+		if _, err := chainhash.NewHashFromStr(ref.TxHash); err != nil || ref.TxPos < 0 {
+			return nil, fmt.Errorf("invalid output in response: %s:%d", ref.TxHash, ref.TxPos)
+		}
+
+		amount, err := sats.New(ref.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid output in response: %s:%d: %w", ref.TxHash, ref.TxPos, err)
+		}
+
+		if largest == nil || amount > largest.Amount {
+			largest = &scanner.Utxo{
+				TxID:        ref.TxHash,
+				OutputIndex: ref.TxPos,
+				Amount:      amount,
+				Script:      script,
+				Height:      ref.Height,
+			}
+		}
+	}
+
+	return largest, nil
+}
+
+// listUnspentRefs lists the unspent outputs of a script, with the backend chosen with --backend.
+func listUnspentRefs(servers []string, script []byte) ([]electrum.UnspentRef, error) {
+	if backend := newChainBackend(); backend != nil {
+		groups, err := backend.ListUnspent([][]byte{script})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(groups) != 1 {
+			return nil, fmt.Errorf("expected 1 result, got %d", len(groups))
+		}
+
+		return groups[0], nil
+	}
+
+	provider := electrum.NewServerProviderFrom(servers)
+	client := electrum.NewClient()
+
+	var err error
+	for attempt := 0; attempt < 3 && !client.IsConnected(); attempt++ {
+		err = client.Connect(provider.NextServer())
+	}
+
+	if !client.IsConnected() {
+		return nil, err
+	}
+	defer client.Disconnect()
+
+	return client.ListUnspent(electrum.GetIndexHash(script))
+}
+
+// buildFundedSweepTx builds a sweep transaction where the fee input pays the fee. The recovered
+// funds are sent in full, and the rest of the fee input is returned to its address.
+func (s *Sweeper) buildFundedSweepTx(utxos []*scanner.Utxo, fee sats.Amount) ([]byte, error) {
+	tx := wire.NewMsgTx(2)
+
+	inputs := append(append([]*scanner.Utxo{}, utxos...), s.FeeInput.Utxo)
+
+	for _, utxo := range inputs {
+		if utxo.Address != nil && utxo.Address.Version() == libwallet.AddressVersionV5 {
+			return nil, fmt.Errorf("the fee can't be paid from another wallet when recovering taproot outputs (%s)", utxo.Address.Address())
+		}
+
+		chainHash, err := chainhash.NewHashFromStr(utxo.TxID)
+		if err != nil {
+			return nil, err
+		}
+
+		outpoint := wire.OutPoint{
+			Hash:  *chainHash,
+			Index: uint32(utxo.OutputIndex),
+		}
+
+		tx.AddTxIn(wire.NewTxIn(&outpoint, []byte{}, [][]byte{}))
+	}
+
+	value, err := scanner.Total(utxos)
+	if err != nil {
+		return nil, err
+	}
+
+	script, err := payto.Script(s.SweepAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkNotDust(value, script, "the output sending the recovered funds"); err != nil {
+		return nil, utils.WrapError(utils.ErrInsufficientFunds, err)
+	}
+
+	changeValue, err := s.FeeInput.Utxo.Amount.Sub(fee)
+	if err != nil || changeValue < dustThresholdFor(s.FeeInput.Utxo.Script) {
+		return nil, utils.WrapError(
+			utils.ErrInsufficientFunds,
+			fmt.Errorf("the fee input of %d sats can't pay a %d sats fee", s.FeeInput.Utxo.Amount, fee),
+		)
+	}
+
+	tx.AddTxOut(wire.NewTxOut(int64(value), script))
+	tx.AddTxOut(wire.NewTxOut(int64(changeValue), s.FeeInput.Utxo.Script))
+
+	writer := &bytes.Buffer{}
+	if err := tx.Serialize(writer); err != nil {
+		return nil, err
+	}
+
+	return writer.Bytes(), nil
+}
+
+// sign adds the signature for the fee input, which is the last input of the transaction.
+func (f *feeInput) sign(tx *wire.MsgTx) error {
+	index := len(tx.TxIn) - 1
+
+	witness, err := txscript.WitnessSignature(
+		tx, txscript.NewTxSigHashes(tx), index, int64(f.Utxo.Amount), f.Utxo.Script, txscript.SigHashAll, f.key, true,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to sign the fee input: %w", err)
+	}
+
+	tx.TxIn[index].Witness = witness
+
+	return nil
+}
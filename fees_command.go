@@ -0,0 +1,329 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/scanner"
+)
+
+// The fees command shows what a sweep would cost at a range of fee rates, and how long each would
+// take to confirm, before choosing one for real. The transaction is sized like the real one (see
+// tx_size.go), from the outputs in saved scan results, or from a number of outputs of a version.
+// It needs no keys.
+
+// feeWhatIfRates are the rates we always show, in sats/vbyte. The current estimates are added.
+var feeWhatIfRates = []int64{1, 2, 3, 5, 8, 10, 15, 20, 30, 50, 75, 100, 150, 200}
+
+// feeWhatIfTargets are the confirmation targets we ask estimates for, in blocks.
+var feeWhatIfTargets = []int{1, 2, 3, 6, 12, 24, 72, 144, 504, 1008}
+
+// sweepOutputScriptSize is the size of the output script we assume for the destination: a
+// taproot or native segwit script output, the largest of the usual ones.
+const sweepOutputScriptSize = 34
+
+// feeWhatIf is a transaction to send, sized, with the fee estimates to compare rates against.
+type feeWhatIf struct {
+	vsize     int64
+	total     sats.Amount     // 0 when unknown
+	estimates map[int]float64 // in sats/vbyte, by target, only those the server knows
+}
+
+func runFeesCommand(args []string) {
+	flags := flag.NewFlagSet("fees", flag.ExitOnError)
+	resultsPath := flags.String("results", "", "size the sweep of the funds in these scan results, saved with scan --out")
+	inputs := flags.Int("inputs", 0, "size a sweep of this many outputs instead")
+	inputVersion := flags.Int("input-version", libwallet.AddressVersionV4, "the address version of those outputs, 1 to 5")
+	outputs := flags.Int("outputs", 1, "the number of outputs of the transaction (2 when paying the fee from another wallet)")
+	amount := flags.Int64("amount", 0, "the total of the outputs to sweep, in sats, to show what's left after the fee")
+	offline := flags.Bool("offline", false, "don't ask a server for fee estimates")
+
+	flags.Parse(args)
+
+	if flags.NArg() > 0 || (*resultsPath == "") == (*inputs <= 0) || *outputs < 1 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	say(`
+		{blue Muun Recovery Tool v%s}
+
+		Comparing fee rates. Nothing will be signed or sent.
+	`, version)
+
+	var versions []int
+	var total sats.Amount
+
+	if *resultsPath != "" {
+		results, err := loadScanResults(*resultsPath)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		if total, err = results.total(); err != nil {
+			exitWithError(err)
+		}
+
+		for _, utxo := range results.Utxos {
+			versions = append(versions, utxo.AddressVersion)
+		}
+
+		if len(versions) == 0 {
+			exitWithError(fmt.Errorf("the scan results in %s have no funds to send", *resultsPath))
+		}
+
+	} else {
+		var err error
+		if total, err = sats.New(*amount); err != nil {
+			exitWithError(fmt.Errorf("invalid amount: %w", err))
+		}
+
+		for i := 0; i < *inputs; i++ {
+			versions = append(versions, *inputVersion)
+		}
+	}
+
+	vsize, err := sweepSize(versions, *outputs)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	whatIf := &feeWhatIf{vsize: vsize, total: total}
+
+	if !*offline {
+		say("► Asking for fee estimates...\n")
+		whatIf.estimates = fetchFeeEstimates(preferredServers(nil))
+
+		if len(whatIf.estimates) == 0 {
+			say("{yellow !} No fee estimates available, confirmation times are unknown\n")
+		}
+	}
+
+	sayBlock("The transaction spends %d outputs to %d, it's {white %d vbytes}", len(versions), *outputs, vsize)
+	if total > 0 {
+		say(", sending {white %d} sats", total)
+	}
+	fmt.Fprintln(userOutput)
+
+	whatIf.printTable()
+
+	for {
+		sayBlock(`
+			{yellow Enter a fee rate (sats/vbyte) to see it in detail}, or q to finish
+		`)
+
+		var userInput string
+		ask(&userInput)
+
+		userInput = strings.TrimSpace(userInput)
+		if userInput == "" || userInput == "q" || userInput == "Q" {
+			break
+		}
+
+		rate, err := strconv.ParseInt(userInput, 10, 64)
+		if err != nil || rate <= 0 {
+			say("The fee rate must be a whole number above 0\n")
+			continue
+		}
+
+		whatIf.printRate(rate)
+	}
+
+	fmt.Fprintln(userOutput)
+}
+
+// sweepSize returns the size in vbytes of a signed transaction spending outputs of the given
+// address versions, with placeholder signatures as large as the real ones can be.
+func sweepSize(versions []int, outputs int) (int64, error) {
+	tx := wire.NewMsgTx(2)
+
+	for _, version := range versions {
+		txIn := wire.NewTxIn(&wire.OutPoint{}, nil, nil)
+
+		if err := addPlaceholderSignatures(txIn, &scanner.Utxo{Address: placeholderAddress{version}}); err != nil {
+			return 0, err
+		}
+
+		tx.AddTxIn(txIn)
+	}
+
+	for i := 0; i < outputs; i++ {
+		tx.AddTxOut(wire.NewTxOut(0, make([]byte, sweepOutputScriptSize)))
+	}
+
+	return virtualSize(tx), nil
+}
+
+// placeholderAddress stands for a wallet address of a version, where only its size matters.
+type placeholderAddress struct {
+	version int
+}
+
+func (a placeholderAddress) Version() int           { return a.version }
+func (a placeholderAddress) DerivationPath() string { return "" }
+func (a placeholderAddress) Address() string        { return "" }
+
+// fetchFeeEstimates asks a server for the fee rate of each of feeWhatIfTargets. Failing to reach
+// one is not a problem, we just won't know the confirmation times.
+func fetchFeeEstimates(servers []string) map[int]float64 {
+	provider := electrum.NewServerProviderFrom(servers)
+	client := electrum.NewClient()
+
+	for attempt := 0; attempt < 3 && !client.IsConnected(); attempt++ {
+		client.Connect(provider.NextServer())
+	}
+
+	if !client.IsConnected() {
+		return nil
+	}
+	defer client.Disconnect()
+
+	estimates := make(map[int]float64)
+
+	for _, target := range feeWhatIfTargets {
+		btcPerKB, err := client.EstimateFee(target)
+		if err != nil {
+			break
+		}
+
+		if btcPerKB > 0 {
+			estimates[target] = btcPerKB * 1e8 / 1000
+		}
+	}
+
+	return estimates
+}
+
+// rates returns the rates to show: the fixed ones and the estimated ones, rounded up.
+func (w *feeWhatIf) rates() []int64 {
+	seen := make(map[int64]bool)
+	var rates []int64
+
+	add := func(rate int64) {
+		if !seen[rate] {
+			rates = append(rates, rate)
+			seen[rate] = true
+		}
+	}
+
+	for _, rate := range feeWhatIfRates {
+		add(rate)
+	}
+
+	for _, estimate := range w.estimates {
+		add(int64(estimate + 0.999))
+	}
+
+	sort.Slice(rates, func(i, j int) bool { return rates[i] < rates[j] })
+
+	return rates
+}
+
+// confirmationTime describes how long a rate is expected to take to confirm: the shortest target
+// whose estimate it pays.
+func (w *feeWhatIf) confirmationTime(rate int64) string {
+	if len(w.estimates) == 0 {
+		return "unknown"
+	}
+
+	for _, target := range feeWhatIfTargets {
+		if estimate, ok := w.estimates[target]; ok && float64(rate) >= estimate {
+			return describeBlocks(target)
+		}
+	}
+
+	return "over a week, or never"
+}
+
+// remaining returns what's left to send after the fee of a rate, and whether it can be sent.
+func (w *feeWhatIf) remaining(rate int64) (fee, remaining sats.Amount, ok bool) {
+	fee, err := sats.Amount(rate).Mul(w.vsize)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	if w.total == 0 {
+		return fee, 0, true
+	}
+
+	remaining, err = w.total.Sub(fee)
+	if err != nil || remaining < dustThreshold {
+		return fee, 0, false
+	}
+
+	return fee, remaining, true
+}
+
+func (w *feeWhatIf) printTable() {
+	sayBlock("%8s %12s %12s %7s  %s\n", "sats/vB", "Fee", "Remaining", "Share", "Confirms in")
+
+	for _, rate := range w.rates() {
+		fee, remaining, ok := w.remaining(rate)
+
+		switch {
+		case !ok:
+			say("%8d %12d %12s %7s  %s\n", rate, fee, "too high", "-", w.confirmationTime(rate))
+		case w.total == 0:
+			say("%8d %12d %12s %7s  %s\n", rate, fee, "-", "-", w.confirmationTime(rate))
+		default:
+			say("%8d %12d %12d %6.2f%%  %s\n", rate, fee, remaining, feeShare(fee, w.total), w.confirmationTime(rate))
+		}
+	}
+}
+
+func (w *feeWhatIf) printRate(rate int64) {
+	fee, remaining, ok := w.remaining(rate)
+
+	if !ok {
+		say("{red ✗} At %d sats/vbyte, the fee is too high: what's left can't be sent\n", rate)
+		return
+	}
+
+	say("At {white %d sats/vbyte}, the fee is {white %d} sats\n", rate, fee)
+	if w.total > 0 {
+		say("{white %d} sats arrive, the fee takes %.2f%% of the funds\n", remaining, feeShare(fee, w.total))
+	}
+	say("Expected to confirm in: %s\n", w.confirmationTime(rate))
+
+	// Show every estimate, to see what a little more or less would buy:
+	for _, target := range feeWhatIfTargets {
+		if estimate, ok := w.estimates[target]; ok {
+			say("• %.1f sats/vbyte to confirm in %s\n", estimate, describeBlocks(target))
+		}
+	}
+}
+
+// feeShare is the percentage of the funds a fee takes.
+func feeShare(fee, total sats.Amount) float64 {
+	return float64(fee) * 100 / float64(total)
+}
+
+// describeBlocks turns a number of blocks into the time they take, 10 minutes each on average.
+func describeBlocks(blocks int) string {
+	minutes := blocks * 10
+
+	switch {
+	case minutes < 60:
+		return fmt.Sprintf("~%d minutes", minutes)
+	case minutes < 24*60:
+		return plural((minutes+30)/60, "hour")
+	default:
+		return plural((minutes+12*60)/(24*60), "day")
+	}
+}
+
+func plural(count int, unit string) string {
+	if count == 1 {
+		return "~1 " + unit
+	}
+
+	return fmt.Sprintf("~%d %ss", count, unit)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// On shared or remote machines, whoever controls the session can drive the Recovery Tool. With
+// --fido2, signing also needs a touch of a FIDO2 security key, registered beforehand with `fido2
+// register`: someone who has to be physically present with the key.
+//
+// We talk to the key through the command-line tools of libfido2 (fido2-token, fido2-cred and
+// fido2-assert), which must be installed. Their answers are not trusted: the assertion is
+// verified here, against the public key saved when registering.
+
+// fido2RelyingParty names the Recovery Tool to the security key.
+const fido2RelyingParty = "recovery-tool"
+
+// fido2CredentialVersion is the version of the credential file format.
+const fido2CredentialVersion = 1
+
+// fido2UserPresent is the flag of the authenticator data set when the key was touched.
+const fido2UserPresent = 0x01
+
+// fido2Credential is a credential of a security key, as saved by `fido2 register`.
+type fido2Credential struct {
+	Version      int    `json:"version"`
+	RelyingParty string `json:"relyingParty"`
+	CredentialID string `json:"credentialId"` // base64, as the fido2 tools use it
+	PublicKey    string `json:"publicKey"`    // PEM
+}
+
+// fido2Gate asks for a touch of the registered security key.
+type fido2Gate struct {
+	credential *fido2Credential
+	publicKey  *ecdsa.PublicKey
+	device     string // empty to use the first key found
+}
+
+// loadFIDO2Gate loads the credential given with --fido2, if any, and checks the fido2 tools can be
+// used. It returns nil without --fido2.
+func loadFIDO2Gate() *fido2Gate {
+	if *fido2CredentialPath == "" {
+		return nil
+	}
+
+	// The sandbox doesn't let the Recovery Tool run other programs, such as fido2-assert:
+	if *sandbox {
+		exitWithError(fmt.Errorf("--fido2 can't be combined with --sandbox"))
+	}
+
+	if _, err := exec.LookPath("fido2-assert"); err != nil {
+		exitWithError(fmt.Errorf("--fido2 needs the fido2-assert tool of libfido2, which wasn't found: %w", err))
+	}
+
+	data, err := ioutil.ReadFile(*fido2CredentialPath)
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to read FIDO2 credential: %w", err))
+	}
+
+	var credential fido2Credential
+	if err := json.Unmarshal(data, &credential); err != nil {
+		exitWithError(fmt.Errorf("failed to parse FIDO2 credential in %s: %w", *fido2CredentialPath, err))
+	}
+
+	if credential.Version != fido2CredentialVersion {
+		exitWithError(fmt.Errorf("unsupported FIDO2 credential version %d in %s", credential.Version, *fido2CredentialPath))
+	}
+
+	publicKey, err := parseFIDO2PublicKey(credential.PublicKey)
+	if err != nil {
+		exitWithError(fmt.Errorf("invalid FIDO2 credential in %s: %w", *fido2CredentialPath, err))
+	}
+
+	return &fido2Gate{&credential, publicKey, *fido2Device}
+}
+
+// require asks for a touch of the security key, and verifies the key's assertion. The user can try
+// again if it fails, or stop the recovery.
+func (g *fido2Gate) require() error {
+	for {
+		err := g.assert()
+		if err == nil {
+			say("{green ✓} Security key confirmed\n")
+			return nil
+		}
+
+		say("\n{yellow The security key wasn't confirmed}: %v\n", err)
+
+		if !readYesNo("Try again?") {
+			return fmt.Errorf("the security key wasn't confirmed, nothing was signed")
+		}
+	}
+}
+
+func (g *fido2Gate) assert() error {
+	device, err := fido2DevicePath(g.device)
+	if err != nil {
+		return err
+	}
+
+	// A fresh challenge for every touch, so old assertions can't be replayed:
+	clientDataHash := make([]byte, sha256.Size)
+	if _, err := rand.Read(clientDataHash); err != nil {
+		return err
+	}
+
+	input := strings.Join([]string{
+		base64.StdEncoding.EncodeToString(clientDataHash),
+		g.credential.RelyingParty,
+		g.credential.CredentialID,
+	}, "\n") + "\n"
+
+	sayBlock(`
+		{yellow Touch your security key} to sign the transaction
+	`)
+
+	lines, err := runFIDO2Tool(input, "fido2-assert", "-G", "-p", device)
+	if err != nil {
+		return err
+	}
+
+	// The output is the client data hash, the relying party, the authenticator data and the
+	// signature, one per line:
+	if len(lines) < 4 {
+		return fmt.Errorf("unexpected output from fido2-assert")
+	}
+
+	returnedHash, err1 := base64.StdEncoding.DecodeString(lines[0])
+	authData, err2 := base64.StdEncoding.DecodeString(lines[2])
+	signature, err3 := base64.StdEncoding.DecodeString(lines[3])
+
+	if err1 != nil || err2 != nil || err3 != nil {
+		return fmt.Errorf("unexpected output from fido2-assert")
+	}
+
+	if !bytes.Equal(returnedHash, clientDataHash) || lines[1] != g.credential.RelyingParty {
+		return fmt.Errorf("the assertion is not for this challenge")
+	}
+
+	return verifyFIDO2Assertion(g.publicKey, g.credential.RelyingParty, unwrapCBORBytes(authData), clientDataHash, signature)
+}
+
+// verifyFIDO2Assertion checks the authenticator data is for the relying party and the key was
+// touched, and that it was signed with the registered key, along with the client data hash.
+func verifyFIDO2Assertion(publicKey *ecdsa.PublicKey, relyingParty string, authData, clientDataHash, signature []byte) error {
+	// The authenticator data starts with the hash of the relying party (32 bytes), the flags (1)
+	// and a counter (4):
+	if len(authData) < sha256.Size+1+4 {
+		return fmt.Errorf("invalid authenticator data")
+	}
+
+	rpHash := sha256.Sum256([]byte(relyingParty))
+	if !bytes.Equal(authData[:sha256.Size], rpHash[:]) {
+		return fmt.Errorf("the assertion is for another relying party")
+	}
+
+	if authData[sha256.Size]&fido2UserPresent == 0 {
+		return fmt.Errorf("the security key wasn't touched")
+	}
+
+	var parsed struct {
+		R, S *big.Int
+	}
+
+	if rest, err := asn1.Unmarshal(signature, &parsed); err != nil || len(rest) > 0 {
+		return fmt.Errorf("invalid assertion signature")
+	}
+
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash...))
+
+	if !ecdsa.Verify(publicKey, digest[:], parsed.R, parsed.S) {
+		return fmt.Errorf("the assertion wasn't signed by the registered security key")
+	}
+
+	return nil
+}
+
+// unwrapCBORBytes returns the content of a CBOR byte string, the way the fido2 tools encode the
+// authenticator data. Anything else is returned as it is.
+func unwrapCBORBytes(data []byte) []byte {
+	if len(data) == 0 || data[0]>>5 != 2 {
+		return data
+	}
+
+	var size, header int
+
+	switch info := data[0] & 0x1f; {
+	case info < 24:
+		size, header = int(info), 1
+	case info == 24 && len(data) >= 2:
+		size, header = int(data[1]), 2
+	case info == 25 && len(data) >= 3:
+		size, header = int(data[1])<<8|int(data[2]), 3
+	default:
+		return data
+	}
+
+	if header+size != len(data) {
+		return data
+	}
+
+	return data[header:]
+}
+
+func parseFIDO2PublicKey(pemData string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemData))
+	if block == nil {
+		return nil, fmt.Errorf("the public key is not in PEM format")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, ok := key.(*ecdsa.PublicKey)
+	if !ok || publicKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("only ES256 (P-256) keys are supported")
+	}
+
+	return publicKey, nil
+}
+
+// fido2DevicePath returns the given device, or the first security key connected.
+func fido2DevicePath(device string) (string, error) {
+	if device != "" {
+		return device, nil
+	}
+
+	lines, err := runFIDO2Tool("", "fido2-token", "-L")
+	if err != nil {
+		return "", err
+	}
+
+	// Each line describes a key, starting with its path: "/dev/hidraw3: vendor=..., product=..."
+	for _, line := range lines {
+		if i := strings.Index(line, ": "); i > 0 {
+			return line[:i], nil
+		}
+	}
+
+	return "", fmt.Errorf("no security key was found, connect one or choose it with --fido2-device")
+}
+
+// runFIDO2Tool runs a tool of libfido2 with the given input, and returns its output lines.
+func runFIDO2Tool(input string, name string, args ...string) ([]string, error) {
+	command := exec.Command(name, args...)
+	command.Stdin = strings.NewReader(input)
+	command.Stderr = os.Stderr // the tools ask for the PIN there, when the key has one
+
+	output, err := command.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", name, err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, nil
+}
+
+// runFIDO2Command registers a security key, saving its credential for --fido2.
+func runFIDO2Command(args []string) {
+	flags := flag.NewFlagSet("fido2", flag.ExitOnError)
+	device := flags.String("device", "", "the security key to use (see fido2-token -L), instead of the first one found")
+	outPath := flags.String("out", "fido2.json", "save the credential to this file")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || flags.Arg(0) != "register" {
+		printUsage()
+		os.Exit(0)
+	}
+
+	say(`
+		{blue Muun Recovery Tool v%s}
+
+		Registering a security key, to confirm signing with --fido2.
+	`, version)
+
+	devicePath, err := fido2DevicePath(*device)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	clientDataHash := make([]byte, sha256.Size)
+	userID := make([]byte, sha256.Size)
+
+	if _, err := rand.Read(clientDataHash); err != nil {
+		exitWithError(err)
+	}
+
+	if _, err := rand.Read(userID); err != nil {
+		exitWithError(err)
+	}
+
+	input := strings.Join([]string{
+		base64.StdEncoding.EncodeToString(clientDataHash),
+		fido2RelyingParty,
+		"recovery",
+		base64.StdEncoding.EncodeToString(userID),
+	}, "\n") + "\n"
+
+	sayBlock(`
+		{yellow Touch your security key} (%s)
+	`, devicePath)
+
+	lines, err := runFIDO2Tool(input, "fido2-cred", "-M", devicePath)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	// Verifying the new credential gives its ID and public key:
+	verified, err := runFIDO2Tool(strings.Join(lines, "\n")+"\n", "fido2-cred", "-V")
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if len(verified) < 2 {
+		exitWithError(fmt.Errorf("unexpected output from fido2-cred"))
+	}
+
+	credential := &fido2Credential{
+		Version:      fido2CredentialVersion,
+		RelyingParty: fido2RelyingParty,
+		CredentialID: verified[0],
+		PublicKey:    strings.Join(verified[1:], "\n") + "\n",
+	}
+
+	if _, err := parseFIDO2PublicKey(credential.PublicKey); err != nil {
+		exitWithError(fmt.Errorf("the security key made an unsupported credential: %w", err))
+	}
+
+	data, err := json.MarshalIndent(credential, "", "  ")
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if err := ioutil.WriteFile(*outPath, data, 0600); err != nil {
+		exitWithError(fmt.Errorf("failed to save the credential: %w", err))
+	}
+
+	sayBlock(`
+		{green ✓} Security key registered, its credential was saved to {white %s}
+		To require it before signing, run the Recovery Tool with: --fido2 %s
+
+	`, *outPath, *outPath)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/scanner"
+)
+
+// keyGeneration is the set of keys from one Emergency Kit. Wallets that rotated their keys may
+// have funds under several generations, which we scan and sweep together.
+type keyGeneration struct {
+	Name    string
+	UserKey keys.PrivateKey
+	MuunKey keys.PrivateKey
+
+	generator *AddressGenerator
+}
+
+func newKeyGeneration(name string, decryptedKeys []*keys.DecryptedKey) *keyGeneration {
+	return &keyGeneration{
+		Name:      name,
+		UserKey:   decryptedKeys[0].Key,
+		MuunKey:   decryptedKeys[1].Key,
+		generator: NewAddressGenerator(decryptedKeys[0].Key, decryptedKeys[1].Key, scanLimits()),
+	}
+}
+
+// controls returns whether a UTXO is in an address of this generation. It's only meaningful after
+// the generation's addresses were streamed for scanning.
+func (g *keyGeneration) controls(utxo *scanner.Utxo) bool {
+	_, ok := g.generator.Addresses()[utxo.Address.Address()]
+	return ok
+}
+
+// readKeyGenerations decrypts the keys of the main Emergency Kit, and those of each additional kit
+// given with --additional-kits. Each kit is decrypted with its own Recovery Code. The encrypted keys
+// of all kits are checked for signs of a broken random number generator (see checkKeyHealth). The
+// main kit is the one given with --kit, if any (see kitPDFPath).
+func readKeyGenerations(optionalPDF string) []*keyGeneration {
+	encryptedKeys, decryptedKeys := readDecryptedKeys(kitPDFPath(optionalPDF))
+
+	generations := []*keyGeneration{newKeyGeneration("kit 1", decryptedKeys)}
+	payloads := kitPayloads("kit 1", encryptedKeys)
+
+	if *additionalKits != "" {
+		for _, path := range strings.Split(*additionalKits, ",") {
+			name := fmt.Sprintf("kit %d", len(generations)+1)
+
+			sayBlock(`
+				Now, {white %s}: the Emergency Kit in %s
+			`, name, path)
+
+			encryptedKeys, decryptedKeys := readDecryptedKeys(strings.TrimSpace(path))
+			generation := newKeyGeneration(name, decryptedKeys)
+
+			for _, other := range generations {
+				if other.UserKey.String() == generation.UserKey.String() {
+					exitWithError(fmt.Errorf("%s has the same keys as %s, it's the same kit", name, other.Name))
+				}
+			}
+
+			generations = append(generations, generation)
+			payloads = append(payloads, kitPayloads(name, encryptedKeys)...)
+		}
+	}
+
+	printKeyHealth(checkKeyHealth(payloads), false)
+
+	return generations
+}
+
+// streamGenerations emits the addresses of all generations, one after the other. If there are scan
+// hints, addresses prioritized by them come first, and those they skip are left out.
+func streamGenerations(generations []*keyGeneration, hints *scanHints) chan libwallet.MuunAddress {
+	ch := make(chan libwallet.MuunAddress)
+
+	go func() {
+		var rest []libwallet.MuunAddress
+
+		for _, generation := range generations {
+			for address := range generation.generator.Stream() {
+				switch {
+				case hints.skips(address):
+					continue
+
+				case hints.prioritizes(address) || !hints.hasPriorities():
+					ch <- address
+
+				default:
+					rest = append(rest, address) // held back until all prioritized addresses are out
+				}
+			}
+		}
+
+		for _, address := range rest {
+			ch <- address
+		}
+
+		close(ch)
+	}()
+
+	return ch
+}
+
+// generationOf returns the generation that controls a UTXO.
+func generationOf(generations []*keyGeneration, utxo *scanner.Utxo) *keyGeneration {
+	for _, generation := range generations {
+		if generation.controls(utxo) {
+			return generation
+		}
+	}
+
+	return nil
+}
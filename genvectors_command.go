@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/muun/libwallet"
+	"github.com/muun/libwallet/recoverycode"
+	"github.com/muun/recovery/keys"
+)
+
+// The genvectors command is for developers, and isn't listed in the usage. It prints test vectors
+// for the encryption schemes the tool depends on, made with fixed keys and fixed entropy, for the
+// iOS and Android ports of libwallet to check against:
+//
+//   - Kit keys: HD private keys encrypted with a Recovery Code, as printed in Emergency Kits.
+//   - Payloads: data encrypted by a key to itself, as the apps store it.
+//
+// Every input is derived from a label, so every run makes the same vectors. libwallet draws its
+// randomness from crypto/rand, so the entropy is fixed by replacing its Reader while the vectors
+// are made. How many bytes Go reads to make a key changed between versions, so builds with other
+// Go versions can make different ephemeral keys: each vector lists the one that came out of it,
+// which is what other implementations should use.
+
+// testVectorsVersion is the version of the test vectors format.
+const testVectorsVersion = 1
+
+type testVectors struct {
+	Version  int                 `json:"version"`
+	KitKeys  []kitKeyTestVector  `json:"kitKeys"`
+	Payloads []payloadTestVector `json:"payloads"`
+}
+
+type kitKeyTestVector struct {
+	RecoveryCode        string `json:"recoveryCode"`
+	Salt                string `json:"salt"`
+	Birthday            int    `json:"birthday"`
+	PrivateKey          string `json:"privateKey"`
+	Entropy             string `json:"entropy"`
+	EphemeralPrivateKey string `json:"ephemeralPrivateKey"`
+	EncryptedKey        string `json:"encryptedKey"`
+}
+
+type payloadTestVector struct {
+	Key                 string `json:"key"`
+	Path                string `json:"path"`
+	Plaintext           string `json:"plaintext"`
+	Entropy             string `json:"entropy"`
+	EphemeralPrivateKey string `json:"ephemeralPrivateKey"`
+	Payload             string `json:"payload"`
+}
+
+func runGenVectorsCommand(args []string) {
+	flags := flag.NewFlagSet("genvectors", flag.ExitOnError)
+	count := flags.Int("count", 4, "how many vectors of each kind to make")
+	outPath := flags.String("out", "", "save the vectors to this file, instead of printing them")
+
+	flags.Parse(args)
+
+	vectors, err := makeTestVectors(*count)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	// The entropy must be the only input. If this Go version ignores it, say so, rather than
+	// publish vectors nobody can reproduce:
+	again, err := makeTestVectors(*count)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	data, err := json.MarshalIndent(vectors, "", "  ")
+	if err != nil {
+		exitWithError(err)
+	}
+
+	dataAgain, err := json.MarshalIndent(again, "", "  ")
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if !bytes.Equal(data, dataAgain) {
+		exitWithError(fmt.Errorf("the vectors changed from one run to the next, this build doesn't let us fix the entropy"))
+	}
+
+	if *outPath == "" {
+		fmt.Println(string(data))
+		return
+	}
+
+	if err := ioutil.WriteFile(*outPath, append(data, '\n'), 0600); err != nil {
+		exitWithError(fmt.Errorf("failed to save the vectors: %w", err))
+	}
+}
+
+func makeTestVectors(count int) (*testVectors, error) {
+	vectors := &testVectors{Version: testVectorsVersion}
+
+	for i := 0; i < count; i++ {
+		kitKey, err := makeKitKeyVector(i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to make kit key vector %d: %w", i, err)
+		}
+
+		payload, err := makePayloadVector(i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to make payload vector %d: %w", i, err)
+		}
+
+		vectors.KitKeys = append(vectors.KitKeys, kitKey)
+		vectors.Payloads = append(vectors.Payloads, payload)
+	}
+
+	return vectors, nil
+}
+
+func makeKitKeyVector(i int) (kitKeyTestVector, error) {
+	label := fmt.Sprintf("kit key %d", i)
+
+	key, err := libwallet.NewHDPrivateKey(vectorBytes(label, "key", 32), defaultNetwork)
+	if err != nil {
+		return kitKeyTestVector{}, err
+	}
+
+	code := vectorRecoveryCode(label)
+	salt := vectorBytes(label, "salt", 8)
+	birthday := 500 + i
+
+	challengeKey, err := libwallet.RecoveryCodeToKey(code, hex.EncodeToString(salt))
+	if err != nil {
+		return kitKeyTestVector{}, err
+	}
+
+	var encrypted string
+
+	entropy, err := withFixedEntropy(label, func() (err error) {
+		encrypted, err = challengeKey.PubKey().EncryptKey(key, salt, birthday)
+		return err
+	})
+
+	if err != nil {
+		return kitKeyTestVector{}, err
+	}
+
+	// Check the vector round-trips, before anyone relies on it:
+	decrypted, err := challengeKey.DecryptRawKey(encrypted, defaultNetwork)
+	if err != nil {
+		return kitKeyTestVector{}, err
+	}
+
+	if decrypted.Key.String() != key.String() || decrypted.Birthday != birthday {
+		return kitKeyTestVector{}, fmt.Errorf("the encrypted key doesn't decrypt to the original")
+	}
+
+	// Kit keys are version (1 byte) || birthday (2 bytes) || ephemeral key || ...
+	ephemeralKey, err := ephemeralPrivateKey(base58.Decode(encrypted)[3:3+33], entropy)
+	if err != nil {
+		return kitKeyTestVector{}, err
+	}
+
+	return kitKeyTestVector{
+		RecoveryCode:        code,
+		Salt:                hex.EncodeToString(salt),
+		Birthday:            birthday,
+		PrivateKey:          key.String(),
+		Entropy:             hex.EncodeToString(bytes.Join(entropy, nil)),
+		EphemeralPrivateKey: ephemeralKey,
+		EncryptedKey:        encrypted,
+	}, nil
+}
+
+func makePayloadVector(i int) (payloadTestVector, error) {
+	label := fmt.Sprintf("payload %d", i)
+
+	root, err := libwallet.NewHDPrivateKey(vectorBytes(label, "key", 32), defaultNetwork)
+	if err != nil {
+		return payloadTestVector{}, err
+	}
+
+	key, err := root.DeriveTo(keys.KitKeyPath)
+	if err != nil {
+		return payloadTestVector{}, err
+	}
+
+	plaintext := vectorBytes(label, "plaintext", 16*(i+1))
+
+	var payload string
+
+	entropy, err := withFixedEntropy(label, func() (err error) {
+		payload, err = key.Encrypter().Encrypt(plaintext)
+		return err
+	})
+
+	if err != nil {
+		return payloadTestVector{}, err
+	}
+
+	decrypted, err := key.Decrypter().Decrypt(payload)
+	if err != nil {
+		return payloadTestVector{}, err
+	}
+
+	if !bytes.Equal(decrypted, plaintext) {
+		return payloadTestVector{}, fmt.Errorf("the payload doesn't decrypt to the original")
+	}
+
+	// Payloads are version (1 byte) || ephemeral key || ...
+	ephemeralKey, err := ephemeralPrivateKey(base58.Decode(payload)[1:1+33], entropy)
+	if err != nil {
+		return payloadTestVector{}, err
+	}
+
+	return payloadTestVector{
+		Key:                 root.String(),
+		Path:                key.Path,
+		Plaintext:           hex.EncodeToString(plaintext),
+		Entropy:             hex.EncodeToString(bytes.Join(entropy, nil)),
+		EphemeralPrivateKey: ephemeralKey,
+		Payload:             payload,
+	}, nil
+}
+
+// vectorBytes derives `size` bytes from a label and a purpose, the same on every run.
+func vectorBytes(label string, purpose string, size int) []byte {
+	var result []byte
+
+	for counter := uint32(0); len(result) < size; counter++ {
+		block := make([]byte, 4)
+		binary.BigEndian.PutUint32(block, counter)
+
+		hash := sha256.Sum256([]byte("muun recovery test vectors/" + label + "/" + purpose + "/" + string(block)))
+		result = append(result, hash[:]...)
+	}
+
+	return result[:size]
+}
+
+// vectorRecoveryCode makes a Recovery Code of the current version from a label, with the format
+// of those the apps generate (see recoverycode.Generate).
+func vectorRecoveryCode(label string) string {
+	var code strings.Builder
+
+	code.WriteByte('L')
+	code.WriteByte(recoverycode.Alphabet[recoverycode.CurrentVersion-2])
+
+	for i, b := range vectorBytes(label, "recovery code", 30) {
+		code.WriteByte(recoverycode.Alphabet[int(b)%len(recoverycode.Alphabet)])
+
+		if (i+3)%4 == 0 && i != 29 {
+			code.WriteByte('-')
+		}
+	}
+
+	return code.String()
+}
+
+// fixedEntropy is a stream of bytes derived from a label, standing in for crypto/rand.
+//
+// Single-byte reads return the next byte without consuming it: Go's ecdsa makes them at random,
+// precisely so callers can't depend on the stream, and we do.
+type fixedEntropy struct {
+	label  string
+	offset int
+	reads  [][]byte
+}
+
+func (e *fixedEntropy) Read(p []byte) (int, error) {
+	data := vectorBytes(e.label, "entropy", e.offset+len(p))[e.offset:]
+	copy(p, data)
+
+	if len(p) > 1 {
+		e.offset += len(p)
+		e.reads = append(e.reads, append([]byte{}, p...))
+	}
+
+	return len(p), nil
+}
+
+// withFixedEntropy runs a function with crypto/rand replaced by a fixedEntropy, and returns the
+// reads it made.
+func withFixedEntropy(label string, run func() error) ([][]byte, error) {
+	entropy := &fixedEntropy{label: label}
+
+	original := rand.Reader
+	rand.Reader = entropy
+	defer func() { rand.Reader = original }()
+
+	err := run()
+
+	return entropy.reads, err
+}
+
+// ephemeralPrivateKey finds the private key of an ephemeral public key among the entropy reads.
+// Go versions turn the bytes they read into a key in one of two ways, so both are tried.
+func ephemeralPrivateKey(publicKey []byte, reads [][]byte) (string, error) {
+	curve := btcec.S256()
+	one := big.NewInt(1)
+	nMinusOne := new(big.Int).Sub(curve.N, one)
+
+	for _, read := range reads {
+		candidates := []*big.Int{new(big.Int).SetBytes(read)}
+
+		if len(read) == curve.BitSize/8+8 {
+			reduced := new(big.Int).Mod(new(big.Int).SetBytes(read), nMinusOne)
+			candidates = append(candidates, reduced.Add(reduced, one))
+		}
+
+		for _, scalar := range candidates {
+			if scalar.Sign() == 0 || scalar.Cmp(curve.N) >= 0 {
+				continue
+			}
+
+			private, public := btcec.PrivKeyFromBytes(curve, paddedScalar(scalar))
+			if bytes.Equal(public.SerializeCompressed(), publicKey) {
+				return hex.EncodeToString(private.Serialize()), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("the ephemeral key didn't come from the fixed entropy, this build ignores it")
+}
+
+func paddedScalar(n *big.Int) []byte {
+	padded := make([]byte, 32)
+	raw := n.Bytes()
+
+	return append(padded[:32-len(raw)], raw...)
+}
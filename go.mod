@@ -5,8 +5,17 @@ go 1.12
 require (
 	github.com/btcsuite/btcd v0.21.0-beta
 	github.com/btcsuite/btcutil v1.0.2
+	github.com/btcsuite/btcutil/psbt v1.0.2
+	github.com/btcsuite/websocket v0.0.0-20150119174127-31079b680792
 	github.com/gookit/color v1.4.2
+	github.com/jinzhu/gorm v1.9.16
 	github.com/muun/libwallet v0.10.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
+	golang.org/x/sys v0.0.0-20210330210617-4fbd30eecc44
+	golang.org/x/text v0.3.6
+	google.golang.org/protobuf v1.25.0
+	gopkg.in/gormigrate.v1 v1.6.0
 )
 
 replace github.com/lightninglabs/neutrino => github.com/muun/neutrino v0.0.0-20190914162326-7082af0fa257
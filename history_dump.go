@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/muun/recovery/scanner"
+)
+
+// Users without network access can scan with the help of someone running a Bitcoin Core node.
+// They export their addresses, the node operator scans for them and sends back the result (the
+// history dump), and they scan against it offline:
+//
+//	recovery-tool export-addresses scan-request.txt
+//	bitcoin-cli -stdin scantxoutset < scan-request.txt > history-dump.json
+//	recovery-tool --history-dump history-dump.json --export-chunks chunks.txt
+//
+// The request only contains addresses, no keys. It's in the format `bitcoin-cli -stdin` expects:
+// one argument per line.
+
+// newUtxoScanner creates the Scanner for this run, offline if a history dump was given. With --db,
+// downloaded transactions are cached in the database.
+func newUtxoScanner(servers []string) *scanner.Scanner {
+	utxoScanner := newBackendScanner(servers)
+
+	if stateDB != nil {
+		utxoScanner.UseTxCache(stateDB.TxCache())
+	}
+
+	if *lowBandwidth {
+		utxoScanner.LimitBandwidth()
+	}
+
+	return utxoScanner
+}
+
+// newBackendScanner returns a Scanner for the backend chosen, or the history dump to scan offline.
+func newBackendScanner(servers []string) *scanner.Scanner {
+	if backend := newChainBackend(); backend != nil {
+		say("► {white Scanning with %s}\n", backend.Name())
+		return scanner.NewScannerWithBackend(backend)
+	}
+
+	if *historyDump == "" {
+		return scanner.NewScannerWithServers(servers)
+	}
+
+	dump, err := scanner.LoadHistoryDump(*historyDump)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	say("► {white Scanning offline}, with the history dump up to block %d\n", dump.Height)
+
+	return scanner.NewOfflineScanner(dump)
+}
+
+// runExportAddressesCommand writes the addresses of the wallet as a scan request for Bitcoin Core.
+func runExportAddressesCommand(args []string) {
+	flags := flag.NewFlagSet("export-addresses", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	outPath := flags.Arg(0)
+
+	printWelcomeMessage()
+
+	hints := readScanHints()
+	generations := readKeyGenerations(flags.Arg(1))
+
+	var descriptors []string
+	for address := range streamGenerations(generations, hints) {
+		descriptors = append(descriptors, fmt.Sprintf("addr(%s)", address.Address()))
+	}
+
+	encoded, err := json.Marshal(descriptors)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	request := "start\n" + string(encoded) + "\n"
+
+	if err := ioutil.WriteFile(outPath, []byte(request), 0600); err != nil {
+		exitWithError(fmt.Errorf("failed to save addresses: %w", err))
+	}
+
+	recordCaseEvent(currentTag(), "addresses", "Saved %d addresses to %s, for an offline scan", len(descriptors), outPath)
+
+	sayBlock(`
+		Saved %d addresses to {white %s}. It contains no keys.
+
+		Someone with a Bitcoin Core node can scan for your funds by running:
+		  bitcoin-cli -stdin scantxoutset < %s > history-dump.json
+
+		With their {white history-dump.json}, you can then recover your funds offline:
+		  recovery-tool --history-dump history-dump.json --export-chunks chunks.txt
+
+	`, len(descriptors), outPath, outPath)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/muun/recovery/electrum"
+)
+
+// maxScannedFileSize is the largest file we look into when searching for leftover key material.
+// Anything bigger is unlikely to be a note with a Recovery Code, and would slow us down.
+const maxScannedFileSize = 1024 * 1024
+
+// keyMaterialRes match secrets that shouldn't be left lying around in plain text: Recovery Codes
+// and extended private keys.
+var keyMaterialRes = []*regexp.Regexp{
+	regexp.MustCompile(`\b[A-Z0-9]{4}(-[A-Z0-9]{4}){7}\b`),
+	regexp.MustCompile(`\b[xt]prv[1-9A-HJ-NP-Za-km-z]{100,}\b`),
+}
+
+// cleanUpAfterRecovery removes what the Recovery Tool left on this computer, looks for secrets
+// saved in plain text in the working directory, and lists what the user should do next.
+//
+// The Recovery Tool never writes keys to disk, but its caches reveal the wallet's transactions,
+// and users often keep their Recovery Code in a text file next to the tool while recovering.
+func cleanUpAfterRecovery() {
+	sayBlock(`
+		{whiteUnderline Cleaning up}
+	`)
+
+	removed, failed := shredCaches()
+
+	if removed > 0 {
+		say("{green ✓} Erased %d cached files\n", removed)
+	}
+
+	for _, path := range failed {
+		say("{yellow !} Couldn't erase %s, please delete it manually\n", path)
+	}
+
+	workDir, err := os.Getwd()
+	if err == nil {
+		exposed := findKeyMaterial(workDir)
+
+		if len(exposed) == 0 {
+			say("{green ✓} No Recovery Codes or private keys found in %s\n", workDir)
+		}
+
+		for _, path := range exposed {
+			say("{red !} %s looks like it contains a Recovery Code or private key\n", path)
+		}
+	}
+
+	sayBlock(`
+		{whiteUnderline Before you go}
+		  1. Destroy your old Emergency Kit and your Recovery Code, and delete any copies of them
+		     (in your email, cloud storage or downloads). They no longer protect any funds
+		  2. Delete the files marked above, if any
+		  3. Clear your terminal history, in case you pasted secrets into it
+		  4. Don't send payments to addresses of your old wallet anymore
+		  5. If you think this computer may be compromised, move your funds again from a safe one
+
+	`)
+}
+
+// shredCaches overwrites and deletes all files cached by the Recovery Tool. It returns how many
+// were erased, and which couldn't be.
+func shredCaches() (int, []string) {
+	var paths []string
+
+	if peerCachePath, err := electrum.DefaultPeerCachePath(); err == nil {
+		cacheDir := filepath.Dir(peerCachePath)
+
+		filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+
+		defer os.RemoveAll(cacheDir)
+	}
+
+	paths = append(paths, defaultCancelFile)
+
+	removed := 0
+	var failed []string
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+
+		if err := shredFile(path); err != nil {
+			failed = append(failed, path)
+			continue
+		}
+
+		removed++
+	}
+
+	return removed, failed
+}
+
+// shredFile overwrites a file with random data before deleting it. It's no guarantee on every
+// file system (SSDs and journaling may keep old copies), but it's the best we can do from here.
+func shredFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	noise := make([]byte, info.Size())
+	rand.Read(noise)
+
+	_, err = file.Write(noise)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// findKeyMaterial returns the files in a directory (not its subdirectories) that look like they
+// contain secrets in plain text.
+func findKeyMaterial(dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var exposed []string
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() || file.Size() > maxScannedFileSize {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Name())
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		for _, re := range keyMaterialRes {
+			if re.Match(data) {
+				exposed = append(exposed, path)
+				break
+			}
+		}
+	}
+
+	return exposed
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/scanner"
+	"github.com/muun/recovery/utils"
+)
+
+// With --json, the Recovery Tool reports what it does as events, one JSON object per line on
+// stdout, for scripts and GUIs that wrap it:
+//
+//	{"event":"scan-progress","time":"...","data":{"scannedAddresses":1200,"satsFound":50000}}
+//
+// Everything meant for people (messages, prompts, the error report) goes to stderr instead, so
+// stdout has nothing but events. Prompts still read their answers from stdin, and the Recovery
+// Code can be given with --recovery-code-fd or --recovery-code-env.
+//
+// The events are:
+//
+//	scan-progress  after each batch of addresses scanned
+//	utxos          the funds found, those that can be sent and those still waiting confirmations
+//	fee-estimate   with --dry-run, the fee of the sweep at the estimated rates
+//	fee            the fee chosen, and the size of the transaction
+//	signed-tx      the signed transaction, in hex
+//	broadcast      whether sending the transaction worked
+//	transfer       with --low-bandwidth, the bytes sent and received, at the end
+//	error          the error the Recovery Tool stopped with
+
+// jsonEvents writes the events, or is nil without --json.
+var jsonEvents *json.Encoder
+
+var jsonEventsMu sync.Mutex
+
+// jsonEvent is a line of the --json output.
+type jsonEvent struct {
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// startJSONEvents sends the events to stdout, and everything else to stderr, with --json.
+func startJSONEvents() {
+	if !*jsonOutput {
+		return
+	}
+
+	jsonEvents = json.NewEncoder(os.Stdout)
+	userOutput = os.Stderr
+	utils.DebugOutput = os.Stderr
+}
+
+// emitEvent writes an event, with --json.
+func emitEvent(event string, data interface{}) {
+	if jsonEvents == nil {
+		return
+	}
+
+	jsonEventsMu.Lock()
+	defer jsonEventsMu.Unlock()
+
+	// Failing to write to stdout leaves nowhere to report it:
+	jsonEvents.Encode(jsonEvent{Event: event, Time: time.Now().UTC(), Data: data})
+}
+
+func emitScanProgress(report *scanner.Report, satsFound sats.Amount) {
+	emitEvent("scan-progress", struct {
+		ScannedAddresses int         `json:"scannedAddresses"`
+		UtxosFound       int         `json:"utxosFound"`
+		SatsFound        sats.Amount `json:"satsFound"`
+	}{report.ScannedAddresses, len(report.UtxosFound), satsFound})
+}
+
+func emitUtxos(utxos []*scanner.Utxo, pending *pendingFunds) {
+	if jsonEvents == nil {
+		return
+	}
+
+	data := struct {
+		Utxos   []scanResultUtxo `json:"utxos"`
+		Pending []scanResultUtxo `json:"pending"`
+		Total   sats.Amount      `json:"total"`
+	}{Utxos: []scanResultUtxo{}, Pending: []scanResultUtxo{}}
+
+	for _, utxo := range utxos {
+		data.Utxos = append(data.Utxos, newScanResultUtxo(utxo))
+	}
+
+	for _, utxo := range pending.Utxos {
+		data.Pending = append(data.Pending, newScanResultUtxo(utxo))
+	}
+
+	data.Total, _ = scanner.Total(utxos) // already added up when printed
+
+	emitEvent("utxos", data)
+}
+
+func emitFee(fee sats.Amount, vsize int64) {
+	emitEvent("fee", struct {
+		Fee   sats.Amount `json:"fee"`
+		VSize int64       `json:"vsize"`
+	}{fee, vsize})
+}
+
+func emitFeeEstimate(target int, rate int64, fee sats.Amount, vsize int64, sendable bool) {
+	emitEvent("fee-estimate", struct {
+		TargetBlocks int         `json:"targetBlocks"`
+		Rate         int64       `json:"rate"`
+		Fee          sats.Amount `json:"fee"`
+		VSize        int64       `json:"vsize"`
+		Sendable     bool        `json:"sendable"`
+	}{target, rate, fee, vsize, sendable})
+}
+
+func emitSignedTx(tx *wire.MsgTx) {
+	if jsonEvents == nil {
+		return
+	}
+
+	txHex, err := encodeTxHex(tx)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	emitEvent("signed-tx", struct {
+		TxID string `json:"txId"`
+		Hex  string `json:"hex"`
+	}{tx.TxHash().String(), txHex})
+}
+
+func emitBroadcast(tx *wire.MsgTx, err error) {
+	data := struct {
+		TxID  string `json:"txId"`
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+	}{TxID: tx.TxHash().String(), OK: err == nil}
+
+	if err != nil {
+		data.Error = err.Error()
+	}
+
+	emitEvent("broadcast", data)
+}
+
+func emitError(err error) {
+	emitEvent("error", struct {
+		Message string `json:"message"`
+	}{err.Error()})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/muun/recovery/keys"
+)
+
+// Each encrypted key in an Emergency Kit carries the ephemeral public key of the ECDH exchange
+// that encrypted it, made by the device that exported the kit. The last 16 bytes of that key are
+// also the AES nonce (IV). A device with a broken random number generator gives itself away by
+// repeating ephemeral keys or nonces, or by picking very small private keys, across the kits it
+// makes. The keys still decrypt, but their encryption is weaker than it should be, and a new kit
+// should be made.
+//
+// None of this needs the Recovery Code: the ephemeral keys are public.
+
+// weakScalarLimit is the largest private key we consider guessable: ephemeral keys made from any
+// of 1..weakScalarLimit are flagged.
+const weakScalarLimit = 1024
+
+// keyPayload is an encrypted key, named for the user.
+type keyPayload struct {
+	label string
+	key   *keys.EncryptedKey
+}
+
+// keyHealthIssue is a problem found in a payload.
+type keyHealthIssue struct {
+	label   string
+	problem string
+}
+
+// kitPayloads names the keys of a kit, in the order kits list them.
+func kitPayloads(kit string, encryptedKeys []*keys.EncryptedKey) []keyPayload {
+	var payloads []keyPayload
+
+	for i, key := range encryptedKeys {
+		payloads = append(payloads, keyPayload{fmt.Sprintf("%s, key %d", kit, i+1), key})
+	}
+
+	return payloads
+}
+
+// checkKeyHealth looks for signs of a broken random number generator in the encrypted keys.
+func checkKeyHealth(payloads []keyPayload) []keyHealthIssue {
+	var issues []keyHealthIssue
+
+	report := func(label string, format string, v ...interface{}) {
+		issues = append(issues, keyHealthIssue{label, fmt.Sprintf(format, v...)})
+	}
+
+	weak := weakPublicKeys()
+
+	ephemeralKeys := make(map[string]string) // to the first label with each
+	nonces := make(map[string]string)
+	cipherTexts := make(map[string]string)
+
+	for _, payload := range payloads {
+		ephemeral, err := hex.DecodeString(payload.key.EphPublicKey)
+		if err == nil {
+			_, err = btcec.ParsePubKey(ephemeral, btcec.S256())
+		}
+
+		if err != nil {
+			report(payload.label, "its ephemeral key is not a valid public key")
+			continue
+		}
+
+		if scalar, ok := weak[string(ephemeral)]; ok {
+			report(payload.label, "its ephemeral key was made from a guessable number (%d)", scalar)
+		}
+
+		if other, ok := ephemeralKeys[string(ephemeral)]; ok {
+			report(payload.label, "it reuses the ephemeral key of %s", other)
+		} else {
+			ephemeralKeys[string(ephemeral)] = payload.label
+
+			// Only a different key with the same nonce is news, a repeated key repeats its nonce:
+			nonce := string(ephemeral[len(ephemeral)-16:])
+
+			if other, ok := nonces[nonce]; ok {
+				report(payload.label, "it reuses the nonce of %s", other)
+			} else {
+				nonces[nonce] = payload.label
+			}
+		}
+
+		if other, ok := cipherTexts[payload.key.CipherText]; ok {
+			report(payload.label, "its encrypted data is identical to that of %s", other)
+		} else {
+			cipherTexts[payload.key.CipherText] = payload.label
+		}
+	}
+
+	return issues
+}
+
+// weakPublicKeys returns the public keys of the private keys 1..weakScalarLimit, serialized as
+// compressed, the way kits store them.
+func weakPublicKeys() map[string]int {
+	weak := make(map[string]int)
+	curve := btcec.S256()
+
+	for scalar := 1; scalar <= weakScalarLimit; scalar++ {
+		x, y := curve.ScalarBaseMult(big.NewInt(int64(scalar)).Bytes())
+		weak[string((&btcec.PublicKey{Curve: curve, X: x, Y: y}).SerializeCompressed())] = scalar
+	}
+
+	return weak
+}
+
+// printKeyHealth warns about the issues found, if any. When asked, it confirms there were none.
+func printKeyHealth(issues []keyHealthIssue, confirmHealthy bool) {
+	if len(issues) == 0 {
+		if confirmHealthy {
+			say("{green ✓} No repeated or weak ephemeral keys or nonces were found\n")
+		}
+
+		return
+	}
+
+	sayBlock(`
+		{yellow The encryption of your Emergency Kit looks weak}
+	`)
+
+	for _, issue := range issues {
+		say("{yellow !} %s: %s\n", issue.label, issue.problem)
+	}
+
+	say(`
+		This suggests the device that made the kit had a problem generating random numbers. Your keys
+		still work, and your funds can be recovered. But once they're safe, or if you keep using the
+		wallet, export a new Emergency Kit from the app and destroy this one.
+	`)
+
+	recordCaseEvent(currentTag(), "key-health", "Found %d problems in the encryption of the kit keys", len(issues))
+}
+
+// runCheckKeysCommand checks the encrypted keys of one or more Emergency Kits for signs of a broken
+// random number generator. It needs no Recovery Code.
+func runCheckKeysCommand(args []string) {
+	flags := flag.NewFlagSet("check-keys", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	say(`
+		{blue Muun Recovery Tool v%s}
+
+		Checking the encryption of your Emergency Kits. Your Recovery Code is not needed.
+	`, version)
+
+	var payloads []keyPayload
+
+	for i, path := range flags.Args() {
+		encryptedKeys, _, err := readBackupFromPDF(path)
+		if err != nil {
+			exitWithError(fmt.Errorf("failed to read %s: %w", path, err))
+		}
+
+		payloads = append(payloads, kitPayloads(fmt.Sprintf("kit %d (%s)", i+1, path), encryptedKeys)...)
+	}
+
+	fmt.Fprintln(userOutput)
+	printKeyHealth(checkKeyHealth(payloads), true)
+	fmt.Fprintln(userOutput)
+}
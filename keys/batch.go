@@ -0,0 +1,69 @@
+package keys
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/muun/recovery/utils"
+)
+
+// Keys in an Emergency Kit carry no authentication tag: decrypting one with the wrong Recovery
+// Code doesn't fail, it just yields a different key. A wrong key can only be caught when the
+// expected one is known, and kits describe theirs by fingerprint (see EncryptedKey.Fingerprint).
+//
+// Attempting every key, rather than stopping at the first failure, tells the two usual causes
+// apart. A mistyped Recovery Code turns every key into the wrong one, while a damaged kit usually
+// spoils one key alone.
+
+// DecryptResult is the outcome of decrypting one key with DecryptBatch. Err is tagged with the
+// sentinels in the `utils` package. When the key couldn't be decrypted, Key is nil, and Err is:
+//
+//   - utils.ErrKeyVersionUnsupported, if the key is in a format we don't know.
+//   - utils.ErrInvalidKey, if a field of the key is malformed.
+//   - utils.ErrKeyAuthFailed (and utils.ErrDecryptionFailed), if it doesn't decrypt to a key.
+//
+// When the key was decrypted, but isn't what the kit describes, Key is the one decrypted, for
+// callers that want to go on regardless, and Err is:
+//
+//   - utils.ErrKeyMismatch, if its fingerprint is another.
+//   - utils.ErrWrongDerivationPath, if the kit derives it from another path.
+type DecryptResult struct {
+	Key *DecryptedKey
+	Err error
+}
+
+// BatchError summarizes the results of DecryptBatch in a single error, or returns nil if every key
+// was decrypted and matches. When no key matches, the Recovery Code is the likely culprit, and the
+// error is tagged with utils.ErrInvalidRecoveryCode as well. Otherwise, the kit is likely damaged,
+// and the error is that of the first key that failed.
+func BatchError(results []*DecryptResult) error {
+	var failed []int
+	mismatched := 0
+
+	for i, result := range results {
+		if result.Err == nil {
+			continue
+		}
+
+		failed = append(failed, i)
+
+		if errors.Is(result.Err, utils.ErrKeyMismatch) {
+			mismatched++
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	first := results[failed[0]].Err
+
+	if mismatched == len(results) {
+		return utils.WrapError(
+			utils.ErrInvalidRecoveryCode,
+			fmt.Errorf("none of the %d keys match the kit, the Recovery Code is likely mistyped: %w", len(results), first),
+		)
+	}
+
+	return fmt.Errorf("%d of %d keys failed, the kit is likely damaged: %w", len(failed), len(results), first)
+}
@@ -0,0 +1,53 @@
+package keys
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Encoded keys may be followed by extensions, so that newer Emergency Kits can carry more data
+// without breaking the Recovery Tools that came before them. Each extension is a TLV: a 1-byte
+// type, a 2-byte big-endian length, and the value. Extensions are kept as found, whether we know
+// their type or not, for callers to use or ignore.
+
+// EncodedKeySize is the size of the known structure of an encoded key: version (1), birthday (2),
+// ephemeral public key (33), ciphertext (64) and salt (8). Extensions come after it.
+const EncodedKeySize = 108
+
+// extensionHeaderSize is the size of the type and length of an extension.
+const extensionHeaderSize = 3
+
+// Extension is a field found after the known structure of an encoded key.
+type Extension struct {
+	Type  byte
+	Value []byte
+}
+
+// ParseExtensions splits the bytes after the known structure of an encoded key into extensions. If
+// they're cut short, the complete ones are returned along with the error.
+func ParseExtensions(data []byte) ([]Extension, error) {
+	var extensions []Extension
+
+	for len(data) > 0 {
+		if len(data) < extensionHeaderSize {
+			return extensions, fmt.Errorf("extension header cut short, %d bytes left", len(data))
+		}
+
+		extensionType := data[0]
+		length := int(binary.BigEndian.Uint16(data[1:extensionHeaderSize]))
+		data = data[extensionHeaderSize:]
+
+		if len(data) < length {
+			return extensions, fmt.Errorf("extension %d cut short, expected %d bytes, found %d", extensionType, length, len(data))
+		}
+
+		extensions = append(extensions, Extension{
+			Type:  extensionType,
+			Value: append([]byte{}, data[:length]...),
+		})
+
+		data = data[length:]
+	}
+
+	return extensions, nil
+}
@@ -0,0 +1,112 @@
+// Package keys defines the key operations the Recovery Tool relies on, so that the recovery
+// pipeline doesn't depend on a particular implementation.
+//
+// Keys are provided by a Backend. The only one, for now, adapts the vendored libwallet, but a
+// different libwallet version (or an alternative implementation) can be swapped in by writing a
+// new Backend, without touching the code that decrypts, derives and scans.
+package keys
+
+import (
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/muun/libwallet"
+)
+
+// PrivateKey is an extended private key, at a known derivation path.
+type PrivateKey interface {
+	// Path returns the derivation path of the key.
+	Path() string
+
+	// WithPath returns the same key, assigned to a different derivation path. Some legacy keys
+	// were exported without their real path.
+	WithPath(path string) PrivateKey
+
+	// DeriveTo derives a descendant key at an absolute path.
+	DeriveTo(path string) (PrivateKey, error)
+
+	// DerivedAt derives the child key at an index.
+	DerivedAt(index int64, hardened bool) (PrivateKey, error)
+
+	// PublicKey returns the extended public key.
+	PublicKey() PublicKey
+
+	// Sign returns a DER-encoded ECDSA signature of the SHA-256 hash of data.
+	Sign(data []byte) ([]byte, error)
+
+	// ECPrivateKey returns the private key alone, without the chain code, to export it.
+	ECPrivateKey() (*btcec.PrivateKey, error)
+
+	// String returns the key in base58 (xprv) format.
+	String() string
+}
+
+// PublicKey is an extended public key, at a known derivation path.
+type PublicKey interface {
+	// Path returns the derivation path of the key.
+	Path() string
+
+	// DeriveTo derives a descendant key at an absolute path, without hardened steps.
+	DeriveTo(path string) (PublicKey, error)
+
+	// DerivedAt derives the (non-hardened) child key at an index.
+	DerivedAt(index int64) (PublicKey, error)
+
+	// Raw returns the compressed public key.
+	Raw() []byte
+
+	// Fingerprint returns the first 4 bytes of the HASH160 of the key, as used in descriptors.
+	Fingerprint() []byte
+
+	// String returns the key in base58 (xpub) format.
+	String() string
+}
+
+// EncryptedKey is a key as stored in an Emergency Kit. All binary fields are hex-encoded.
+type EncryptedKey struct {
+	Version      int
+	Birthday     int
+	EphPublicKey string
+	CipherText   string
+	Salt         string
+	Extensions   []Extension // found after the known fields, see ParseExtensions
+	Fingerprint  []byte      // of the key once decrypted, if known (kits describe them)
+	Path         string      // where the kit says the key is derived from, if known
+}
+
+// EncryptedKeyVersion is the only format of encrypted keys we can decrypt.
+const EncryptedKeyVersion = 2
+
+// KitKeyPath is where Muun wallets derive their keys from, see paths.go. All addresses can be
+// derived from the keys at this path without hardened steps.
+const KitKeyPath = "m/1'/1'"
+
+// DecryptedKey is a key recovered from an Emergency Kit, along with its birthday (the block height
+// at which it was created).
+type DecryptedKey struct {
+	Key      PrivateKey
+	Birthday int
+}
+
+// Decrypter recovers the keys in an Emergency Kit with the Recovery Code.
+type Decrypter interface {
+	// Decrypt returns the decrypted keys, in the same order. Errors are tagged with the sentinels
+	// in the `utils` package.
+	Decrypt(encryptedKeys []*EncryptedKey, recoveryCode string) ([]*DecryptedKey, error)
+
+	// DecryptBatch attempts every key, even after one fails, and returns a result for each, in the
+	// same order. The error is only for failures that leave no key to attempt, such as a malformed
+	// Recovery Code. See BatchError to make sense of the results.
+	DecryptBatch(encryptedKeys []*EncryptedKey, recoveryCode string) ([]*DecryptResult, error)
+}
+
+// Backend is an implementation of keys and addresses.
+type Backend interface {
+	Decrypter
+
+	// ParsePublicKey decodes an extended public key in base58 (xpub) format, at a given path.
+	ParsePublicKey(encoded string, path string) (PublicKey, error)
+
+	// CreateAddress creates a wallet address of the given version for a pair of keys. Addresses
+	// are returned as the libwallet.MuunAddress interface, which any implementation can satisfy.
+	// Version 1 addresses only use the user key, and the Muun key may be nil.
+	CreateAddress(version int, userKey, muunKey PublicKey) (libwallet.MuunAddress, error)
+}
@@ -0,0 +1,286 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/utils"
+)
+
+// LibwalletBackend implements keys and addresses with libwallet.
+type LibwalletBackend struct {
+	network *libwallet.Network
+}
+
+// NewLibwalletBackend creates a LibwalletBackend for a network.
+func NewLibwalletBackend(network *libwallet.Network) *LibwalletBackend {
+	return &LibwalletBackend{network}
+}
+
+// Decrypt implements Decrypter.
+func (b *LibwalletBackend) Decrypt(encryptedKeys []*EncryptedKey, recoveryCode string) ([]*DecryptedKey, error) {
+	results, err := b.DecryptBatch(encryptedKeys, recoveryCode)
+	if err != nil {
+		return nil, err
+	}
+
+	decryptedKeys := make([]*DecryptedKey, len(results))
+
+	for i, result := range results {
+		if result.Err != nil {
+			return nil, result.Err
+		}
+
+		decryptedKeys[i] = result.Key
+	}
+
+	return decryptedKeys, nil
+}
+
+// DecryptBatch implements Decrypter.
+func (b *LibwalletBackend) DecryptBatch(encryptedKeys []*EncryptedKey, recoveryCode string) ([]*DecryptResult, error) {
+	if len(encryptedKeys) == 0 {
+		return nil, utils.WrapError(utils.ErrInvalidKey, fmt.Errorf("no keys to decrypt"))
+	}
+
+	// Always take the salt from the last key (the same salt was used for all keys, but our legacy
+	// key format did not include it in the first key):
+	salt := encryptedKeys[len(encryptedKeys)-1].Salt
+
+	decryptionKey, err := libwallet.RecoveryCodeToKey(recoveryCode, salt)
+	if err != nil {
+		return nil, utils.WrapError(utils.ErrInvalidRecoveryCode, fmt.Errorf("failed to process recovery code: %w", err))
+	}
+
+	results := make([]*DecryptResult, len(encryptedKeys))
+
+	for i, encryptedKey := range encryptedKeys {
+		if err := checkEncryptedKey(encryptedKey); err != nil {
+			results[i] = &DecryptResult{Err: fmt.Errorf("key %d can't be decrypted: %w", i, err)}
+			continue
+		}
+
+		decryptedKey, err := decryptionKey.DecryptKey(&libwallet.EncryptedPrivateKeyInfo{
+			Version:      encryptedKey.Version,
+			Birthday:     encryptedKey.Birthday,
+			EphPublicKey: encryptedKey.EphPublicKey,
+			CipherText:   encryptedKey.CipherText,
+			Salt:         encryptedKey.Salt,
+		}, b.network)
+
+		// The fields were checked, what failed is the decrypted key itself:
+		if err != nil {
+			results[i] = &DecryptResult{Err: utils.WrapError(
+				utils.ErrDecryptionFailed,
+				utils.WrapError(utils.ErrKeyAuthFailed, fmt.Errorf("failed to decrypt key %d: %w", i, err)),
+			)}
+			continue
+		}
+
+		key := &DecryptedKey{&libwalletPrivateKey{decryptedKey.Key}, decryptedKey.Birthday}
+		results[i] = &DecryptResult{Key: key}
+
+		if encryptedKey.Fingerprint != nil && !bytes.Equal(key.Key.PublicKey().Fingerprint(), encryptedKey.Fingerprint) {
+			results[i].Err = utils.WrapError(utils.ErrKeyMismatch, fmt.Errorf(
+				"key %d has fingerprint %x, the kit expects %x",
+				i, key.Key.PublicKey().Fingerprint(), encryptedKey.Fingerprint,
+			))
+			continue
+		}
+
+		if encryptedKey.Path != "" {
+			if path, err := NormalizePath(encryptedKey.Path); err != nil || path != KitKeyPath {
+				results[i].Err = utils.WrapError(utils.ErrWrongDerivationPath, fmt.Errorf(
+					"the kit derives key %d from %s, Muun wallets use %s", i, encryptedKey.Path, KitKeyPath,
+				))
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// checkEncryptedKey checks the version and fields of an encrypted key, which libwallet assumes are
+// right.
+func checkEncryptedKey(key *EncryptedKey) error {
+	if key.Version != EncryptedKeyVersion {
+		return utils.WrapError(utils.ErrKeyVersionUnsupported, fmt.Errorf("found version %d, expected %d", key.Version, EncryptedKeyVersion))
+	}
+
+	ephPublicKey, err := hex.DecodeString(key.EphPublicKey)
+	if err == nil {
+		_, err = btcec.ParsePubKey(ephPublicKey, btcec.S256())
+	}
+	if err != nil {
+		return utils.WrapError(utils.ErrInvalidKey, fmt.Errorf("bad public key: %w", err))
+	}
+
+	cipherText, err := hex.DecodeString(key.CipherText)
+	if err != nil || len(cipherText) != 64 {
+		return utils.WrapError(utils.ErrInvalidKey, fmt.Errorf("bad ciphertext"))
+	}
+
+	return nil
+}
+
+// ParsePublicKey implements Backend.
+func (b *LibwalletBackend) ParsePublicKey(encoded string, path string) (PublicKey, error) {
+	key, err := libwallet.NewHDPublicKeyFromString(encoded, path, b.network)
+	if err != nil {
+		return nil, err
+	}
+
+	return &libwalletPublicKey{key}, nil
+}
+
+// CreateAddress implements Backend.
+func (b *LibwalletBackend) CreateAddress(version int, userKey, muunKey PublicKey) (libwallet.MuunAddress, error) {
+	user, ok := userKey.(*libwalletPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("libwallet can't create addresses for keys from another backend")
+	}
+
+	// The first wallets were single-key, with pay-to-pubkey-hash addresses:
+	if version == 1 {
+		return libwallet.CreateAddressV1(user.key)
+	}
+
+	muun, ok := muunKey.(*libwalletPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("libwallet can't create addresses for keys from another backend")
+	}
+
+	switch version {
+	case 2:
+		return libwallet.CreateAddressV2(user.key, muun.key)
+	case 3:
+		return libwallet.CreateAddressV3(user.key, muun.key)
+	case 4:
+		return libwallet.CreateAddressV4(user.key, muun.key)
+	case 5:
+		return libwallet.CreateAddressV5(user.key, muun.key)
+	}
+
+	return nil, fmt.Errorf("unsupported address version %d", version)
+}
+
+// LibwalletPrivateKey returns the libwallet key behind a PrivateKey, if it came from libwallet.
+//
+// Signing transactions is done by libwallet's PartiallySignedTransaction, which needs its own key
+// type. It's the one place where we can't use the interfaces.
+func LibwalletPrivateKey(key PrivateKey) (*libwallet.HDPrivateKey, bool) {
+	adapter, ok := key.(*libwalletPrivateKey)
+	if !ok {
+		return nil, false
+	}
+
+	return adapter.key, true
+}
+
+// LibwalletPublicKey returns the libwallet key behind a PublicKey, if it came from libwallet. It's
+// needed to sign with a signature made elsewhere for the other key, see LibwalletPrivateKey.
+func LibwalletPublicKey(key PublicKey) (*libwallet.HDPublicKey, bool) {
+	adapter, ok := key.(*libwalletPublicKey)
+	if !ok {
+		return nil, false
+	}
+
+	return adapter.key, true
+}
+
+type libwalletPrivateKey struct {
+	key *libwallet.HDPrivateKey
+}
+
+func (k *libwalletPrivateKey) Path() string {
+	return k.key.Path
+}
+
+func (k *libwalletPrivateKey) WithPath(path string) PrivateKey {
+	key := *k.key
+	key.Path = path
+
+	return &libwalletPrivateKey{&key}
+}
+
+func (k *libwalletPrivateKey) DeriveTo(path string) (PrivateKey, error) {
+	key, err := k.key.DeriveTo(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &libwalletPrivateKey{key}, nil
+}
+
+func (k *libwalletPrivateKey) DerivedAt(index int64, hardened bool) (PrivateKey, error) {
+	key, err := k.key.DerivedAt(index, hardened)
+	if err != nil {
+		return nil, err
+	}
+
+	return &libwalletPrivateKey{key}, nil
+}
+
+func (k *libwalletPrivateKey) PublicKey() PublicKey {
+	return &libwalletPublicKey{k.key.PublicKey()}
+}
+
+func (k *libwalletPrivateKey) Sign(data []byte) ([]byte, error) {
+	return k.key.Sign(data)
+}
+
+func (k *libwalletPrivateKey) ECPrivateKey() (*btcec.PrivateKey, error) {
+	// libwallet doesn't expose the key, but its xprv has it:
+	extended, err := hdkeychain.NewKeyFromString(k.key.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return extended.ECPrivKey()
+}
+
+func (k *libwalletPrivateKey) String() string {
+	return k.key.String()
+}
+
+type libwalletPublicKey struct {
+	key *libwallet.HDPublicKey
+}
+
+func (k *libwalletPublicKey) Path() string {
+	return k.key.Path
+}
+
+func (k *libwalletPublicKey) DeriveTo(path string) (PublicKey, error) {
+	key, err := k.key.DeriveTo(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &libwalletPublicKey{key}, nil
+}
+
+func (k *libwalletPublicKey) DerivedAt(index int64) (PublicKey, error) {
+	key, err := k.key.DerivedAt(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &libwalletPublicKey{key}, nil
+}
+
+func (k *libwalletPublicKey) Raw() []byte {
+	return k.key.Raw()
+}
+
+func (k *libwalletPublicKey) Fingerprint() []byte {
+	return k.key.Fingerprint()
+}
+
+func (k *libwalletPublicKey) String() string {
+	return k.key.String()
+}
@@ -0,0 +1,188 @@
+package keys
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// hardenedStart is the first hardened child index. Indexes in paths are written below it, with a
+// mark when hardened.
+const hardenedStart = 1 << 31
+
+// Muun wallets derive every key under m/schema:1'/recovery:1', and then by purpose:
+//
+//	m/1'/1'/0/<i>            change addresses
+//	m/1'/1'/1/<i>            receiving addresses
+//	m/1'/1'/2/<c>/<i>        addresses for payments from contact <c>
+//	m/1'/1'/4/...            keys for lightning invoices
+//
+// Paths can be written with segment names (`m/schema:1'/recovery:1'/external:1/7`), and hardened
+// segments marked with ', h or H. Parsing accepts all these forms, checking that names agree with
+// the schema.
+
+var pathSegmentRe = regexp.MustCompile(`^(?:([a-z]+):)?(\d+)(['hH]?)$`)
+
+// purposeNames are the branches under m/schema:1'/recovery:1'.
+var purposeNames = map[uint32]string{
+	0: "change",
+	1: "external",
+	2: "contacts",
+	4: "invoices",
+}
+
+// PathSegment is a step in a derivation path.
+type PathSegment struct {
+	Index    uint32
+	Hardened bool
+	Name     string // from the schema, empty for segments it doesn't name
+}
+
+// Path is a parsed derivation path.
+type Path []PathSegment
+
+// ParsePath parses and validates a derivation path. The leading `m` is optional.
+func ParsePath(path string) (Path, error) {
+	trimmed := path
+	if trimmed == "m" || strings.HasPrefix(trimmed, "m/") {
+		trimmed = trimmed[1:]
+	}
+
+	trimmed = strings.TrimPrefix(trimmed, "/")
+	if trimmed == "" {
+		return Path{}, nil
+	}
+
+	var parsed Path
+
+	for _, chunk := range strings.Split(trimmed, "/") {
+		match := pathSegmentRe.FindStringSubmatch(chunk)
+		if match == nil {
+			return nil, fmt.Errorf("invalid derivation path %q: bad segment %q", path, chunk)
+		}
+
+		index, err := strconv.ParseUint(match[2], 10, 32)
+		if err != nil || index >= hardenedStart {
+			return nil, fmt.Errorf("invalid derivation path %q: index %s is out of range", path, match[2])
+		}
+
+		segment := PathSegment{Index: uint32(index), Hardened: match[3] != ""}
+		segment.Name = schemaName(parsed, segment)
+
+		if match[1] != "" && match[1] != segment.Name {
+			return nil, fmt.Errorf("invalid derivation path %q: segment %q doesn't match the schema", path, chunk)
+		}
+
+		parsed = append(parsed, segment)
+	}
+
+	return parsed, nil
+}
+
+// NormalizePath returns the canonical form of a derivation path, without names and with ' for
+// hardened segments, such as m/1'/1'/1/7.
+func NormalizePath(path string) (string, error) {
+	parsed, err := ParsePath(path)
+	if err != nil {
+		return "", err
+	}
+
+	return parsed.String(), nil
+}
+
+// String returns the path in canonical form.
+func (p Path) String() string {
+	return p.format(false)
+}
+
+// Named returns the path with the schema name of each segment, such as
+// m/schema:1'/recovery:1'/external:1/7.
+func (p Path) Named() string {
+	return p.format(true)
+}
+
+// Describe explains what the path is used for in a Muun wallet, such as "receiving address #7".
+func (p Path) Describe() string {
+	if !p.inRecovery() {
+		switch {
+		case len(p) == 0:
+			return "root key"
+		case len(p) == 1 && p[0].Name != "":
+			return "Muun schema keys"
+		default:
+			return "outside the Muun schema"
+		}
+	}
+
+	rest := p[2:]
+	if len(rest) == 0 {
+		return "wallet keys"
+	}
+
+	purpose := rest[0].Name
+
+	switch {
+	case purpose == "change" && len(rest) == 2:
+		return fmt.Sprintf("change address #%d", rest[1].Index)
+
+	case purpose == "external" && len(rest) == 2:
+		return fmt.Sprintf("receiving address #%d", rest[1].Index)
+
+	case purpose == "contacts" && len(rest) == 2:
+		return fmt.Sprintf("addresses for contact #%d", rest[1].Index)
+
+	case purpose == "contacts" && len(rest) == 3:
+		return fmt.Sprintf("address #%d for contact #%d", rest[2].Index, rest[1].Index)
+
+	case purpose == "invoices":
+		return "lightning invoice key"
+
+	case purpose != "" && len(rest) == 1:
+		return purpose + " keys"
+	}
+
+	return "outside the Muun schema"
+}
+
+func (p Path) format(named bool) string {
+	var b strings.Builder
+	b.WriteString("m")
+
+	for _, segment := range p {
+		b.WriteString("/")
+
+		if named && segment.Name != "" {
+			b.WriteString(segment.Name + ":")
+		}
+
+		b.WriteString(strconv.FormatUint(uint64(segment.Index), 10))
+
+		if segment.Hardened {
+			b.WriteString("'")
+		}
+	}
+
+	return b.String()
+}
+
+// inRecovery returns whether the path is under m/schema:1'/recovery:1'.
+func (p Path) inRecovery() bool {
+	return len(p) >= 2 && p[0].Name == "schema" && p[1].Name == "recovery"
+}
+
+// schemaName returns the name the schema gives to a segment, following a parent path.
+func schemaName(parent Path, segment PathSegment) string {
+	switch {
+	case len(parent) == 0 && segment.Index == 1 && segment.Hardened:
+		return "schema"
+
+	case len(parent) == 1 && parent[0].Name == "schema" && segment.Index == 1 && segment.Hardened:
+		return "recovery"
+
+	case len(parent) == 2 && parent.inRecovery() && !segment.Hardened:
+		return purposeNames[segment.Index]
+	}
+
+	return ""
+}
@@ -0,0 +1,44 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+)
+
+// walletIDDomain separates the hashes behind wallet IDs from any other use of the same data.
+const walletIDDomain = "muun-recovery/wallet-id/v1"
+
+// walletIDSize is the length of a wallet ID, in bytes before hex encoding.
+const walletIDSize = 16
+
+// WalletID returns an identifier for the wallet with the given public keys (the user's and Muun's)
+// on a network, such as "mainnet". Artifacts of the same wallet can be told apart from others, and
+// correlated, by their ID: caches, reports, journals.
+//
+// It's stable: the order of the keys doesn't matter, nor their derivation path. It's derived from
+// the key fingerprints alone, which are already in the Emergency Kit descriptors, so it reveals
+// nothing about the keys or the addresses of the wallet.
+func WalletID(network string, keys ...PublicKey) string {
+	var fingerprints [][]byte
+	for _, key := range keys {
+		fingerprints = append(fingerprints, key.Fingerprint())
+	}
+
+	sort.Slice(fingerprints, func(i, j int) bool {
+		return bytes.Compare(fingerprints[i], fingerprints[j]) < 0
+	})
+
+	hash := sha256.New()
+	hash.Write([]byte(walletIDDomain))
+	hash.Write([]byte{0})
+	hash.Write([]byte(network))
+
+	for _, fingerprint := range fingerprints {
+		hash.Write([]byte{0})
+		hash.Write(fingerprint)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)[:walletIDSize])
+}
@@ -1,64 +1,151 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 
+	"github.com/btcsuite/btcutil/base58"
 	"github.com/muun/libwallet"
 	"github.com/muun/libwallet/emergencykit"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/utils"
 )
 
 var defaultNetwork = libwallet.Mainnet()
 
-func decodeKeysFromInput(rawKey1 string, rawKey2 string) ([]*libwallet.EncryptedPrivateKeyInfo, error) {
+// keyBackend implements the key operations used throughout the tool. See the `keys` package.
+var keyBackend keys.Backend = keys.NewLibwalletBackend(defaultNetwork)
+
+func decodeKeysFromInput(rawKey1 string, rawKey2 string) ([]*keys.EncryptedKey, error) {
 	key1, err := libwallet.DecodeEncryptedPrivateKey(rawKey1)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode first key: %w", err)
+		return nil, classifyDecodeError(rawKey1, fmt.Errorf("failed to decode first key: %w", err))
 	}
 
 	key2, err := libwallet.DecodeEncryptedPrivateKey(rawKey2)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode second key: %w", err)
+		return nil, classifyDecodeError(rawKey2, fmt.Errorf("failed to decode second key: %w", err))
+	}
+
+	return []*keys.EncryptedKey{
+		fromLibwalletKey(key1, decodeKeyExtensions(rawKey1)),
+		fromLibwalletKey(key2, decodeKeyExtensions(rawKey2)),
+	}, nil
+}
+
+func fromLibwalletKey(key *libwallet.EncryptedPrivateKeyInfo, extensions []keys.Extension) *keys.EncryptedKey {
+	return &keys.EncryptedKey{
+		Version:      key.Version,
+		Birthday:     key.Birthday,
+		EphPublicKey: key.EphPublicKey,
+		CipherText:   key.CipherText,
+		Salt:         key.Salt,
+		Extensions:   extensions,
+	}
+}
+
+// decodeKeyExtensions returns the extensions after the known fields of an encoded key. libwallet
+// decodes the known fields, and ignores whatever follows. Legacy keys, without a salt, have none.
+//
+// The known fields are all we need to decrypt the key, so broken extensions (usually, a key cut
+// short while pasting) are left out rather than treated as an error.
+func decodeKeyExtensions(rawKey string) []keys.Extension {
+	if len(rawKey) <= libwallet.EncodedKeyLengthLegacy {
+		return nil
+	}
+
+	decoded := base58.Decode(rawKey)
+	if len(decoded) <= keys.EncodedKeySize {
+		return nil
+	}
+
+	extensions, err := keys.ParseExtensions(decoded[keys.EncodedKeySize:])
+	if err != nil {
+		utils.NewLogger("Keys").Printf("ignoring broken key extensions: %v", err)
+	}
+
+	return extensions
+}
+
+// classifyDecodeError tags a key decoding error with the right sentinel, telling apart keys in an
+// unknown format from plainly malformed ones.
+func classifyDecodeError(rawKey string, err error) error {
+	decoded := base58.Decode(rawKey)
+
+	if len(decoded) > 0 && decoded[0] != keys.EncryptedKeyVersion {
+		return utils.WrapError(utils.ErrKeyVersionUnsupported, err)
 	}
 
-	return []*libwallet.EncryptedPrivateKeyInfo{key1, key2}, nil
+	return utils.WrapError(utils.ErrInvalidKey, err)
 }
 
-func decodeKeysFromMetadata(meta *emergencykit.Metadata) ([]*libwallet.EncryptedPrivateKeyInfo, error) {
-	decodedKeys := make([]*libwallet.EncryptedPrivateKeyInfo, len(meta.EncryptedKeys))
+func decodeKeysFromMetadata(meta *emergencykit.Metadata) ([]*keys.EncryptedKey, error) {
+	if len(meta.EncryptedKeys) != 2 {
+		return nil, utils.WrapError(utils.ErrInvalidKey, fmt.Errorf("expected 2 keys in metadata, found %d", len(meta.EncryptedKeys)))
+	}
+
+	decodedKeys := make([]*keys.EncryptedKey, len(meta.EncryptedKeys))
+
+	// The descriptors tell which keys to expect, so that decryption can catch the wrong ones:
+	kitKeys, hasKitKeys := kitFingerprints(meta)
 
 	for i, metaKey := range meta.EncryptedKeys {
-		decodedKeys[i] = &libwallet.EncryptedPrivateKeyInfo{
-			Version:      meta.Version,
+		// The PDF is untrusted input. Check everything our dependencies assume:
+		if err := validateMetadataKey(metaKey); err != nil {
+			return nil, utils.WrapError(utils.ErrInvalidKey, fmt.Errorf("invalid key %d in metadata: %w", i, err))
+		}
+
+		decodedKeys[i] = &keys.EncryptedKey{
+			Version:      keys.EncryptedKeyVersion, // the same format as printed keys, whatever the kit version
 			Birthday:     meta.BirthdayBlock,
 			EphPublicKey: metaKey.DhPubKey,
 			CipherText:   metaKey.EncryptedPrivKey,
 			Salt:         metaKey.Salt,
 		}
+
+		if hasKitKeys {
+			decodedKeys[i].Fingerprint, _ = hex.DecodeString(kitKeys[i].fingerprint)
+			decodedKeys[i].Path = kitKeys[i].path
+		}
 	}
 
 	return decodedKeys, nil
 }
 
-func decryptKeys(encryptedKeys []*libwallet.EncryptedPrivateKeyInfo, recoveryCode string) ([]*libwallet.DecryptedPrivateKey, error) {
-	// Always take the salt from the second key (the same salt was used for all keys, but our legacy
-	// key format did not include it in the first key):
-	salt := encryptedKeys[1].Salt
-
-	decryptionKey, err := libwallet.RecoveryCodeToKey(recoveryCode, salt)
-	if err != nil {
-		return nil, fmt.Errorf("failed to process recovery code: %w", err)
+// validateMetadataKey checks the sizes of the fields in a metadata key.
+func validateMetadataKey(metaKey *emergencykit.MetadataKey) error {
+	fields := []struct {
+		name     string
+		value    string
+		expected int
+	}{
+		{"public key", metaKey.DhPubKey, 33},
+		{"ciphertext", metaKey.EncryptedPrivKey, 64},
+		{"salt", metaKey.Salt, 8},
 	}
 
-	decryptedKeys := make([]*libwallet.DecryptedPrivateKey, len(encryptedKeys))
-
-	for i, encryptedKey := range encryptedKeys {
-		decryptedKey, err := decryptionKey.DecryptKey(encryptedKey, defaultNetwork)
+	for _, field := range fields {
+		raw, err := hex.DecodeString(field.value)
 		if err != nil {
-			return nil, fmt.Errorf("failed to decrypt key %d: %w", i, err)
+			return fmt.Errorf("bad %s: %w", field.name, err)
+		}
+
+		if len(raw) != field.expected {
+			return fmt.Errorf("bad %s: expected %d bytes, found %d", field.name, field.expected, len(raw))
 		}
+	}
+
+	return nil
+}
+
+// decryptKeys attempts to decrypt both keys, see keys.DecryptBatch. Whether they're the ones the kit
+// describes is up to verifyDecryptedKeys.
+func decryptKeys(encryptedKeys []*keys.EncryptedKey, recoveryCode string) (_ []*keys.DecryptResult, err error) {
+	defer utils.RecoverPanic(&err)
 
-		decryptedKeys[i] = decryptedKey
+	if len(encryptedKeys) != 2 {
+		return nil, utils.WrapError(utils.ErrInvalidKey, fmt.Errorf("expected 2 keys, found %d", len(encryptedKeys)))
 	}
 
-	return decryptedKeys, nil
+	return keyBackend.DecryptBatch(encryptedKeys, recoveryCode)
 }
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/muun/libwallet/emergencykit"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/utils"
+)
+
+// kitRecordVersion is the version of the kit record file format.
+const kitRecordVersion = 1
+
+// kitSamplePaths are the derivation paths of the addresses we record when enrolling a kit, and
+// check on every run. One change and one external address is enough to catch a broken derivation.
+var kitSamplePaths = []string{"m/1'/1'/0/0", "m/1'/1'/1/0"}
+
+// kitSchedules maps the supported schedules to their interval (for daemon mode) and cron spec.
+var kitSchedules = map[string]struct {
+	interval time.Duration
+	cronSpec string
+}{
+	"daily":   {24 * time.Hour, "0 9 * * *"},
+	"weekly":  {7 * 24 * time.Hour, "0 9 * * 1"},
+	"monthly": {30 * 24 * time.Hour, "0 9 1 * *"},
+}
+
+// kitRecord is what we learn about an Emergency Kit when it's enrolled, with the Recovery Code at
+// hand. It allows later checks to run unattended, without any secrets: it holds only public keys.
+type kitRecord struct {
+	Version int `json:"version"`
+	caseTag
+	EnrolledAt   time.Time       `json:"enrolledAt"`
+	MetadataHash string          `json:"metadataHash"`
+	UserKey      string          `json:"userKey"` // extended public keys at `keys.KitKeyPath`
+	MuunKey      string          `json:"muunKey"`
+	Addresses    []kitRecordAddr `json:"addresses"`
+}
+
+type kitRecordAddr struct {
+	Version int    `json:"version"`
+	Path    string `json:"path"`
+	Address string `json:"address"`
+}
+
+// kitCheckResult is the outcome of an unattended check, printed and sent to the webhook.
+type kitCheckResult struct {
+	caseTag
+	Kit       string    `json:"kit"`
+	CheckedAt time.Time `json:"checkedAt"`
+	OK        bool      `json:"ok"`
+	Problems  []string  `json:"problems"`
+}
+
+// runVerifyKitCommand checks that an Emergency Kit still works, so users learn about broken
+// backups before they need them.
+//
+// The first run enrolls the kit: the user enters the Recovery Code, we decrypt the keys and record
+// their public keys and a few addresses. Later runs need no secrets, and can be scheduled: they
+// check that the kit can still be read, hasn't changed, and derives the same addresses.
+func runVerifyKitCommand(args []string) {
+	flags := flag.NewFlagSet("verify-kit", flag.ExitOnError)
+	recordPath := flags.String("record", "", "where to keep what we learn about the kit (default: next to the kit)")
+	webhookURL := flags.String("webhook", "", "POST the result of each check to this URL")
+	schedule := flags.String("schedule", "", "install a cron job to check the kit daily, weekly or monthly")
+	daemon := flags.Bool("daemon", false, "keep running, and check the kit on --schedule")
+	statePath := flags.String("state", "", "in daemon mode, where to remember when the kit was last checked (default: next to the record)")
+	listen := flags.String("listen", "", "in daemon mode, serve /healthz and /readyz at this address (such as 127.0.0.1:8080)")
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	kitPath, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if *recordPath == "" {
+		*recordPath = strings.TrimSuffix(kitPath, filepath.Ext(kitPath)) + ".record.json"
+	}
+
+	if *statePath == "" {
+		*statePath = strings.TrimSuffix(*recordPath, ".record.json") + ".state.json"
+	}
+
+	if *listen != "" && !*daemon {
+		exitWithError(fmt.Errorf("--listen only works in daemon mode, with --daemon"))
+	}
+
+	if *schedule != "" {
+		if _, ok := kitSchedules[*schedule]; !ok {
+			exitWithError(fmt.Errorf("unknown schedule %q, use daily, weekly or monthly", *schedule))
+		}
+	}
+
+	record, err := loadKitRecord(*recordPath)
+	if os.IsNotExist(err) {
+		record = enrollKit(kitPath, *recordPath)
+
+	} else if err != nil {
+		exitWithError(err)
+	}
+
+	switch {
+	case *daemon:
+		if *schedule == "" {
+			exitWithError(fmt.Errorf("daemon mode needs a --schedule"))
+		}
+
+		runKitDaemon(kitPath, record, *webhookURL, *schedule, *statePath, *listen)
+
+	case *schedule != "":
+		installKitSchedule(kitPath, *recordPath, *webhookURL, *schedule)
+
+	default:
+		if !reportKitCheck(checkKit(kitPath, record), *webhookURL) {
+			os.Exit(1)
+		}
+	}
+}
+
+// enrollKit decrypts the keys in a kit, and saves the record for unattended checks.
+func enrollKit(kitPath string, recordPath string) *kitRecord {
+	say(`
+		{blue Muun Recovery Tool v%s}
+
+		Let's check your Emergency Kit. You will need {yellow your Recovery Code} this first time.
+		Later checks won't need it.
+	`, version)
+
+	metadata, err := (&emergencykit.MetadataReader{SrcFile: kitPath}).ReadMetadata()
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to read the kit: %w", err))
+	}
+
+	_, decryptedKeys := readDecryptedKeys(kitPath)
+
+	userKey, muunKey, err := exportableKeys(decryptedKeys[0].Key, decryptedKeys[1].Key)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	record := &kitRecord{
+		Version:      kitRecordVersion,
+		caseTag:      currentTag(),
+		EnrolledAt:   time.Now().UTC(),
+		MetadataHash: hashMetadata(metadata),
+		UserKey:      userKey.String(),
+		MuunKey:      muunKey.String(),
+	}
+
+	// Derive the sample addresses from the private keys, the way a recovery would. Checks will
+	// derive them again from the public keys, and compare:
+	for _, path := range kitSamplePaths {
+		derivedUserKey, err := decryptedKeys[0].Key.DeriveTo(path)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		derivedMuunKey, err := decryptedKeys[1].Key.DeriveTo(path)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		for _, version := range addressVersions {
+			addr, err := keyBackend.CreateAddress(version, derivedUserKey.PublicKey(), derivedMuunKey.PublicKey())
+			if err != nil {
+				exitWithError(err)
+			}
+
+			record.Addresses = append(record.Addresses, kitRecordAddr{version, path, addr.Address()})
+		}
+	}
+
+	if err := record.save(recordPath); err != nil {
+		exitWithError(err)
+	}
+
+	recordCaseEvent(record.caseTag, "kit-enrolled", "Decrypted the Emergency Kit %s, saved its record to %s", kitPath, recordPath)
+
+	sayBlock(`
+		{green ✓ Your Emergency Kit and Recovery Code work}
+		We saved what we need for future checks in {white %s}
+	`, recordPath)
+
+	return record
+}
+
+// checkKit verifies, without secrets, that a kit is still readable and matches its record.
+func checkKit(kitPath string, record *kitRecord) *kitCheckResult {
+	result := &kitCheckResult{caseTag: record.caseTag, Kit: kitPath, CheckedAt: time.Now().UTC(), Problems: []string{}}
+
+	fail := func(format string, v ...interface{}) {
+		result.Problems = append(result.Problems, fmt.Sprintf(format, v...))
+	}
+
+	metadata, err := (&emergencykit.MetadataReader{SrcFile: kitPath}).ReadMetadata()
+	if err != nil {
+		fail("the kit can't be read: %v", err)
+
+	} else {
+		if _, err := decodeKeysFromMetadata(metadata); err != nil {
+			fail("the keys in the kit are invalid: %v", err)
+		}
+
+		if err := validateKitDescriptors(metadata); err != nil {
+			fail("the descriptors in the kit are invalid: %v", err)
+		}
+
+		if hashMetadata(metadata) != record.MetadataHash {
+			fail("the kit changed since it was enrolled, enroll it again if this is expected")
+		}
+	}
+
+	userKey, err := keyBackend.ParsePublicKey(record.UserKey, keys.KitKeyPath)
+	if err != nil {
+		fail("the record has an invalid user key: %v", err)
+	}
+
+	muunKey, err := keyBackend.ParsePublicKey(record.MuunKey, keys.KitKeyPath)
+	if err != nil {
+		fail("the record has an invalid muun key: %v", err)
+	}
+
+	if userKey != nil && muunKey != nil {
+		for _, expected := range record.Addresses {
+			addr, err := deriveAddress(userKey, muunKey, expected.Version, expected.Path)
+
+			if err != nil || addr.Address() != expected.Address {
+				fail("address v%d at %s doesn't derive as expected", expected.Version, expected.Path)
+			}
+		}
+	}
+
+	result.OK = len(result.Problems) == 0
+
+	return result
+}
+
+// reportKitCheck prints the result of a check and sends it to the webhook, returning whether the
+// check passed.
+func reportKitCheck(result *kitCheckResult, webhookURL string) bool {
+	if result.OK {
+		say("{green ✓ %s} Emergency Kit checked, everything is in order\n", utils.FormatTime(result.CheckedAt))
+	} else {
+		say("{red ✗ %s} Emergency Kit check failed\n", utils.FormatTime(result.CheckedAt))
+
+		for _, problem := range result.Problems {
+			say("  • %s\n", problem)
+		}
+	}
+
+	if result.OK {
+		recordCaseEvent(result.caseTag, "kit-check", "Checked the Emergency Kit %s, everything is in order", result.Kit)
+	} else {
+		recordCaseEvent(result.caseTag, "kit-check", "Checked the Emergency Kit %s, it failed: %s", result.Kit, strings.Join(result.Problems, "; "))
+	}
+
+	if webhookURL != "" {
+		if err := postJSON(webhookURL, result); err != nil {
+			say("{yellow Couldn't send the result}: %v\n", err)
+		}
+	}
+
+	return result.OK
+}
+
+// installKitSchedule adds a cron job for unattended checks, after asking the user.
+func installKitSchedule(kitPath, recordPath, webhookURL, schedule string) {
+	executable, err := os.Executable()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	recordPath, err = filepath.Abs(recordPath)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	command := []string{executable, "verify-kit", "--record", recordPath}
+	if webhookURL != "" {
+		command = append(command, "--webhook", webhookURL)
+	}
+	command = append(command, kitPath)
+
+	for i := range command {
+		command[i] = "'" + strings.ReplaceAll(command[i], "'", `'\''`) + "'"
+	}
+
+	entry := kitSchedules[schedule].cronSpec + " " + strings.Join(command, " ")
+
+	if _, err := exec.LookPath("crontab"); err != nil {
+		sayBlock(`
+			Couldn't find {white crontab} on this system. To check your kit %s, schedule this command
+			with your system's task scheduler, or run it with {white --daemon}:
+
+			%s
+		`, schedule, strings.Join(command, " "))
+		return
+	}
+
+	sayBlock(`
+		This will add the following line to your crontab:
+
+		%s
+	`, entry)
+
+	if !readYesNo("Install it?") {
+		return
+	}
+
+	// `crontab -l` fails when there's no crontab yet, which is fine:
+	current, _ := exec.Command("crontab", "-l").Output()
+
+	if strings.Contains(string(current), entry) {
+		say("\nThe check is already scheduled\n")
+		return
+	}
+
+	updated := strings.TrimRight(string(current), "\n")
+	if updated != "" {
+		updated += "\n"
+	}
+
+	install := exec.Command("crontab", "-")
+	install.Stdin = strings.NewReader(updated + entry + "\n")
+
+	if output, err := install.CombinedOutput(); err != nil {
+		exitWithError(fmt.Errorf("failed to install cron job: %v: %s", err, output))
+	}
+
+	sayBlock("{green ✓ Your kit will be checked %s}\n\n", schedule)
+}
+
+func hashMetadata(metadata *emergencykit.Metadata) string {
+	data, _ := json.Marshal(metadata) // it was decoded from JSON, it can be encoded
+	hash := sha256.Sum256(data)
+
+	return hex.EncodeToString(hash[:])
+}
+
+func loadKitRecord(path string) (*kitRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var record kitRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse kit record in %s: %w", path, err)
+	}
+
+	if record.Version != kitRecordVersion {
+		return nil, fmt.Errorf("unsupported kit record version %d in %s", record.Version, path)
+	}
+
+	return &record, nil
+}
+
+func (r *kitRecord) save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode kit record: %w", err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save kit record: %w", err)
+	}
+
+	return nil
+}
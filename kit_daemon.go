@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/muun/recovery/utils"
+)
+
+// In daemon mode, verify-kit runs as a service, usually under an orchestrator (systemd, Docker,
+// Kubernetes). For them, it can serve health endpoints with --listen:
+//
+//	/healthz answers 200 while the daemon is running, even while it's shutting down.
+//	/readyz answers 200 once the daemon is waiting for or running checks, and 503 before that
+//	        and during shutdown. Both include the state of the last check.
+//
+// SIGTERM (or Ctrl+C) stops the daemon gracefully: a check in progress runs to the end, including
+// its report and the state file, which is never left half written. The state file remembers when
+// the last check ran, so a restarted daemon resumes the schedule instead of checking right away.
+
+// kitDaemonStateVersion is the version of the daemon state file format.
+const kitDaemonStateVersion = 1
+
+// healthShutdownTimeout is how long we give the health endpoints to answer pending requests on
+// shutdown.
+const healthShutdownTimeout = 5 * time.Second
+
+// kitDaemonState is what the daemon remembers between runs.
+type kitDaemonState struct {
+	Version   int       `json:"version"`
+	LastCheck time.Time `json:"lastCheck"`
+	LastOK    bool      `json:"lastOK"`
+}
+
+// kitDaemonStatus is what the health endpoints report.
+type kitDaemonStatus struct {
+	mu sync.Mutex
+
+	Status    string    `json:"status"` // starting, waiting, checking or stopping
+	LastCheck time.Time `json:"lastCheck"`
+	LastOK    bool      `json:"lastOK"`
+	NextCheck time.Time `json:"nextCheck"`
+}
+
+// runKitDaemon checks the kit on schedule until it's told to stop.
+func runKitDaemon(kitPath string, record *kitRecord, webhookURL, schedule, statePath, listen string) {
+	interval := kitSchedules[schedule].interval
+
+	state, err := loadKitDaemonState(statePath)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	status := &kitDaemonStatus{Status: "starting", LastCheck: state.LastCheck, LastOK: state.LastOK}
+
+	var server *http.Server
+	if listen != "" {
+		server = serveKitHealth(listen, status)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+
+	for {
+		next := state.LastCheck.Add(interval)
+		status.set("waiting", state, next)
+
+		select {
+		case sig := <-stop:
+			shutdownKitDaemon(server, status, state, sig, next)
+			return
+
+		case <-time.After(time.Until(next)):
+		}
+
+		// A stop signal received from here on waits in the channel until the check is done:
+		status.set("checking", state, next)
+
+		result := checkKit(kitPath, record)
+		reportKitCheck(result, webhookURL)
+
+		state.LastCheck = result.CheckedAt
+		state.LastOK = result.OK
+
+		if err := state.save(statePath); err != nil {
+			say("{yellow Couldn't save the daemon state}: %v\n", err)
+		}
+	}
+}
+
+// shutdownKitDaemon stops the health endpoints, once no check is running.
+func shutdownKitDaemon(server *http.Server, status *kitDaemonStatus, state *kitDaemonState, sig os.Signal, next time.Time) {
+	status.set("stopping", state, next)
+
+	say("Stopping (%v). The next check is due at %s, whenever the daemon runs again\n", sig, utils.FormatTime(next))
+
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthShutdownTimeout)
+	defer cancel()
+
+	server.Shutdown(ctx)
+}
+
+// serveKitHealth starts the health endpoints in the background.
+func serveKitHealth(listen string, status *kitDaemonStatus) *http.Server {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to serve health endpoints at %s: %w", listen, err))
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status.write(w, http.StatusOK)
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if status.ready() {
+			status.write(w, http.StatusOK)
+		} else {
+			status.write(w, http.StatusServiceUnavailable)
+		}
+	})
+
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			say("{yellow Health endpoints stopped}: %v\n", err)
+		}
+	}()
+
+	say("► Health endpoints at {white http://%s/healthz} and {white /readyz}\n", listener.Addr())
+
+	return server
+}
+
+func (s *kitDaemonStatus) set(status string, state *kitDaemonState, next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Status = status
+	s.LastCheck = state.LastCheck
+	s.LastOK = state.LastOK
+	s.NextCheck = next
+}
+
+func (s *kitDaemonStatus) ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Status == "waiting" || s.Status == "checking"
+}
+
+func (s *kitDaemonStatus) write(w http.ResponseWriter, code int) {
+	s.mu.Lock()
+	data, err := json.Marshal(s)
+	s.mu.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// loadKitDaemonState reads the state file. Without one, the daemon checks right away.
+func loadKitDaemonState(path string) (*kitDaemonState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &kitDaemonState{Version: kitDaemonStateVersion}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read daemon state: %w", err)
+	}
+
+	var state kitDaemonState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse daemon state in %s: %w", path, err)
+	}
+
+	if state.Version != kitDaemonStateVersion {
+		return nil, fmt.Errorf("unsupported daemon state version %d in %s", state.Version, path)
+	}
+
+	return &state, nil
+}
+
+// save writes the state file. It writes a temporary file and renames it, so a crash never leaves
+// it half written.
+func (s *kitDaemonState) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode daemon state: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to save daemon state: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to save daemon state: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/muun/libwallet/emergencykit"
+	"github.com/muun/recovery/descriptors"
+)
+
+// Copying the encrypted keys out of an Emergency Kit by hand is slow, and a single wrong character
+// spoils a key. Kits carry the same data for machines, in a metadata.json file attached to the
+// PDF, and the tool reads it when given the kit:
+//
+//	recovery-tool --kit emergency-kit.pdf
+//
+// (or with the path after the options, as before, which is read the same way). The attachment has
+// both encrypted keys and the output descriptors of the wallet. Before using anything, every
+// descriptor's checksum is verified, and all must describe the same pair of keys: a kit that fails
+// is damaged, and the keys are asked for instead. The fingerprints in the descriptors then tell
+// whether the keys decrypt to the right ones (see keys.BatchError).
+//
+// Kits without the attachment, such as printed ones scanned back, can't be read: their keys are
+// only in the text, and in QR codes we have no way to decode.
+
+// kitPDFPath returns the path of the Emergency Kit PDF, given with --kit or as an argument, or an
+// empty string if there's none. Either way, the kit must open.
+func kitPDFPath(argument string) string {
+	path := argument
+
+	if *kitPDF != "" {
+		if argument != "" && argument != *kitPDF {
+			exitWithError(fmt.Errorf("two Emergency Kits were given, %s with --kit and %s, use only one", *kitPDF, argument))
+		}
+
+		path = *kitPDF
+	}
+
+	if path == "" {
+		return ""
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		exitWithError(fmt.Errorf("can't open the Emergency Kit: %w", err))
+	}
+
+	file.Close()
+
+	return path
+}
+
+// validateKitDescriptors checks the output descriptors in the kit metadata: each checksum must be
+// right, and all descriptors must be of the keys the kit describes (see kitFingerprints).
+func validateKitDescriptors(metadata *emergencykit.Metadata) error {
+	expected, ok := kitFingerprints(metadata)
+
+	for i, descriptor := range metadata.OutputDescriptors {
+		separator := strings.LastIndex(descriptor, "#")
+		if separator < 0 {
+			return fmt.Errorf("descriptor %d has no checksum", i+1)
+		}
+
+		text, checksum := descriptor[:separator], descriptor[separator+1:]
+
+		if descriptors.Checksum(text) != checksum {
+			return fmt.Errorf("descriptor %d is damaged, its checksum doesn't match", i+1)
+		}
+
+		found := descriptorKeys(text)
+
+		if !ok || len(found) != 2 {
+			return fmt.Errorf("descriptor %d is not one of a Muun wallet", i+1)
+		}
+
+		if found[0] != expected[0] || found[1] != expected[1] {
+			return fmt.Errorf("descriptor %d is of other keys than the rest", i+1)
+		}
+	}
+
+	return nil
+}
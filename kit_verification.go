@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/muun/libwallet/emergencykit"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/utils"
+)
+
+// kitVersions are the Emergency Kit versions that print a verification code. Kits typed in by hand
+// don't tell us their version, so we try them all.
+var kitVersions = []int{1, 2, 3}
+
+// kitFingerprintsRegexp extracts a key from a descriptor in the kit metadata: its fingerprint, and
+// the path it's derived from, up to the change or external branch.
+var kitFingerprintsRegexp = regexp.MustCompile(`([0-9a-fA-F]{8})((?:/\d+['hH]?)*)/[01]/\*`)
+
+// kitKey is a key as described in the kit metadata.
+type kitKey struct {
+	fingerprint string // lowercase hex
+	path        string // such as m/1'/1'
+}
+
+// verifyDecryptedKeys checks that the decrypted keys belong to the kit the user has, before the
+// long scan begins, and returns them. Keys read from a PDF were compared against the descriptors in
+// its metadata as they were decrypted (see keys.BatchError), and the user is asked for the
+// verification code printed in the kit.
+func verifyDecryptedKeys(encryptedKeys []*keys.EncryptedKey, results []*keys.DecryptResult, metadata *emergencykit.Metadata) []*keys.DecryptedKey {
+	batchErr := keys.BatchError(results)
+	decryptedKeys := make([]*keys.DecryptedKey, len(results))
+
+	for i, result := range results {
+		if result.Key == nil {
+			exitWithError(batchErr)
+		}
+
+		decryptedKeys[i] = result.Key
+	}
+
+	switch {
+	case errors.Is(batchErr, utils.ErrInvalidRecoveryCode):
+		sayBlock(`
+			{red None of the decrypted keys match the ones described in your Emergency Kit.}
+			The Recovery Code is likely mistyped, or belongs to another kit. Continuing could show no funds.
+		`)
+
+	case batchErr != nil:
+		sayBlock(`
+			{red The decrypted keys don't match the ones described in your Emergency Kit.}
+			The kit may be damaged or altered. Continuing could show no funds, or the wrong ones.
+		`)
+
+	case encryptedKeys[0].Fingerprint != nil:
+		say("{green ✓} The decrypted keys match the ones described in your Emergency Kit\n")
+	}
+
+	if batchErr != nil && !readYesNo("Continue anyway?") {
+		exitWithError(batchErr)
+	}
+
+	versions := kitVersions
+	if metadata != nil {
+		versions = []int{metadata.Version}
+	}
+
+	codes, err := kitVerificationCodes(encryptedKeys[1], versions)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	sayBlock(`
+		{yellow Enter the verification code} shown at the top of your Emergency Kit, after "Verification #"
+		(or 'skip' if it doesn't have one)
+	`)
+
+	var userInput string
+	ask(&userInput)
+
+	userInput = strings.TrimPrefix(strings.TrimSpace(userInput), "#")
+
+	if strings.EqualFold(userInput, "skip") {
+		return decryptedKeys
+	}
+
+	for _, code := range codes {
+		if code == userInput {
+			say("{green ✓} The verification code matches\n")
+			return decryptedKeys
+		}
+	}
+
+	sayBlock(`
+		{red The verification code doesn't match these keys.} If you have more than one Emergency Kit,
+		make sure to use the keys and the Recovery Code of the same one.
+	`)
+
+	if !readYesNo("Continue anyway?") {
+		os.Exit(1)
+	}
+
+	return decryptedKeys
+}
+
+// kitVerificationCodes computes the verification code that a kit with this Muun key (always the
+// second one) would show, for each kit version. Apps derive it from the encoded encrypted key.
+func kitVerificationCodes(muunKey *keys.EncryptedKey, versions []int) ([]string, error) {
+	encoded, err := encodeEncryptedKey(muunKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var codes []string
+
+	for _, version := range versions {
+		hash := sha256.Sum256([]byte(encoded + strconv.Itoa(version)))
+
+		var code strings.Builder
+		for _, b := range hash[:6] {
+			code.WriteString(strconv.Itoa(int(b) % 10))
+		}
+
+		codes = append(codes, code.String())
+	}
+
+	return codes, nil
+}
+
+// encodeEncryptedKey serializes a key the way the apps do when printing it in a kit.
+func encodeEncryptedKey(key *keys.EncryptedKey) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(keys.EncryptedKeyVersion)
+
+	birthday := make([]byte, 2)
+	binary.BigEndian.PutUint16(birthday, uint16(key.Birthday))
+	buf.Write(birthday)
+
+	for _, field := range []string{key.EphPublicKey, key.CipherText, key.Salt} {
+		raw, err := hex.DecodeString(field)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode key: %w", err)
+		}
+
+		buf.Write(raw)
+	}
+
+	return base58.Encode(buf.Bytes()), nil
+}
+
+// kitFingerprints returns the user and Muun keys described in the kit metadata. Older kits have no
+// descriptors, and thus no fingerprints.
+func kitFingerprints(metadata *emergencykit.Metadata) ([2]kitKey, bool) {
+	for _, descriptor := range metadata.OutputDescriptors {
+		if found := descriptorKeys(descriptor); len(found) == 2 {
+			return [2]kitKey{found[0], found[1]}, true
+		}
+	}
+
+	return [2]kitKey{}, false
+}
+
+// descriptorKeys returns the keys in a descriptor of the kit metadata, in order.
+func descriptorKeys(descriptor string) []kitKey {
+	var found []kitKey
+
+	for _, match := range kitFingerprintsRegexp.FindAllStringSubmatch(descriptor, -1) {
+		found = append(found, kitKey{strings.ToLower(match[1]), "m" + match[2]})
+	}
+
+	return found
+}
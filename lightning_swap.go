@@ -0,0 +1,825 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/payto"
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/scanner"
+	"github.com/muun/recovery/utils"
+	"golang.org/x/crypto/ripemd160"
+)
+
+// With --lightning, the funds are sent to a Lightning invoice instead of a bitcoin address, through
+// a submarine swap: the sweep locks them in an output that the swap provider (a Boltz instance, or
+// anything speaking its API) can only claim by paying the invoice, since paying reveals the secret
+// the output asks for. If the provider doesn't pay, the output goes back to us after a timeout.
+//
+// We don't take the provider's word for any of this. The lockup script is rebuilt from the invoice
+// and our refund key, and must match the one we're given byte for byte. The refund key is ours,
+// made for the swap, and saved with everything else needed to refund it (see swap-refund).
+
+// defaultSwapProvider is the API of the public Boltz instance.
+const defaultSwapProvider = "https://api.boltz.exchange"
+
+// swapFileVersion is the version of the swap file format.
+const swapFileVersion = 1
+
+// swapMaxSurplus is how much more than the provider asks for we can send. The sweep sends all the
+// funds, and any surplus goes to the miners, so the invoice should take almost all of them.
+const swapMaxSurplus = sats.Amount(1000)
+
+// swapMinTimeout and swapMaxTimeout bound the blocks until a swap can be refunded. Too few, and
+// the provider may not have time to pay. Too many, and the funds are stuck for long if it doesn't.
+const swapMinTimeout = 24
+const swapMaxTimeout = 4032
+
+// swapMinInvoiceExpiry is how long an invoice must remain valid: the provider pays it once the
+// sweep confirms.
+const swapMinInvoiceExpiry = 30 * time.Minute
+
+// swapPollInterval is how often we ask the provider about the swap after sending, for at most
+// swapWaitLimit. The swap goes on without us after that.
+const swapPollInterval = 30 * time.Second
+const swapWaitLimit = 2 * time.Hour
+
+const swapPairID = "BTC/BTC"
+
+// submarineSwap is a swap arranged with the provider. It's saved to the --swap-file, with the
+// refund key, before the sweep is signed.
+type submarineSwap struct {
+	Version int `json:"version"`
+	caseTag
+	CreatedAt          time.Time   `json:"createdAt"`
+	Provider           string      `json:"provider"`
+	ID                 string      `json:"id"`
+	Invoice            string      `json:"invoice"`
+	InvoiceAmount      sats.Amount `json:"invoiceAmount"`
+	ExpectedAmount     sats.Amount `json:"expectedAmount"`
+	Address            string      `json:"address"`
+	RedeemScript       string      `json:"redeemScript"` // hex
+	TimeoutBlockHeight int         `json:"timeoutBlockHeight"`
+	RefundKey          string      `json:"refundKey"` // WIF
+}
+
+// swapPair describes the provider's fees and limits for on-chain to Lightning swaps.
+type swapPair struct {
+	Limits struct {
+		Minimal int64 `json:"minimal"`
+		Maximal int64 `json:"maximal"`
+	} `json:"limits"`
+
+	Fees struct {
+		Percentage       float64 `json:"percentage"`
+		PercentageSwapIn float64 `json:"percentageSwapIn"`
+		MinerFees        struct {
+			BaseAsset struct {
+				Normal int64 `json:"normal"`
+			} `json:"baseAsset"`
+		} `json:"minerFees"`
+	} `json:"fees"`
+}
+
+type swapRequest struct {
+	Type            string `json:"type"`
+	PairID          string `json:"pairId"`
+	OrderSide       string `json:"orderSide"`
+	Invoice         string `json:"invoice"`
+	RefundPublicKey string `json:"refundPublicKey"`
+}
+
+type swapResponse struct {
+	ID                 string `json:"id"`
+	Address            string `json:"address"`
+	RedeemScript       string `json:"redeemScript"`
+	ExpectedAmount     int64  `json:"expectedAmount"`
+	TimeoutBlockHeight int    `json:"timeoutBlockHeight"`
+}
+
+// swapProvider is a client for the API of the swap provider.
+type swapProvider struct {
+	url    *url.URL
+	client *http.Client
+}
+
+// checkLightningOptions fails early when --lightning is combined with options that need a plain
+// address, or the provider is not a valid URL.
+func checkLightningOptions() {
+	if !*lightning {
+		return
+	}
+
+	conflicts := []struct {
+		option string
+		set    bool
+	}{
+		{"--fee-input", *feeFromExternalInput},
+		{"--test-sweep", *testSweep > 0},
+		{"--migrate", *migrate},
+		{"--watch-url", *watchURL != ""},
+		{"--export-snapshot", *exportSnapshot != ""},
+		{"--export-chunks", *exportChunks != ""},
+	}
+
+	for _, conflict := range conflicts {
+		if conflict.set {
+			exitWithError(fmt.Errorf("--lightning can't be combined with %s", conflict.option))
+		}
+	}
+
+	if _, err := newSwapProvider(*swapProviderURL); err != nil {
+		exitWithError(err)
+	}
+}
+
+func newSwapProvider(rawURL string) (*swapProvider, error) {
+	parsedURL, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil || (parsedURL.Scheme != "https" && parsedURL.Scheme != "http") || parsedURL.Host == "" {
+		return nil, fmt.Errorf("invalid swap provider URL %q", rawURL)
+	}
+
+	return &swapProvider{parsedURL, &http.Client{Timeout: webhookTimeout}}, nil
+}
+
+// call sends a request to the provider, with a JSON body unless it's nil, and decodes the JSON
+// response into `result`. The provider explains failed requests in an `error` field.
+func (p *swapProvider) call(path string, body interface{}, result interface{}) error {
+	if err := utils.CheckNetwork(); err != nil {
+		return err
+	}
+
+	var res *http.Response
+	var err error
+
+	if body == nil {
+		res, err = p.client.Get(p.url.String() + path)
+	} else {
+		var data []byte
+		if data, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+
+		res, err = p.client.Post(p.url.String()+path, "application/json", bytes.NewReader(data))
+	}
+
+	if err != nil {
+		return utils.WrapError(utils.ErrBackendUnavailable, fmt.Errorf("failed to reach %s: %w", p.url.Host, err))
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read the response of %s: %w", p.url.Host, err)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var failure struct {
+			Error string `json:"error"`
+		}
+
+		if json.Unmarshal(data, &failure) == nil && failure.Error != "" {
+			return fmt.Errorf("%s refused the request: %s", p.url.Host, failure.Error)
+		}
+
+		return fmt.Errorf("%s responded with status %s", p.url.Host, res.Status)
+	}
+
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("failed to parse the response of %s: %w", p.url.Host, err)
+	}
+
+	return nil
+}
+
+func (p *swapProvider) pair() (*swapPair, error) {
+	var response struct {
+		Pairs map[string]*swapPair `json:"pairs"`
+	}
+
+	if err := p.call("/getpairs", nil, &response); err != nil {
+		return nil, err
+	}
+
+	pair, ok := response.Pairs[swapPairID]
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't offer %s swaps", p.url.Host, swapPairID)
+	}
+
+	return pair, nil
+}
+
+func (p *swapProvider) createSwap(invoice string, refundKey *btcec.PublicKey) (*swapResponse, error) {
+	request := &swapRequest{
+		Type:            "submarine",
+		PairID:          swapPairID,
+		OrderSide:       "sell",
+		Invoice:         invoice,
+		RefundPublicKey: hex.EncodeToString(refundKey.SerializeCompressed()),
+	}
+
+	var response swapResponse
+	if err := p.call("/createswap", request, &response); err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
+
+func (p *swapProvider) status(id string) (string, error) {
+	var response struct {
+		Status string `json:"status"`
+	}
+
+	if err := p.call("/swapstatus", map[string]string{"id": id}, &response); err != nil {
+		return "", err
+	}
+
+	return response.Status, nil
+}
+
+// percentage is the provider's fee, as a percentage of the invoice.
+func (p *swapPair) percentage() float64 {
+	if p.Fees.PercentageSwapIn > 0 {
+		return p.Fees.PercentageSwapIn
+	}
+
+	return p.Fees.Percentage
+}
+
+// expectedAmount is what the provider asks to lock up to pay an invoice.
+func (p *swapPair) expectedAmount(invoice int64) int64 {
+	return invoice + int64(math.Ceil(float64(invoice)*p.percentage()/100)) + p.Fees.MinerFees.BaseAsset.Normal
+}
+
+// invoiceAmountFor returns the largest invoice the provider can pay with `sendable` sats.
+func (p *swapPair) invoiceAmountFor(sendable sats.Amount) int64 {
+	amount := int64(float64(int64(sendable)-p.Fees.MinerFees.BaseAsset.Normal) / (1 + p.percentage()/100))
+
+	for amount > 0 && p.expectedAmount(amount) > int64(sendable) {
+		amount--
+	}
+
+	if amount > p.Limits.Maximal && p.Limits.Maximal > 0 {
+		return p.Limits.Maximal
+	}
+
+	return amount
+}
+
+// arrangeSwap asks for an invoice for the funds left after the fee, and arranges its payment with
+// the provider. The swap is verified and saved before returning.
+func arrangeSwap(sendable sats.Amount, utxoScanner *scanner.Scanner) *submarineSwap {
+	provider, err := newSwapProvider(*swapProviderURL)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	pair, err := provider.pair()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	invoiceAmount := pair.invoiceAmountFor(sendable)
+	if invoiceAmount < pair.Limits.Minimal {
+		exitWithError(utils.WrapError(
+			utils.ErrInsufficientFunds,
+			fmt.Errorf("%s swaps at least %d sats, and %d sats can be sent", provider.url.Host, pair.Limits.Minimal, invoiceAmount),
+		))
+	}
+
+	invoice := readSwapInvoice(invoiceAmount)
+
+	if err := utils.CheckRandomness(); err != nil {
+		exitWithError(err)
+	}
+
+	refundKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to make the refund key: %w", err))
+	}
+
+	tip, err := utxoScanner.GetTipHeight()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	response, err := provider.createSwap(invoice.RawInvoice, refundKey.PubKey())
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if err := verifySwap(response, invoice, refundKey.PubKey(), sendable, tip); err != nil {
+		exitWithError(fmt.Errorf("the swap offered by %s is not safe, nothing was sent: %w", provider.url.Host, err))
+	}
+
+	wif, err := btcutil.NewWIF(refundKey, &chainParams, true)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	swap := &submarineSwap{
+		Version:            swapFileVersion,
+		caseTag:            currentTag(),
+		CreatedAt:          time.Now().UTC(),
+		Provider:           provider.url.String(),
+		ID:                 response.ID,
+		Invoice:            invoice.RawInvoice,
+		InvoiceAmount:      sats.Amount(invoice.Sats),
+		ExpectedAmount:     sats.Amount(response.ExpectedAmount),
+		Address:            response.Address,
+		RedeemScript:       response.RedeemScript,
+		TimeoutBlockHeight: response.TimeoutBlockHeight,
+		RefundKey:          wif.String(),
+	}
+
+	// A swap arranged before, in this run or another, may have been funded. We keep its refund key:
+	if err := keepPreviousSwap(*swapFile); err != nil {
+		exitWithError(err)
+	}
+
+	if err := swap.save(*swapFile); err != nil {
+		exitWithError(err)
+	}
+
+	recordCaseEvent(currentTag(), "swap", "Arranged swap %s with %s to pay %d sats over Lightning", swap.ID, provider.url.Host, swap.InvoiceAmount)
+
+	sayBlock(`
+		{green ✓} Swap {white %s} arranged with %s, and checked
+		  {white Invoice}: %d sats
+		  {white Swap fee}: %d sats
+		  {white Refundable after block}: %d (%s from now)
+
+		If the invoice isn't paid, you can get the funds back after that block, with the key saved in
+		{white %s}. Keep this file until the invoice is paid.
+	`, swap.ID, provider.url.Host, swap.InvoiceAmount, swap.ExpectedAmount-swap.InvoiceAmount,
+		swap.TimeoutBlockHeight, describeBlocks(swap.TimeoutBlockHeight-tip), *swapFile)
+
+	return swap
+}
+
+// readSwapInvoice asks for a Lightning invoice for the given amount.
+func readSwapInvoice(amount int64) *libwallet.Invoice {
+	sayBlock(`
+		{yellow Enter a Lightning invoice for %d sats}
+		After the swap fee, that's the most that can be sent. Invoices for up to %d sats less are
+		accepted, the difference goes to the miners.
+	`, amount, swapMaxSurplus)
+
+	var userInput string
+	ask(&userInput)
+
+	invoice, err := libwallet.ParseInvoice(strings.TrimSpace(userInput), libwallet.Mainnet())
+	if err != nil {
+		say(`
+			This is not a valid Lightning invoice
+			Please, try again
+		`)
+
+		return readSwapInvoice(amount)
+	}
+
+	if invoice.Sats > amount || invoice.Sats < amount-int64(swapMaxSurplus) {
+		say(`
+			The invoice is for %d sats, it must be for %d sats
+			Please, try again
+		`, invoice.Sats, amount)
+
+		return readSwapInvoice(amount)
+	}
+
+	if time.Until(time.Unix(invoice.Expiry, 0)) < swapMinInvoiceExpiry {
+		say(`
+			The invoice expires too soon. It's paid once the transaction confirms
+			Please, try a new one
+		`)
+
+		return readSwapInvoice(amount)
+	}
+
+	return invoice
+}
+
+// verifySwap checks that the output the provider asks for can only be claimed by paying the
+// invoice, or refunded with our key after a reasonable timeout, and that it takes what we expect.
+func verifySwap(response *swapResponse, invoice *libwallet.Invoice, refundKey *btcec.PublicKey, sendable sats.Amount, tip int) error {
+	script, err := hex.DecodeString(response.RedeemScript)
+	if err != nil {
+		return fmt.Errorf("invalid lockup script: %w", err)
+	}
+
+	// The only thing we can't predict is the provider's key, second among the data pushed:
+	pushes, err := txscript.PushedData(script)
+	if err != nil || len(pushes) != 4 {
+		return fmt.Errorf("unexpected lockup script %s", response.RedeemScript)
+	}
+
+	claimKey, err := btcec.ParsePubKey(pushes[1], btcec.S256())
+	if err != nil {
+		return fmt.Errorf("invalid claim key in the lockup script: %w", err)
+	}
+
+	expected, err := swapScript(invoice.PaymentHash, claimKey, refundKey, response.TimeoutBlockHeight)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(script, expected) {
+		return fmt.Errorf("the lockup script doesn't match the invoice and our refund key")
+	}
+
+	address, err := swapAddress(script)
+	if err != nil {
+		return err
+	}
+
+	if address.EncodeAddress() != response.Address {
+		return fmt.Errorf("the lockup address %s doesn't match its script", response.Address)
+	}
+
+	if response.ExpectedAmount <= invoice.Sats {
+		return fmt.Errorf("the swap asks for %d sats to pay %d", response.ExpectedAmount, invoice.Sats)
+	}
+
+	surplus, err := sendable.Sub(sats.Amount(response.ExpectedAmount))
+	if err != nil {
+		return fmt.Errorf("the swap asks for %d sats, and %d can be sent", response.ExpectedAmount, sendable)
+	}
+
+	if surplus > swapMaxSurplus {
+		return fmt.Errorf("the swap asks for %d sats, leaving %d of the %d sats to send as fee", response.ExpectedAmount, surplus, sendable)
+	}
+
+	if blocks := response.TimeoutBlockHeight - tip; blocks < swapMinTimeout || blocks > swapMaxTimeout {
+		return fmt.Errorf("the swap can be refunded in %d blocks, it should be between %d and %d", blocks, swapMinTimeout, swapMaxTimeout)
+	}
+
+	return nil
+}
+
+// swapScript builds the lockup script of a swap. The provider claims with the preimage of the
+// payment hash, which it learns by paying the invoice. We refund after the timeout:
+//
+//	OP_HASH160 <RIPEMD160(payment hash)> OP_EQUAL
+//	OP_IF <claim key>
+//	OP_ELSE <timeout> OP_CHECKLOCKTIMEVERIFY OP_DROP <refund key>
+//	OP_ENDIF OP_CHECKSIG
+func swapScript(paymentHash []byte, claimKey, refundKey *btcec.PublicKey, timeout int) ([]byte, error) {
+	hasher := ripemd160.New()
+	hasher.Write(paymentHash)
+
+	return txscript.NewScriptBuilder().
+		AddOp(txscript.OP_HASH160).
+		AddData(hasher.Sum(nil)).
+		AddOp(txscript.OP_EQUAL).
+		AddOp(txscript.OP_IF).
+		AddData(claimKey.SerializeCompressed()).
+		AddOp(txscript.OP_ELSE).
+		AddInt64(int64(timeout)).
+		AddOp(txscript.OP_CHECKLOCKTIMEVERIFY).
+		AddOp(txscript.OP_DROP).
+		AddData(refundKey.SerializeCompressed()).
+		AddOp(txscript.OP_ENDIF).
+		AddOp(txscript.OP_CHECKSIG).
+		Script()
+}
+
+// swapAddress returns the native segwit address of a lockup script.
+func swapAddress(script []byte) (*btcutil.AddressWitnessScriptHash, error) {
+	hash := sha256.Sum256(script)
+	return btcutil.NewAddressWitnessScriptHash(hash[:], &chainParams)
+}
+
+// swapAddressPlaceholder stands in for the lockup address, which has the same size, until the swap
+// is arranged. We need the amount to send, after the fee, to ask for the invoice.
+func swapAddressPlaceholder() btcutil.Address {
+	address, err := swapAddress(nil)
+	if err != nil {
+		panic(err) // a hash always makes a valid address
+	}
+
+	return address
+}
+
+// describe tells the user where the funds go, for the confirmation.
+func (s *submarineSwap) describe() string {
+	return fmt.Sprintf("Lightning invoice for %d sats, through %s (%d sats fee), locked in %s", s.InvoiceAmount, s.Provider, s.ExpectedAmount-s.InvoiceAmount, s.Address)
+}
+
+// lockup returns the address and script of the swap, checking the file wasn't corrupted.
+func (s *submarineSwap) lockup() (*btcutil.AddressWitnessScriptHash, []byte, error) {
+	script, err := hex.DecodeString(s.RedeemScript)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid lockup script in swap file: %w", err)
+	}
+
+	address, err := swapAddress(script)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if address.EncodeAddress() != s.Address {
+		return nil, nil, fmt.Errorf("the lockup address in the swap file doesn't match its script")
+	}
+
+	return address, script, nil
+}
+
+// isSwapLockup tells whether an address is the lockup of the swap saved to the --swap-file. Without
+// the file there's no telling, lockups look like any other script hash.
+func isSwapLockup(address string) bool {
+	swap, err := loadSwap(*swapFile)
+	if err != nil {
+		return false
+	}
+
+	lockup, _, err := swap.lockup()
+	return err == nil && lockup.EncodeAddress() == address
+}
+
+func (s *submarineSwap) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode swap: %w", err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save swap: %w", err)
+	}
+
+	return nil
+}
+
+// keepPreviousSwap moves the swap saved at a path, if any, next to it, named after when it was
+// arranged (the ID comes from the provider, it's not safe in a path).
+func keepPreviousSwap(path string) error {
+	previous, err := loadSwap(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	kept := path + "." + previous.CreatedAt.Format("20060102T150405Z")
+	if err := os.Rename(path, kept); err != nil {
+		return fmt.Errorf("failed to keep the previous swap: %w", err)
+	}
+
+	say("The previous swap {white %s} was kept in {white %s}\n", previous.ID, kept)
+
+	return nil
+}
+
+func loadSwap(path string) (*submarineSwap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var swap submarineSwap
+	if err := json.Unmarshal(data, &swap); err != nil {
+		return nil, fmt.Errorf("failed to parse swap in %s: %w", path, err)
+	}
+
+	if swap.Version != swapFileVersion {
+		return nil, fmt.Errorf("unsupported swap version %d in %s", swap.Version, path)
+	}
+
+	return &swap, nil
+}
+
+// swapPaid and swapFailed tell apart the final statuses of a swap, in the provider's words.
+func swapPaid(status string) bool {
+	return status == "invoice.paid" || status == "transaction.claimed"
+}
+
+func swapFailed(status string) bool {
+	return status == "invoice.failedToPay" || status == "transaction.lockupFailed" || status == "swap.expired"
+}
+
+// followSwap reports the progress of the swap after sending, until the invoice is paid or the
+// swap fails, for a while. Failing to reach the provider is not a reason to stop.
+func followSwap(swap *submarineSwap) {
+	provider, err := newSwapProvider(swap.Provider)
+	if err != nil {
+		return
+	}
+
+	sayBlock(`
+		The provider pays the invoice once it sees the transaction. Waiting for it (you can stop
+		the Recovery Tool, the swap goes on without it)...
+	`)
+
+	var last string
+	deadline := time.Now().Add(swapWaitLimit)
+
+	for time.Now().Before(deadline) {
+		status, err := provider.status(swap.ID)
+
+		if err == nil && status != last {
+			say("► Swap status: %s\n", status)
+			last = status
+		}
+
+		if swapPaid(status) {
+			say("{green ✓} The invoice was paid\n")
+			recordCaseEvent(swap.caseTag, "swap-paid", "Swap %s paid the invoice", swap.ID)
+			return
+		}
+
+		if swapFailed(status) {
+			sayBlock(`
+				{yellow The swap failed}. Your funds can be refunded after block %d, by running:
+				  recovery-tool swap-refund %s
+			`, swap.TimeoutBlockHeight, *swapFile)
+
+			recordCaseEvent(swap.caseTag, "swap-failed", "Swap %s failed: %s", swap.ID, status)
+			return
+		}
+
+		time.Sleep(swapPollInterval)
+	}
+
+	sayBlock(`
+		The invoice wasn't paid yet. If it isn't, your funds can be refunded after block %d, by running:
+		  recovery-tool swap-refund %s
+	`, swap.TimeoutBlockHeight, *swapFile)
+}
+
+// runSwapRefundCommand sends the funds locked in a failed swap to an address, once its timeout
+// has passed.
+func runSwapRefundCommand(args []string) {
+	flags := flag.NewFlagSet("swap-refund", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	say(`
+		{blue Muun Recovery Tool v%s}
+
+		Refunding a Lightning swap.
+	`, version)
+
+	swap, err := loadSwap(flags.Arg(0))
+	if err != nil {
+		exitWithError(err)
+	}
+
+	address, script, err := swap.lockup()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	// The provider's word is not needed, but it can spare us from refunding a paid swap:
+	if provider, err := newSwapProvider(swap.Provider); err == nil {
+		if status, err := provider.status(swap.ID); err == nil && swapPaid(status) {
+			sayBlock("The invoice of swap %s was paid, there's nothing to refund\n\n", swap.ID)
+			return
+		}
+	}
+
+	servers := preferredServers(nil)
+
+	lockupScript, err := payto.Script(address)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	utxo, err := findLargestUtxo(servers, lockupScript)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if utxo == nil {
+		sayBlock("No funds are locked in %s. They were claimed or refunded already\n\n", swap.Address)
+		return
+	}
+
+	tipScanner := scanner.NewScannerWithServers(servers)
+	if backend := newChainBackend(); backend != nil {
+		tipScanner = scanner.NewScannerWithBackend(backend)
+	}
+
+	tip, err := tipScanner.GetTipHeight()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	// The refund is valid once the block after the timeout can include it:
+	if blocks := swap.TimeoutBlockHeight - tip; blocks > 0 {
+		sayBlock(`
+			The %d sats locked in the swap can be refunded after block %d, %d blocks from now (%s).
+			Please, try again then.
+
+		`, utxo.Amount, swap.TimeoutBlockHeight, blocks, describeBlocks(blocks))
+		return
+	}
+
+	wif, err := btcutil.DecodeWIF(swap.RefundKey)
+	if err != nil {
+		exitWithError(fmt.Errorf("invalid refund key in swap file: %w", err))
+	}
+
+	destination := readAddress()
+
+	unsignedTx, err := buildSwapRefundTx(utxo, swap.TimeoutBlockHeight, destination, 0)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	// Size it with a placeholder signature, the largest DER one:
+	unsignedTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 73), {}, script}
+	fee := readFee(utxo.Amount, virtualSize(unsignedTx), dustThresholdForAddress(destination))
+
+	refundTx, err := buildSwapRefundTx(utxo, swap.TimeoutBlockHeight, destination, fee)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	signature, err := txscript.RawTxInWitnessSignature(
+		refundTx, txscript.NewTxSigHashes(refundTx), 0, int64(utxo.Amount), script, txscript.SigHashAll, wif.PrivKey,
+	)
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to sign the refund: %w", err))
+	}
+
+	// An empty preimage doesn't match the payment hash, which takes us to the refund branch:
+	refundTx.TxIn[0].Witness = wire.TxWitness{signature, {}, script}
+
+	if err := validateTx(refundTx, []*scanner.Utxo{utxo}); err != nil {
+		exitWithError(err)
+	}
+
+	transports, err := parseBroadcastTransports(*broadcastVia)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	readConfirmation(sats.Amount(refundTx.TxOut[0].Value), fee, destination.String(), "")
+
+	sayBlock("Sending transaction...")
+
+	if err := broadcastWithFallback(refundTx, transports); err != nil {
+		exitWithError(err)
+	}
+
+	recordCaseEvent(swap.caseTag, "swap-refund", "Refunded swap %s to %s in transaction %s", swap.ID, destination, refundTx.TxHash())
+
+	sayBlock(`
+		Refund sent! You can check the status here: https://blockstream.info/tx/%v
+
+	`, refundTx.TxHash())
+}
+
+// buildSwapRefundTx builds the transaction refunding a swap, locked at its timeout, unsigned.
+func buildSwapRefundTx(utxo *scanner.Utxo, timeout int, destination btcutil.Address, fee sats.Amount) (*wire.MsgTx, error) {
+	chainHash, err := chainhash.NewHashFromStr(utxo.TxID)
+	if err != nil {
+		return nil, err
+	}
+
+	script, err := payto.Script(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := utxo.Amount.Sub(fee)
+	if err != nil || value < dustThresholdFor(script) {
+		return nil, utils.WrapError(
+			utils.ErrInsufficientFunds,
+			fmt.Errorf("the %d sats to refund can't pay a %d sats fee and leave more than the dust threshold", utxo.Amount, fee),
+		)
+	}
+
+	tx := wire.NewMsgTx(2)
+	tx.LockTime = uint32(timeout)
+
+	// The lock time is only enforced for inputs that don't have the final sequence number:
+	txIn := wire.NewTxIn(&wire.OutPoint{Hash: *chainHash, Index: uint32(utxo.OutputIndex)}, nil, nil)
+	txIn.Sequence = wire.MaxTxInSequenceNum - 1
+
+	tx.AddTxIn(txIn)
+	tx.AddTxOut(wire.NewTxOut(int64(value), script))
+
+	return tx, nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/libwallet/btcsuitew/btcutilw"
+	"github.com/muun/recovery/payto"
+)
+
+// With --liquid, the funds are sent to the Liquid sidechain through a peg-in: a payment to an
+// address of the federation, which the user's Liquid wallet claims as L-BTC. The claim needs the
+// claim script the wallet made for it, the transaction and a proof it was mined, so we save all of
+// it to the --pegin-file.
+//
+// The peg-in address is the federation script, with its keys tweaked by the claim script (see
+// peginScript). Given the federation script (`getsidechaininfo` in Elements) we build it ourselves.
+// Otherwise, we send to the address the Liquid wallet gave along with the claim script.
+
+// peginFileVersion is the version of the peg-in file format.
+const peginFileVersion = 1
+
+// peginConfirmations is how deep in the chain the peg-in must be before Liquid accepts the claim.
+const peginConfirmations = 102
+
+// peginClaim is everything needed to claim a peg-in on Liquid. The transaction is added once sent.
+type peginClaim struct {
+	Version int `json:"version"`
+	caseTag
+	CreatedAt    time.Time `json:"createdAt"`
+	PeginAddress string    `json:"peginAddress"`
+	ClaimScript  string    `json:"claimScript"`            // hex
+	FedpegScript string    `json:"fedpegScript,omitempty"` // hex, when we built the address
+	TxID         string    `json:"txId,omitempty"`
+	TxHex        string    `json:"txHex,omitempty"`
+	ProofURL     string    `json:"proofUrl,omitempty"` // where to get the txoutproof, once mined
+}
+
+// checkLiquidOptions fails early when --liquid is combined with options it can't work with, or the
+// federation script is invalid.
+func checkLiquidOptions() {
+	if !*liquid {
+		if *fedpegScriptHex != "" {
+			exitWithError(fmt.Errorf("--fedpeg-script is only used with --liquid"))
+		}
+
+		return
+	}
+
+	conflicts := []struct {
+		option string
+		set    bool
+	}{
+		{"--lightning", *lightning},
+		{"--test-sweep", *testSweep > 0},
+		{"--migrate", *migrate},
+		{"--export-chunks", *exportChunks != ""},
+	}
+
+	for _, conflict := range conflicts {
+		if conflict.set {
+			exitWithError(fmt.Errorf("--liquid can't be combined with %s", conflict.option))
+		}
+	}
+
+	if *fedpegScriptHex != "" {
+		if _, err := hex.DecodeString(*fedpegScriptHex); err != nil {
+			exitWithError(fmt.Errorf("invalid --fedpeg-script: %w", err))
+		}
+	}
+}
+
+// readPegin asks for the claim script of the Liquid wallet, and builds or asks for the peg-in
+// address. The claim data is saved before returning the address to send to.
+func readPegin() btcutil.Address {
+	claimScript := readClaimScript()
+
+	claim := &peginClaim{
+		Version:     peginFileVersion,
+		caseTag:     currentTag(),
+		CreatedAt:   time.Now().UTC(),
+		ClaimScript: hex.EncodeToString(claimScript),
+	}
+
+	var address btcutil.Address
+
+	if *fedpegScriptHex != "" {
+		fedpegScript, _ := hex.DecodeString(*fedpegScriptHex) // checked in checkLiquidOptions
+
+		script, err := peginScript(fedpegScript, claimScript)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		address, err = peginAddress(script)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		claim.FedpegScript = *fedpegScriptHex
+
+		sayBlock(`
+			{green ✓} Peg-in address built from the federation script and your claim script:
+			  %s
+		`, address.EncodeAddress())
+	} else {
+		address = readPeginAddress()
+	}
+
+	claim.PeginAddress = address.EncodeAddress()
+
+	if err := claim.save(*peginFile); err != nil {
+		exitWithError(err)
+	}
+
+	say(`
+		The claim script was saved to {white %s}. You'll need it to claim your L-BTC.
+	`, *peginFile)
+
+	return address
+}
+
+func readClaimScript() []byte {
+	sayBlock(`
+		{yellow Enter the claim script of your Liquid wallet}
+		Elements gives it with the peg-in address, when you run 'getpeginaddress'.
+	`)
+
+	var userInput string
+	ask(&userInput)
+
+	script, err := hex.DecodeString(strings.TrimSpace(userInput))
+	class := txscript.GetScriptClass(script)
+
+	if err != nil || len(script) == 0 || class == txscript.NonStandardTy || class == txscript.NullDataTy {
+		say(`
+			This is not a valid claim script
+			Please, try again
+		`)
+
+		return readClaimScript()
+	}
+
+	return script
+}
+
+func readPeginAddress() btcutil.Address {
+	sayBlock(`
+		{yellow Enter the peg-in address your Liquid wallet gave with the claim script}
+		Without the federation script (see --fedpeg-script), it can't be checked. Make sure they
+		come from the same 'getpeginaddress', or the funds can't be claimed.
+	`)
+
+	var userInput string
+	ask(&userInput)
+
+	addr, err := btcutilw.DecodeAddress(strings.TrimSpace(userInput), &chainParams)
+	if err != nil || !addr.IsForNet(&chainParams) {
+		say(`
+			This is not a valid bitcoin address
+			Please, try again
+		`)
+
+		return readPeginAddress()
+	}
+
+	if _, err := payto.Script(addr); err != nil {
+		say(`
+			The Recovery Tool can't send to this type of address yet
+			Please, try another one
+		`)
+
+		return readPeginAddress()
+	}
+
+	return addr
+}
+
+// peginScript tweaks the keys of the federation script with the claim script, the way Elements
+// does: each key P becomes P + HMAC-SHA256(P, claim script)·G. In Liquid's script, the emergency
+// keys after OP_ELSE are left as they are.
+func peginScript(fedpegScript, claimScript []byte) ([]byte, error) {
+	script := append([]byte{}, fedpegScript...)
+
+	for pos := 0; pos < len(script); {
+		opcode := script[pos]
+		pos++
+
+		if opcode == txscript.OP_ELSE {
+			break
+		}
+
+		var size int
+
+		switch {
+		case opcode >= txscript.OP_DATA_1 && opcode <= txscript.OP_DATA_75:
+			size = int(opcode)
+
+		case opcode == txscript.OP_PUSHDATA1 && pos+1 <= len(script):
+			size = int(script[pos])
+			pos++
+
+		case opcode == txscript.OP_PUSHDATA2 && pos+2 <= len(script):
+			size = int(binary.LittleEndian.Uint16(script[pos:]))
+			pos += 2
+
+		case opcode == txscript.OP_PUSHDATA4 && pos+4 <= len(script):
+			size = int(binary.LittleEndian.Uint32(script[pos:]))
+			pos += 4
+
+		case opcode >= txscript.OP_PUSHDATA1 && opcode <= txscript.OP_PUSHDATA4:
+			return nil, fmt.Errorf("invalid federation script: truncated push")
+		}
+
+		if size < 0 || pos+size > len(script) {
+			return nil, fmt.Errorf("invalid federation script: truncated push")
+		}
+
+		if size == btcec.PubKeyBytesLenCompressed {
+			if err := tweakPeginKey(script[pos:pos+size], claimScript); err != nil {
+				return nil, err
+			}
+		}
+
+		pos += size
+	}
+
+	return script, nil
+}
+
+// tweakPeginKey replaces a compressed public key with its tweaked version, in place.
+func tweakPeginKey(key []byte, claimScript []byte) error {
+	curve := btcec.S256()
+
+	pubKey, err := btcec.ParsePubKey(key, curve)
+	if err != nil {
+		return fmt.Errorf("invalid key in federation script: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(claimScript)
+	tweak := mac.Sum(nil)
+
+	if new(big.Int).SetBytes(tweak).Cmp(curve.N) >= 0 {
+		return fmt.Errorf("the claim script can't tweak the federation key %x", key)
+	}
+
+	x, y := curve.ScalarBaseMult(tweak)
+	x, y = curve.Add(pubKey.X, pubKey.Y, x, y)
+
+	if x.Sign() == 0 && y.Sign() == 0 {
+		return fmt.Errorf("the claim script can't tweak the federation key %x", key)
+	}
+
+	copy(key, (&btcec.PublicKey{Curve: curve, X: x, Y: y}).SerializeCompressed())
+
+	return nil
+}
+
+// peginAddress returns the peg-in address of a tweaked federation script. Liquid's federation uses
+// segwit nested in P2SH.
+func peginAddress(script []byte) (*btcutil.AddressScriptHash, error) {
+	hash := sha256.Sum256(script)
+
+	witnessProgram, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(hash[:]).Script()
+	if err != nil {
+		return nil, err
+	}
+
+	return btcutil.NewAddressScriptHash(witnessProgram, &chainParams)
+}
+
+// completePegin adds the sent transaction to the peg-in file, and explains how to claim it.
+func completePegin(tx *wire.MsgTx) {
+	claim, err := loadPeginClaim(*peginFile)
+	if err != nil {
+		sayBlock("{yellow Couldn't update the peg-in file}: %v\n", err)
+		return
+	}
+
+	txHex, err := encodeTxHex(tx)
+	if err != nil {
+		sayBlock("{yellow Couldn't update the peg-in file}: %v\n", err)
+		return
+	}
+
+	claim.TxID = tx.TxHash().String()
+	claim.TxHex = txHex
+	claim.ProofURL = fmt.Sprintf("https://blockstream.info/api/tx/%s/merkleblock-proof", claim.TxID)
+
+	if err := claim.save(*peginFile); err != nil {
+		sayBlock("{yellow Couldn't update the peg-in file}: %v\n", err)
+		return
+	}
+
+	recordCaseEvent(claim.caseTag, "pegin", "Sent peg-in %s to %s, claim data in %s", claim.TxID, claim.PeginAddress, *peginFile)
+
+	sayBlock(`
+		To get your L-BTC, claim the peg-in once it has %d confirmations (about 17 hours). Its
+		claim script and transaction are in {white %s}. The proof it was mined comes from
+		'bitcoin-cli gettxoutproof', or from:
+		  %s
+		Then, in your Liquid wallet:
+		  elements-cli claimpegin <txHex> <proof> <claimScript>
+	`, peginConfirmations, *peginFile, claim.ProofURL)
+}
+
+func (c *peginClaim) save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode peg-in: %w", err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save peg-in: %w", err)
+	}
+
+	return nil
+}
+
+func loadPeginClaim(path string) (*peginClaim, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var claim peginClaim
+	if err := json.Unmarshal(data, &claim); err != nil {
+		return nil, fmt.Errorf("failed to parse peg-in in %s: %w", path, err)
+	}
+
+	if claim.Version != peginFileVersion {
+		return nil, fmt.Errorf("unsupported peg-in version %d in %s", claim.Version, path)
+	}
+
+	return &claim, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/muun/recovery/utils"
+)
+
+// Some users recover over metered or satellite connections, where every megabyte costs money or
+// minutes. With --low-bandwidth, the tool transfers as little as it can:
+//
+//   - Batches are smaller and connections fewer (see scanner.Scanner.LimitBandwidth). A batch that
+//     fails is sent again in full, and each connection costs a handshake.
+//   - The scan keeps a checkpoint in the user's cache even without --state-file or --db, so that a
+//     dropped connection doesn't mean scanning everything again.
+//   - The history of the addresses with funds isn't downloaded for the privacy analysis, which
+//     stays partial.
+//   - Forensic mode, which scans everything twice, is refused.
+//
+// Downloaded transactions are cached as always. The poisoning check still fetches the funding
+// transactions of the outputs to send, as it protects the funds, but those are few.
+//
+// There's no compression to ask Electrum servers for. Answers over HTTP (Esplora, the swap
+// provider) are already compressed, as Go asks for gzip on its own.
+//
+// Everything sent and received is counted, TLS included, and reported at the end.
+
+// startTransferCount counts the bytes transferred, with --low-bandwidth. Electrum connections are
+// always counted, HTTP ones only from here on.
+func startTransferCount() {
+	if !*lowBandwidth {
+		return
+	}
+
+	utils.CountHTTPTransfers()
+}
+
+// checkLowBandwidthOptions fails early on options that transfer too much for --low-bandwidth.
+func checkLowBandwidthOptions() {
+	if !*lowBandwidth {
+		return
+	}
+
+	if *scanMode == scanModeForensic {
+		exitWithError(fmt.Errorf("forensic mode scans everything twice, it can't be combined with --low-bandwidth"))
+	}
+}
+
+// lowBandwidthCheckpointPath returns where to keep the scan checkpoint of the wallet with
+// --low-bandwidth, when no --state-file was given.
+func lowBandwidthCheckpointPath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find a place for the scan checkpoint: %w", err)
+	}
+
+	dir := filepath.Join(cacheDir, "muun-recovery")
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create %s for the scan checkpoint: %w", dir, err)
+	}
+
+	return filepath.Join(dir, "scan-"+walletID+".jsonl"), nil
+}
+
+// printTransferReport shows how much was transferred, with --low-bandwidth.
+func printTransferReport() {
+	if !*lowBandwidth {
+		return
+	}
+
+	sent, received := utils.TransferredBytes()
+
+	emitEvent("transfer", struct {
+		Sent     int64 `json:"sent"`
+		Received int64 `json:"received"`
+	}{sent, received})
+
+	sayBlock(`
+		{whiteUnderline Data transferred}
+		  {white Sent}: %s
+		  {white Received}: %s
+		  {white Total}: %s
+
+	`, formatBytes(sent), formatBytes(received), formatBytes(sent+received))
+}
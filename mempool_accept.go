@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/scanner"
+)
+
+// Users running their own Bitcoin Core node can have it check the transaction before we send it,
+// with --bitcoind. testmempoolaccept runs every check the node would run on a transaction it's
+// relayed (scripts, fees, standardness, conflicts), without adding it to the mempool. If the node
+// would reject it, we stop and show why, instead of finding out from a failed broadcast.
+
+// mempoolRejection is a transaction the node wouldn't accept, with the reason it gave.
+type mempoolRejection struct {
+	TxID   string
+	Reason string
+}
+
+func (r *mempoolRejection) Error() string {
+	return fmt.Sprintf(
+		"transaction %s wasn't sent, your node would reject it: %s\n%s",
+		r.TxID, r.Reason, explainRejectReason(r.Reason),
+	)
+}
+
+// checkMempoolAcceptance asks the node configured with --bitcoind whether it would accept the
+// transaction. Without a node, there's nothing to check. If the node can't be reached we carry on,
+// since the servers we send the transaction to run the same checks.
+func checkMempoolAcceptance(tx *wire.MsgTx) error {
+	if *bitcoindURL == "" {
+		return nil
+	}
+
+	txHex, err := encodeTxHex(tx)
+	if err != nil {
+		return err
+	}
+
+	var results []struct {
+		TxID         string `json:"txid"`
+		Allowed      bool   `json:"allowed"`
+		RejectReason string `json:"reject-reason"`
+	}
+
+	node, err := scanner.NewBitcoindBackend(*bitcoindURL)
+	if err != nil {
+		return err
+	}
+
+	if err := node.Call("testmempoolaccept", []interface{}{[]string{txHex}}, &results); err != nil {
+		say("{yellow !} Couldn't check the transaction with your node: %v\n", err)
+		return nil
+	}
+
+	if len(results) != 1 {
+		say("{yellow !} Couldn't check the transaction with your node: unexpected response\n")
+		return nil
+	}
+
+	result := results[0]
+
+	// A transaction the node already has was sent before, sending it again does no harm:
+	if !result.Allowed && !isAlreadyKnown(result.RejectReason) {
+		return &mempoolRejection{TxID: tx.TxHash().String(), Reason: result.RejectReason}
+	}
+
+	say("{green ✓} Your node would accept transaction %s\n", tx.TxHash())
+
+	return nil
+}
+
+// isAlreadyKnown tells whether a reject reason means the node has the transaction already.
+func isAlreadyKnown(reason string) bool {
+	return strings.Contains(reason, "txn-already-in-mempool") || strings.Contains(reason, "txn-already-known")
+}
+
+// rejectReasons explains the reasons Bitcoin Core gives most often, which are terse. They're
+// matched by prefix, older versions put the reject code first (such as "66: min relay fee not met")
+// and details after.
+var rejectReasons = []struct {
+	prefix      string
+	explanation string
+}{
+	{"missing-inputs", "The funds it spends don't exist, or were spent already. If your node is still syncing, wait until it's done and try again."},
+	{"bad-txns-inputs-missingorspent", "The funds it spends were spent already, by a transaction that's been mined."},
+	{"txn-mempool-conflict", "Another transaction waiting to be mined spends the same funds. It has to be mined or dropped first."},
+	{"insufficient fee", "It replaces a transaction waiting to be mined, and has to pay a higher fee than that one to do so."},
+	{"min relay fee not met", "The fee is below the minimum nodes relay. Try again with a higher fee."},
+	{"mempool min fee not met", "The fee is below what your node accepts while its mempool is full. Try again with a higher fee."},
+	{"max-fee-exceeded", "The fee is above what your node allows by default (see -maxtxfee). Check the fee is what you meant."},
+	{"absurdly-high-fee", "The fee is above what your node allows by default (see -maxtxfee). Check the fee is what you meant."},
+	{"dust", "An output is too small for nodes to relay it, it'd cost more to spend than it's worth."},
+	{"bad-txns-in-belowout", "It sends more than the funds it spends."},
+	{"non-final", "It can't be mined yet, its lock time hasn't been reached. Try again later."},
+	{"non-BIP68-final", "It spends funds that can't be moved yet, their relative lock time hasn't passed. Try again later."},
+	{"mandatory-script-verify-flag-failed", "A signature or script is invalid, the funds can't be spent this way. Try again with --debug-scripts to see which."},
+	{"non-mandatory-script-verify-flag", "A signature or script doesn't follow the rules nodes relay, though it may be valid in a block. Try again with --debug-scripts to see which."},
+	{"too-long-mempool-chain", "It spends funds from a chain of too many transactions waiting to be mined. Wait for some of them to be mined and try again."},
+	{"tx-size", "It's too large for nodes to relay it. Send the funds in several transactions."},
+	{"bad-txns-too-many-sigops", "It has too many signature checks for nodes to relay it. Send the funds in several transactions."},
+	{"scriptpubkey", "An output pays to a script nodes don't relay."},
+	{"scriptsig-not-pushonly", "An input has a script nodes don't relay."},
+	{"bad-txns-nonstandard-inputs", "An input spends funds in a way nodes don't relay."},
+	{"version", "Its version is one nodes don't relay."},
+}
+
+// explainRejectReason turns the reason a node gives to reject a transaction into plain words.
+func explainRejectReason(reason string) string {
+	// Drop the reject code, if there's one:
+	if i := strings.Index(reason, ": "); i >= 0 && strings.Trim(reason[:i], "0123456789") == "" {
+		reason = reason[i+2:]
+	}
+
+	for _, known := range rejectReasons {
+		if strings.HasPrefix(reason, known.prefix) {
+			return known.explanation
+		}
+	}
+
+	return "Your node didn't say more. Its debug.log may have the details."
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/muun/recovery/descriptors"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/scanner"
+)
+
+// migrationTarget is a wallet the user can import their Muun wallet into.
+type migrationTarget struct {
+	name         string
+	instructions string
+}
+
+// Muun scripts list the keys in a fixed order (user first) instead of sorting them, so only wallets
+// that support plain `multi()` descriptors can derive the same addresses. Electrum always sorts
+// multisig keys, and can't be used.
+var migrationTargets = []migrationTarget{
+	{
+		name: "Bitcoin Core",
+		instructions: `
+			Create a new descriptor wallet (without private keys disabled), and import each descriptor
+			in the {white Console} window with:
+
+			  importdescriptors '[{"desc": "DESCRIPTOR", "timestamp": 0, "active": false}]'
+
+			Then list the first address of each descriptor with:
+
+			  deriveaddresses "DESCRIPTOR" "[0,0]"
+		`,
+	},
+	{
+		name: "Sparrow",
+		instructions: `
+			Choose {white File → New Wallet}, then {white Import → Output Descriptor}, and paste one
+			descriptor. Repeat for each descriptor, in a separate wallet. Sparrow shows the first
+			address in the {white Addresses} tab.
+		`,
+	},
+}
+
+// migrationBranch is the branch of external addresses, whose first address we compare against.
+const migrationBranch = "1"
+
+// migrationVersions describes how each address version maps to a descriptor, given the user and
+// Muun keys.
+var migrationVersions = []struct {
+	version int
+	format  string
+}{
+	{1, "pkh(%[1]s)"}, // single-key, without the Muun key
+	{2, "sh(multi(2,%s,%s))"},
+	{3, "sh(wsh(multi(2,%s,%s)))"},
+	{4, "wsh(multi(2,%s,%s))"},
+}
+
+// runMigrationAssistant helps the user import their wallet into another one instead of sweeping the
+// funds, verifying that the target wallet derives the same addresses. It returns whether the user
+// chose to skip the sweep.
+func runMigrationAssistant(generations []*keyGeneration, utxos []*scanner.Utxo) bool {
+	sayBlock(`
+		{whiteUnderline Migrating your wallet}
+		Instead of sending your funds to a new address, you can import your wallet into another one.
+	`)
+
+	if len(generations) > 1 {
+		sayBlock(`
+			{yellow Your funds are under several Emergency Kits}, and we can only migrate one. You'll
+			need to send them to a new address.
+		`)
+
+		return false
+	}
+
+	hasTaprootFunds, hasSingleKeyFunds := false, false
+	for _, utxo := range utxos {
+		switch utxo.Address.Version() {
+		case 5:
+			hasTaprootFunds = true
+		case 1:
+			hasSingleKeyFunds = true
+		}
+	}
+
+	if hasTaprootFunds {
+		sayBlock(`
+			{yellow Some of your funds are in taproot addresses}, which other wallets can't import
+			yet. You'll need to send them to a new address.
+		`)
+
+		return false
+	}
+
+	target := readMigrationTarget()
+
+	descriptors, err := migrationDescriptors(generations[0].UserKey, generations[0].MuunKey)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	sayBlock(`
+		{red These descriptors contain your private keys.} Anyone who sees them can take your funds.
+		Don't share them, save them or take screenshots.
+	`)
+
+	sayBlock(target.instructions)
+
+	for _, descriptor := range descriptors {
+		if descriptor.version == 1 && !hasSingleKeyFunds {
+			continue // only the earliest wallets have funds there, don't make everyone import it
+		}
+
+		sayBlock("{whiteUnderline Version %d descriptor}\n", descriptor.version)
+		fmt.Fprintln(userOutput, descriptor.text)
+
+		if !verifyMigratedAddress(target, descriptor.firstAddress) {
+			sayBlock(`
+				{red The address doesn't match.} %s is not deriving the same addresses, so it can't see
+				your funds. Let's send them to a new address instead.
+			`, target.name)
+
+			return false
+		}
+
+		say("{green ✓ Address verified}\n")
+	}
+
+	sayBlock(`
+		{green ✓ %s derives the same addresses as your Muun wallet}
+		Your funds can be spent from there. You can still send them to a new address, if you want.
+	`, target.name)
+
+	return readYesNo("Skip sending the funds?")
+}
+
+type migrationDescriptor struct {
+	version      int
+	text         string
+	firstAddress string
+}
+
+// migrationDescriptors returns the descriptors for the external addresses of each version, with
+// the private keys and a checksum, along with the address at index 0.
+func migrationDescriptors(userKey, muunKey keys.PrivateKey) ([]migrationDescriptor, error) {
+	derivedUserKey, err := userKey.DeriveTo(keys.KitKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive user key: %w", err)
+	}
+
+	derivedMuunKey, err := muunKey.DeriveTo(keys.KitKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive muun key: %w", err)
+	}
+
+	firstPath := keys.KitKeyPath + "/" + migrationBranch + "/0"
+
+	firstUserKey, err := derivedUserKey.DeriveTo(firstPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive user key: %w", err)
+	}
+
+	firstMuunKey, err := derivedMuunKey.DeriveTo(firstPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive muun key: %w", err)
+	}
+
+	var migrated []migrationDescriptor
+
+	for _, v := range migrationVersions {
+		addr, err := keyBackend.CreateAddress(v.version, firstUserKey.PublicKey(), firstMuunKey.PublicKey())
+		if err != nil {
+			return nil, err
+		}
+
+		text := fmt.Sprintf(
+			v.format,
+			derivedUserKey.String()+"/"+migrationBranch+"/*",
+			derivedMuunKey.String()+"/"+migrationBranch+"/*",
+		)
+
+		migrated = append(migrated, migrationDescriptor{
+			version:      v.version,
+			text:         text + "#" + descriptors.Checksum(text),
+			firstAddress: addr.Address(),
+		})
+	}
+
+	return migrated, nil
+}
+
+func readMigrationTarget() migrationTarget {
+	sayBlock(`
+		{yellow Which wallet are you importing into?}
+	`)
+
+	for i, target := range migrationTargets {
+		say("  %d. %s\n", i+1, target.name)
+	}
+
+	var userInput string
+	ask(&userInput)
+
+	for i, target := range migrationTargets {
+		if userInput == fmt.Sprint(i+1) {
+			return target
+		}
+	}
+
+	say(`
+		Please, enter the number of a wallet from the list
+		(other wallets, such as Electrum, can't derive Muun addresses)
+	`)
+
+	return readMigrationTarget()
+}
+
+func verifyMigratedAddress(target migrationTarget, expected string) bool {
+	sayBlock(`
+		{yellow Enter the first address %s shows for this descriptor}
+	`, target.name)
+
+	var userInput string
+	ask(&userInput)
+
+	return strings.TrimSpace(userInput) == expected
+}
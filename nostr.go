@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/websocket"
+	"github.com/muun/recovery/utils"
+)
+
+// nostrTxKind is the event kind we publish transactions with. There's no finalized NIP for
+// transaction broadcast yet: we use an ephemeral kind (relays forward it to subscribers without
+// storing it), which bridges watching relays for it can pick up and send to the Bitcoin network.
+const nostrTxKind = 28333
+
+// nostrRelayTimeout bounds the time we wait for each relay to connect and acknowledge our event.
+const nostrRelayTimeout = 15 * time.Second
+
+// defaultNostrRelays are well-known public relays, used when no others are given.
+var defaultNostrRelays = []string{"wss://relay.damus.io", "wss://nos.lol", "wss://relay.nostr.band"}
+
+// nostrEvent is a signed event, as defined in NIP-01.
+type nostrEvent struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+// newNostrTxEvent creates an event with a raw transaction, signed with a throwaway key so it can't
+// be linked to anything else.
+func newNostrTxEvent(txHex string) (*nostrEvent, error) {
+	privateKey, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+
+	pubKeyX, _ := btcec.S256().ScalarBaseMult(scalarBytes(privateKey))
+
+	event := &nostrEvent{
+		PubKey:    hex.EncodeToString(scalarBytes(pubKeyX)),
+		CreatedAt: time.Now().Unix(),
+		Kind:      nostrTxKind,
+		Tags:      [][]string{{"t", "bitcoin-tx"}},
+		Content:   txHex,
+	}
+
+	// The ID is the hash of a canonical serialization of the event, defined in NIP-01:
+	serialized, err := marshalJSONNoEscape([]interface{}{0, event.PubKey, event.CreatedAt, event.Kind, event.Tags, event.Content})
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize event: %w", err)
+	}
+
+	id := sha256.Sum256(serialized)
+
+	sig, err := signSchnorr(privateKey, id)
+	if err != nil {
+		return nil, err
+	}
+
+	event.ID = hex.EncodeToString(id[:])
+	event.Sig = hex.EncodeToString(sig[:])
+
+	return event, nil
+}
+
+// publishNostrEvent sends an event to a relay, and waits for it to be accepted.
+func publishNostrEvent(relayURL string, event *nostrEvent) error {
+	if err := utils.CheckNetwork(); err != nil {
+		return err
+	}
+
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: nostrRelayTimeout,
+		NetDial: func(network, address string) (net.Conn, error) {
+			return utils.Dial(network, address, nostrRelayTimeout)
+		},
+	}
+
+	conn, _, err := dialer.Dial(relayURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", relayURL, err)
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(nostrRelayTimeout))
+	conn.SetReadDeadline(time.Now().Add(nostrRelayTimeout))
+
+	if err := conn.WriteJSON([]interface{}{"EVENT", event}); err != nil {
+		return fmt.Errorf("failed to send event to %s: %w", relayURL, err)
+	}
+
+	// Wait for ["OK", <id>, <accepted>, <message>], skipping anything else the relay sends:
+	for {
+		var message []json.RawMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			return fmt.Errorf("no response from %s: %w", relayURL, err)
+		}
+
+		var messageType, eventID string
+		if len(message) < 4 || json.Unmarshal(message[0], &messageType) != nil || messageType != "OK" {
+			continue
+		}
+
+		if json.Unmarshal(message[1], &eventID) != nil || eventID != event.ID {
+			continue
+		}
+
+		var accepted bool
+		var reason string
+		json.Unmarshal(message[2], &accepted)
+		json.Unmarshal(message[3], &reason)
+
+		if !accepted {
+			return fmt.Errorf("%s rejected the event: %s", relayURL, reason)
+		}
+
+		return nil
+	}
+}
+
+// signSchnorr creates a BIP-340 signature of a 32-byte message.
+func signSchnorr(privateKey *big.Int, message [32]byte) ([64]byte, error) {
+	var sig [64]byte
+	curve := btcec.S256()
+
+	d := new(big.Int).Set(privateKey)
+	pubKeyX, pubKeyY := curve.ScalarBaseMult(scalarBytes(d))
+
+	if pubKeyY.Bit(0) == 1 {
+		d.Sub(curve.N, d)
+	}
+
+	aux := make([]byte, 32)
+	if _, err := rand.Read(aux); err != nil {
+		return sig, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	t := scalarBytes(d)
+	auxHash := taggedHash("BIP0340/aux", aux)
+	for i := range t {
+		t[i] ^= auxHash[i]
+	}
+
+	k := new(big.Int).SetBytes(taggedHash("BIP0340/nonce", t, scalarBytes(pubKeyX), message[:]))
+	k.Mod(k, curve.N)
+
+	if k.Sign() == 0 {
+		return sig, fmt.Errorf("failed to generate nonce")
+	}
+
+	rX, rY := curve.ScalarBaseMult(scalarBytes(k))
+	if rY.Bit(0) == 1 {
+		k.Sub(curve.N, k)
+	}
+
+	e := new(big.Int).SetBytes(taggedHash("BIP0340/challenge", scalarBytes(rX), scalarBytes(pubKeyX), message[:]))
+	e.Mod(e, curve.N)
+
+	s := new(big.Int).Mul(e, d)
+	s.Add(s, k)
+	s.Mod(s, curve.N)
+
+	copy(sig[:32], scalarBytes(rX))
+	copy(sig[32:], scalarBytes(s))
+
+	return sig, nil
+}
+
+func taggedHash(tag string, data ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+
+	hash := sha256.New()
+	hash.Write(tagHash[:])
+	hash.Write(tagHash[:])
+
+	for _, d := range data {
+		hash.Write(d)
+	}
+
+	return hash.Sum(nil)
+}
+
+func randomScalar() (*big.Int, error) {
+	buf := make([]byte, 32)
+
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+
+		scalar := new(big.Int).SetBytes(buf)
+		if scalar.Sign() > 0 && scalar.Cmp(btcec.S256().N) < 0 {
+			return scalar, nil
+		}
+	}
+}
+
+// scalarBytes encodes a number as 32 big-endian bytes.
+func scalarBytes(n *big.Int) []byte {
+	buf := make([]byte, 32)
+	b := n.Bytes()
+	copy(buf[32-len(b):], b)
+
+	return buf
+}
+
+// marshalJSONNoEscape encodes JSON without escaping HTML characters, as required for signatures.
+func marshalJSONNoEscape(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/muun/recovery/utils"
+)
+
+// enterOfflineWindow makes sure this computer is disconnected before the keys are decrypted or
+// used to sign, if the user asked for it with --offline-window. It waits until no network
+// interface has an address, and then blocks outgoing connections from the Recovery Tool itself,
+// in case one comes back up.
+//
+// The window lasts until leaveOfflineWindow. Nothing that needs the network can happen in it.
+func enterOfflineWindow(purpose string) {
+	if !*offlineWindow {
+		return
+	}
+
+	for {
+		connected, err := connectedInterfaces()
+		if err != nil {
+			exitWithError(fmt.Errorf("couldn't check the network interfaces: %w", err))
+		}
+
+		if len(connected) == 0 {
+			break
+		}
+
+		sayBlock(`
+			{yellow This computer is still connected} through %s.
+			Disconnect it from all networks (unplug cables, turn off Wi-Fi) before %s.
+		`, strings.Join(connected, ", "), purpose)
+
+		if !readYesNo("Have you disconnected?") {
+			exitWithError(fmt.Errorf("the computer must be disconnected to continue with --offline-window"))
+		}
+	}
+
+	utils.BlockNetwork()
+
+	say("{green ✓} Offline: no network interfaces are connected, and the Recovery Tool won't connect anywhere\n\n")
+}
+
+// leaveOfflineWindow ends the window opened by enterOfflineWindow. If the next step needs the
+// network, it waits until the user reconnects.
+func leaveOfflineWindow(reconnect bool) {
+	if !*offlineWindow {
+		return
+	}
+
+	utils.AllowNetwork()
+
+	if !reconnect {
+		return
+	}
+
+	for {
+		sayBlock(`
+			{white Done offline}. You can reconnect this computer to the internet now.
+		`)
+
+		if !readYesNo("Have you reconnected?") {
+			exitWithError(fmt.Errorf("the Recovery Tool needs the internet to continue"))
+		}
+
+		connected, err := connectedInterfaces()
+		if err != nil || len(connected) > 0 {
+			return // if we can't tell, the next step will fail loudly on its own
+		}
+
+		say("{yellow !} No network interfaces are connected yet\n")
+	}
+}
+
+// connectedInterfaces returns the names of the network interfaces that are up and have an address
+// other than loopback or link-local, that is, those that may reach other computers.
+func connectedInterfaces() ([]string, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var connected []string
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				connected = append(connected, iface.Name)
+				break
+			}
+		}
+	}
+
+	return connected, nil
+}
@@ -0,0 +1,78 @@
+// Package payto builds the output scripts that pay to addresses.
+//
+// Each type of address has a builder, registered with Register. Supporting a new kind of
+// destination (such as a future witness version) is a matter of registering a builder for its
+// address type, without touching the code that builds transactions.
+package payto
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/libwallet/btcsuitew/btcutilw"
+)
+
+// Builder returns the output script that pays to an address.
+type Builder func(address btcutil.Address) ([]byte, error)
+
+var (
+	buildersMu sync.RWMutex
+	builders   = make(map[reflect.Type]Builder)
+)
+
+func init() {
+	// btcutil knows the scripts of its own address types:
+	Register((*btcutil.AddressPubKey)(nil), txscript.PayToAddrScript)
+	Register((*btcutil.AddressPubKeyHash)(nil), txscript.PayToAddrScript)
+	Register((*btcutil.AddressScriptHash)(nil), txscript.PayToAddrScript)
+	Register((*btcutil.AddressWitnessPubKeyHash)(nil), txscript.PayToAddrScript)
+	Register((*btcutil.AddressWitnessScriptHash)(nil), txscript.PayToAddrScript)
+
+	Register((*btcutilw.AddressTaprootKey)(nil), payToTaprootKey)
+}
+
+// Register sets the builder for a type of address, given as a value of that type (usually a nil
+// pointer). It panics if the type already has one: builders are registered once, on init.
+func Register(addressType btcutil.Address, builder Builder) {
+	buildersMu.Lock()
+	defer buildersMu.Unlock()
+
+	key := reflect.TypeOf(addressType)
+
+	if _, ok := builders[key]; ok {
+		panic(fmt.Sprintf("payto: a builder for %v is already registered", key))
+	}
+
+	builders[key] = builder
+}
+
+// Script returns the output script that pays to an address.
+func Script(address btcutil.Address) ([]byte, error) {
+	buildersMu.RLock()
+	builder, ok := builders[reflect.TypeOf(address)]
+	buildersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("can't pay to %T addresses", address)
+	}
+
+	script, err := builder(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build the script for %s: %w", address.EncodeAddress(), err)
+	}
+
+	return script, nil
+}
+
+// payToTaprootKey builds a segwit v1 script: OP_1 <32-byte key>.
+func payToTaprootKey(address btcutil.Address) ([]byte, error) {
+	key := address.ScriptAddress()
+	if len(key) != 32 {
+		return nil, fmt.Errorf("taproot keys have 32 bytes, not %d", len(key))
+	}
+
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_1).AddData(key).Script()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/muun/recovery/scanner"
+)
+
+// lookalikeMinMatch is the number of leading or trailing characters two different addresses must
+// share to be considered lookalikes. People tend to check only the start and end of addresses,
+// and address poisoning attacks grind keys to match exactly those.
+const lookalikeMinMatch = 4
+
+// maxHistoryTxs limits how many transactions we fetch to look for lookalike addresses.
+const maxHistoryTxs = 50
+
+// findLookalikes returns the addresses in `known` that resemble `destination` without being it.
+func findLookalikes(destination string, known []string) []string {
+	var lookalikes []string
+	seen := make(map[string]bool)
+
+	for _, addr := range known {
+		if addr == destination || seen[addr] {
+			continue
+		}
+
+		seen[addr] = true
+
+		if looksAlike(destination, addr) {
+			lookalikes = append(lookalikes, addr)
+		}
+	}
+
+	return lookalikes
+}
+
+// looksAlike returns whether two addresses share a significant prefix (after the part that
+// depends only on the address type) or suffix.
+func looksAlike(a, b string) bool {
+	a = strings.ToLower(stripAddressHeader(a))
+	b = strings.ToLower(stripAddressHeader(b))
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	return prefix >= lookalikeMinMatch || suffix >= lookalikeMinMatch
+}
+
+// stripAddressHeader removes the characters every address of the same type shares.
+func stripAddressHeader(addr string) string {
+	lower := strings.ToLower(addr)
+
+	for _, header := range []string{"bc1q", "bc1p", "bc1", "1", "3"} {
+		if strings.HasPrefix(lower, header) {
+			return addr[len(header):]
+		}
+	}
+
+	return addr
+}
+
+// historyAddresses collects the addresses involved in the transactions that funded our UTXOs,
+// besides our own. This is where a poisoning attacker's lookalike addresses would show up.
+func historyAddresses(utxoScanner *scanner.Scanner, utxos []*scanner.Utxo) []string {
+	var addrs []string
+	seenTxs := make(map[string]bool)
+
+	for _, utxo := range utxos {
+		if seenTxs[utxo.TxID] || len(seenTxs) >= maxHistoryTxs {
+			continue
+		}
+
+		seenTxs[utxo.TxID] = true
+
+		tx, err := utxoScanner.GetTransaction(utxo.TxID)
+		if err != nil {
+			continue // this is a best-effort check, a missing transaction won't stop the recovery
+		}
+
+		for _, txOut := range tx.TxOut {
+			addr, ok := scriptToAddress(txOut.PkScript)
+			if !ok {
+				continue
+			}
+
+			if _, isOurs := utxoScanner.FindAddress(txOut.PkScript); !isOurs {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	return addrs
+}
+
+// checkAddressPoisoning warns the user if the destination looks like, but isn't, an address from
+// the wallet's history. The user must explicitly choose to continue.
+func checkAddressPoisoning(destination string, utxoScanner *scanner.Scanner, utxos []*scanner.Utxo) {
+	known := historyAddresses(utxoScanner, utxos)
+	for _, utxo := range utxos {
+		known = append(known, utxo.Address.Address())
+	}
+
+	lookalikes := findLookalikes(destination, known)
+	if len(lookalikes) == 0 {
+		return
+	}
+
+	sayBlock(`
+		{red Warning: your destination address looks like an address from your wallet's history}
+
+		  {white Destination}: %s
+	`, destination)
+
+	for _, addr := range lookalikes {
+		say("  {white Similar}:     %s\n", addr)
+	}
+
+	sayBlock(`
+		Scammers send tiny payments from addresses that look like the ones you use, hoping you'll
+		copy theirs by mistake. Check the {white full} destination address in your destination wallet.
+	`)
+
+	if !readYesNo("Is the destination address correct?") {
+		sayBlock(`
+			Recovery tool stopped
+			You can try again or contact us at {blue support@muun.com}
+		`)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// profileVersion is the version of the encrypted profile file format.
+const profileVersion = 1
+
+// Parameters for deriving the profile encryption key from its passphrase.
+const (
+	profileScryptN    = 1 << 15
+	profileScryptR    = 8
+	profileScryptP    = 1
+	profileSaltLength = 16
+)
+
+// minPassphraseLength is the shortest passphrase we accept to encrypt anything with.
+const minPassphraseLength = 8
+
+var profileNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// errWrongPassphrase means a profile couldn't be opened, most likely due to a wrong passphrase.
+var errWrongPassphrase = errors.New("wrong passphrase, or the profile is corrupted")
+
+// profile holds the configuration for recurring runs against the same wallet (such as periodic
+// checks of an Emergency Kit), so it doesn't have to be entered every time. It contains no keys,
+// but it's encrypted anyway, since it reveals the wallet's funds and where they would go.
+type profile struct {
+	Servers     []string     `json:"servers"`     // preferred Electrum servers
+	Destination string       `json:"destination"` // where to sweep the funds
+	LastScan    *scanResults `json:"lastScan"`    // to compare new scans against
+	SavedAt     time.Time    `json:"savedAt"`     // to tell which copy is newer, see remoteProfile
+}
+
+// profileFile is the encrypted profile, as stored on disk.
+type profileFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Box     []byte `json:"box"`
+}
+
+// openProfile is a decrypted profile, along with what's needed to save it again.
+type openProfile struct {
+	*profile
+	path   string
+	key    *[32]byte
+	salt   []byte
+	remote remoteProfile // optional, see --profile-sync
+}
+
+func profilePath(name string) (string, error) {
+	if !profileNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid profile name %q, use letters, numbers, '-' and '_'", name)
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate profiles: %w", err)
+	}
+
+	return filepath.Join(configDir, "muun-recovery", "profiles", name+".profile"), nil
+}
+
+// loadOrCreateProfile opens a profile, asking for its passphrase. If it doesn't exist, a new one
+// is created with a passphrase chosen by the user.
+//
+// With --profile-sync, the remote copy is fetched too, and the newer of both is used.
+func loadOrCreateProfile(name string) *openProfile {
+	path, err := profilePath(name)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	var remote remoteProfile
+	var remoteData []byte
+
+	if *profileSync != "" {
+		remote, err = openRemoteProfile(*profileSync)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		remoteData, err = remote.fetch()
+		if err != nil {
+			exitWithError(fmt.Errorf("failed to fetch the profile (run without --profile-sync to use the local copy): %w", err))
+		}
+	}
+
+	localData, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		exitWithError(fmt.Errorf("failed to read profile: %w", err))
+	}
+
+	if localData == nil && remoteData == nil {
+		sayBlock(`
+			Creating profile {white %s}. Choose a passphrase to protect it.
+		`, name)
+
+		p := newProfile(path, readNewPassphrase())
+		p.remote = remote
+
+		return p
+	}
+
+	sayBlock(`
+		{yellow Enter the passphrase for profile %s}
+	`, name)
+
+	passphrase := readPassphrase()
+
+	var p *openProfile
+
+	if localData != nil {
+		p, err = decodeProfile(localData, path, passphrase)
+		if err != nil {
+			exitWithError(err)
+		}
+	}
+
+	if remoteData != nil {
+		remoteCopy, err := decodeProfile(remoteData, remote.String(), passphrase)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		if p == nil || remoteCopy.SavedAt.After(p.SavedAt) {
+			if err := writeProfileFile(path, remoteData); err != nil {
+				exitWithError(err)
+			}
+
+			say("{green ✓} Restored the profile saved in %s\n", remote)
+
+			p = remoteCopy
+			p.path = path
+		}
+	}
+
+	p.remote = remote
+
+	say("{green ✓ Profile loaded}\n")
+
+	return p
+}
+
+func newProfile(path string, passphrase string) *openProfile {
+	salt := make([]byte, profileSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		exitWithError(fmt.Errorf("failed to generate salt: %w", err))
+	}
+
+	key, err := deriveProfileKey(passphrase, salt)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	return &openProfile{profile: &profile{}, path: path, key: key, salt: salt}
+}
+
+// decodeProfile decrypts a profile file, read from `source`.
+func decodeProfile(data []byte, source string, passphrase string) (*openProfile, error) {
+	var file profileFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse profile in %s: %w", source, err)
+	}
+
+	if file.Version != profileVersion {
+		return nil, fmt.Errorf("unsupported profile version %d in %s", file.Version, source)
+	}
+
+	if len(file.Nonce) != 24 {
+		return nil, fmt.Errorf("failed to parse profile in %s: invalid nonce", source)
+	}
+
+	key, err := deriveProfileKey(passphrase, file.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], file.Nonce)
+
+	plaintext, ok := secretbox.Open(nil, file.Box, &nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("failed to open profile in %s: %w", source, errWrongPassphrase)
+	}
+
+	var p profile
+	if err := json.Unmarshal(plaintext, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse profile in %s: %w", source, err)
+	}
+
+	return &openProfile{profile: &p, path: source, key: key, salt: file.Salt}, nil
+}
+
+// save encrypts the profile and writes it to disk, with a fresh nonce. With --profile-sync, the
+// remote copy is replaced too.
+func (p *openProfile) save() error {
+	p.SavedAt = time.Now().UTC()
+
+	plaintext, err := json.Marshal(p.profile)
+	if err != nil {
+		return fmt.Errorf("failed to encode profile: %w", err)
+	}
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	data, err := json.Marshal(&profileFile{
+		Version: profileVersion,
+		Salt:    p.salt,
+		Nonce:   nonce[:],
+		Box:     secretbox.Seal(nil, plaintext, &nonce, p.key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode profile: %w", err)
+	}
+
+	if err := writeProfileFile(p.path, data); err != nil {
+		return err
+	}
+
+	if p.remote != nil {
+		if err := p.remote.store(data); err != nil {
+			return fmt.Errorf("failed to sync profile (run without --profile-sync to skip it): %w", err)
+		}
+	}
+
+	return nil
+}
+
+func writeProfileFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to save profile: %w", err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save profile: %w", err)
+	}
+
+	return nil
+}
+
+func deriveProfileKey(passphrase string, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key([]byte(passphrase), salt, profileScryptN, profileScryptR, profileScryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive profile key: %w", err)
+	}
+
+	var key [32]byte
+	copy(key[:], derived)
+
+	return &key, nil
+}
+
+// readPassphrase reads a line without echoing it, when the input is a terminal.
+func readPassphrase() string {
+	fd := int(os.Stdin.Fd())
+
+	if !terminal.IsTerminal(fd) {
+		var userInput string
+		ask(&userInput)
+		return userInput
+	}
+
+	fmt.Fprint(userOutput, "➜ ")
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(userOutput)
+
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to read passphrase: %w", err))
+	}
+
+	return string(passphrase)
+}
+
+func readNewPassphrase() string {
+	sayBlock(`
+		{yellow Enter a passphrase} (at least %d characters)
+	`, minPassphraseLength)
+
+	passphrase := readPassphrase()
+
+	if len(passphrase) < minPassphraseLength {
+		say("The passphrase is too short. Please, try again\n")
+		return readNewPassphrase()
+	}
+
+	sayBlock(`
+		{yellow Enter the passphrase again}
+	`)
+
+	if readPassphrase() != passphrase {
+		say("The passphrases don't match. Please, try again\n")
+		return readNewPassphrase()
+	}
+
+	return passphrase
+}
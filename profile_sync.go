@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/muun/recovery/utils"
+)
+
+// A profile can be kept in sync with a copy in a WebDAV folder or an S3 bucket, so that a recovery
+// started on one computer can continue on another one, if the first breaks down. Only the
+// encrypted profile file leaves the computer: the storage never sees the passphrase, nor the
+// contents.
+//
+// Each copy records when it was saved, inside the encrypted contents, and the newer one wins. The
+// storage can't tamper with that date, but it can hide the latest copy, so the local one is
+// preferred when it's newer.
+
+const (
+	profileSyncTimeout = 30 * time.Second
+	profileMaxSize     = 16 * 1024 * 1024
+)
+
+// remoteProfile is the remote copy of an encrypted profile file.
+type remoteProfile interface {
+	// fetch returns the stored file, or nil if there's none yet.
+	fetch() ([]byte, error)
+
+	// store replaces the stored file.
+	store(data []byte) error
+
+	// String describes the location, without credentials.
+	String() string
+}
+
+// openRemoteProfile returns the remote copy at a URL: https:// for WebDAV (with the username and
+// password in the URL, if needed) or s3://bucket/key for S3.
+func openRemoteProfile(rawURL string) (remoteProfile, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || parsedURL.Host == "" {
+		return nil, fmt.Errorf("invalid --profile-sync URL %q", rawURL)
+	}
+
+	switch parsedURL.Scheme {
+	case "https", "http":
+		return &webdavProfile{parsedURL}, nil
+
+	case "s3":
+		return newS3Profile(parsedURL)
+	}
+
+	return nil, fmt.Errorf("unsupported --profile-sync URL %q, use https:// (WebDAV) or s3://", rawURL)
+}
+
+// webdavProfile is a profile file in a WebDAV folder, which only needs GET and PUT.
+type webdavProfile struct {
+	url *url.URL
+}
+
+func (w *webdavProfile) fetch() ([]byte, error) {
+	req, err := w.request(http.MethodGet, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return fetchProfile(req, w)
+}
+
+func (w *webdavProfile) store(data []byte) error {
+	req, err := w.request(http.MethodPut, data)
+	if err != nil {
+		return err
+	}
+
+	return storeProfile(req, w)
+}
+
+func (w *webdavProfile) request(method string, body []byte) (*http.Request, error) {
+	location := *w.url
+	location.User = nil
+
+	req, err := http.NewRequest(method, location.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if w.url.User != nil {
+		password, _ := w.url.User.Password()
+		req.SetBasicAuth(w.url.User.Username(), password)
+	}
+
+	return req, nil
+}
+
+func (w *webdavProfile) String() string {
+	return w.url.Host + w.url.Path
+}
+
+// s3Profile is a profile file in an S3 bucket, or one of a compatible service. Credentials are
+// taken from the usual AWS environment variables, and AWS_ENDPOINT_URL points to other services.
+type s3Profile struct {
+	endpoint     *url.URL
+	bucket       string
+	key          string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3Profile(location *url.URL) (*s3Profile, error) {
+	s := &s3Profile{
+		bucket:       location.Host,
+		key:          strings.TrimPrefix(location.Path, "/"),
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
+	if s.key == "" || strings.HasSuffix(s.key, "/") {
+		return nil, fmt.Errorf("the S3 location must name a file, as in s3://bucket/recovery.profile")
+	}
+
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to sync the profile with S3")
+	}
+
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	}
+
+	var err error
+	if s.endpoint, err = url.Parse(endpoint); err != nil || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid AWS_ENDPOINT_URL %q", endpoint)
+	}
+
+	return s, nil
+}
+
+func (s *s3Profile) fetch() ([]byte, error) {
+	req, err := s.request(http.MethodGet, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return fetchProfile(req, s)
+}
+
+func (s *s3Profile) store(data []byte) error {
+	req, err := s.request(http.MethodPut, data)
+	if err != nil {
+		return err
+	}
+
+	return storeProfile(req, s)
+}
+
+// request creates a path-style request for the profile file, signed for S3.
+func (s *s3Profile) request(method string, body []byte) (*http.Request, error) {
+	location := *s.endpoint
+	location.Path = "/" + s.bucket + "/" + s.key
+	location.RawPath = "/" + s3Escape(s.bucket) + "/" + s3Escape(s.key)
+
+	req, err := http.NewRequest(method, location.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	payloadHash := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(payloadHash[:]), time.Now().UTC())
+
+	return req, nil
+}
+
+// sign adds an AWS Signature Version 4 to a request without query parameters, covering all of its
+// headers.
+func (s *s3Profile) sign(req *http.Request, payloadHash string, now time.Time) {
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", now.Format("20060102T150405Z"))
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+
+	names = append(names, "host")
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"", // no query
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		req.Header.Get("x-amz-date"),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	signingKey := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(signingKey, stringToSign)),
+	))
+}
+
+func (s *s3Profile) String() string {
+	return "s3://" + s.bucket + "/" + s.key
+}
+
+// s3Escape encodes a path as S3 signatures expect: every byte except unreserved characters and
+// slashes is percent-encoded.
+func s3Escape(path string) string {
+	var escaped strings.Builder
+
+	for _, b := range []byte(path) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9', strings.IndexByte("-._~/", b) != -1:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// fetchProfile downloads the remote copy. A missing file is not an error, it's created on save.
+func fetchProfile(req *http.Request, remote remoteProfile) ([]byte, error) {
+	res, err := doProfileRequest(req, remote)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("%s responded with status %s", remote, res.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, profileMaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download profile from %s: %w", remote, err)
+	}
+
+	if len(data) > profileMaxSize {
+		return nil, fmt.Errorf("the profile in %s is too large", remote)
+	}
+
+	return data, nil
+}
+
+// storeProfile uploads the remote copy.
+func storeProfile(req *http.Request, remote remoteProfile) error {
+	res, err := doProfileRequest(req, remote)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s responded with status %s", remote, res.Status)
+	}
+
+	return nil
+}
+
+func doProfileRequest(req *http.Request, remote remoteProfile) (*http.Response, error) {
+	if err := utils.CheckNetwork(); err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: profileSyncTimeout}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %w", remote, err)
+	}
+
+	return res, nil
+}
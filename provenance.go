@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Auditors need to tie what the Recovery Tool did to the exact code that did it. Every artifact
+// it writes records the provenance of the build that wrote it: the release, the commit, the Go
+// compiler, a digest of the versions of every module compiled in, and the SHA-256 of the executable
+// itself. Releases publish a manifest with the same information, signed, which `verify-provenance`
+// compares against.
+//
+// The commit is set when building, with `-ldflags "-X main.buildRevision=<commit>"`, as the
+// Makefile does. Go reads the module versions from the executable.
+
+// buildRevision is the commit the Recovery Tool was built from.
+var buildRevision = "unknown"
+
+// buildProvenance describes the build of the running Recovery Tool.
+type buildProvenance struct {
+	Version    string `json:"version"`
+	Revision   string `json:"revision"`
+	GoVersion  string `json:"goVersion"`
+	Platform   string `json:"platform"`
+	Modules    string `json:"modules"`              // SHA-256 of the module list, see modulesDigest
+	Executable string `json:"executable,omitempty"` // SHA-256 of the executable, if it can be read
+}
+
+// moduleVersion is a module compiled into the Recovery Tool.
+type moduleVersion struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Sum     string `json:"sum,omitempty"`
+}
+
+// releaseManifest describes a release, as published and signed by its authors.
+type releaseManifest struct {
+	Version   string            `json:"version"`
+	Revision  string            `json:"revision"`
+	GoVersion string            `json:"goVersion"`
+	Modules   string            `json:"modules"`
+	Binaries  map[string]string `json:"binaries"` // file name to SHA-256, in hex
+}
+
+// signedManifest carries a manifest with an Ed25519 signature of its exact bytes.
+type signedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"` // hex
+}
+
+var provenance struct {
+	sync.Once
+	build *buildProvenance
+}
+
+// currentProvenance returns the provenance of this build. It's computed once, hashing the
+// executable takes a moment.
+func currentProvenance() *buildProvenance {
+	provenance.Do(func() {
+		provenance.build = &buildProvenance{
+			Version:   version,
+			Revision:  buildRevision,
+			GoVersion: runtime.Version(),
+			Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+			Modules:   modulesDigest(buildModules()),
+		}
+
+		if hash, err := executableHash(); err == nil {
+			provenance.build.Executable = hash
+		}
+	})
+
+	return provenance.build
+}
+
+// buildSummary describes the build in a line, for reports.
+func buildSummary() string {
+	build := currentProvenance()
+
+	revision := build.Revision
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+
+	return fmt.Sprintf("v%s, commit %s, %s, %s", build.Version, revision, build.GoVersion, build.Platform)
+}
+
+// buildModules lists the modules compiled in, sorted by path. Builds without module information,
+// such as those made outside of a module, list none.
+func buildModules() []moduleVersion {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+
+	var modules []moduleVersion
+
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+
+		modules = append(modules, moduleVersion{dep.Path, dep.Version, dep.Sum})
+	}
+
+	sort.Slice(modules, func(i, j int) bool {
+		return modules[i].Path < modules[j].Path
+	})
+
+	return modules
+}
+
+// modulesDigest hashes a module list, one "path version sum" line per module.
+func modulesDigest(modules []moduleVersion) string {
+	hash := sha256.New()
+
+	for _, module := range modules {
+		fmt.Fprintf(hash, "%s %s %s\n", module.Path, module.Version, module.Sum)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func executableHash() (string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// runProvenanceCommand prints the provenance of this build, with the full module list, as JSON.
+// Its fields, other than the executable, are those of a release manifest.
+func runProvenanceCommand(args []string) {
+	flags := flag.NewFlagSet("provenance", flag.ExitOnError)
+	flags.Parse(args)
+
+	output := struct {
+		*buildProvenance
+		ModuleList []moduleVersion `json:"moduleList"`
+	}{currentProvenance(), buildModules()}
+
+	data, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Println(string(data))
+}
+
+// runVerifyProvenanceCommand checks a signed release manifest, and compares it with this build, or
+// with the builds recorded in the given artifacts.
+func runVerifyProvenanceCommand(args []string) {
+	flags := flag.NewFlagSet("verify-provenance", flag.ExitOnError)
+	keyHex := flags.String("key", "", "the Ed25519 public key (hex) the release manifest is signed with")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || *keyHex == "" {
+		printUsage()
+		os.Exit(0)
+	}
+
+	say(`
+		{blue Muun Recovery Tool v%s}
+
+		Verifying build provenance.
+	`, version)
+
+	manifest, err := loadSignedManifest(flags.Arg(0), *keyHex)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	say("\n{green ✓} The manifest of v%s is signed with the given key\n", manifest.Version)
+
+	matched := true
+
+	if flags.NArg() == 1 {
+		say("\n{white This Recovery Tool} (%s)\n", buildSummary())
+		matched = printProvenanceMatch(manifest, currentProvenance())
+	}
+
+	for _, path := range flags.Args()[1:] {
+		build, err := loadArtifactProvenance(path)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		say("\n{white %s}\n", path)
+		matched = printProvenanceMatch(manifest, build) && matched
+	}
+
+	fmt.Fprintln(userOutput)
+
+	if !matched {
+		say("{red ✗} Not made by the release in the manifest\n\n")
+		os.Exit(1)
+	}
+
+	say("{green ✓} Made by the release in the manifest\n\n")
+}
+
+// loadSignedManifest reads a signed release manifest, and verifies its signature.
+func loadSignedManifest(path string, keyHex string) (*releaseManifest, error) {
+	key, err := hex.DecodeString(keyHex)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid release key, it must be %d bytes in hex", ed25519.PublicKeySize)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var signed signedManifest
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("failed to parse release manifest in %s: %w", path, err)
+	}
+
+	signature, err := hex.DecodeString(signed.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), signed.Manifest, signature) {
+		return nil, fmt.Errorf("the release manifest in %s is not signed with the given key", path)
+	}
+
+	var manifest releaseManifest
+	if err := json.Unmarshal(signed.Manifest, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse release manifest in %s: %w", path, err)
+	}
+
+	return &manifest, nil
+}
+
+// loadArtifactProvenance reads the build recorded in an artifact. Snapshots keep it inside their
+// signed payload.
+func loadArtifactProvenance(path string) (*buildProvenance, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var artifact struct {
+		Build   *buildProvenance `json:"build"`
+		Payload []byte           `json:"payload"`
+	}
+
+	if err := json.Unmarshal(data, &artifact); err != nil {
+		return nil, fmt.Errorf("%s is not an artifact of the Recovery Tool: %w", path, err)
+	}
+
+	if artifact.Build == nil && artifact.Payload != nil {
+		if err := json.Unmarshal(artifact.Payload, &artifact); err != nil {
+			return nil, fmt.Errorf("%s is not an artifact of the Recovery Tool: %w", path, err)
+		}
+	}
+
+	if artifact.Build == nil {
+		return nil, fmt.Errorf("%s doesn't record the build that made it", path)
+	}
+
+	return artifact.Build, nil
+}
+
+// printProvenanceMatch compares a build with a manifest, field by field, and returns whether they
+// all match.
+func printProvenanceMatch(manifest *releaseManifest, build *buildProvenance) bool {
+	var binaries []string
+	for name, hash := range manifest.Binaries {
+		if strings.EqualFold(hash, build.Executable) {
+			binaries = append(binaries, name)
+		}
+	}
+
+	checks := []struct {
+		name     string
+		expected string
+		found    string
+		ok       bool
+	}{
+		{"Version", manifest.Version, build.Version, manifest.Version == build.Version},
+		{"Commit", manifest.Revision, build.Revision, manifest.Revision == build.Revision},
+		{"Compiler", manifest.GoVersion, build.GoVersion, manifest.GoVersion == build.GoVersion},
+		{"Modules", manifest.Modules, build.Modules, manifest.Modules == build.Modules},
+		{"Executable", "one of the release binaries", build.Executable + describeBinaries(binaries), len(binaries) > 0},
+	}
+
+	matched := true
+
+	for _, check := range checks {
+		if check.ok {
+			say("{green ✓} %s: %s\n", check.name, check.found)
+			continue
+		}
+
+		found := check.found
+		if found == "" {
+			found = "not recorded"
+		}
+
+		say("{red ✗} %s: %s, expected %s\n", check.name, found, check.expected)
+		matched = false
+	}
+
+	return matched
+}
+
+func describeBinaries(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	sort.Strings(names)
+	return " (" + strings.Join(names, ", ") + ")"
+}
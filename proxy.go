@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/muun/recovery/utils"
+)
+
+// Scanning asks the servers about every address of the wallet, tying them all to the IP address
+// they come from. With --proxy, every connection goes through a SOCKS5 proxy instead, usually Tor:
+//
+//	recovery-tool --proxy socks5://127.0.0.1:9050
+//
+// (9150 for the Tor Browser). That includes the Electrum servers, Esplora, broadcasting, swaps
+// and everything else the tool connects to, except a node on this same computer. The proxy
+// resolves the host names too, so Electrum servers and Esplora APIs on .onion addresses can be
+// used, which keeps the traffic within Tor:
+//
+//	recovery-tool --proxy socks5://127.0.0.1:9050 --servers <address>.onion:50002
+
+// startProxy sends every connection through the proxy given with --proxy, from now on. Without
+// one, .onion addresses can't be reached, and we fail early if any was given.
+func startProxy() {
+	if *proxyURL != "" {
+		if err := utils.UseProxy(*proxyURL); err != nil {
+			exitWithError(err)
+		}
+
+		return
+	}
+
+	for _, server := range strings.Split(*serverList, ",") {
+		if host, _, err := net.SplitHostPort(strings.TrimSpace(server)); err == nil && isOnion(host) {
+			exitWithError(fmt.Errorf("%s can only be reached through Tor, use --proxy (such as socks5://127.0.0.1:9050)", server))
+		}
+	}
+
+	if parsed, err := url.Parse(*esploraURL); err == nil && isOnion(parsed.Hostname()) && *chainBackend == backendEsplora {
+		exitWithError(fmt.Errorf("%s can only be reached through Tor, use --proxy (such as socks5://127.0.0.1:9050)", *esploraURL))
+	}
+}
+
+// isOnion tells whether a host is a Tor onion service.
+func isOnion(host string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), ".onion")
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/scanner"
+)
+
+// With --psbt-out, the sweep is saved as an unsigned BIP-174 PSBT instead of being signed and sent:
+//
+//	recovery-tool --psbt-out sweep.psbt
+//
+// Each input carries what a signer needs to check and sign it on its own: the output it spends
+// (the whole previous transaction, for legacy inputs), its redeem and witness scripts, and the
+// derivation of both keys, with the fingerprints the Emergency Kit's descriptors use. It can be
+// reviewed in another wallet, and signed there or on an air-gapped computer holding the keys.
+//
+// Taproot inputs are spent with a MuSig2 signature of both keys, which PSBTs can't describe yet,
+// so sweeps with them can't be exported.
+
+// checkPSBTOptions fails early when --psbt-out is combined with options that need to sign or send.
+func checkPSBTOptions() {
+	if *psbtOut == "" {
+		return
+	}
+
+	switch {
+	case *dryRun:
+		exitWithError(fmt.Errorf("--dry-run doesn't build a transaction, it can't be combined with --psbt-out"))
+	case *testSweep > 0:
+		exitWithError(fmt.Errorf("a test sweep must be sent, it can't be combined with --psbt-out"))
+	case *feeFromExternalInput:
+		exitWithError(fmt.Errorf("a fee input can't be combined with --psbt-out, its key would be needed to sign"))
+	case *lightning || *liquid:
+		exitWithError(fmt.Errorf("--lightning and --liquid need the transaction signed, they can't be combined with --psbt-out"))
+	case *exportChunks != "" || *exportSnapshot != "":
+		exitWithError(fmt.Errorf("--psbt-out can't be combined with --export-chunks or --export-snapshot"))
+	}
+}
+
+// writeSweepPSBT saves the unsigned sweep as a PSBT: in binary if the path ends in .psbt, as
+// base64 text otherwise.
+func writeSweepPSBT(path string, sweeper *Sweeper, utxoScanner *scanner.Scanner, utxos []*scanner.Utxo, fee sats.Amount) {
+	rawTx, err := buildSweepTx(utxos, sweeper.SweepAddress, sweeper.Payments, fee)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	// Locked at the latest block, as the sweeps we sign (see withLockTime):
+	rawTx, err = withLockTime(rawTx, lockTimeAtTip(utxoScanner))
+	if err != nil {
+		exitWithError(err)
+	}
+
+	tx := wire.NewMsgTx(0)
+	if err := tx.Deserialize(bytes.NewReader(rawTx)); err != nil {
+		exitWithError(fmt.Errorf("failed to decode sweep tx: %w", err))
+	}
+
+	packet, err := newSweepPSBT(tx, utxos, sweeper.Generations, utxoScanner)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	var data []byte
+
+	if strings.HasSuffix(path, ".psbt") {
+		var buf bytes.Buffer
+		if err := packet.Serialize(&buf); err != nil {
+			exitWithError(fmt.Errorf("failed to encode PSBT: %w", err))
+		}
+
+		data = buf.Bytes()
+
+	} else {
+		text, err := packet.B64Encode()
+		if err != nil {
+			exitWithError(fmt.Errorf("failed to encode PSBT: %w", err))
+		}
+
+		data = []byte(text + "\n")
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		exitWithError(fmt.Errorf("failed to save PSBT: %w", err))
+	}
+
+	recordCaseEvent(currentTag(), "psbt", "Saved the unsigned sweep %s to %s, as a PSBT", tx.TxHash(), path)
+
+	sayBlock(`
+		PSBT saved to {white %s}. Nothing was signed or sent.
+
+		Both keys in your Emergency Kit must sign each input. Open it in a wallet that has them (or
+		their descriptors, to review it), sign it, and send the finalized transaction from there.
+
+	`, path)
+}
+
+// newSweepPSBT describes an unsigned sweep as a PSBT, with what a signer needs for each input.
+func newSweepPSBT(tx *wire.MsgTx, utxos []*scanner.Utxo, generations []*keyGeneration, utxoScanner *scanner.Scanner) (*psbt.Packet, error) {
+	packet, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PSBT: %w", err)
+	}
+
+	updater, err := psbt.NewUpdater(packet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PSBT: %w", err)
+	}
+
+	byOutpoint := make(map[wire.OutPoint]*scanner.Utxo)
+	for _, utxo := range utxos {
+		hash, err := chainhash.NewHashFromStr(utxo.TxID)
+		if err != nil {
+			return nil, err
+		}
+
+		byOutpoint[wire.OutPoint{Hash: *hash, Index: uint32(utxo.OutputIndex)}] = utxo
+	}
+
+	for i, txIn := range tx.TxIn {
+		utxo, ok := byOutpoint[txIn.PreviousOutPoint]
+		if !ok {
+			return nil, fmt.Errorf("input %d spends %v, which isn't among the funds found", i, txIn.PreviousOutPoint)
+		}
+
+		generation := generationOf(generations, utxo)
+		if generation == nil {
+			return nil, fmt.Errorf("no kit controls %s", utxo.Address.Address())
+		}
+
+		if err := describePSBTInput(updater, i, utxo, generation, utxoScanner); err != nil {
+			return nil, fmt.Errorf("failed to describe input %d (%s): %w", i, utxo.Address.Address(), err)
+		}
+	}
+
+	return packet, nil
+}
+
+// describePSBTInput adds the output an input spends, its scripts and the derivation of its keys.
+func describePSBTInput(updater *psbt.Updater, index int, utxo *scanner.Utxo, generation *keyGeneration, utxoScanner *scanner.Scanner) error {
+	version := utxo.Address.Version()
+
+	if version == libwallet.AddressVersionV5 {
+		return fmt.Errorf("taproot outputs are spent with a MuSig2 signature, which PSBTs can't describe yet")
+	}
+
+	path, err := bip32Path(utxo.Address.DerivationPath())
+	if err != nil {
+		return err
+	}
+
+	userPub, muunPub, err := inputPublicKeys(utxo, generation)
+	if err != nil {
+		return err
+	}
+
+	// The scripts are rebuilt from the keys, and must pay to the output being spent:
+	var redeemScript, witnessScript []byte
+
+	if version != libwallet.AddressVersionV1 {
+		if witnessScript, err = multisigScript(userPub, muunPub); err != nil {
+			return err
+		}
+	}
+
+	var expected []byte
+
+	switch version {
+	case libwallet.AddressVersionV1:
+		expected, err = payToScript(btcutil.NewAddressPubKeyHash(btcutil.Hash160(userPub), &chainParams))
+
+	case libwallet.AddressVersionV2:
+		redeemScript, witnessScript = witnessScript, nil
+		expected, err = payToScript(btcutil.NewAddressScriptHash(redeemScript, &chainParams))
+
+	case libwallet.AddressVersionV3:
+		scriptHash := sha256.Sum256(witnessScript)
+		if redeemScript, err = txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(scriptHash[:]).Script(); err != nil {
+			return err
+		}
+
+		expected, err = payToScript(btcutil.NewAddressScriptHash(redeemScript, &chainParams))
+
+	case libwallet.AddressVersionV4:
+		scriptHash := sha256.Sum256(witnessScript)
+		expected, err = payToScript(btcutil.NewAddressWitnessScriptHash(scriptHash[:], &chainParams))
+
+	default:
+		return fmt.Errorf("unsupported address version %d", version)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(expected, utxo.Script) {
+		return fmt.Errorf("the keys don't match the script of the output")
+	}
+
+	// Legacy inputs sign the whole previous transaction, segwit ones only the output:
+	if version == libwallet.AddressVersionV1 || version == libwallet.AddressVersionV2 {
+		prevTx, err := utxoScanner.GetTransaction(utxo.TxID)
+		if err != nil {
+			return err
+		}
+
+		if err := updater.AddInNonWitnessUtxo(prevTx, index); err != nil {
+			return err
+		}
+
+	} else {
+		if err := updater.AddInWitnessUtxo(wire.NewTxOut(int64(utxo.Amount), utxo.Script), index); err != nil {
+			return err
+		}
+	}
+
+	if err := updater.AddInSighashType(txscript.SigHashAll, index); err != nil {
+		return err
+	}
+
+	if redeemScript != nil {
+		if err := updater.AddInRedeemScript(redeemScript, index); err != nil {
+			return err
+		}
+	}
+
+	if witnessScript != nil {
+		if err := updater.AddInWitnessScript(witnessScript, index); err != nil {
+			return err
+		}
+	}
+
+	// Fingerprints are those of the kit's keys, as in its descriptors (see kitFingerprints):
+	derivations := []struct {
+		root   []byte
+		pubKey []byte
+	}{
+		{generation.UserKey.PublicKey().Fingerprint(), userPub},
+	}
+
+	if version != libwallet.AddressVersionV1 {
+		derivations = append(derivations, struct {
+			root   []byte
+			pubKey []byte
+		}{generation.MuunKey.PublicKey().Fingerprint(), muunPub})
+	}
+
+	for _, derivation := range derivations {
+		fingerprint := binary.LittleEndian.Uint32(derivation.root)
+
+		if err := updater.AddInBip32Derivation(fingerprint, path, derivation.pubKey, index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inputPublicKeys returns the user and Muun public keys of the address an output is in.
+func inputPublicKeys(utxo *scanner.Utxo, generation *keyGeneration) (userPub, muunPub []byte, err error) {
+	userKey, err := generation.UserKey.DeriveTo(utxo.Address.DerivationPath())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	muunRoot, err := generation.MuunKey.DeriveTo(keys.KitKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	muunKey, err := muunRoot.DeriveTo(utxo.Address.DerivationPath())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return userKey.PublicKey().Raw(), muunKey.PublicKey().Raw(), nil
+}
+
+// multisigScript builds the 2-of-2 script of multisig addresses, with the user key first.
+func multisigScript(userPub, muunPub []byte) ([]byte, error) {
+	userAddress, err := btcutil.NewAddressPubKey(userPub, &chainParams)
+	if err != nil {
+		return nil, err
+	}
+
+	muunAddress, err := btcutil.NewAddressPubKey(muunPub, &chainParams)
+	if err != nil {
+		return nil, err
+	}
+
+	return txscript.MultiSigScript([]*btcutil.AddressPubKey{userAddress, muunAddress}, 2)
+}
+
+// payToScript returns the output script of an address, as it's created.
+func payToScript(address btcutil.Address, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return txscript.PayToAddrScript(address)
+}
+
+// bip32Path turns a derivation path into its indexes, hardened ones with the high bit set.
+func bip32Path(path string) ([]uint32, error) {
+	parsed, err := keys.ParsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []uint32
+
+	for _, step := range parsed {
+		index := step.Index
+		if step.Hardened {
+			index += hdkeychain.HardenedKeyStart
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	return indexes, nil
+}
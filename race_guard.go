@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/scanner"
+	"github.com/muun/recovery/utils"
+)
+
+// Between signing a sweep and broadcasting it, someone with a copy of the keys (whoever stole the
+// Emergency Kit, for instance) could get a conflicting transaction to the network first. We keep
+// that window as short as we can: the inputs are checked once more right before sending, and the
+// transaction goes to several servers at once (see broadcastTx).
+
+// replaceableSequence is the sequence of the inputs of the sweeps we sign. Any sequence below the
+// final one enforces the lock time, and this one also signals that the sweep can be replaced with
+// a higher fee (BIP-125), if it gets stuck (see bump-fee).
+const replaceableSequence = wire.MaxTxInSequenceNum - 2
+
+// withLockTime sets the lock time of a raw transaction to a block height, with every input's
+// sequence set so that it's enforced, and the transaction replaceable. A transaction locked at the
+// tip can only be mined in the next block, like those of most wallets: miners gain nothing from
+// re-mining the last one to take its fee, and the sweep doesn't stand out. A lock time of 0 leaves
+// the transaction unlocked, but still replaceable.
+func withLockTime(rawTx []byte, lockTime uint32) ([]byte, error) {
+	tx := wire.NewMsgTx(0)
+	if err := tx.Deserialize(bytes.NewReader(rawTx)); err != nil {
+		return nil, fmt.Errorf("failed to decode sweep tx: %w", err)
+	}
+
+	tx.LockTime = lockTime
+	for _, txIn := range tx.TxIn {
+		txIn.Sequence = replaceableSequence
+	}
+
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// lockTimeAtTip returns the height of the latest block, to lock the sweep at. If it can't be
+// learned, the sweep isn't locked, as it never was.
+func lockTimeAtTip(utxoScanner *scanner.Scanner) uint32 {
+	tip, err := utxoScanner.GetTipHeight()
+	if err != nil || tip <= 0 {
+		return 0
+	}
+
+	return uint32(tip)
+}
+
+// checkBeforeBroadcast verifies, right before sending, that no other transaction spent the outputs
+// we're about to spend, or is spending them from the mempool, and that the server isn't behind the
+// block the sweep is locked at. It stops the recovery if anything's wrong. If the check itself
+// fails, we go ahead with what we know, as we always did.
+func checkBeforeBroadcast(utxoScanner *scanner.Scanner, utxos []*scanner.Utxo, lockTime uint32) {
+	conflicts, tip, err := utxoScanner.FindConflicts(utxos)
+	if err != nil {
+		say("{yellow Couldn't check the funds once more before sending}: %v\n", err)
+		return
+	}
+
+	if len(conflicts) > 0 {
+		for _, utxo := range conflicts {
+			say("{red • %d} sats in %s:%d were spent, or are being spent, by another transaction\n", utxo.Amount, utxo.TxID, utxo.OutputIndex)
+		}
+
+		exitWithError(utils.WrapError(
+			utils.ErrFundsSpent,
+			fmt.Errorf("%d of the outputs to send were spent by another transaction, nothing was sent", len(conflicts)),
+		))
+	}
+
+	if tip < int(lockTime) {
+		exitWithError(fmt.Errorf(
+			"the server is at block %d, behind block %d we signed at, so it may not know of conflicting transactions. Nothing was sent",
+			tip, lockTime,
+		))
+	}
+
+	say("{green ✓} The funds are still unspent, at block %d\n", tip)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/scanner"
+	"github.com/muun/recovery/utils"
+)
+
+// rebroadcastScheduleVersion is the version of the rebroadcast schedule file format.
+const rebroadcastScheduleVersion = 1
+
+// rebroadcastFirstInterval is the wait before the first rebroadcast. Each one doubles it, up to
+// rebroadcastMaxInterval, so a transaction stuck for days doesn't cause a flood of requests.
+const rebroadcastFirstInterval = 2 * time.Minute
+const rebroadcastMaxInterval = 6 * time.Hour
+
+// rebroadcastServers is how many servers we send the transaction to on each attempt. We move
+// along the public list, so every attempt reaches servers that haven't seen it from us.
+const rebroadcastServers = 3
+
+// rebroadcastSchedule tracks a sent transaction until it confirms, so that servers dropping it from
+// their mempool (after a restart, or a fee spike) don't leave it forgotten. It's saved after every
+// attempt, so the tool can be stopped and resumed with `recovery-tool rebroadcast`.
+type rebroadcastSchedule struct {
+	Version int `json:"version"`
+	caseTag
+	TxID         string    `json:"txId"`
+	TxHex        string    `json:"txHex"`
+	InputScripts []string  `json:"inputScripts"` // hex, in input order, to learn if they were spent
+	Attempts     int       `json:"attempts"`
+	Interval     int64     `json:"interval"` // in seconds
+	NextAttempt  time.Time `json:"nextAttempt"`
+	NextServer   int       `json:"nextServer"` // index in the public server list
+}
+
+type rebroadcastStatus int
+
+const (
+	txMissing   rebroadcastStatus = iota // servers don't know about it
+	txPending                            // in the mempool
+	txConfirmed                          // in a block
+	txReplaced                           // its inputs were spent by another transaction
+)
+
+// runRebroadcastCommand resumes the rebroadcast schedule saved in a file.
+func runRebroadcastCommand(args []string) {
+	flags := flag.NewFlagSet("rebroadcast", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	schedule, err := loadRebroadcastSchedule(flags.Arg(0))
+	if err != nil {
+		exitWithError(err)
+	}
+
+	runRebroadcastSchedule(schedule, flags.Arg(0))
+}
+
+// newRebroadcastSchedule creates the schedule for a transaction spending the given UTXOs, and saves
+// it to a file.
+func newRebroadcastSchedule(path string, tx *wire.MsgTx, utxos []*scanner.Utxo) (*rebroadcastSchedule, error) {
+	txHex, err := encodeTxHex(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	scripts := make(map[string]string)
+	for _, utxo := range utxos {
+		scripts[fmt.Sprintf("%s:%d", utxo.TxID, utxo.OutputIndex)] = hex.EncodeToString(utxo.Script)
+	}
+
+	schedule := &rebroadcastSchedule{
+		Version:     rebroadcastScheduleVersion,
+		caseTag:     currentTag(),
+		TxID:        tx.TxHash().String(),
+		TxHex:       txHex,
+		Interval:    int64(rebroadcastFirstInterval / time.Second),
+		NextAttempt: time.Now().UTC().Add(rebroadcastFirstInterval),
+	}
+
+	for _, txIn := range tx.TxIn {
+		script, ok := scripts[txIn.PreviousOutPoint.String()]
+		if !ok {
+			return nil, fmt.Errorf("missing output script for input %v", txIn.PreviousOutPoint)
+		}
+
+		schedule.InputScripts = append(schedule.InputScripts, script)
+	}
+
+	if err := schedule.save(path); err != nil {
+		return nil, err
+	}
+
+	return schedule, nil
+}
+
+// runRebroadcastSchedule rebroadcasts a transaction at growing intervals, until it confirms or is
+// replaced. Then the schedule file is removed.
+func runRebroadcastSchedule(schedule *rebroadcastSchedule, path string) {
+	log := utils.NewLogger("Rebroadcast")
+
+	tx, err := schedule.tx()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	sayBlock(`
+		{whiteUnderline Rebroadcasting}
+		We'll keep sending transaction {white %s} to new servers until it confirms.
+		You can stop the Recovery Tool at any time, and resume with:
+		  recovery-tool rebroadcast %s
+
+	`, schedule.TxID, path)
+
+	for {
+		if wait := time.Until(schedule.NextAttempt); wait > 0 {
+			say("► Next check at %s\n", utils.FormatTime(schedule.NextAttempt))
+			time.Sleep(wait)
+		}
+
+		status, err := checkTxStatus(tx, schedule.InputScripts)
+		if err != nil {
+			log.Printf("Failed to check the transaction status: %v", err)
+		}
+
+		switch status {
+		case txConfirmed:
+			say("{green ✓} The transaction was confirmed\n")
+			recordCaseEvent(schedule.caseTag, "confirmed", "Transaction %s confirmed", schedule.TxID)
+			os.Remove(path)
+			return
+
+		case txReplaced:
+			say("{yellow !} The funds were spent by a different transaction, we'll stop sending this one\n")
+			recordCaseEvent(schedule.caseTag, "replaced", "The funds of transaction %s were spent by a different one", schedule.TxID)
+			os.Remove(path)
+			return
+		}
+
+		accepted := schedule.broadcast(log)
+		say("► Sent to %d of %d servers (attempt %d)\n", accepted, rebroadcastServers, schedule.Attempts)
+
+		schedule.Interval *= 2
+		if schedule.Interval > int64(rebroadcastMaxInterval/time.Second) {
+			schedule.Interval = int64(rebroadcastMaxInterval / time.Second)
+		}
+
+		schedule.NextAttempt = time.Now().UTC().Add(time.Duration(schedule.Interval) * time.Second)
+
+		if err := schedule.save(path); err != nil {
+			exitWithError(err)
+		}
+	}
+}
+
+// broadcast sends the transaction to the next few servers in the public list, and returns how many
+// of them accepted it.
+func (s *rebroadcastSchedule) broadcast(log utils.Logger) int {
+	accepted := 0
+
+	for i := 0; i < rebroadcastServers; i++ {
+		server := electrum.PublicServers[s.NextServer%len(electrum.PublicServers)]
+		s.NextServer++
+
+		client := electrum.NewClient()
+		if err := client.Connect(server); err != nil {
+			continue
+		}
+
+		if _, err := client.Broadcast(s.TxHex); err != nil {
+			log.Printf("%s rejected the transaction: %v", server, err)
+		} else {
+			accepted++
+		}
+
+		client.Disconnect()
+	}
+
+	s.Attempts++
+
+	return accepted
+}
+
+// checkTxStatus asks a server whether the transaction is confirmed, pending or gone. If it's gone,
+// the inputs tell us whether it was replaced or just dropped.
+func checkTxStatus(tx *wire.MsgTx, inputScripts []string) (rebroadcastStatus, error) {
+	servers := electrum.NewServerProvider()
+	client := electrum.NewClient()
+
+	var err error
+	for attempt := 0; attempt < 3 && !client.IsConnected(); attempt++ {
+		err = client.Connect(servers.NextServer())
+	}
+
+	if !client.IsConnected() {
+		return txMissing, err
+	}
+	defer client.Disconnect()
+
+	txID := tx.TxHash().String()
+
+	history, err := client.GetHistory(electrum.GetIndexHash(tx.TxOut[0].PkScript))
+	if err != nil {
+		return txMissing, err
+	}
+
+	for _, ref := range history {
+		if ref.TxHash != txID {
+			continue
+		}
+
+		if ref.Height > 0 {
+			return txConfirmed, nil
+		}
+
+		return txPending, nil
+	}
+
+	for i, txIn := range tx.TxIn {
+		script, err := hex.DecodeString(inputScripts[i])
+		if err != nil {
+			return txMissing, err
+		}
+
+		refs, err := client.ListUnspent(electrum.GetIndexHash(script))
+		if err != nil {
+			return txMissing, err
+		}
+
+		unspent := false
+		for _, ref := range refs {
+			if ref.TxHash == txIn.PreviousOutPoint.Hash.String() && uint32(ref.TxPos) == txIn.PreviousOutPoint.Index {
+				unspent = true
+			}
+		}
+
+		if !unspent {
+			return txReplaced, nil
+		}
+	}
+
+	return txMissing, nil
+}
+
+func (s *rebroadcastSchedule) tx() (*wire.MsgTx, error) {
+	txBytes, err := hex.DecodeString(s.TxHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction in rebroadcast schedule: %w", err)
+	}
+
+	tx := wire.NewMsgTx(2)
+	if err := tx.Deserialize(bytes.NewReader(txBytes)); err != nil {
+		return nil, fmt.Errorf("invalid transaction in rebroadcast schedule: %w", err)
+	}
+
+	if len(tx.TxIn) != len(s.InputScripts) || len(tx.TxOut) == 0 {
+		return nil, fmt.Errorf("invalid rebroadcast schedule: it doesn't match the transaction")
+	}
+
+	return tx, nil
+}
+
+func loadRebroadcastSchedule(path string) (*rebroadcastSchedule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedule rebroadcastSchedule
+	if err := json.Unmarshal(data, &schedule); err != nil {
+		return nil, fmt.Errorf("failed to parse rebroadcast schedule in %s: %w", path, err)
+	}
+
+	if schedule.Version != rebroadcastScheduleVersion {
+		return nil, fmt.Errorf("unsupported rebroadcast schedule version %d in %s", schedule.Version, path)
+	}
+
+	return &schedule, nil
+}
+
+func (s *rebroadcastSchedule) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode rebroadcast schedule: %w", err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save rebroadcast schedule: %w", err)
+	}
+
+	return nil
+}
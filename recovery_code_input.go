@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// recoveryCodeDashes are characters that look like the '-' separator, and are often produced by
+// non-English keyboards, word processors and OCR.
+const recoveryCodeDashes = "‐‑‒–—―−﹘﹣－"
+
+// normalizeRecoveryCode replaces characters that were obviously meant as a valid Recovery Code
+// character, returning the result along with a description of each replacement. Ambiguous cases
+// (such as 'O' for '0', neither of which is in the alphabet) are left alone, for validation to
+// reject.
+func normalizeRecoveryCode(input string) (string, []string) {
+	var result strings.Builder
+	var changes []string
+	seen := make(map[rune]bool)
+
+	for _, r := range input {
+		normalized := normalizeRecoveryCodeRune(r)
+
+		// Lower-case letters are expected, and not worth mentioning:
+		if normalized != r && r > unicode.MaxASCII && !seen[r] {
+			changes = append(changes, fmt.Sprintf("'%c' (U+%04X) → '%c'", r, r, normalized))
+			seen[r] = true
+		}
+
+		result.WriteRune(normalized)
+	}
+
+	return result.String(), changes
+}
+
+func normalizeRecoveryCodeRune(r rune) rune {
+	// Full-width forms (common with CJK input methods) map directly to ASCII:
+	if r >= '！' && r <= '～' {
+		r -= '！' - '!'
+	}
+
+	if strings.ContainsRune(recoveryCodeDashes, r) {
+		return '-'
+	}
+
+	// Accented letters decompose to their base letter followed by combining marks:
+	if r > unicode.MaxASCII {
+		decomposed := []rune(norm.NFD.String(string(r)))
+
+		if len(decomposed) > 1 && decomposed[0] <= unicode.MaxASCII && isCombiningMarks(decomposed[1:]) {
+			r = decomposed[0]
+		}
+	}
+
+	return unicode.ToUpper(r)
+}
+
+func isCombiningMarks(runes []rune) bool {
+	for _, r := range runes {
+		if !unicode.Is(unicode.Mn, r) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -3,20 +3,28 @@ package main
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 
 	"github.com/muun/libwallet"
-	"github.com/muun/libwallet/btcsuitew/txscriptw"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/payto"
+	"github.com/muun/recovery/sats"
 	"github.com/muun/recovery/scanner"
+	"github.com/muun/recovery/utils"
 )
 
-func buildSweepTx(utxos []*scanner.Utxo, sweepAddress btcutil.Address, fee int64) ([]byte, error) {
+// dustThreshold is the dust threshold of the largest standard outputs (P2PKH). It's the minimum
+// output amount we're willing to create when the output script isn't known yet (see
+// dustThresholdFor).
+const dustThreshold = 546
+
+func buildSweepTx(utxos []*scanner.Utxo, sweepAddress btcutil.Address, payments []*payment, fee sats.Amount) ([]byte, error) {
 
 	tx := wire.NewMsgTx(2)
-	value := int64(0)
 
 	for _, utxo := range utxos {
 		chainHash, err := chainhash.NewHashFromStr(utxo.TxID)
@@ -30,32 +38,73 @@ func buildSweepTx(utxos []*scanner.Utxo, sweepAddress btcutil.Address, fee int64
 		}
 
 		tx.AddTxIn(wire.NewTxIn(&outpoint, []byte{}, [][]byte{}))
-		value += utxo.Amount
 	}
 
-	value -= fee
+	total, err := scanner.Total(utxos)
+	if err != nil {
+		return nil, err
+	}
 
-	script, err := txscriptw.PayToAddrScript(sweepAddress)
+	script, err := payto.Script(sweepAddress)
 	if err != nil {
 		return nil, err
 	}
-	tx.AddTxOut(wire.NewTxOut(value, script))
 
-	writer := &bytes.Buffer{}
-	err = tx.Serialize(writer)
+	// The destination gets what's left after the payments given with --output, if any, and the fee:
+	paid, err := addPayments(tx, payments)
 	if err != nil {
 		return nil, err
 	}
 
-	if fee != 0 {
-		readConfirmation(value, fee, sweepAddress.String())
+	available, err := total.Sub(paid)
+	if err != nil {
+		return nil, utils.WrapError(
+			utils.ErrInsufficientFunds,
+			fmt.Errorf("the outputs given with --output add up to %d sats, more than the %d sats to send", paid, total),
+		)
+	}
+
+	value, err := available.Sub(fee)
+	if err != nil || value < dustThresholdFor(script) {
+		left := "the %d sats to send"
+		if len(payments) > 0 {
+			left = "the %d sats left after the outputs given with --output"
+		}
+
+		return nil, utils.WrapError(
+			utils.ErrInsufficientFunds,
+			fmt.Errorf(left+" can't pay a %d sats fee and leave more than the dust threshold", available, fee),
+		)
+	}
+
+	tx.TxOut = append([]*wire.TxOut{wire.NewTxOut(int64(value), script)}, tx.TxOut...)
+
+	writer := &bytes.Buffer{}
+	err = tx.Serialize(writer)
+	if err != nil {
+		return nil, err
 	}
 
 	return writer.Bytes(), nil
 }
 
-func buildSignedTx(utxos []*scanner.Utxo, sweepTx []byte, userKey *libwallet.HDPrivateKey,
-	muunKey *libwallet.HDPrivateKey) (*wire.MsgTx, error) {
+func buildSignedTx(utxos []*scanner.Utxo, sweepTx []byte, userKey keys.PrivateKey,
+	muunKey keys.PrivateKey) (_ *wire.MsgTx, err error) {
+
+	defer utils.RecoverPanic(&err)
+
+	// Signing is done by libwallet, and only works with its own keys:
+	libwalletUserKey, ok1 := keys.LibwalletPrivateKey(userKey)
+	libwalletMuunKey, ok2 := keys.LibwalletPrivateKey(muunKey)
+
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("can't sign with keys from a backend other than libwallet")
+	}
+
+	// Nonce generation panics if there's no randomness available. Check beforehand:
+	if err := utils.CheckRandomness(); err != nil {
+		return nil, err
+	}
 
 	inputList := &libwallet.InputList{}
 	for _, utxo := range utxos {
@@ -71,13 +120,17 @@ func buildSignedTx(utxos []*scanner.Utxo, sweepTx []byte, userKey *libwallet.HDP
 		return nil, err
 	}
 
-	signedTx, err := pstx.FullySign(userKey, muunKey)
+	signedTx, err := pstx.FullySign(libwalletUserKey, libwalletMuunKey)
 	if err != nil {
 		return nil, err
 	}
 
 	wireTx := wire.NewMsgTx(0)
-	wireTx.BtcDecode(bytes.NewReader(signedTx.Bytes), 0, wire.WitnessEncoding)
+	err = wireTx.BtcDecode(bytes.NewReader(signedTx.Bytes), 0, wire.WitnessEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signed tx: %w", err)
+	}
+
 	return wireTx, nil
 }
 
@@ -129,7 +182,7 @@ type outpoint struct {
 func (o *outpoint) TxId() []byte {
 	raw, err := hex.DecodeString(o.utxo.TxID)
 	if err != nil {
-		panic(err) // we wrote this hex value ourselves, no input from anywhere else
+		panic(err) // validated by the scanner when the utxo was found, see scanner.validateUnspentRef
 	}
 
 	return raw
@@ -140,5 +193,5 @@ func (o *outpoint) Index() int {
 }
 
 func (o *outpoint) Amount() int64 {
-	return o.utxo.Amount
+	return int64(o.utxo.Amount)
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/scanner"
+	"github.com/muun/recovery/utils"
+)
+
+// runReviewCommand loads a snapshot exported with --export-snapshot, and verifies the proposed
+// sweep using only public information. It needs no keys, so anyone can run it.
+func runReviewCommand(args []string) {
+	flags := flag.NewFlagSet("review", flag.ExitOnError)
+	offline := flags.Bool("offline", false, "don't check that the funds are still unspent")
+	evidencePath := flags.String("evidence", "", "check that the funds exist with this evidence bundle, saved with --export-evidence")
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	say(`
+		{blue Muun Recovery Tool v%s}
+
+		Reviewing a proposed recovery. Nothing will be signed or sent.
+	`, version)
+
+	s, err := loadSnapshot(flags.Arg(0))
+	if err != nil {
+		exitWithError(err)
+	}
+
+	addresses, err := s.verify()
+	if err != nil {
+		exitWithError(fmt.Errorf("the snapshot doesn't check out: %w", err))
+	}
+
+	sayBlock(`
+		{green ✓ Signature and transaction verified}
+
+		{whiteUnderline Snapshot of %s}
+
+	`, utils.FormatTime(s.CreatedAt))
+
+	if tag := s.caseTag.describe(); tag != "" {
+		say("For %s\n\n", tag)
+	}
+
+	for _, utxo := range s.Scan.Utxos {
+		say("• {white %d} sats in %s (%s)\n", utxo.Amount, utxo.Address, describePath(utxo.DerivationPath))
+	}
+
+	if *evidencePath != "" {
+		if err := checkSnapshotEvidence(s, *evidencePath); err != nil {
+			exitWithError(err)
+		}
+
+		say("\n{green ✓ Every output is proven to exist} by the evidence bundle\n")
+	}
+
+	sayBlock(`
+		{whiteUnderline Proposed transaction}
+		  {white Amount}: %v sats
+		  {white Fee}: %v sats
+		  {white Destination}: %v
+	`, s.Amount, s.Fee, s.Destination)
+
+	if *offline {
+		sayBlock("Skipped checking that the funds are still unspent\n\n")
+		recordCaseEvent(s.caseTag, "review", "Reviewed the snapshot %s, without checking the funds are unspent", flags.Arg(0))
+		return
+	}
+
+	sayBlock("Checking that the funds are still unspent...\n")
+
+	spent, err := findSpentUtxos(s, addresses)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if len(spent) > 0 {
+		for _, utxo := range spent {
+			say("{red • %d} sats in %s are no longer available\n", utxo.Amount, utxo.Address)
+		}
+
+		sayBlock("{red The snapshot is outdated}. Ask for a new one before signing\n\n")
+		recordCaseEvent(s.caseTag, "review", "Reviewed the snapshot %s, it's outdated", flags.Arg(0))
+		os.Exit(1)
+	}
+
+	say("{green ✓ All funds are still unspent}\n\n")
+	recordCaseEvent(s.caseTag, "review", "Reviewed the snapshot %s, it checks out", flags.Arg(0))
+}
+
+// describePath explains a derivation path for reviewers, such as "receiving address #7".
+func describePath(path string) string {
+	parsed, err := keys.ParsePath(path)
+	if err != nil {
+		return "invalid path " + path
+	}
+
+	return parsed.Describe()
+}
+
+// checkSnapshotEvidence verifies an evidence bundle, and checks that it proves every output the
+// snapshot spends. The proofs don't show the outputs are still unspent, only that they were mined.
+func checkSnapshotEvidence(s *snapshot, path string) error {
+	bundle, err := loadEvidenceBundle(path)
+	if err != nil {
+		return err
+	}
+
+	verified, err := bundle.verify()
+	if err != nil {
+		return fmt.Errorf("the evidence doesn't check out: %w", err)
+	}
+
+	proven := make(map[string]bool)
+	for _, evidence := range verified {
+		key := fmt.Sprintf("%s:%d:%d:%x", evidence.Utxo.TxID, evidence.Utxo.OutputIndex, evidence.Utxo.Amount, evidence.Utxo.Script)
+		proven[key] = true
+	}
+
+	for _, utxo := range s.Scan.Utxos {
+		key := fmt.Sprintf("%s:%d:%s", utxo.outpoint(), utxo.Amount, utxo.Script)
+		if !proven[key] {
+			return fmt.Errorf("the evidence bundle doesn't prove %d sats in %s exist", utxo.Amount, utxo.outpoint())
+		}
+	}
+
+	return nil
+}
+
+// findSpentUtxos returns the snapshot outputs that are no longer unspent.
+func findSpentUtxos(s *snapshot, addresses []libwallet.MuunAddress) ([]scanResultUtxo, error) {
+	unspent := make(map[string]bool)
+	iterator := scanner.NewScanner().Iterate(addresses)
+
+	for {
+		statuses, err := iterator.NextBatch(context.Background())
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to check funds: %w", err)
+		}
+
+		for _, status := range statuses {
+			for _, utxo := range status.Utxos {
+				unspent[fmt.Sprintf("%s:%d", utxo.TxID, utxo.OutputIndex)] = true
+			}
+		}
+	}
+
+	var spent []scanResultUtxo
+	for _, utxo := range s.Scan.Utxos {
+		if !unspent[utxo.outpoint()] {
+			spent = append(spent, utxo)
+		}
+	}
+
+	return spent, nil
+}
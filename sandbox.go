@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// enterSandbox restricts what the process can do from now on, if the user asked for it with
+// --sandbox. It's called once the keys are decrypted and in memory, when the Recovery Tool no
+// longer needs to read anything other than its caches and the files it was told to write.
+//
+// The restrictions can't be lifted, and depend on the platform: see restrictProcess. If they can't
+// be applied, we stop rather than go on without the protection the user asked for.
+//
+// `outputs` are files the Recovery Tool may still write, or read, such as --export-snapshot.
+func enterSandbox(outputs ...string) {
+	if !*sandbox {
+		return
+	}
+
+	var dirs []string
+	for _, path := range outputs {
+		if path != "" && path != "-" {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+	}
+
+	if workDir, err := os.Getwd(); err == nil {
+		dirs = append(dirs, workDir)
+	}
+
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		dirs = append(dirs, cacheDir)
+	}
+
+	if configDir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, configDir)
+	}
+
+	if err := restrictProcess(dirs); err != nil {
+		exitWithError(fmt.Errorf("couldn't enter the sandbox (run without --sandbox to skip it): %w", err))
+	}
+
+	say("{green ✓} Sandbox enabled\n\n")
+}
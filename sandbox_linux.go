@@ -0,0 +1,147 @@
+//go:build linux && (amd64 || 386 || arm64)
+// +build linux
+// +build amd64 386 arm64
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Values from linux/seccomp.h, missing in x/sys.
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+)
+
+// Offsets of the fields in struct seccomp_data, which filters inspect.
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// sandboxDeniedSyscalls fail with EPERM once the sandbox is in place. The Recovery Tool never
+// makes them, but an attacker who took over the process would use them to run other programs,
+// read its memory from another process, or reach into the kernel.
+var sandboxDeniedSyscalls = []uintptr{
+	unix.SYS_EXECVE,
+	unix.SYS_EXECVEAT,
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_CHROOT,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_BPF,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_KEYCTL,
+	unix.SYS_ADD_KEY,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_PERSONALITY,
+	unix.SYS_UNSHARE,
+	unix.SYS_SETNS,
+	unix.SYS_REBOOT,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+}
+
+// restrictProcess installs a seccomp filter on every thread, denying the system calls in
+// sandboxDeniedSyscalls, and stops other processes of the same user from attaching to this one.
+//
+// Unlike pledge on OpenBSD, this doesn't restrict which files can be opened: `dirs` are ignored.
+func restrictProcess(dirs []string) error {
+	// prctl settings are per-thread. Seccomp's TSYNC copies them to the other threads, as long
+	// as it runs on the same thread as prctl:
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0); err != nil {
+		return fmt.Errorf("prctl(PR_SET_DUMPABLE): %w", err)
+	}
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %w", err)
+	}
+
+	filter := sandboxFilter()
+	program := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	_, _, errno := unix.Syscall(
+		unix.SYS_SECCOMP,
+		seccompSetModeFilter,
+		seccompFilterFlagTsync,
+		uintptr(unsafe.Pointer(&program)),
+	)
+
+	if errno != 0 {
+		return fmt.Errorf("seccomp: %w", errno)
+	}
+
+	return nil
+}
+
+// sandboxFilter builds the BPF program for restrictProcess. It denies system calls made with a
+// different calling convention (other than sandboxArch), which have different numbers.
+func sandboxFilter() []unix.SockFilter {
+	load := func(offset uint32) unix.SockFilter {
+		return unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offset}
+	}
+
+	ret := func(value uint32) unix.SockFilter {
+		return unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: value}
+	}
+
+	// Jumps are relative, so we write the checks first and point them to DENY after:
+	type denial struct {
+		check    int
+		whenTrue bool
+	}
+
+	var checks []unix.SockFilter
+	var denials []denial
+
+	deny := func(code uint16, value uint32, whenTrue bool) {
+		denials = append(denials, denial{len(checks), whenTrue})
+		checks = append(checks, unix.SockFilter{Code: unix.BPF_JMP | code | unix.BPF_K, K: value})
+	}
+
+	checks = append(checks, load(seccompDataArch))
+	deny(unix.BPF_JEQ, sandboxArch, false)
+
+	checks = append(checks, load(seccompDataNr))
+	if sandboxSyscallLimit != 0 {
+		deny(unix.BPF_JGE, sandboxSyscallLimit, true)
+	}
+
+	for _, nr := range sandboxDeniedSyscalls {
+		deny(unix.BPF_JEQ, uint32(nr), true)
+	}
+
+	// The checks are followed by ALLOW, and then DENY:
+	for _, d := range denials {
+		offset := uint8(len(checks) - d.check)
+
+		if d.whenTrue {
+			checks[d.check].Jt = offset
+		} else {
+			checks[d.check].Jf = offset
+		}
+	}
+
+	return append(checks, ret(seccompRetAllow), ret(seccompRetErrno|uint32(unix.EPERM)))
+}
@@ -0,0 +1,7 @@
+package main
+
+// sandboxArch is AUDIT_ARCH_I386.
+const sandboxArch = 0x40000003
+
+// sandboxSyscallLimit is unused here: there's no other ABI on this architecture.
+const sandboxSyscallLimit = 0
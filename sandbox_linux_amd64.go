@@ -0,0 +1,8 @@
+package main
+
+// sandboxArch is AUDIT_ARCH_X86_64.
+const sandboxArch = 0xc000003e
+
+// sandboxSyscallLimit denies x32 system calls, which share the architecture but are numbered from
+// 0x40000000.
+const sandboxSyscallLimit = 0x40000000
@@ -0,0 +1,7 @@
+package main
+
+// sandboxArch is AUDIT_ARCH_AARCH64.
+const sandboxArch = 0xc00000b7
+
+// sandboxSyscallLimit is unused here: there's no other ABI on this architecture.
+const sandboxSyscallLimit = 0
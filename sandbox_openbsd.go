@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxPromises are the pledge(2) promises the Recovery Tool needs after loading the keys: files
+// (in the unveiled directories), the network and the terminal.
+const sandboxPromises = "stdio rpath wpath cpath inet dns tty flock"
+
+// sandboxSystemPaths are read by the standard library to resolve names and verify certificates.
+var sandboxSystemPaths = []string{"/etc/resolv.conf", "/etc/hosts", "/etc/ssl"}
+
+// restrictProcess hides every file except `dirs` (and a few system paths, read-only) with
+// unveil(2), and limits the process to the system calls in sandboxPromises with pledge(2).
+func restrictProcess(dirs []string) error {
+	for _, dir := range dirs {
+		if err := unveil(dir, "rwc"); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range sandboxSystemPaths {
+		if err := unveil(path, "r"); err != nil {
+			return err
+		}
+	}
+
+	if err := unix.UnveilBlock(); err != nil {
+		return fmt.Errorf("unveil: %w", err)
+	}
+
+	if err := unix.Pledge(sandboxPromises, ""); err != nil {
+		return fmt.Errorf("pledge: %w", err)
+	}
+
+	return nil
+}
+
+// unveil is unix.Unveil, ignoring paths that don't exist yet: there's nothing in them to protect.
+func unveil(path string, permissions string) error {
+	err := unix.Unveil(path, permissions)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unveil %s: %w", path, err)
+	}
+
+	return nil
+}
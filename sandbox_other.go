@@ -0,0 +1,14 @@
+//go:build (!linux && !openbsd) || (linux && !amd64 && !386 && !arm64)
+// +build !linux,!openbsd linux,!amd64,!386,!arm64
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// restrictProcess isn't supported on this platform.
+func restrictProcess(dirs []string) error {
+	return fmt.Errorf("sandboxing isn't supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,92 @@
+// Package sats handles amounts of bitcoin, in satoshis.
+//
+// Amounts come from untrusted sources (servers, history dumps, files shared for review), and are
+// summed, subtracted and multiplied into the values of transactions. Arithmetic on an Amount fails
+// when the result is out of range, instead of silently overflowing or going negative.
+package sats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Max is the largest valid amount: all the bitcoin there will ever be.
+const Max Amount = 21000000 * 1e8
+
+// Amount is a number of satoshis, between 0 and Max.
+type Amount int64
+
+// ErrOutOfRange means an amount, or the result of arithmetic on amounts, is not between 0 and Max.
+var ErrOutOfRange = errors.New("amount out of range")
+
+// New returns an amount of `value` satoshis, checking it's in range.
+func New(value int64) (Amount, error) {
+	amount := Amount(value)
+	if !amount.valid() {
+		return 0, fmt.Errorf("%w: %d sats", ErrOutOfRange, value)
+	}
+
+	return amount, nil
+}
+
+// Add returns a + b.
+func (a Amount) Add(b Amount) (Amount, error) {
+	if !a.valid() || !b.valid() || a > Max-b {
+		return 0, fmt.Errorf("%w: %d + %d sats", ErrOutOfRange, a, b)
+	}
+
+	return a + b, nil
+}
+
+// Sub returns a - b. Subtracting more than there is fails.
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if !a.valid() || !b.valid() || b > a {
+		return 0, fmt.Errorf("%w: %d - %d sats", ErrOutOfRange, a, b)
+	}
+
+	return a - b, nil
+}
+
+// Mul returns a * n, such as a fee rate times a size.
+func (a Amount) Mul(n int64) (Amount, error) {
+	if !a.valid() || n < 0 || (n > 0 && a > Max/Amount(n)) {
+		return 0, fmt.Errorf("%w: %d sats * %d", ErrOutOfRange, a, n)
+	}
+
+	return a * Amount(n), nil
+}
+
+// Sum adds up amounts.
+func Sum(amounts ...Amount) (Amount, error) {
+	var total Amount
+
+	for _, amount := range amounts {
+		var err error
+		if total, err = total.Add(amount); err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
+}
+
+// UnmarshalJSON decodes an amount, checking it's in range, since files can be edited by anyone.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	var value int64
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	amount, err := New(value)
+	if err != nil {
+		return err
+	}
+
+	*a = amount
+	return nil
+}
+
+func (a Amount) valid() bool {
+	return a >= 0 && a <= Max
+}
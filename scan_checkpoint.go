@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/scanner"
+	"github.com/muun/recovery/statedb"
+	"github.com/muun/recovery/utils"
+)
+
+// Scans can take long, and a flaky connection can make them fail halfway. With --state-file, the
+// scan records its progress, and a new run resumes where the last one stopped:
+//
+//	recovery-tool --state-file recovery.json
+//
+// The file has a line for each batch of addresses scanned, with the outputs found in them. When
+// resuming, addresses without funds are not scanned again. Those with funds are, so their outputs
+// are up to date: they could have been spent since. Once the scan completes, the file is removed,
+// since a later run should see funds that arrived in the meantime.
+//
+// Lines are appended as the scan goes, so a crash loses at most the one being written.
+//
+// With --db, the checkpoint is kept in the state database instead, without having to ask: one for
+// each wallet, with the same lines.
+
+// scanCheckpointVersion is the version of the checkpoint file format.
+const scanCheckpointVersion = 1
+
+// scanCheckpoint is the progress of a scan, saved as it goes.
+type scanCheckpoint struct {
+	path      string
+	file      *os.File
+	db        *statedb.DB // instead of the file, with --db
+	name      string      // of the checkpoint in the database
+	startedAt time.Time
+
+	scanned map[string]bool // addresses without funds, not scanned again
+	funded  map[string]bool // addresses with funds, scanned again
+	skipped int32           // addresses not scanned again in this run, updated atomically
+	found   int             // outputs of the current scan already recorded
+}
+
+// scanCheckpointHeader is the first line of a checkpoint file.
+type scanCheckpointHeader struct {
+	Version int `json:"version"`
+	caseTag
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// scanCheckpointEntry is a line of a checkpoint file, after the header.
+type scanCheckpointEntry struct {
+	Scanned []string         `json:"scanned"`
+	Utxos   []scanResultUtxo `json:"utxos,omitempty"`
+}
+
+// openScanCheckpoint resumes the checkpoint given with --state-file, or the one of the wallet in
+// the database given with --db, or in the user's cache with --low-bandwidth, or starts it. Without
+// any of these options, it returns nil, and nothing is saved.
+func openScanCheckpoint() *scanCheckpoint {
+	var checkpoint *scanCheckpoint
+	var err error
+
+	switch {
+	case stateDB != nil:
+		checkpoint, err = loadStateDBCheckpoint(stateDB, "scan:"+walletID)
+	case *stateFile != "":
+		checkpoint, err = loadScanCheckpoint(*stateFile)
+	case *lowBandwidth:
+		var path string
+		if path, err = lowBandwidthCheckpointPath(); err == nil {
+			checkpoint, err = loadScanCheckpoint(path)
+		}
+	default:
+		return nil
+	}
+
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if len(checkpoint.scanned)+len(checkpoint.funded) > 0 {
+		say(
+			"► {white Resuming the scan} started at %s: %d addresses done, the %d with funds will be checked again\n",
+			utils.FormatTime(checkpoint.startedAt),
+			len(checkpoint.scanned)+len(checkpoint.funded),
+			len(checkpoint.funded),
+		)
+	}
+
+	return checkpoint
+}
+
+// loadScanCheckpoint reads a checkpoint file, or creates it if it doesn't exist, and opens it to
+// record more progress.
+func loadScanCheckpoint(path string) (*scanCheckpoint, error) {
+	checkpoint := &scanCheckpoint{
+		path:    path,
+		scanned: make(map[string]bool),
+		funded:  make(map[string]bool),
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scan state: %w", err)
+	}
+
+	valid, err := checkpoint.read(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// A line cut short by a crash is dropped, the next ones go where it started:
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open scan state: %w", err)
+	}
+
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open scan state: %w", err)
+	}
+
+	checkpoint.file = file
+
+	if valid == 0 {
+		if err := checkpoint.start(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return checkpoint, nil
+}
+
+// loadStateDBCheckpoint reads a checkpoint from the database, and starts it if it was never
+// written. Lines are written whole, there are none cut short to drop.
+func loadStateDBCheckpoint(db *statedb.DB, name string) (*scanCheckpoint, error) {
+	checkpoint := &scanCheckpoint{
+		path:    db.Path(),
+		db:      db,
+		name:    name,
+		scanned: make(map[string]bool),
+		funded:  make(map[string]bool),
+	}
+
+	lines, err := db.CheckpointLines(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, line := range lines {
+		if err := checkpoint.readLine(i+1, line); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(lines) == 0 {
+		if err := checkpoint.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	return checkpoint, nil
+}
+
+// start writes the header of a new checkpoint.
+func (c *scanCheckpoint) start() error {
+	c.startedAt = time.Now().UTC()
+
+	return c.append(scanCheckpointHeader{Version: scanCheckpointVersion, caseTag: currentTag(), StartedAt: c.startedAt})
+}
+
+// read loads the progress in a checkpoint file, and returns the length of the lines that could be
+// read in full.
+func (c *scanCheckpoint) read(file *os.File) (int64, error) {
+	reader := bufio.NewReader(file)
+
+	var valid int64
+
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return valid, nil // an unterminated line was being written when the scan stopped
+		}
+
+		if err != nil {
+			return 0, fmt.Errorf("failed to read scan state: %w", err)
+		}
+
+		if err := c.readLine(lineNumber, line); err != nil {
+			return 0, err
+		}
+
+		valid += int64(len(line))
+	}
+}
+
+// readLine loads the progress in a line: the header first, then the entries.
+func (c *scanCheckpoint) readLine(lineNumber int, line []byte) error {
+	if lineNumber == 1 {
+		var header scanCheckpointHeader
+		if err := json.Unmarshal(line, &header); err != nil {
+			return fmt.Errorf("%s is not a scan state file: %w", c.path, err)
+		}
+
+		if header.Version != scanCheckpointVersion {
+			return fmt.Errorf("unsupported scan state version %d in %s", header.Version, c.path)
+		}
+
+		c.startedAt = header.StartedAt
+
+		return nil
+	}
+
+	var entry scanCheckpointEntry
+	if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+		return fmt.Errorf("invalid scan state in %s, line %d: %w", c.path, lineNumber, err)
+	}
+
+	for _, address := range entry.Scanned {
+		c.scanned[address] = true
+	}
+
+	for _, utxo := range entry.Utxos {
+		c.funded[utxo.Address] = true
+	}
+
+	return nil
+}
+
+// filter passes on the addresses that weren't scanned yet, and those with funds.
+func (c *scanCheckpoint) filter(addresses chan libwallet.MuunAddress) chan libwallet.MuunAddress {
+	filtered := make(chan libwallet.MuunAddress)
+
+	go func() {
+		defer close(filtered)
+
+		for address := range addresses {
+			if c.scanned[address.Address()] && !c.funded[address.Address()] {
+				atomic.AddInt32(&c.skipped, 1)
+				continue
+			}
+
+			filtered <- address
+		}
+	}()
+
+	return filtered
+}
+
+// skippedAddresses returns how many addresses weren't scanned again, so far.
+func (c *scanCheckpoint) skippedAddresses() int {
+	return int(atomic.LoadInt32(&c.skipped))
+}
+
+// record saves the progress in a scan report.
+func (c *scanCheckpoint) record(report *scanner.Report) error {
+	if len(report.Scanned) == 0 {
+		return nil
+	}
+
+	entry := scanCheckpointEntry{Scanned: report.Scanned}
+
+	for _, utxo := range report.UtxosFound[c.found:] {
+		entry.Utxos = append(entry.Utxos, newScanResultUtxo(utxo))
+	}
+
+	c.found = len(report.UtxosFound)
+
+	return c.append(entry)
+}
+
+// append writes a line to the file, or the database.
+func (c *scanCheckpoint) append(line interface{}) error {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return fmt.Errorf("failed to encode scan state: %w", err)
+	}
+
+	if c.db != nil {
+		return c.db.AppendCheckpoint(c.name, data)
+	}
+
+	if _, err := c.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to save scan state: %w", err)
+	}
+
+	return nil
+}
+
+// complete removes the file, or the checkpoint from the database, once the scan is done.
+func (c *scanCheckpoint) complete() {
+	if c.db != nil {
+		if err := c.db.ClearCheckpoint(c.name); err != nil {
+			say("{yellow Couldn't remove the scan state}: %v\n", err)
+		}
+
+		return
+	}
+
+	c.file.Close()
+
+	if err := os.Remove(c.path); err != nil {
+		say("{yellow Couldn't remove the scan state}: %v\n", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/muun/recovery/utils"
+)
+
+// runScanCommand scans the wallet and reports the funds found, without sweeping them. Results can
+// be saved, and compared against those of a previous run.
+func runScanCommand(args []string) {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	outPath := flags.String("out", "", "save the scan results to this file, as JSON (or protobuf, if it ends in .pb)")
+	diffPath := flags.String("diff", "", "compare against the results of a previous scan, saved with --out")
+
+	flags.Parse(args)
+
+	if flags.NArg() > 1 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	// Load the previous results first, we don't want to find out they're broken after scanning:
+	var previous *scanResults
+
+	if *diffPath != "" {
+		var err error
+
+		previous, err = loadScanResults(*diffPath)
+		if err != nil {
+			exitWithError(err)
+		}
+	}
+
+	hints := readScanHints()
+
+	say(`
+		{blue Muun Recovery Tool v%s}
+
+		This will scan your wallet and show your funds, {white without moving them}.
+
+		You will need {yellow your Recovery Code} and {yellow your Emergency Kit PDF}.
+	`, version)
+
+	var p *openProfile
+	if *profileName != "" {
+		p = loadOrCreateProfile(*profileName)
+
+		// Unless told otherwise, compare against the last scan of this wallet:
+		if previous == nil {
+			previous = p.LastScan
+		}
+	} else if *profileSync != "" {
+		exitWithError(fmt.Errorf("--profile-sync needs a --profile to sync"))
+	}
+
+	servers := preferredServers(p)
+	checkServerNetworks(servers)
+
+	enterOfflineWindow("decrypting your keys")
+	generations := readKeyGenerations(flags.Arg(0))
+	leaveOfflineWindow(*historyDump == "")
+
+	enterSandbox(*outPath, *historyDump)
+
+	sayBlock(`
+		Starting scan of all possible addresses. This will take a few minutes.
+	`)
+
+	utxoScanner, report := scanFunds(generations, servers, hints)
+	current := newScanResults(report)
+
+	confirmed, pending := holdUnconfirmed(utxoScanner, report.UtxosFound)
+	printUtxos(confirmed, generations)
+	pending.print()
+	emitUtxos(confirmed, pending)
+
+	if previous != nil && previous.Wallet != "" && previous.Wallet != current.Wallet {
+		sayBlock("{yellow The previous results are of a different wallet}, %s\n", previous.Wallet)
+	}
+
+	if previous != nil {
+		printScanDiff(diffScanResults(previous, current, utxoScanner))
+	}
+
+	if *outPath != "" {
+		if err := current.save(*outPath); err != nil {
+			exitWithError(err)
+		}
+
+		sayBlock("Scan results saved to {white %s}\n\n", *outPath)
+		recordCaseEvent(current.caseTag, "scan-results", "Saved the scan results to %s", *outPath)
+	}
+
+	if p != nil {
+		p.LastScan = current
+
+		if err := p.save(); err != nil {
+			exitWithError(err)
+		}
+
+		sayBlock("Scan results saved to profile {white %s}\n\n", *profileName)
+	}
+}
+
+func printScanDiff(diff *scanDiff) {
+	sayBlock(`
+		{whiteUnderline Changes since the scan of %s}
+
+	`, utils.FormatTime(diff.Previous.ScannedAt))
+
+	if len(diff.NewlyFound)+len(diff.NewlySpent)+len(diff.Missing) == 0 {
+		say("No changes, the same %d outputs were found\n", len(diff.Unchanged))
+		return
+	}
+
+	for _, utxo := range diff.NewlyFound {
+		say("{green + %d} sats in %s (newly found)\n", utxo.Amount, utxo.Address)
+	}
+
+	for _, utxo := range diff.NewlySpent {
+		say("{red - %d} sats in %s (spent since)\n", utxo.Amount, utxo.Address)
+	}
+
+	for _, utxo := range diff.Missing {
+		say("{yellow ? %d} sats in %s (address not scanned this time)\n", utxo.Amount, utxo.Address)
+	}
+
+	before, err := diff.Previous.total()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	now, err := diff.Current.total()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	say("\n%d outputs unchanged\n", len(diff.Unchanged))
+	say("— {white %d} sats before, {white %d} sats now\n", before, now)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/scanner"
+)
+
+// The scan covers a fixed range of indexes in each chain of addresses (see AddressGenerator), and
+// funds beyond it aren't found. Once the scan is complete, we show what it covered in each chain of
+// each kit, and where the funds were, so users and support can judge whether scanning further could
+// find more.
+//
+// Wallets leave gaps between the addresses they use, so funds close to the end of a range, closer
+// than the gaps before them, suggest there may be more after it.
+
+// coverageMarginDivisor sets how close to the end of a range funds must be for us to warn, at
+// least: the last 1/20th of it.
+const coverageMarginDivisor = 20
+
+// chainCoverage is what a scan covered in a chain of addresses, by index. Each index has an
+// address of every version.
+type chainCoverage struct {
+	name    string
+	last    uint32 // the last index generated, they start at 0
+	skipped map[uint32]bool
+	funded  map[uint32]bool
+}
+
+// generationCoverage is what a scan covered in the chains of a key generation. Each contact has a
+// chain of its own.
+type generationCoverage struct {
+	name     string
+	change   *chainCoverage
+	external *chainCoverage
+	contacts map[uint32]*chainCoverage
+}
+
+func newChainCoverage(name string) *chainCoverage {
+	return &chainCoverage{
+		name:    name,
+		skipped: make(map[uint32]bool),
+		funded:  make(map[uint32]bool),
+	}
+}
+
+// newGenerationCoverage collects the coverage of a generation, whose addresses were streamed for a
+// complete scan.
+func newGenerationCoverage(generation *keyGeneration, hints *scanHints, funded map[string]bool) *generationCoverage {
+	coverage := &generationCoverage{
+		name:     generation.Name,
+		change:   newChainCoverage("change"),
+		external: newChainCoverage("receiving"),
+		contacts: make(map[uint32]*chainCoverage),
+	}
+
+	for _, details := range generation.generator.Addresses() {
+		path, err := keys.ParsePath(details.Address.DerivationPath())
+		if err != nil {
+			continue
+		}
+
+		chain, index, ok := coverage.chainOf(path)
+		if !ok {
+			continue
+		}
+
+		chain.add(index, hints.skipsPath(path), funded[details.Address.Address()])
+	}
+
+	return coverage
+}
+
+// chainOf returns the chain of an address path, and its index in it. See keys.Path for the schema.
+func (c *generationCoverage) chainOf(path keys.Path) (*chainCoverage, uint32, bool) {
+	switch {
+	case len(path) == 4 && path[2].Index == 0:
+		return c.change, path[3].Index, true
+
+	case len(path) == 4 && path[2].Index == 1:
+		return c.external, path[3].Index, true
+
+	case len(path) == 5 && path[2].Index == 2:
+		contact := path[3].Index
+		if c.contacts[contact] == nil {
+			c.contacts[contact] = newChainCoverage(fmt.Sprintf("contact #%d", contact))
+		}
+
+		return c.contacts[contact], path[4].Index, true
+	}
+
+	return nil, 0, false
+}
+
+// contactsSummary is the coverage of the contacts themselves: which were scanned, and which have
+// funds.
+func (c *generationCoverage) contactsSummary() *chainCoverage {
+	summary := newChainCoverage("contacts")
+
+	for contact, chain := range c.contacts {
+		summary.add(contact, chain.scanned() == 0, len(chain.funded) > 0)
+	}
+
+	return summary
+}
+
+// chains returns the chains to show, in order: contacts are summarized, and only those with funds
+// are shown on their own.
+func (c *generationCoverage) chains() []*chainCoverage {
+	chains := []*chainCoverage{c.change, c.external, c.contactsSummary()}
+
+	var funded []uint32
+	for contact, chain := range c.contacts {
+		if len(chain.funded) > 0 {
+			funded = append(funded, contact)
+		}
+	}
+
+	sort.Slice(funded, func(i, j int) bool { return funded[i] < funded[j] })
+
+	for _, contact := range funded {
+		chains = append(chains, c.contacts[contact])
+	}
+
+	return chains
+}
+
+func (c *chainCoverage) add(index uint32, skipped, funded bool) {
+	if index > c.last {
+		c.last = index
+	}
+
+	if skipped {
+		c.skipped[index] = true
+	}
+
+	if funded {
+		c.funded[index] = true
+	}
+}
+
+func (c *chainCoverage) scanned() int {
+	return int(c.last) + 1 - len(c.skipped)
+}
+
+func (c *chainCoverage) lastFunded() (uint32, bool) {
+	var last uint32
+	for index := range c.funded {
+		if index > last {
+			last = index
+		}
+	}
+
+	return last, len(c.funded) > 0
+}
+
+// largestGap returns the longest run of indexes without funds, before the last one with funds.
+func (c *chainCoverage) largestGap() (from, to uint32, ok bool) {
+	lastFunded, hasFunds := c.lastFunded()
+	if !hasFunds {
+		return 0, 0, false
+	}
+
+	start := uint32(0)
+
+	for index := uint32(0); index <= lastFunded; index++ {
+		if !c.funded[index] {
+			continue
+		}
+
+		if index > start && (!ok || index-start > to-from+1) {
+			from, to, ok = start, index-1, true
+		}
+
+		start = index + 1
+	}
+
+	return from, to, ok
+}
+
+// nearEnd returns whether the last funds are close enough to the end of the range that there may
+// be more after it.
+func (c *chainCoverage) nearEnd() bool {
+	lastFunded, hasFunds := c.lastFunded()
+	if !hasFunds {
+		return false
+	}
+
+	margin := (c.last + 1) / coverageMarginDivisor
+	if from, to, ok := c.largestGap(); ok && to-from+1 > margin {
+		margin = to - from + 1
+	}
+
+	return c.last-lastFunded <= margin
+}
+
+func (c *chainCoverage) print(generation string) {
+	lastFunded, gap := "-", "-"
+
+	if index, ok := c.lastFunded(); ok {
+		lastFunded = fmt.Sprintf("#%d", index)
+	}
+
+	if from, to, ok := c.largestGap(); ok {
+		gap = fmt.Sprintf("#%d-%d", from, to)
+	}
+
+	say("  %-8s %-12s #0-%-8d %8d %7d  %-12s %s\n",
+		generation, c.name, c.last, len(c.skipped), len(c.funded), lastFunded, gap)
+}
+
+// printScanCoverage shows what a complete scan covered, in every chain of every generation, and
+// warns about funds found close to the end of a range. Then, how the scan hints were used.
+func printScanCoverage(generations []*keyGeneration, hints *scanHints, report *scanner.Report) {
+	funded := make(map[string]bool)
+	for _, utxo := range report.UtxosFound {
+		funded[utxo.Address.Address()] = true
+	}
+
+	sayBlock(`
+		{whiteUnderline Scan coverage}
+	`)
+
+	say("  %-8s %-12s %-11s %8s %7s  %-12s %s\n", "Kit", "Chain", "Indexes", "Skipped", "Funded", "Last funded", "Largest gap")
+
+	var nearEnd []string
+
+	for _, generation := range generations {
+		coverage := newGenerationCoverage(generation, hints, funded)
+
+		for _, chain := range coverage.chains() {
+			chain.print(generation.Name)
+
+			if chain.nearEnd() {
+				nearEnd = append(nearEnd, fmt.Sprintf("%s, %s", generation.Name, chain.name))
+			}
+		}
+	}
+
+	for _, chain := range nearEnd {
+		say("{yellow !} %s has funds close to the end of the scanned indexes. There may be more after them, which this scan can't find\n", chain)
+	}
+
+	if len(nearEnd) > 0 {
+		say("  If you expected more funds, contact us at {blue support@muun.com} with this report\n")
+	}
+
+	printScanHintsOutcome(hints, report)
+
+	fmt.Fprintln(userOutput)
+}
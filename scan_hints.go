@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/muun/libwallet"
+	"github.com/muun/libwallet/btcsuitew/btcutilw"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/scanner"
+)
+
+// Users who know something about their wallet (from old statements, or a previous recovery) can
+// speed up the scan with a hints file, given with --scan-hints. Each line is a hint:
+//
+//	# addresses known to have funds, scanned first:
+//	prioritize bc1qxy2kgdygjrsqtzq2n0yrf2493p83kkfjhx0wlh
+//
+//	# derivation paths known to be empty, not scanned at all:
+//	skip m/1'/1'/2/5            contact #5, and all its addresses
+//	skip m/1'/1'/1/100-2500     receiving addresses #100 to #2500
+//
+// Skipping is a trade-off: funds in skipped addresses won't be found. The scan reports what was
+// left out.
+
+// scanHintRangeRe matches a path ending in a range of indexes, such as m/1'/1'/1/100-2500.
+var scanHintRangeRe = regexp.MustCompile(`^(.*)/(\d+)-(\d+)$`)
+
+// scanHints are the hints loaded from a file, and the record of how they were used in a scan.
+type scanHints struct {
+	prioritized map[string]bool // by address
+	skipped     []pathRange
+
+	// Filled in while streaming addresses:
+	prioritizedSeen map[string]bool
+	skippedSeen     map[string]bool // addresses can be streamed more than once
+}
+
+// pathRange matches the children of a path with indexes in [From, To], and their descendants.
+type pathRange struct {
+	Parent   keys.Path
+	From, To keys.PathSegment
+}
+
+// readScanHints loads the hints given with --scan-hints, if any.
+func readScanHints() *scanHints {
+	if *scanHintsPath == "" {
+		return nil
+	}
+
+	hints, err := loadScanHints(*scanHintsPath)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	return hints
+}
+
+func loadScanHints(path string) (*scanHints, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scan hints: %w", err)
+	}
+	defer file.Close()
+
+	hints := &scanHints{
+		prioritized:     make(map[string]bool),
+		prioritizedSeen: make(map[string]bool),
+		skippedSeen:     make(map[string]bool),
+	}
+
+	lineScanner := bufio.NewScanner(file)
+
+	for lineNumber := 1; lineScanner.Scan(); lineNumber++ {
+		fields := strings.Fields(lineScanner.Text())
+
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid scan hint in line %d: expected a hint and its target", lineNumber)
+		}
+
+		switch fields[0] {
+		case "prioritize":
+			address, err := btcutilw.DecodeAddress(fields[1], &chainParams)
+			if err == nil && !address.IsForNet(&chainParams) {
+				err = fmt.Errorf("%s isn't a Bitcoin address", fields[1])
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid scan hint in line %d: %w", lineNumber, err)
+			}
+
+			hints.prioritized[address.String()] = true
+
+		case "skip":
+			skipped, err := parsePathRange(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid scan hint in line %d: %w", lineNumber, err)
+			}
+
+			hints.skipped = append(hints.skipped, skipped)
+
+		default:
+			return nil, fmt.Errorf("invalid scan hint in line %d: unknown hint %q", lineNumber, fields[0])
+		}
+	}
+
+	if err := lineScanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read scan hints: %w", err)
+	}
+
+	return hints, nil
+}
+
+// parsePathRange parses a path, optionally ending in a range of indexes (such as 100-2500).
+func parsePathRange(text string) (pathRange, error) {
+	from, to := text, text
+
+	if match := scanHintRangeRe.FindStringSubmatch(text); match != nil {
+		from, to = match[1]+"/"+match[2], match[1]+"/"+match[3]
+	}
+
+	fromPath, err := keys.ParsePath(from)
+	if err != nil {
+		return pathRange{}, err
+	}
+
+	toPath, err := keys.ParsePath(to)
+	if err != nil {
+		return pathRange{}, err
+	}
+
+	if len(fromPath) < 3 {
+		return pathRange{}, fmt.Errorf("%s would skip the whole wallet", text)
+	}
+
+	first, last := fromPath[len(fromPath)-1], toPath[len(toPath)-1]
+	if first.Index > last.Index {
+		return pathRange{}, fmt.Errorf("invalid range in %s", text)
+	}
+
+	return pathRange{Parent: fromPath[:len(fromPath)-1], From: first, To: last}, nil
+}
+
+// contains returns whether a path is in the range, or under it.
+func (r pathRange) contains(path keys.Path) bool {
+	if len(path) <= len(r.Parent) || path[:len(r.Parent)].String() != r.Parent.String() {
+		return false
+	}
+
+	child := path[len(r.Parent)]
+
+	return child.Hardened == r.From.Hardened && child.Index >= r.From.Index && child.Index <= r.To.Index
+}
+
+// hasPriorities returns whether any address should be scanned before the rest.
+func (h *scanHints) hasPriorities() bool {
+	return h != nil && len(h.prioritized) > 0
+}
+
+// prioritizes returns whether an address should be scanned before the rest.
+func (h *scanHints) prioritizes(address libwallet.MuunAddress) bool {
+	if h == nil || !h.prioritized[address.Address()] {
+		return false
+	}
+
+	h.prioritizedSeen[address.Address()] = true
+	return true
+}
+
+// skips returns whether an address shouldn't be scanned at all.
+func (h *scanHints) skips(address libwallet.MuunAddress) bool {
+	if h == nil || len(h.skipped) == 0 {
+		return false
+	}
+
+	path, err := keys.ParsePath(address.DerivationPath())
+	if err != nil || !h.skipsPath(path) {
+		return false
+	}
+
+	h.skippedSeen[address.Address()] = true
+	return true
+}
+
+// skipsPath returns whether a path is in a range marked as empty.
+func (h *scanHints) skipsPath(path keys.Path) bool {
+	if h == nil {
+		return false
+	}
+
+	for _, skipped := range h.skipped {
+		if skipped.contains(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// prioritizedAddresses lists the addresses to scan first.
+func (h *scanHints) prioritizedAddresses() []string {
+	var addresses []string
+	if h != nil {
+		for address := range h.prioritized {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
+// printScanHintsOutcome tells the user how the hints shaped the scan: what was left out, and
+// whether the addresses they expected funds in had any.
+func printScanHintsOutcome(hints *scanHints, report *scanner.Report) {
+	if hints == nil {
+		return
+	}
+
+	funded := make(map[string]bool)
+	for _, utxo := range report.UtxosFound {
+		funded[utxo.Address.Address()] = true
+	}
+
+	sayBlock(`
+		{whiteUnderline Scan hints}
+		  {white Scanned}: %d addresses
+		  {white Skipped}: %d addresses, in ranges you marked as empty
+	`, report.ScannedAddresses, len(hints.skippedSeen))
+
+	for address := range hints.prioritized {
+		switch {
+		case !hints.prioritizedSeen[address]:
+			say("{yellow !} %s isn't one of the addresses we scan, or you skipped it\n", address)
+		case funded[address]:
+			say("{green ✓} %s has funds\n", address)
+		default:
+			say("{yellow !} %s has no funds left\n", address)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/muun/recovery/scanner"
+)
+
+// The scan runs in one of two modes, set with --mode:
+//
+// Fast mode scans the addresses wallets actually use (see fastLimits), with whatever servers answer
+// first. It finds the funds of almost every wallet, and it's what users should try first.
+//
+// Forensic mode is for those sure there was more money than the fast scan found. It derives much
+// longer chains, and many more contacts (see forensicLimits), then scans everything again with
+// servers other than those that answered the first time, to rule out a server that's out of date or
+// hiding outputs. Where the scans disagree, the evidence settles it (see reconcileScans), and the
+// differences are reported.
+//
+// Both modes generate every address version, for every path.
+const (
+	scanModeFast     = "fast"
+	scanModeForensic = "forensic"
+)
+
+func checkScanMode() {
+	if *scanMode != scanModeFast && *scanMode != scanModeForensic {
+		exitWithError(fmt.Errorf("invalid scan mode %q, use %s or %s", *scanMode, scanModeFast, scanModeForensic))
+	}
+}
+
+// scanLimits returns the ranges of addresses to generate in the current mode.
+func scanLimits() addressLimits {
+	if *scanMode == scanModeForensic {
+		return forensicLimits
+	}
+
+	return fastLimits
+}
+
+// crossCheckScan scans the addresses of all generations again, with servers other than those that
+// answered the first scan, and returns a report with the outputs found by either one. Offline scans
+// use a single history dump, so they can't be checked this way.
+func crossCheckScan(
+	generations []*keyGeneration,
+	servers []string,
+	hints *scanHints,
+	utxoScanner *scanner.Scanner,
+	report *scanner.Report,
+) *scanner.Report {
+
+	if *historyDump != "" {
+		say("{yellow !} The scan was offline, so it can't be checked against other servers\n")
+		return report
+	}
+
+	if *chainBackend != backendElectrum {
+		say("{yellow !} The scan used the %s backend, so it can't be checked against other servers\n", *chainBackend)
+		return report
+	}
+
+	firstServers := utxoScanner.AnsweringServers()
+
+	sayBlock(`
+		{white Forensic mode}: scanning again, with servers other than the %d that answered, to check
+		the results.
+	`, len(firstServers))
+
+	checkScanner := scanner.NewScannerWithout(servers, firstServers)
+	checkReport := runScan(checkScanner, generations, hints, nil)
+
+	say("{green ✓ Second scan complete}\n")
+
+	if shared := sharedServers(firstServers, checkScanner.AnsweringServers()); len(shared) > 0 {
+		say("{yellow !} No other servers were available for some addresses, %d servers answered both scans\n", len(shared))
+	}
+
+	reconciled := reconcileScans(report.UtxosFound, checkReport.UtxosFound, utxoScanner, checkScanner)
+	reconciled.print()
+
+	if len(reconciled.Discrepancies) == 0 {
+		say("{green ✓} Both scans found the same %d outputs\n", len(reconciled.Utxos))
+	} else {
+		say(`
+			Servers can be out of date, or leave outputs out. Where the scans disagreed, outputs were
+			checked against their transactions and the proof they were mined. Those included are checked
+			once more before sending.
+		`)
+	}
+
+	recordCaseEvent(currentTag(), "cross-check", "Scanned again with other servers: %d outputs in total, %d discrepancies, %d outputs left out",
+		len(reconciled.Utxos), len(reconciled.Discrepancies), reconciled.dropped())
+
+	return &scanner.Report{ScannedAddresses: report.ScannedAddresses, UtxosFound: reconciled.Utxos}
+}
+
+func outpointOf(utxo *scanner.Utxo) string {
+	return fmt.Sprintf("%s:%d", utxo.TxID, utxo.OutputIndex)
+}
+
+func sharedServers(first, second []string) []string {
+	inFirst := make(map[string]bool)
+	for _, server := range first {
+		inFirst[server] = true
+	}
+
+	var shared []string
+	for _, server := range second {
+		if inFirst[server] {
+			shared = append(shared, server)
+		}
+	}
+
+	return shared
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/muun/recovery/artifacts"
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/scanner"
+)
+
+// scanResultsVersion is the version of the scan results file format.
+const scanResultsVersion = 1
+
+// scanResults is the saved outcome of a scan, that later runs can be compared against.
+type scanResults struct {
+	Version int `json:"version"`
+	caseTag
+	ScannedAt        time.Time        `json:"scannedAt"`
+	ScannedAddresses int              `json:"scannedAddresses"`
+	Utxos            []scanResultUtxo `json:"utxos"`
+}
+
+// scanResultUtxo is an unspent output in a scanResults file.
+type scanResultUtxo struct {
+	TxID           string      `json:"txId"`
+	OutputIndex    int         `json:"outputIndex"`
+	Amount         sats.Amount `json:"amount"`
+	Address        string      `json:"address"`
+	AddressVersion int         `json:"addressVersion"`
+	DerivationPath string      `json:"derivationPath"`
+	Script         string      `json:"script"`
+}
+
+// scanDiff describes what changed between two scans.
+type scanDiff struct {
+	Previous   *scanResults
+	Current    *scanResults
+	NewlyFound []scanResultUtxo // outputs that weren't there before
+	NewlySpent []scanResultUtxo // outputs that were there before, and are now gone
+	Missing    []scanResultUtxo // outputs that were there before, in addresses we didn't scan now
+	Unchanged  []scanResultUtxo
+}
+
+func newScanResults(report *scanner.Report) *scanResults {
+	results := &scanResults{
+		Version:          scanResultsVersion,
+		caseTag:          currentTag(),
+		ScannedAt:        time.Now().UTC(),
+		ScannedAddresses: report.ScannedAddresses,
+		Utxos:            []scanResultUtxo{},
+	}
+
+	for _, utxo := range report.UtxosFound {
+		results.Utxos = append(results.Utxos, newScanResultUtxo(utxo))
+	}
+
+	return results
+}
+
+func newScanResultUtxo(utxo *scanner.Utxo) scanResultUtxo {
+	return scanResultUtxo{
+		TxID:           utxo.TxID,
+		OutputIndex:    utxo.OutputIndex,
+		Amount:         utxo.Amount,
+		Address:        utxo.Address.Address(),
+		AddressVersion: utxo.Address.Version(),
+		DerivationPath: utxo.Address.DerivationPath(),
+		Script:         hex.EncodeToString(utxo.Script),
+	}
+}
+
+func loadScanResults(path string) (*scanResults, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scan results: %w", err)
+	}
+
+	// Results are saved as JSON, or in the artifacts wire format for other programs:
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return loadScanResultsArtifact(data, path)
+	}
+
+	var results scanResults
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("failed to parse scan results in %s: %w", path, err)
+	}
+
+	if results.Version != scanResultsVersion {
+		return nil, fmt.Errorf("unsupported scan results version %d in %s", results.Version, path)
+	}
+
+	return &results, nil
+}
+
+func (r *scanResults) save(path string) error {
+	var data []byte
+	var err error
+
+	if strings.HasSuffix(path, ".pb") {
+		data, err = artifacts.Marshal(r.toArtifact())
+	} else {
+		data, err = json.MarshalIndent(r, "", "  ")
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to encode scan results: %w", err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write scan results: %w", err)
+	}
+
+	return nil
+}
+
+func (r *scanResults) toArtifact() *artifacts.ScanResults {
+	artifact := &artifacts.ScanResults{
+		ScannedAt:         r.ScannedAt.Unix(),
+		ScannedAddresses:  uint32(r.ScannedAddresses),
+		WalletFingerprint: r.Wallet,
+		CaseID:            r.CaseID,
+	}
+
+	for _, utxo := range r.Utxos {
+		script, _ := hex.DecodeString(utxo.Script) // we encoded it
+
+		artifact.Utxos = append(artifact.Utxos, &artifacts.Utxo{
+			TxID:           utxo.TxID,
+			OutputIndex:    uint32(utxo.OutputIndex),
+			Amount:         int64(utxo.Amount),
+			Address:        utxo.Address,
+			AddressVersion: uint32(utxo.AddressVersion),
+			DerivationPath: utxo.DerivationPath,
+			Script:         script,
+		})
+	}
+
+	return artifact
+}
+
+func loadScanResultsArtifact(data []byte, path string) (*scanResults, error) {
+	artifact, err := artifacts.Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse scan results in %s: %w", path, err)
+	}
+
+	scan, ok := artifact.(*artifacts.ScanResults)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't contain scan results", path)
+	}
+
+	results := &scanResults{
+		Version:          scanResultsVersion,
+		caseTag:          caseTag{Wallet: scan.WalletFingerprint, CaseID: scan.CaseID},
+		ScannedAt:        time.Unix(scan.ScannedAt, 0).UTC(),
+		ScannedAddresses: int(scan.ScannedAddresses),
+		Utxos:            []scanResultUtxo{},
+	}
+
+	for _, utxo := range scan.Utxos {
+		amount, err := sats.New(utxo.Amount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scan results in %s: %w", path, err)
+		}
+
+		results.Utxos = append(results.Utxos, scanResultUtxo{
+			TxID:           utxo.TxID,
+			OutputIndex:    int(utxo.OutputIndex),
+			Amount:         amount,
+			Address:        utxo.Address,
+			AddressVersion: int(utxo.AddressVersion),
+			DerivationPath: utxo.DerivationPath,
+			Script:         hex.EncodeToString(utxo.Script),
+		})
+	}
+
+	return results, nil
+}
+
+func (r *scanResults) total() (sats.Amount, error) {
+	var total sats.Amount
+
+	for _, utxo := range r.Utxos {
+		var err error
+		if total, err = total.Add(utxo.Amount); err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
+}
+
+// diffScanResults compares a previous scan to the current one. The Scanner that produced the
+// current results is used to tell spent outputs apart from those in addresses we didn't scan.
+func diffScanResults(previous, current *scanResults, utxoScanner *scanner.Scanner) *scanDiff {
+	diff := &scanDiff{Previous: previous, Current: current}
+
+	previousByOutpoint := make(map[string]bool)
+	for _, utxo := range previous.Utxos {
+		previousByOutpoint[utxo.outpoint()] = true
+	}
+
+	currentByOutpoint := make(map[string]bool)
+	for _, utxo := range current.Utxos {
+		currentByOutpoint[utxo.outpoint()] = true
+
+		if previousByOutpoint[utxo.outpoint()] {
+			diff.Unchanged = append(diff.Unchanged, utxo)
+		} else {
+			diff.NewlyFound = append(diff.NewlyFound, utxo)
+		}
+	}
+
+	for _, utxo := range previous.Utxos {
+		if currentByOutpoint[utxo.outpoint()] {
+			continue
+		}
+
+		script, err := hex.DecodeString(utxo.Script)
+		_, wasScanned := utxoScanner.FindAddress(script)
+
+		if err == nil && wasScanned {
+			diff.NewlySpent = append(diff.NewlySpent, utxo)
+		} else {
+			diff.Missing = append(diff.Missing, utxo)
+		}
+	}
+
+	return diff
+}
+
+func (u *scanResultUtxo) outpoint() string {
+	return fmt.Sprintf("%s:%d", u.TxID, u.OutputIndex)
+}
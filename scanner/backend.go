@@ -0,0 +1,238 @@
+package scanner
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/sats"
+)
+
+// ChainBackend is where a Scanner gets its data from the blockchain. Electrum servers are the
+// default, and the only backend with everything the recovery can use (subscriptions, proofs, fee
+// estimates). The others are for users who run their own node, or can't reach Electrum servers:
+// with them, a Scanner can scan, fetch transactions and check for conflicts, which is all a
+// recovery needs.
+//
+// Responses are as untrusted as an Electrum server's, and checked the same way.
+type ChainBackend interface {
+	// Name identifies the backend in messages.
+	Name() string
+
+	// ListUnspent returns the unspent outputs of each script, in the same order.
+	ListUnspent(scripts [][]byte) ([][]electrum.UnspentRef, error)
+
+	// BatchSize is how many scripts ListUnspent should be given at once.
+	BatchSize() int
+
+	// GetTransaction returns a transaction by ID, verified against it (see txcache.Verify).
+	GetTransaction(txID string) (*wire.MsgTx, error)
+
+	// GetTipHeight returns the height of the latest block.
+	GetTipHeight() (int, error)
+}
+
+// NewScannerWithBackend creates a Scanner that gets its data from the given backend, instead of
+// Electrum servers. Operations only Electrum servers support, such as watching addresses, fail.
+func NewScannerWithBackend(backend ChainBackend) *Scanner {
+	s := NewScannerWithServers(nil)
+	s.backend = backend
+
+	return s
+}
+
+// usesElectrum tells whether the Scanner talks to Electrum servers, which can do more than other
+// backends.
+func (s *Scanner) usesElectrum() bool {
+	_, ok := s.backend.(*electrumBackend)
+	return ok
+}
+
+// unsupported returns the error for an operation the backend can't do.
+func (s *Scanner) unsupported(operation string) error {
+	return fmt.Errorf("%s is not supported with the %s backend", operation, s.backend.Name())
+}
+
+// scanBackend is the counterpart of a Scan for backends other than Electrum. Batches are listed
+// one at a time, the backend decides how to go about each one.
+func (s *Scanner) scanBackend(addresses chan libwallet.MuunAddress) <-chan *Report {
+	reports := make(chan *Report)
+
+	go func() {
+		defer close(reports)
+
+		s.log.Printf("Scan started with %s", s.backend.Name())
+
+		queue := &addressQueue{scanner: s, addresses: addresses}
+		report := &Report{UtxosFound: []*Utxo{}}
+
+		for {
+			batch := queue.next(s.backend.BatchSize())
+			if len(batch) == 0 && queue.err == nil {
+				break
+			}
+
+			// An address we couldn't scan fails the scan, like the backend failing would:
+			var utxos []*Utxo
+			err := queue.err
+
+			if err == nil {
+				utxos, err = s.listBatch(batch)
+			}
+
+			if err != nil {
+				reports <- &Report{
+					ScannedAddresses: report.ScannedAddresses,
+					UtxosFound:       report.UtxosFound,
+					Err:              s.log.Errorf("Scan failed: %w", err),
+				}
+
+				for range addresses {
+					// drain the channel, so the producer can finish
+				}
+
+				return
+			}
+
+			report.ScannedAddresses += len(batch)
+			report.UtxosFound = append(report.UtxosFound, utxos...)
+			report.Scanned = addressesOf(batch)
+
+			newReport := *report
+			reports <- &newReport
+		}
+
+		s.log.Printf("Scan complete")
+	}()
+
+	return reports
+}
+
+// listBatch lists the unspent outputs of a batch of addresses with the backend.
+func (s *Scanner) listBatch(batch []*indexedAddress) ([]*Utxo, error) {
+	scripts := make([][]byte, len(batch))
+	for i, entry := range batch {
+		scripts[i] = entry.script
+	}
+
+	groups, err := s.backend.ListUnspent(scripts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(groups) != len(batch) {
+		return nil, fmt.Errorf("Expected %d results, got %d", len(batch), len(groups))
+	}
+
+	var utxos []*Utxo
+
+	for i, group := range groups {
+		found, err := utxosFromRefs(batch[i], group)
+		if err != nil {
+			return nil, err
+		}
+
+		utxos = append(utxos, found...)
+	}
+
+	return utxos, nil
+}
+
+// utxosFromRefs validates the unspent outputs a backend listed for an address, and returns them as
+// UTXOs. Backends are untrusted, a malformed response is a failure like any other.
+func utxosFromRefs(entry *indexedAddress, refs []electrum.UnspentRef) ([]*Utxo, error) {
+	var utxos []*Utxo
+
+	for _, ref := range refs {
+		if err := validateUnspentRef(ref); err != nil {
+			return nil, err
+		}
+
+		utxos = append(utxos, &Utxo{
+			TxID:        ref.TxHash,
+			OutputIndex: ref.TxPos,
+			Amount:      sats.Amount(ref.Value),
+			Script:      entry.script,
+			Address:     entry.address,
+			Height:      ref.Height,
+		})
+	}
+
+	return utxos, nil
+}
+
+// electrumBackend is the default ChainBackend, for one-off requests to the Scanner's Electrum
+// servers. Scans don't go through it: they're spread across several servers at once (see Scan).
+type electrumBackend struct {
+	scanner *Scanner
+}
+
+func (b *electrumBackend) Name() string {
+	return "electrum"
+}
+
+func (b *electrumBackend) BatchSize() int {
+	return batchSize
+}
+
+func (b *electrumBackend) ListUnspent(scripts [][]byte) ([][]electrum.UnspentRef, error) {
+	indexHashes := make([]string, len(scripts))
+	for i, script := range scripts {
+		indexHashes[i] = electrum.GetIndexHash(script)
+	}
+
+	var groups [][]electrum.UnspentRef
+
+	err := b.scanner.withServer(func(client *electrum.Client) error {
+		var err error
+
+		if client.SupportsBatching() {
+			groups, err = client.ListUnspentBatch(indexHashes)
+			return err
+		}
+
+		groups = nil
+
+		for _, indexHash := range indexHashes {
+			refs, err := client.ListUnspent(indexHash)
+			if err != nil {
+				return err
+			}
+
+			groups = append(groups, refs)
+		}
+
+		return nil
+	})
+
+	return groups, err
+}
+
+func (b *electrumBackend) GetTransaction(txID string) (*wire.MsgTx, error) {
+	var tx *wire.MsgTx
+
+	err := b.scanner.withServer(func(client *electrum.Client) error {
+		var err error
+		tx, err = fetchTransaction(client, txID) // a server that lied is disconnected, and another one tried
+		return err
+	})
+
+	return tx, err
+}
+
+func (b *electrumBackend) GetTipHeight() (int, error) {
+	var height int
+
+	err := b.scanner.withServer(func(client *electrum.Client) error {
+		tip, err := client.SubscribeHeaders()
+		if err != nil {
+			return err
+		}
+
+		height = tip.Height
+		return nil
+	})
+
+	return height, err
+}
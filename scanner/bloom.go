@@ -0,0 +1,70 @@
+package scanner
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// bloomFilter is a minimal, fixed-size Bloom filter over index hashes.
+//
+// Index hashes are SHA-256 digests, so their bits are already uniformly distributed. Instead of
+// hashing again for each probe, we slice the digest into two 64-bit values and combine them using
+// double hashing (Kirsch-Mitzenmacher), which is as good as k independent hash functions for our
+// purposes.
+//
+// It's not thread-safe. Callers must synchronize access.
+type bloomFilter struct {
+	bits   []uint64
+	size   uint64
+	probes uint64
+}
+
+// newBloomFilter creates a filter sized for `capacity` items with the given false-positive rate.
+func newBloomFilter(capacity int, falsePositiveRate float64) *bloomFilter {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	// Standard optimal sizing formulas, see https://en.wikipedia.org/wiki/Bloom_filter
+	size := math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	probes := math.Ceil(size / float64(capacity) * math.Ln2)
+
+	words := (uint64(size) + 63) / 64
+
+	return &bloomFilter{
+		bits:   make([]uint64, words),
+		size:   words * 64,
+		probes: uint64(probes),
+	}
+}
+
+// add inserts a hash into the filter.
+func (f *bloomFilter) add(hash *scriptHash) {
+	h1, h2 := f.split(hash)
+
+	for i := uint64(0); i < f.probes; i++ {
+		bit := (h1 + i*h2) % f.size
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// mayContain returns false if the hash was definitely never added, true if it probably was.
+func (f *bloomFilter) mayContain(hash *scriptHash) bool {
+	h1, h2 := f.split(hash)
+
+	for i := uint64(0); i < f.probes; i++ {
+		bit := (h1 + i*h2) % f.size
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *bloomFilter) split(hash *scriptHash) (uint64, uint64) {
+	h1 := binary.LittleEndian.Uint64(hash[0:8])
+	h2 := binary.LittleEndian.Uint64(hash[8:16]) | 1 // odd, so probes never collapse into one bit
+
+	return h1, h2
+}
@@ -0,0 +1,55 @@
+package scanner
+
+import (
+	"fmt"
+)
+
+// FindConflicts asks the backend, once more, about the outputs a transaction is about to spend. It
+// returns those that are no longer unspent, along with the height of the latest block.
+//
+// Electrum servers leave out of their unspent lists the outputs spent by transactions in their
+// mempool, so a conflicting transaction is found even before it's mined. Outputs from other wallets
+// (such as a fee input) are checked by their script, like the rest.
+func (s *Scanner) FindConflicts(utxos []*Utxo) ([]*Utxo, int, error) {
+	if s.dump != nil {
+		return nil, 0, fmt.Errorf("can't check for conflicts while offline")
+	}
+
+	tip, err := s.backend.GetTipHeight()
+	if err != nil {
+		return nil, 0, s.log.Errorf("Failed to check for conflicts: %w", err)
+	}
+
+	var scripts [][]byte
+	listed := make(map[string]bool)
+
+	for _, utxo := range utxos {
+		if !listed[string(utxo.Script)] {
+			scripts = append(scripts, utxo.Script)
+			listed[string(utxo.Script)] = true
+		}
+	}
+
+	groups, err := s.backend.ListUnspent(scripts)
+	if err != nil {
+		return nil, 0, s.log.Errorf("Failed to check for conflicts: %w", err)
+	}
+
+	unspent := make(map[string]bool)
+
+	for _, refs := range groups {
+		for _, ref := range refs {
+			unspent[fmt.Sprintf("%s:%d", ref.TxHash, ref.TxPos)] = true
+		}
+	}
+
+	var conflicts []*Utxo
+
+	for _, utxo := range utxos {
+		if !unspent[fmt.Sprintf("%s:%d", utxo.TxID, utxo.OutputIndex)] {
+			conflicts = append(conflicts, utxo)
+		}
+	}
+
+	return conflicts, tip, nil
+}
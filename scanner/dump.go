@@ -0,0 +1,182 @@
+package scanner
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/electrum"
+)
+
+// HistoryDump is a snapshot of the unspent outputs of a set of addresses, exported by someone with
+// a full node. It lets us scan without any network access.
+//
+// The format is the output of Bitcoin Core's `scantxoutset` command. Several outputs can be
+// concatenated in one file, if the scan was split.
+type HistoryDump struct {
+	Height   int
+	unspents map[string][]*dumpUnspent // by hex-encoded output script
+}
+
+type dumpUnspent struct {
+	TxID         string  `json:"txid"`
+	Vout         int     `json:"vout"`
+	ScriptPubKey string  `json:"scriptPubKey"`
+	Amount       float64 `json:"amount"` // in BTC
+	Height       int     `json:"height"`
+}
+
+type scanTxOutSetResult struct {
+	Success  bool           `json:"success"`
+	Height   int            `json:"height"`
+	Unspents []*dumpUnspent `json:"unspents"`
+}
+
+// LoadHistoryDump reads a dump file.
+func LoadHistoryDump(path string) (*HistoryDump, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history dump: %w", err)
+	}
+	defer file.Close()
+
+	dump := newHistoryDump()
+	decoder := json.NewDecoder(file)
+
+	for {
+		var result scanTxOutSetResult
+
+		err := decoder.Decode(&result)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid history dump: %w", err)
+		}
+
+		if err := dump.add(&result); err != nil {
+			return nil, fmt.Errorf("invalid history dump: %w", err)
+		}
+	}
+
+	if dump.Height == 0 {
+		return nil, fmt.Errorf("invalid history dump: it's empty")
+	}
+
+	return dump, nil
+}
+
+func newHistoryDump() *HistoryDump {
+	return &HistoryDump{unspents: make(map[string][]*dumpUnspent)}
+}
+
+// add includes the result of a scantxoutset in the dump.
+func (d *HistoryDump) add(result *scanTxOutSetResult) error {
+	if !result.Success {
+		return fmt.Errorf("the scan that produced it didn't complete")
+	}
+
+	if d.Height == 0 || result.Height < d.Height {
+		d.Height = result.Height // if it was split, we're only as fresh as the oldest part
+	}
+
+	for _, unspent := range result.Unspents {
+		if _, err := hex.DecodeString(unspent.ScriptPubKey); err != nil {
+			return fmt.Errorf("bad script %q", unspent.ScriptPubKey)
+		}
+
+		d.unspents[unspent.ScriptPubKey] = append(d.unspents[unspent.ScriptPubKey], unspent)
+	}
+
+	return nil
+}
+
+// utxosFor returns the unspent outputs paying to an address.
+func (d *HistoryDump) utxosFor(entry *indexedAddress) ([]*Utxo, error) {
+	refs, err := d.unspentRefs(hex.EncodeToString(entry.script))
+	if err != nil {
+		return nil, err
+	}
+
+	// The dump is as untrusted as any server response:
+	return utxosFromRefs(entry, refs)
+}
+
+// unspentRefs returns the unspent outputs of a script, in the format Electrum servers use.
+func (d *HistoryDump) unspentRefs(scriptHex string) ([]electrum.UnspentRef, error) {
+	var refs []electrum.UnspentRef
+
+	for _, unspent := range d.unspents[scriptHex] {
+		amount, err := btcutil.NewAmount(unspent.Amount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid amount in history dump: %w", err)
+		}
+
+		refs = append(refs, electrum.UnspentRef{TxHash: unspent.TxID, TxPos: unspent.Vout, Value: int64(amount), Height: unspent.Height})
+	}
+
+	return refs, nil
+}
+
+// NewOfflineScanner creates a Scanner that looks up addresses in a HistoryDump, instead of asking
+// Electrum servers. Operations that need the network, such as watching addresses, fail.
+func NewOfflineScanner(dump *HistoryDump) *Scanner {
+	s := NewScannerWithServers(nil)
+	s.dump = dump
+
+	return s
+}
+
+// scanDump is the offline counterpart of a Scan, using the dump.
+func (s *Scanner) scanDump(addresses chan libwallet.MuunAddress) <-chan *Report {
+	reports := make(chan *Report)
+
+	go func() {
+		defer close(reports)
+
+		report := &Report{UtxosFound: []*Utxo{}}
+
+		for address := range addresses {
+			// Skipping an address could miss its funds, so failing to derive its script fails the
+			// scan:
+			var utxos []*Utxo
+
+			entry, err := s.index.add(address)
+			if err != nil {
+				err = fmt.Errorf("failed to derive the script of %s: %w", address.Address(), err)
+			} else {
+				utxos, err = s.dump.utxosFor(entry)
+			}
+
+			if err != nil {
+				reports <- &Report{ScannedAddresses: report.ScannedAddresses, UtxosFound: report.UtxosFound, Err: err}
+
+				for range addresses {
+					// drain the channel, so the producer can finish
+				}
+
+				return
+			}
+
+			report.ScannedAddresses++
+			report.UtxosFound = append(report.UtxosFound, utxos...)
+			report.Scanned = append(report.Scanned, address.Address())
+
+			if report.ScannedAddresses%batchSize == 0 || len(utxos) > 0 {
+				newReport := *report
+				reports <- &newReport
+
+				report.Scanned = nil
+			}
+		}
+
+		reports <- report
+	}()
+
+	return reports
+}
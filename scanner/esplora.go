@@ -0,0 +1,234 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet/btcsuitew/btcutilw"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/txcache"
+	"github.com/muun/recovery/utils"
+)
+
+// esploraTimeout is how long we wait for each request.
+const esploraTimeout = 30 * time.Second
+
+// esploraConcurrency is how many requests we make at once. Public instances limit how fast they
+// can be queried, so we stay well below what a self-hosted one could take.
+const esploraConcurrency = 4
+
+// EsploraBackend is a ChainBackend that asks an Esplora HTTP API (https://github.com/Blockstream/esplora),
+// such as blockstream.info's or a self-hosted one. It lists outputs one address at a time.
+type EsploraBackend struct {
+	baseURL string
+}
+
+// NewEsploraBackend creates an EsploraBackend for the API at the given URL, such as
+// https://blockstream.info/api.
+func NewEsploraBackend(baseURL string) (*EsploraBackend, error) {
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		return nil, fmt.Errorf("invalid Esplora URL %q, use https://...", baseURL)
+	}
+
+	return &EsploraBackend{strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+func (b *EsploraBackend) Name() string {
+	return "esplora"
+}
+
+func (b *EsploraBackend) BatchSize() int {
+	return batchSize
+}
+
+// esploraUtxo is an unspent output, as Esplora lists them.
+type esploraUtxo struct {
+	TxID   string `json:"txid"`
+	Vout   int    `json:"vout"`
+	Value  int64  `json:"value"`
+	Status struct {
+		Confirmed   bool `json:"confirmed"`
+		BlockHeight int  `json:"block_height"`
+	} `json:"status"`
+}
+
+func (b *EsploraBackend) ListUnspent(scripts [][]byte) ([][]electrum.UnspentRef, error) {
+	groups := make([][]electrum.UnspentRef, len(scripts))
+	errs := make([]error, len(scripts))
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, esploraConcurrency)
+
+	for i, script := range scripts {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(i int, script []byte) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			groups[i], errs[i] = b.listUnspent(script)
+		}(i, script)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return groups, nil
+}
+
+func (b *EsploraBackend) listUnspent(script []byte) ([]electrum.UnspentRef, error) {
+	address, err := scriptAddress(script)
+	if err != nil {
+		return nil, err
+	}
+
+	var utxos []esploraUtxo
+	if err := b.getJSON("/address/"+address+"/utxo", &utxos); err != nil {
+		return nil, err
+	}
+
+	var refs []electrum.UnspentRef
+
+	for _, utxo := range utxos {
+		height := 0
+		if utxo.Status.Confirmed {
+			height = utxo.Status.BlockHeight
+		}
+
+		refs = append(refs, electrum.UnspentRef{TxHash: utxo.TxID, TxPos: utxo.Vout, Value: utxo.Value, Height: height})
+	}
+
+	return refs, nil
+}
+
+func (b *EsploraBackend) GetTransaction(txID string) (*wire.MsgTx, error) {
+	txHex, err := b.get("/tx/" + txID + "/hex")
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := hex.DecodeString(strings.TrimSpace(txHex))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tx %s: %w", txID, err)
+	}
+
+	return txcache.Verify(txID, raw)
+}
+
+func (b *EsploraBackend) GetTipHeight() (int, error) {
+	text, err := b.get("/blocks/tip/height")
+	if err != nil {
+		return 0, err
+	}
+
+	height, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected tip height from Esplora: %q", text)
+	}
+
+	return height, nil
+}
+
+// Broadcast sends a signed transaction to the network, through Esplora.
+func (b *EsploraBackend) Broadcast(tx *wire.MsgTx) error {
+	var txBytes bytes.Buffer
+	if err := tx.BtcEncode(&txBytes, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		return fmt.Errorf("error while encoding tx: %w", err)
+	}
+
+	if err := utils.CheckNetwork(); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: esploraTimeout}
+
+	res, err := client.Post(b.baseURL+"/tx", "text/plain", strings.NewReader(hex.EncodeToString(txBytes.Bytes())))
+	if err != nil {
+		return fmt.Errorf("failed to reach Esplora: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		reason, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Esplora rejected the transaction: %s", strings.TrimSpace(string(reason)))
+	}
+
+	return nil
+}
+
+// get requests a path of the API, and returns the response as text.
+func (b *EsploraBackend) get(path string) (string, error) {
+	if err := utils.CheckNetwork(); err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Timeout: esploraTimeout}
+
+	res, err := client.Get(b.baseURL + path)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach Esplora: %w", err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response from Esplora: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Esplora responded to %s with status %s: %s", path, res.Status, strings.TrimSpace(string(body)))
+	}
+
+	return string(body), nil
+}
+
+// getJSON requests a path of the API, and decodes the response.
+func (b *EsploraBackend) getJSON(path string, result interface{}) error {
+	body, err := b.get(path)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(body), result); err != nil {
+		return fmt.Errorf("unexpected response from Esplora to %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// scriptAddress returns the address an output script pays to. Esplora looks outputs up by address.
+func scriptAddress(script []byte) (string, error) {
+	// Taproot outputs are OP_1 <32 bytes>, which btcd doesn't know about yet:
+	if len(script) == 34 && script[0] == txscript.OP_1 && script[1] == txscript.OP_DATA_32 {
+		address, err := btcutilw.NewAddressTaprootKey(script[2:], &chaincfg.MainNetParams)
+		if err != nil {
+			return "", err
+		}
+
+		return address.EncodeAddress(), nil
+	}
+
+	_, addresses, _, err := txscript.ExtractPkScriptAddrs(script, &chaincfg.MainNetParams)
+	if err != nil || len(addresses) != 1 {
+		return "", fmt.Errorf("script %x has no address to look up", script)
+	}
+
+	return addresses[0].EncodeAddress(), nil
+}
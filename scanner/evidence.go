@@ -0,0 +1,158 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/utils"
+)
+
+// InputEvidence shows that an output exists in the blockchain: its funding transaction, the block
+// header it was mined in, and the merkle proof that links them.
+//
+// Checking it needs no trust in whoever collected it, only in the block header, which anyone can
+// compare with their own node or a block explorer.
+type InputEvidence struct {
+	Utxo        *Utxo
+	Tx          *wire.MsgTx
+	Header      *wire.BlockHeader
+	MerkleProof []*chainhash.Hash // siblings in the merkle tree, from the bottom up
+	Position    int               // of the transaction in the block
+}
+
+// GetInputEvidence collects the InputEvidence of a confirmed output.
+func (s *Scanner) GetInputEvidence(utxo *Utxo) (*InputEvidence, error) {
+	if utxo.Height <= 0 {
+		return nil, fmt.Errorf("%s:%d is not confirmed yet, there's no proof it exists", utxo.TxID, utxo.OutputIndex)
+	}
+
+	if s.dump != nil {
+		return nil, utils.WrapError(utils.ErrBackendUnavailable, fmt.Errorf("proofs are not available offline"))
+	}
+
+	if !s.usesElectrum() {
+		return nil, utils.WrapError(utils.ErrBackendUnavailable, s.unsupported("fetching proofs"))
+	}
+
+	tx, err := s.GetTransaction(utxo.TxID)
+	if err != nil {
+		return nil, err
+	}
+
+	var evidence *InputEvidence
+
+	err = s.withServer(func(client *electrum.Client) error {
+		evidence, err = fetchInputEvidence(client, utxo, tx)
+		return err
+	})
+
+	if err != nil {
+		return nil, s.log.Errorf("Failed to fetch proof for %s: %w", utxo.TxID, err)
+	}
+
+	return evidence, nil
+}
+
+func fetchInputEvidence(client *electrum.Client, utxo *Utxo, tx *wire.MsgTx) (*InputEvidence, error) {
+	proof, err := client.GetMerkle(utxo.TxID, utxo.Height)
+	if err != nil {
+		return nil, err
+	}
+
+	headerHex, err := client.GetBlockHeader(proof.BlockHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	evidence := &InputEvidence{Utxo: utxo, Tx: tx, Position: proof.Pos}
+
+	rawHeader, err := hex.DecodeString(headerHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block header in response: %w", err)
+	}
+
+	evidence.Header = &wire.BlockHeader{}
+	if err := evidence.Header.Deserialize(bytes.NewReader(rawHeader)); err != nil {
+		return nil, fmt.Errorf("invalid block header in response: %w", err)
+	}
+
+	for _, sibling := range proof.Merkle {
+		hash, err := chainhash.NewHashFromStr(sibling)
+		if err != nil {
+			return nil, fmt.Errorf("invalid merkle proof in response: %w", err)
+		}
+
+		evidence.MerkleProof = append(evidence.MerkleProof, hash)
+	}
+
+	// Servers are untrusted, we only keep what checks out:
+	if err := evidence.Verify(); err != nil {
+		return nil, err
+	}
+
+	return evidence, nil
+}
+
+// Verify checks that the evidence is consistent: the transaction has the output, the merkle proof
+// places it in the block, and the block header has valid proof of work.
+//
+// It can't tell whether the block is in the main chain. That's up to whoever compares its hash.
+func (e *InputEvidence) Verify() error {
+	txHash := e.Tx.TxHash()
+
+	if txHash.String() != e.Utxo.TxID {
+		return fmt.Errorf("the transaction is %s, not %s", txHash, e.Utxo.TxID)
+	}
+
+	if e.Utxo.OutputIndex < 0 || e.Utxo.OutputIndex >= len(e.Tx.TxOut) {
+		return fmt.Errorf("transaction %s has no output %d", txHash, e.Utxo.OutputIndex)
+	}
+
+	output := e.Tx.TxOut[e.Utxo.OutputIndex]
+
+	if output.Value != int64(e.Utxo.Amount) || !bytes.Equal(output.PkScript, e.Utxo.Script) {
+		return fmt.Errorf("output %s:%d doesn't match the expected amount and script", txHash, e.Utxo.OutputIndex)
+	}
+
+	// Inner nodes of the merkle tree are 64 bytes long. A transaction of that size could pass
+	// for one, and prove something else entirely:
+	if e.Tx.SerializeSizeStripped() == 64 {
+		return fmt.Errorf("transaction %s can't be proven with a merkle proof", txHash)
+	}
+
+	if len(e.MerkleProof) > 32 || e.Position < 0 || e.Position >= 1<<uint(len(e.MerkleProof)) {
+		return fmt.Errorf("invalid merkle proof for %s", txHash)
+	}
+
+	root := txHash
+	for level, sibling := range e.MerkleProof {
+		if e.Position>>uint(level)&1 == 0 {
+			root = chainhash.DoubleHashH(append(root[:], sibling[:]...))
+		} else {
+			root = chainhash.DoubleHashH(append(sibling[:], root[:]...))
+		}
+	}
+
+	if !root.IsEqual(&e.Header.MerkleRoot) {
+		return fmt.Errorf("the merkle proof of %s doesn't match block %s", txHash, e.Header.BlockHash())
+	}
+
+	target := blockchain.CompactToBig(e.Header.Bits)
+	blockHash := e.Header.BlockHash()
+
+	if target.Sign() <= 0 || target.Cmp(chaincfg.MainNetParams.PowLimit) > 0 {
+		return fmt.Errorf("block %s has an invalid difficulty target", blockHash)
+	}
+
+	if blockchain.HashToBig(&blockHash).Cmp(target) > 0 {
+		return fmt.Errorf("block %s doesn't have enough proof of work", blockHash)
+	}
+
+	return nil
+}
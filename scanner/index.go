@@ -0,0 +1,109 @@
+package scanner
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/muun/libwallet"
+	"github.com/muun/libwallet/btcsuitew/btcutilw"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/payto"
+)
+
+// expectedAddressCount is a rough upper bound on the size of the address space we scan, used to
+// size the bloom filter. Exceeding it only degrades the false-positive rate, never correctness.
+const expectedAddressCount = 120000
+
+// bloomFalsePositiveRate is the target rate of false positives in the bloom pre-filter.
+const bloomFalsePositiveRate = 0.001
+
+// scriptHash is the Electrum index hash of an output script, as raw bytes.
+type scriptHash [32]byte
+
+// indexedAddress is a candidate address with its output script and index hash, derived once.
+type indexedAddress struct {
+	address   libwallet.MuunAddress
+	script    []byte
+	hash      scriptHash
+	hashParam string // the hex-encoded hash, as sent to Electrum
+}
+
+// scriptIndex is a compact table of all candidate addresses, keyed by index hash.
+//
+// Since most lookups made when matching backend responses are for scripts that aren't ours, the
+// table is fronted by a bloom filter that answers negative lookups without touching the map.
+//
+// It's thread-safe.
+type scriptIndex struct {
+	mu      sync.RWMutex
+	entries map[scriptHash]*indexedAddress
+	filter  *bloomFilter
+}
+
+func newScriptIndex() *scriptIndex {
+	return &scriptIndex{
+		entries: make(map[scriptHash]*indexedAddress),
+		filter:  newBloomFilter(expectedAddressCount, bloomFalsePositiveRate),
+	}
+}
+
+// add derives the output script and index hash for an address, and stores the result.
+func (idx *scriptIndex) add(address libwallet.MuunAddress) (*indexedAddress, error) {
+	script, err := getOutputScript(address)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &indexedAddress{
+		address: address,
+		script:  script,
+		hash:    electrum.GetRawIndexHash(script),
+	}
+
+	entry.hashParam = hex.EncodeToString(entry.hash[:])
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.entries[entry.hash] = entry
+	idx.filter.add(&entry.hash)
+
+	return entry, nil
+}
+
+// lookup returns the entry for an index hash, if it belongs to the candidate set.
+func (idx *scriptIndex) lookup(hash scriptHash) (*indexedAddress, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if !idx.filter.mayContain(&hash) {
+		return nil, false
+	}
+
+	entry, ok := idx.entries[hash]
+	return entry, ok
+}
+
+// lookupScript is like `lookup`, but takes an output script.
+func (idx *scriptIndex) lookupScript(script []byte) (*indexedAddress, bool) {
+	return idx.lookup(electrum.GetRawIndexHash(script))
+}
+
+// getOutputScript creates the script that sends to a Bitcoin address.
+func getOutputScript(address libwallet.MuunAddress) ([]byte, error) {
+	rawAddress := address.Address()
+
+	decodedAddress, err := btcutilw.DecodeAddress(rawAddress, &chaincfg.MainNetParams)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode address %s: %w", rawAddress, err)
+	}
+
+	outputScript, err := payto.Script(decodedAddress)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to craft script for %s: %w", rawAddress, err)
+	}
+
+	return outputScript, nil
+}
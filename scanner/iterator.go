@@ -0,0 +1,129 @@
+package scanner
+
+import (
+	"context"
+	"io"
+
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/utils"
+)
+
+// AddressStatus is the scan result for a single address.
+type AddressStatus struct {
+	Address libwallet.MuunAddress
+	Utxos   []*Utxo
+}
+
+// Iterator is a pull-based alternative to `Scan`, for callers that want to drive the scan at their
+// own pace (such as mobile apps, that must keep their UI responsive and may be suspended at any
+// time).
+//
+// Each call to `NextBatch` scans the next group of addresses and returns their status. Callers can
+// persist `Position()` and later resume from it with `IterateFrom`, as long as they provide the
+// same addresses in the same order.
+//
+// It's not thread-safe. Batches must be requested one at a time.
+type Iterator struct {
+	scanner   *Scanner
+	addresses []libwallet.MuunAddress
+	position  int
+}
+
+// Iterate creates an Iterator over a list of addresses, starting at the beginning.
+func (s *Scanner) Iterate(addresses []libwallet.MuunAddress) *Iterator {
+	return s.IterateFrom(addresses, 0)
+}
+
+// IterateFrom creates an Iterator over a list of addresses, starting at the given position.
+func (s *Scanner) IterateFrom(addresses []libwallet.MuunAddress, position int) *Iterator {
+	return &Iterator{
+		scanner:   s,
+		addresses: addresses,
+		position:  position,
+	}
+}
+
+// Position returns the index of the first address that hasn't been scanned yet.
+func (it *Iterator) Position() int {
+	return it.position
+}
+
+// Len returns the total number of addresses to scan.
+func (it *Iterator) Len() int {
+	return len(it.addresses)
+}
+
+// NextBatch scans the next group of addresses and returns the status of each one, or `io.EOF`
+// when there are no addresses left. The position only advances when the batch succeeds, so a
+// failed or canceled call can simply be repeated.
+func (it *Iterator) NextBatch(ctx context.Context) (_ []AddressStatus, err error) {
+	defer utils.RecoverPanic(&err)
+
+	if it.position >= len(it.addresses) {
+		return nil, io.EOF
+	}
+
+	end := it.position + batchSize
+	if end > len(it.addresses) {
+		end = len(it.addresses)
+	}
+
+	var batch []*indexedAddress
+	for _, address := range it.addresses[it.position:end] {
+		entry, err := it.scanner.index.add(address)
+		if err != nil {
+			return nil, err
+		}
+
+		batch = append(batch, entry)
+	}
+
+	// Wait for a client, like concurrent scans do:
+	var client *electrum.Client
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+
+	case client = <-it.scanner.pool.Acquire():
+	}
+
+	defer it.scanner.pool.Release(client)
+
+	task := &scanTask{
+		servers:   it.scanner.servers,
+		peers:     it.scanner.peers,
+		client:    client,
+		addresses: batch,
+		timeout:   taskTimeout,
+		exit:      ctx.Done(),
+	}
+
+	result := task.Execute()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err() // canceled tasks exit without an error of their own
+	}
+
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	// Group the UTXOs found by address, including addresses with no funds:
+	statuses := make([]AddressStatus, len(batch))
+	byAddress := make(map[string]*AddressStatus)
+
+	for i, entry := range batch {
+		statuses[i].Address = entry.address
+		byAddress[entry.address.Address()] = &statuses[i]
+	}
+
+	for _, utxo := range result.Utxos {
+		status := byAddress[utxo.Address.Address()]
+		status.Utxos = append(status.Utxos, utxo)
+	}
+
+	it.position = end
+	return statuses, nil
+}
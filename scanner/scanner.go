@@ -1,18 +1,28 @@
 package scanner
 
 import (
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/btcsuite/btcd/wire"
 	"github.com/muun/libwallet"
 	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/txcache"
 	"github.com/muun/recovery/utils"
 )
 
-const electrumPoolSize = 6
+const electrumPoolSize = 12
 const taskTimeout = 5 * time.Minute
+
+// batchSize is the number of addresses in a batch, before the tuner adapts it for each server.
 const batchSize = 100
 
+// maxServerAttempts is the number of servers tried for one-off requests before giving up.
+const maxServerAttempts = 10
+
 // Scanner finds unspent outputs and their transactions when given a map of addresses.
 //
 // It implements multi-server support, batching feature detection and use, concurrency control,
@@ -23,7 +33,8 @@ const batchSize = 100
 //
 // Batching is leveraged when supported by a particular server, falling back to sequential requests
 // for single addresses (which is much slower, but can get us out of trouble when better servers are
-// not available).
+// not available). The size of batches, and the number of concurrent tasks, adapt to the servers
+// and the connection as the scan goes (see tuner).
 //
 // Timeouts and cancellations are an internal affair, not configurable by callers. See taskTimeout
 // declared above.
@@ -36,13 +47,23 @@ const batchSize = 100
 type Scanner struct {
 	pool    *electrum.Pool
 	servers *electrum.ServerProvider
-	log     *utils.Logger
+	peers   *electrum.PeerCache
+	txs     TxCache
+	index   *scriptIndex
+	tuner   *tuner
+	backend ChainBackend // Electrum servers, unless another one was given
+	dump    *HistoryDump // when set, the scan is offline
+	log     utils.Logger
+
+	priority map[string]bool // addresses batched on their own, see Prioritize
+	answered map[string]bool // servers that returned results, see AnsweringServers
 }
 
 // Report contains information about an ongoing scan.
 type Report struct {
 	ScannedAddresses int
 	UtxosFound       []*Utxo
+	Scanned          []string // the addresses scanned since the previous report
 	Err              error
 }
 
@@ -50,9 +71,24 @@ type Report struct {
 type Utxo struct {
 	TxID        string
 	OutputIndex int
-	Amount      int64
+	Amount      sats.Amount
 	Address     libwallet.MuunAddress
 	Script      []byte
+	Height      int // 0 or negative while unconfirmed
+}
+
+// Total adds up the amounts of some UTXOs.
+func Total(utxos []*Utxo) (sats.Amount, error) {
+	var total sats.Amount
+
+	for _, utxo := range utxos {
+		var err error
+		if total, err = total.Add(utxo.Amount); err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
 }
 
 // scanContext contains the synchronization objects for a single Scanner round, to manage Tasks.
@@ -71,15 +107,104 @@ type scanContext struct {
 
 // NewScanner creates an initialized Scanner.
 func NewScanner() *Scanner {
-	return &Scanner{
+	return NewScannerWithServers(nil)
+}
+
+// NewScannerWithServers creates an initialized Scanner that tries the given servers first, before
+// those that worked in previous runs and the public list.
+func NewScannerWithServers(servers []string) *Scanner {
+	return NewScannerWithout(servers, nil)
+}
+
+// NewScannerWithout creates a Scanner like NewScannerWithServers, that never connects to the
+// `excluded` servers. It can check the results of another Scanner against different servers (see
+// AnsweringServers), unless there are no others to use.
+func NewScannerWithout(servers []string, excluded []string) *Scanner {
+	log := utils.NewLogger("Scanner")
+	peers := loadPeerCache(log)
+
+	preferred := append([]string{}, servers...)
+	if peers != nil {
+		preferred = append(preferred, peers.Fresh()...)
+	}
+
+	s := &Scanner{
 		pool:    electrum.NewPool(electrumPoolSize),
-		servers: electrum.NewServerProvider(),
-		log:     utils.NewLogger("Scanner"),
+		servers: electrum.NewServerProviderWithout(preferred, excluded),
+		peers:   peers,
+		txs:     openTxCache(log),
+		index:   newScriptIndex(),
+		tuner:   newTuner(),
+		log:     log,
 	}
+
+	s.backend = &electrumBackend{s}
+
+	return s
+}
+
+// loadPeerCache opens the cache of servers from previous runs. Failing to do so is not a problem,
+// we just won't get a head start.
+func loadPeerCache(log utils.Logger) *electrum.PeerCache {
+	path, err := electrum.DefaultPeerCachePath()
+	if err != nil {
+		log.Printf("Peer cache unavailable: %v", err)
+		return nil
+	}
+
+	peers, err := electrum.LoadPeerCache(path, electrum.DefaultPeerTTL)
+	if err != nil {
+		log.Printf("Peer cache unavailable: %v", err)
+		return nil
+	}
+
+	return peers
+}
+
+// LimitBandwidth keeps batches small and connections few, for slow and metered connections.
+func (s *Scanner) LimitBandwidth() {
+	s.tuner.limitBandwidth()
+}
+
+// TxCache keeps the transactions downloaded, to avoid fetching them again. It's a txcache.Store,
+// unless another one is given with UseTxCache.
+type TxCache interface {
+	Get(txID string) (*wire.MsgTx, bool)
+	Put(tx *wire.MsgTx) error
+}
+
+// UseTxCache replaces the local transaction store.
+func (s *Scanner) UseTxCache(txs TxCache) {
+	s.txs = txs
+}
+
+// openTxCache opens the local transaction store. As with peers, we can live without it.
+func openTxCache(log utils.Logger) TxCache {
+	dir, err := txcache.DefaultDir()
+	if err != nil {
+		log.Printf("Tx cache unavailable: %v", err)
+		return nil
+	}
+
+	txs, err := txcache.Open(dir, txcache.DefaultMaxBytes)
+	if err != nil {
+		log.Printf("Tx cache unavailable: %v", err)
+		return nil
+	}
+
+	return txs
 }
 
 // Scan an address space and return all relevant transactions for a sweep.
 func (s *Scanner) Scan(addresses chan libwallet.MuunAddress) <-chan *Report {
+	if s.dump != nil {
+		return s.scanDump(addresses)
+	}
+
+	if !s.usesElectrum() {
+		return s.scanBackend(addresses)
+	}
+
 	var waitGroup sync.WaitGroup
 
 	// Create the Context that goroutines will share:
@@ -104,6 +229,40 @@ func (s *Scanner) Scan(addresses chan libwallet.MuunAddress) <-chan *Report {
 	return ctx.reports
 }
 
+// Prioritize makes a Scan send the given addresses in batches of their own, so their results come
+// back first. They must also come first in the address channel: the Scanner doesn't reorder it.
+func (s *Scanner) Prioritize(addresses []string) {
+	s.priority = make(map[string]bool)
+
+	for _, address := range addresses {
+		s.priority[address] = true
+	}
+}
+
+// AnsweringServers returns the servers that returned results in the scans so far. It's only safe
+// to call once a Scan is done.
+func (s *Scanner) AnsweringServers() []string {
+	var servers []string
+	for server := range s.answered {
+		servers = append(servers, server)
+	}
+
+	sort.Strings(servers)
+
+	return servers
+}
+
+// FindAddress returns the scanned address that an output script pays to, if it's one of ours.
+// It's cheap to call with foreign scripts, so it can be used to match any backend response.
+func (s *Scanner) FindAddress(script []byte) (libwallet.MuunAddress, bool) {
+	entry, ok := s.index.lookupScript(script)
+	if !ok {
+		return nil, false
+	}
+
+	return entry.address, true
+}
+
 func (s *Scanner) startCollect(ctx *scanContext) {
 	// Collect all results until the done signal, or abort on the first error:
 	for {
@@ -113,6 +272,7 @@ func (s *Scanner) startCollect(ctx *scanContext) {
 
 			newReport := *ctx.reportCache // create a new private copy
 			ctx.reportCache = &newReport
+			ctx.reportCache.Scanned = nil
 
 			if result.Err != nil {
 				ctx.reportCache.Err = s.log.Errorf("Scan failed: %w", result.Err)
@@ -123,7 +283,13 @@ func (s *Scanner) startCollect(ctx *scanContext) {
 				return
 			}
 
+			if s.answered == nil {
+				s.answered = make(map[string]bool)
+			}
+			s.answered[result.Server] = true
+
 			ctx.reportCache.ScannedAddresses += len(result.Task.addresses)
+			ctx.reportCache.Scanned = addressesOf(result.Task.addresses)
 			ctx.reportCache.UtxosFound = append(ctx.reportCache.UtxosFound, result.Utxos...)
 			ctx.reports <- ctx.reportCache
 
@@ -137,12 +303,17 @@ func (s *Scanner) startCollect(ctx *scanContext) {
 func (s *Scanner) startScan(ctx *scanContext) {
 	s.log.Printf("Scan started")
 
-	batches := streamBatches(ctx.addresses)
+	queue := &addressQueue{scanner: s, addresses: ctx.addresses}
 
 	var client *electrum.Client
 
-	for batch := range batches {
-		// Stop the loop until a client becomes available, or the scan is canceled:
+	for {
+		// Stop the loop until the tuner allows another task and a client becomes available, or the
+		// scan is canceled:
+		if !s.tuner.acquire(ctx.stopScan) {
+			return
+		}
+
 		select {
 		case <-ctx.stopScan:
 			return
@@ -150,26 +321,50 @@ func (s *Scanner) startScan(ctx *scanContext) {
 		case client = <-s.pool.Acquire():
 		}
 
-		// Start scanning this address in background:
+		// The batch is sized for the server this client is connected to, if any:
+		batch := queue.next(s.tuner.batchSize(client.Server))
+
+		if len(batch) == 0 {
+			s.pool.Release(client)
+			s.tuner.release()
+			break
+		}
+
+		// Start scanning this batch in background:
 		ctx.wg.Add(1)
 
-		go func(batch []libwallet.MuunAddress) {
+		go func(client *electrum.Client, batch []*indexedAddress) {
+			defer s.tuner.release()
 			defer s.pool.Release(client)
 			defer ctx.wg.Done()
 
 			s.scanBatch(ctx, client, batch)
-		}(batch)
+		}(client, batch)
+	}
+
+	// An address we couldn't scan fails the scan, like a task would:
+	if queue.err != nil {
+		select {
+		case ctx.results <- &scanTaskResult{Task: &scanTask{}, Err: queue.err}:
+		case <-ctx.stopScan:
+		}
 	}
 
 	// Wait for all tasks that are still executing to complete:
 	ctx.wg.Wait()
 	s.log.Printf("Scan complete")
 
+	if s.peers != nil {
+		if err := s.peers.Save(); err != nil {
+			s.log.Printf("Failed to save peer cache: %v", err)
+		}
+	}
+
 	// Signal to the collector that this Context has no more pending work:
 	close(ctx.stopCollect)
 }
 
-func (s *Scanner) scanBatch(ctx *scanContext, client *electrum.Client, batch []libwallet.MuunAddress) {
+func (s *Scanner) scanBatch(ctx *scanContext, client *electrum.Client, batch []*indexedAddress) {
 	// NOTE:
 	// We begin by building the task, passing our selected Client. Since we're choosing the instance,
 	// it's our job to control acquisition and release of Clients to prevent sharing (remember,
@@ -177,6 +372,8 @@ func (s *Scanner) scanBatch(ctx *scanContext, client *electrum.Client, batch []l
 	// up to us.
 	task := &scanTask{
 		servers:   s.servers,
+		peers:     s.peers,
+		tuner:     s.tuner,
 		client:    client,
 		addresses: batch,
 		timeout:   taskTimeout,
@@ -187,32 +384,78 @@ func (s *Scanner) scanBatch(ctx *scanContext, client *electrum.Client, batch []l
 	ctx.results <- task.Execute()
 }
 
-func streamBatches(addresses chan libwallet.MuunAddress) chan []libwallet.MuunAddress {
-	batches := make(chan []libwallet.MuunAddress)
+// addressesOf returns the addresses in a batch.
+func addressesOf(batch []*indexedAddress) []string {
+	addresses := make([]string, len(batch))
+	for i, entry := range batch {
+		addresses[i] = entry.address.Address()
+	}
 
-	go func() {
-		var nextBatch []libwallet.MuunAddress
+	return addresses
+}
 
-		for address := range addresses {
-			// Add items to the batch until we reach the limit:
-			nextBatch = append(nextBatch, address)
+// addressQueue hands out incoming addresses in batches, deriving their scripts and index hashes
+// as they arrive. This happens exactly once per address, no matter how many times a task retries.
+//
+// It's not thread-safe.
+type addressQueue struct {
+	scanner   *Scanner
+	addresses chan libwallet.MuunAddress
+
+	// An address read, but left for the next batch:
+	pending         *indexedAddress
+	pendingPriority bool
+
+	// Why the queue ended early, if it did. Skipping an address could miss its funds, so the
+	// scan must fail instead:
+	err error
+}
 
-			if len(nextBatch) < batchSize {
-				continue
-			}
+// next returns up to `size` addresses, or none when there are no more. Prioritized addresses are
+// never batched with others, so their results don't wait for a full batch.
+func (q *addressQueue) next(size int) []*indexedAddress {
+	var batch []*indexedAddress
+	var batchIsPriority bool
 
-			// Send back the batch and start over:
-			batches <- nextBatch
-			nextBatch = []libwallet.MuunAddress{}
+	for len(batch) < size {
+		entry, isPriority, ok := q.read()
+		if !ok {
+			break
 		}
 
-		// Send back an incomplete batch with any remaining addresses:
-		if len(nextBatch) > 0 {
-			batches <- nextBatch
+		if batchIsPriority && !isPriority {
+			q.pending, q.pendingPriority = entry, isPriority
+			break
 		}
 
-		close(batches)
-	}()
+		batch = append(batch, entry)
+		batchIsPriority = isPriority
+	}
+
+	return batch
+}
+
+func (q *addressQueue) read() (*indexedAddress, bool, bool) {
+	if q.pending != nil {
+		entry := q.pending
+		q.pending = nil
+
+		return entry, q.pendingPriority, true
+	}
+
+	if q.err != nil {
+		return nil, false, false
+	}
+
+	for address := range q.addresses {
+		entry, err := q.scanner.index.add(address)
+		if err != nil {
+			q.err = fmt.Errorf("failed to derive the script of %s: %w", address.Address(), err)
+			return nil, false, false
+		}
+
+		return entry, q.scanner.priority[address.Address()], true
+	}
 
-	return batches
+	return nil, false, false
 }
@@ -1,30 +1,32 @@
 package scanner
 
 import (
+	"encoding/hex"
 	"fmt"
 	"time"
 
-	"github.com/btcsuite/btcd/chaincfg"
-	"github.com/muun/libwallet"
-	"github.com/muun/libwallet/btcsuitew/btcutilw"
-	"github.com/muun/libwallet/btcsuitew/txscriptw"
 	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/utils"
 )
 
 // scanTask encapsulates a parallelizable Scanner unit of work.
 type scanTask struct {
 	servers   *electrum.ServerProvider
+	peers     *electrum.PeerCache
+	tuner     *tuner // nil when the batch size is fixed
 	client    *electrum.Client
-	addresses []libwallet.MuunAddress
+	addresses []*indexedAddress
 	timeout   time.Duration
-	exit      chan struct{}
+	exit      <-chan struct{}
 }
 
 // scanTaskResult contains a summary of the execution of a task.
 type scanTaskResult struct {
-	Task  *scanTask
-	Utxos []*Utxo
-	Err   error
+	Task   *scanTask
+	Utxos  []*Utxo
+	Server string // the server that answered, on success
+	Err    error
 }
 
 // Execute obtains the Utxo set for the Task address, implementing a retry strategy.
@@ -53,7 +55,8 @@ func (t *scanTask) Execute() *scanTaskResult {
 			lastError = result.Err // keep retrying when an attempt fails
 
 		case <-timeout:
-			return t.errorResult(fmt.Errorf("Task timed out. Last error: %w", lastError)) // stop on timeout
+			err := fmt.Errorf("Task timed out. Last error: %w", lastError)
+			return t.errorResult(utils.WrapError(utils.ErrBackendUnavailable, err)) // stop on timeout
 		}
 	}
 }
@@ -81,20 +84,17 @@ func (t *scanTask) tryExecute() *scanTaskResult {
 		}
 	}
 
-	// Prepare the output scripts for all given addresses:
-	outputScripts, err := getOutputScripts(t.addresses)
-	if err != nil {
-		return t.errorResult(err)
-	}
-
-	// Prepare the index hashes that Electrum requires to list outputs:
-	indexHashes, err := getIndexHashes(outputScripts)
-	if err != nil {
-		return t.errorResult(err)
+	// Collect the index hashes that Electrum requires to list outputs (derived beforehand):
+	indexHashes := make([]string, len(t.addresses))
+	for i, entry := range t.addresses {
+		indexHashes[i] = entry.hashParam
 	}
 
 	// Call Electrum to get the unspent output list, grouped by index for each address:
 	var unspentRefGroups [][]electrum.UnspentRef
+	var err error
+
+	start := time.Now()
 
 	if t.client.SupportsBatching() {
 		unspentRefGroups, err = t.listUnspentWithBatching(indexHashes)
@@ -102,25 +102,33 @@ func (t *scanTask) tryExecute() *scanTaskResult {
 		unspentRefGroups, err = t.listUnspentWithoutBatching(indexHashes)
 	}
 
+	if t.tuner != nil {
+		t.tuner.record(t.client.Server, len(indexHashes), time.Since(start), err)
+	}
+
 	if err != nil {
 		return t.errorResult(err)
 	}
 
+	// This server is doing its job. Remember it for next time:
+	if t.peers != nil {
+		t.peers.Record(t.client)
+	}
+
 	// Compile the results into a list of `Utxos`:
 	var utxos []*Utxo
 
-	for i, unspentRefGroup := range unspentRefGroups {
-		for _, unspentRef := range unspentRefGroup {
-			newUtxo := &Utxo{
-				TxID:        unspentRef.TxHash,
-				OutputIndex: unspentRef.TxPos,
-				Amount:      unspentRef.Value,
-				Script:      outputScripts[i],
-				Address:     t.addresses[i],
-			}
+	if len(unspentRefGroups) != len(t.addresses) {
+		return t.errorResult(fmt.Errorf("Expected %d results, got %d", len(t.addresses), len(unspentRefGroups)))
+	}
 
-			utxos = append(utxos, newUtxo)
+	for i, unspentRefGroup := range unspentRefGroups {
+		found, err := utxosFromRefs(t.addresses[i], unspentRefGroup)
+		if err != nil {
+			return t.errorResult(err)
 		}
+
+		utxos = append(utxos, found...)
 	}
 
 	return t.successResult(utxos)
@@ -150,48 +158,27 @@ func (t *scanTask) listUnspentWithoutBatching(indexHashes []string) ([][]electru
 	return unspentRefGroups, nil
 }
 
+// validateUnspentRef checks that an output reported by a server is well-formed.
+func validateUnspentRef(ref electrum.UnspentRef) error {
+	if _, err := hex.DecodeString(ref.TxHash); err != nil || len(ref.TxHash) != 64 {
+		return fmt.Errorf("Invalid tx hash in response: %q", ref.TxHash)
+	}
+
+	if _, err := sats.New(ref.Value); ref.TxPos < 0 || err != nil {
+		return fmt.Errorf("Invalid output in response: %s:%d (%d sats)", ref.TxHash, ref.TxPos, ref.Value)
+	}
+
+	return nil
+}
+
 func (t *scanTask) errorResult(err error) *scanTaskResult {
 	return &scanTaskResult{Task: t, Err: err}
 }
 
 func (t *scanTask) successResult(utxos []*Utxo) *scanTaskResult {
-	return &scanTaskResult{Task: t, Utxos: utxos}
+	return &scanTaskResult{Task: t, Utxos: utxos, Server: t.client.Server}
 }
 
 func (t *scanTask) exitResult() *scanTaskResult {
 	return &scanTaskResult{Task: t}
 }
-
-// getIndexHashes calculates all the Electrum index hashes for a list of output scripts.
-func getIndexHashes(outputScripts [][]byte) ([]string, error) {
-	indexHashes := make([]string, len(outputScripts))
-
-	for i, outputScript := range outputScripts {
-		indexHashes[i] = electrum.GetIndexHash(outputScript)
-	}
-
-	return indexHashes, nil
-}
-
-// getOutputScripts creates all the scripts that send to an list of Bitcoin address.
-func getOutputScripts(addresses []libwallet.MuunAddress) ([][]byte, error) {
-	outputScripts := make([][]byte, len(addresses))
-
-	for i, address := range addresses {
-		rawAddress := address.Address()
-
-		decodedAddress, err := btcutilw.DecodeAddress(rawAddress, &chaincfg.MainNetParams)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to decode address %s: %w", rawAddress, err)
-		}
-
-		outputScript, err := txscriptw.PayToAddrScript(decodedAddress)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to craft script for %s: %w", rawAddress, err)
-		}
-
-		outputScripts[i] = outputScript
-	}
-
-	return outputScripts, nil
-}
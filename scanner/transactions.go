@@ -0,0 +1,96 @@
+package scanner
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/txcache"
+	"github.com/muun/recovery/utils"
+)
+
+// GetTransaction returns a transaction by ID, from the local cache when possible, or from the
+// backend otherwise. Downloaded transactions are verified against their ID before use.
+func (s *Scanner) GetTransaction(txID string) (*wire.MsgTx, error) {
+	if s.txs != nil {
+		if tx, ok := s.txs.Get(txID); ok {
+			return tx, nil
+		}
+	}
+
+	if s.dump != nil {
+		return nil, utils.WrapError(utils.ErrBackendUnavailable, fmt.Errorf("tx %s is not available offline", txID))
+	}
+
+	tx, err := s.backend.GetTransaction(txID)
+	if err != nil {
+		err = s.log.Errorf("Failed to fetch tx %s: %w", txID, err)
+		return nil, utils.WrapError(utils.ErrBackendUnavailable, err)
+	}
+
+	if s.txs != nil {
+		if err := s.txs.Put(tx); err != nil {
+			s.log.Printf("Failed to cache tx %s: %v", txID, err)
+		}
+	}
+
+	return tx, nil
+}
+
+// GetTipHeight returns the height of the latest block, or that of the history dump when offline.
+func (s *Scanner) GetTipHeight() (int, error) {
+	if s.dump != nil {
+		return s.dump.Height, nil
+	}
+
+	height, err := s.backend.GetTipHeight()
+	if err != nil {
+		err = s.log.Errorf("Failed to get the latest block: %w", err)
+		return 0, utils.WrapError(utils.ErrBackendUnavailable, err)
+	}
+
+	return height, nil
+}
+
+// withServer runs a one-off request with a client from the pool, trying other servers when it
+// fails. Errors are tagged with ErrBackendUnavailable.
+func (s *Scanner) withServer(request func(client *electrum.Client) error) error {
+	client := <-s.pool.Acquire()
+	defer s.pool.Release(client)
+
+	var lastErr error
+
+	for attempt := 0; attempt < maxServerAttempts; attempt++ {
+		if !client.IsConnected() {
+			if err := client.Connect(s.servers.NextServer()); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+
+		if err := request(client); err != nil {
+			client.Disconnect() // the server failed or lied to us, try another one
+			lastErr = err
+			continue
+		}
+
+		return nil
+	}
+
+	return utils.WrapError(utils.ErrBackendUnavailable, lastErr)
+}
+
+func fetchTransaction(client *electrum.Client, txID string) (*wire.MsgTx, error) {
+	txHex, err := client.GetTransaction(txID)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tx %s: %w", txID, err)
+	}
+
+	return txcache.Verify(txID, raw)
+}
@@ -0,0 +1,183 @@
+package scanner
+
+import (
+	"sync"
+	"time"
+)
+
+// Limits for the tuner. Batches start at batchSize, and concurrent tasks at initialConcurrency.
+const (
+	minBatchSize       = 10
+	maxBatchSize       = 1000
+	initialConcurrency = 6
+	maxConcurrency     = electrumPoolSize
+
+	// targetLatency is the longest we want a server to take answering a batch. Slower answers
+	// mean the batch is too big for the server, or the connection is saturated.
+	targetLatency = 5 * time.Second
+
+	// Limits on slow and metered connections, see LimitBandwidth.
+	lowBandwidthBatchSize   = 50
+	lowBandwidthConcurrency = 2
+)
+
+// tuner adapts the scan to the servers and connection at hand, instead of using fixed numbers.
+//
+// Batch sizes are tuned per server: they grow while the server answers quickly, and shrink when
+// it's slow or fails. Concurrency is tuned for the whole scan, since it's limited by the user's
+// connection: one more task is allowed after a round of quick answers, and one less after a
+// failure or a very slow answer.
+//
+// It's thread-safe.
+type tuner struct {
+	mu         sync.Mutex
+	batchSizes map[string]int // by server
+
+	concurrency int // tasks allowed to run at once
+	active      int // tasks running
+	successes   int // quick answers since concurrency last changed
+
+	maxBatchSize   int
+	maxConcurrency int
+
+	changed chan struct{} // closed when tasks may start, then replaced
+}
+
+func newTuner() *tuner {
+	return &tuner{
+		batchSizes:     make(map[string]int),
+		concurrency:    initialConcurrency,
+		maxBatchSize:   maxBatchSize,
+		maxConcurrency: maxConcurrency,
+		changed:        make(chan struct{}),
+	}
+}
+
+// limitBandwidth keeps batches small and connections few. A batch that fails is sent again in
+// full, and each connection costs a handshake: on slow and metered connections, where failures
+// are common and every byte counts, large batches and many connections waste more than they save.
+func (t *tuner) limitBandwidth() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.maxBatchSize = lowBandwidthBatchSize
+	t.maxConcurrency = lowBandwidthConcurrency
+	t.concurrency = clamp(t.concurrency, 1, t.maxConcurrency)
+
+	for server, size := range t.batchSizes {
+		t.batchSizes[server] = clamp(size, minBatchSize, t.maxBatchSize)
+	}
+
+	t.notify()
+}
+
+// acquire waits until a task may start, and counts it as running. It returns false if `stop` was
+// closed first.
+func (t *tuner) acquire(stop <-chan struct{}) bool {
+	for {
+		t.mu.Lock()
+
+		if t.active < t.concurrency {
+			t.active++
+			t.mu.Unlock()
+			return true
+		}
+
+		changed := t.changed
+		t.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// release counts a task as finished.
+func (t *tuner) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active--
+	t.notify()
+}
+
+// batchSize returns the size of the next batch for a server.
+func (t *tuner) batchSize(server string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.batchSizeLocked(server)
+}
+
+func (t *tuner) batchSizeLocked(server string) int {
+	if size, ok := t.batchSizes[server]; ok {
+		return size
+	}
+
+	return clamp(batchSize, minBatchSize, t.maxBatchSize)
+}
+
+// record adjusts the batch size of a server and the concurrency of the scan, given the outcome of
+// a request for `size` addresses.
+func (t *tuner) record(server string, size int, elapsed time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current := t.batchSizeLocked(server)
+
+	switch {
+	case err != nil:
+		t.batchSizes[server] = clamp(current/2, minBatchSize, t.maxBatchSize)
+		t.slowDown()
+
+	case elapsed > 2*targetLatency:
+		t.batchSizes[server] = clamp(current/2, minBatchSize, t.maxBatchSize)
+		t.slowDown()
+
+	case elapsed > targetLatency:
+		t.batchSizes[server] = clamp(current*3/4, minBatchSize, t.maxBatchSize)
+
+	default:
+		// Partial batches (at the end of the scan) say nothing about larger ones:
+		if size >= current {
+			t.batchSizes[server] = clamp(current*3/2, minBatchSize, t.maxBatchSize)
+		}
+
+		t.successes++
+		if t.successes >= t.concurrency && t.concurrency < t.maxConcurrency {
+			t.concurrency++
+			t.successes = 0
+		}
+	}
+
+	t.notify()
+}
+
+// slowDown allows one less concurrent task.
+func (t *tuner) slowDown() {
+	t.successes = 0
+
+	if t.concurrency > 1 {
+		t.concurrency--
+	}
+}
+
+// notify wakes up callers waiting in acquire.
+func (t *tuner) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+func clamp(value, min, max int) int {
+	if value < min {
+		return min
+	}
+
+	if value > max {
+		return max
+	}
+
+	return value
+}
@@ -0,0 +1,247 @@
+package scanner
+
+import (
+	"fmt"
+
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/utils"
+)
+
+// Watcher keeps an eye on the addresses that held funds at the end of a scan, using Electrum
+// subscriptions, so that the UTXO set can be brought up to date right before a sweep without
+// scanning the whole address space again.
+//
+// It also follows new blocks, so that what we show about the blockchain (the latest block, and fee
+// estimates) can be kept current while the user decides.
+//
+// The user can take a while to choose a fee and destination. If the server drops our connection
+// in the meantime (which they do with idle sessions) we can't know what changed, so we list
+// the unspent outputs of all watched addresses again. That's still a handful of requests.
+type Watcher struct {
+	servers  *electrum.ServerProvider
+	client   *electrum.Client
+	watched  map[string]*indexedAddress // by index hash
+	statuses map[string]string          // by index hash
+	utxos    []*Utxo
+	log      utils.Logger
+}
+
+// Watch subscribes to changes in the addresses that hold the given UTXOs.
+func (s *Scanner) Watch(utxos []*Utxo) (*Watcher, error) {
+	if s.dump != nil {
+		return nil, fmt.Errorf("can't watch addresses while offline")
+	}
+
+	if !s.usesElectrum() {
+		return nil, s.unsupported("watching addresses")
+	}
+
+	w := &Watcher{
+		servers:  s.servers,
+		client:   electrum.NewClient(),
+		watched:  make(map[string]*indexedAddress),
+		statuses: make(map[string]string),
+		utxos:    utxos,
+		log:      utils.NewLogger("Watcher"),
+	}
+
+	for _, utxo := range utxos {
+		entry, ok := s.index.lookupScript(utxo.Script)
+		if !ok {
+			return nil, fmt.Errorf("utxo %s:%d is not from a scanned address", utxo.TxID, utxo.OutputIndex)
+		}
+
+		w.watched[entry.hashParam] = entry
+	}
+
+	if err := w.subscribe(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Refresh returns the current UTXO set for the watched addresses, and whether it changed.
+func (w *Watcher) Refresh() ([]*Utxo, bool, error) {
+	var changed []string
+
+	if err := w.client.Ping(); err == nil {
+		// Our subscriptions are alive, so the server told us about everything that happened:
+		for indexHash, status := range w.client.ScriptHashNotifications() {
+			if _, ok := w.watched[indexHash]; ok && w.statuses[indexHash] != status {
+				changed = append(changed, indexHash)
+			}
+		}
+
+	} else {
+		// We lost the connection, and with it our subscriptions. Check everything again:
+		w.log.Printf("Connection lost, re-subscribing: %v", err)
+
+		if err := w.subscribe(); err != nil {
+			return nil, false, err
+		}
+
+		for indexHash := range w.watched {
+			changed = append(changed, indexHash)
+		}
+	}
+
+	if len(changed) == 0 {
+		return w.utxos, false, nil
+	}
+
+	utxos, err := w.relist(changed)
+	if err != nil {
+		return nil, false, err
+	}
+
+	didChange := !sameUtxos(w.utxos, utxos)
+	w.utxos = utxos
+
+	return utxos, didChange, nil
+}
+
+// Tip returns the height of the latest block, or 0 if unknown.
+func (w *Watcher) Tip() int {
+	// Pinging delivers pending notifications. If the connection was lost, we can only give the last
+	// block we know of: re-subscribing is up to Refresh, which must check the addresses again.
+	w.client.Ping()
+
+	if tip := w.client.Tip(); tip != nil {
+		return tip.Height
+	}
+
+	return 0
+}
+
+// EstimateFeeRate returns the fee rate (in sats/vbyte) needed to confirm within a number of blocks,
+// or 0 if the server can't tell.
+func (w *Watcher) EstimateFeeRate(blocks int) float64 {
+	btcPerKB, err := w.client.EstimateFee(blocks)
+	if err != nil || btcPerKB <= 0 {
+		return 0
+	}
+
+	return btcPerKB * 1e8 / 1000
+}
+
+// Close cancels all subscriptions and disconnects.
+func (w *Watcher) Close() {
+	if !w.client.IsConnected() {
+		return
+	}
+
+	for indexHash := range w.watched {
+		_, err := w.client.UnsubscribeScriptHash(indexHash)
+		if err != nil {
+			break // older servers don't support unsubscribing, disconnecting is enough
+		}
+	}
+
+	w.client.Disconnect()
+}
+
+// subscribe connects to a server and subscribes to all watched addresses, recording their status.
+func (w *Watcher) subscribe() error {
+	var err error
+
+	for attempt := 0; attempt < maxServerAttempts; attempt++ {
+		err = w.client.Connect(w.servers.NextServer())
+		if err != nil {
+			continue
+		}
+
+		err = w.trySubscribe()
+		if err == nil {
+			return nil
+		}
+
+		w.client.Disconnect()
+	}
+
+	return utils.WrapError(utils.ErrBackendUnavailable, fmt.Errorf("failed to watch addresses: %w", err))
+}
+
+func (w *Watcher) trySubscribe() error {
+	for indexHash := range w.watched {
+		status, err := w.client.SubscribeScriptHash(indexHash)
+		if err != nil {
+			return err
+		}
+
+		w.statuses[indexHash] = status
+	}
+
+	// Following blocks is a nice-to-have, servers that don't let us can still watch addresses:
+	if _, err := w.client.SubscribeHeaders(); err != nil {
+		w.log.Printf("Failed to follow new blocks: %v", err)
+	}
+
+	// Discard notifications that may have arrived while subscribing, we already have fresh statuses:
+	w.client.ScriptHashNotifications()
+
+	return nil
+}
+
+// relist replaces the UTXOs of the changed addresses with a fresh listing.
+func (w *Watcher) relist(changed []string) ([]*Utxo, error) {
+	isChanged := make(map[string]bool)
+	for _, indexHash := range changed {
+		isChanged[indexHash] = true
+	}
+
+	var utxos []*Utxo
+
+	for _, utxo := range w.utxos {
+		if !isChanged[electrum.GetIndexHash(utxo.Script)] {
+			utxos = append(utxos, utxo)
+		}
+	}
+
+	for _, indexHash := range changed {
+		entry := w.watched[indexHash]
+
+		refs, err := w.client.ListUnspent(indexHash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to refresh %s: %w", entry.address.Address(), err)
+		}
+
+		for _, ref := range refs {
+			if err := validateUnspentRef(ref); err != nil {
+				return nil, err
+			}
+
+			utxos = append(utxos, &Utxo{
+				TxID:        ref.TxHash,
+				OutputIndex: ref.TxPos,
+				Amount:      sats.Amount(ref.Value),
+				Address:     entry.address,
+				Script:      entry.script,
+				Height:      ref.Height,
+			})
+		}
+	}
+
+	return utxos, nil
+}
+
+// sameUtxos returns whether two UTXO lists reference the same set of outputs.
+func sameUtxos(a, b []*Utxo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	outpoints := make(map[string]bool)
+	for _, utxo := range a {
+		outpoints[fmt.Sprintf("%s:%d", utxo.TxID, utxo.OutputIndex)] = true
+	}
+
+	for _, utxo := range b {
+		if !outpoints[fmt.Sprintf("%s:%d", utxo.TxID, utxo.OutputIndex)] {
+			return false
+		}
+	}
+
+	return true
+}
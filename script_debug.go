@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet/btcsuitew/txscriptw"
+	"github.com/muun/libwallet/musig"
+	"github.com/muun/recovery/scanner"
+)
+
+// Signatures are checked against the scripts they spend as soon as they're made, and every input
+// again before a transaction is sent, the way nodes would check them (with btcd's script engine
+// and the standard flags). A transaction that fails is never broadcast: it would be rejected
+// anyway, with an error that says little about why.
+//
+// With --debug-scripts, a failure also prints everything needed to diagnose it from a user's
+// report, without their keys: each step of the script execution with the stacks after it, which
+// signature matches which key of the multisig, and the sighash preimage that was signed.
+
+// validateTx checks every input of a signed transaction before it's sent, given the outputs it
+// spends, in order.
+func validateTx(tx *wire.MsgTx, spent []*scanner.Utxo) error {
+	if len(spent) != len(tx.TxIn) {
+		return fmt.Errorf("can't validate transaction %s: it has %d inputs, for %d outputs spent", tx.TxHash(), len(tx.TxIn), len(spent))
+	}
+
+	if err := verifySignedInputs(tx, spent); err != nil {
+		return fmt.Errorf("transaction %s wasn't sent, nodes would reject it: %w", tx.TxHash(), err)
+	}
+
+	return nil
+}
+
+// verifySignedInputs checks the signatures of the inputs spending the given UTXOs, which come first
+// in the transaction, in order.
+func verifySignedInputs(tx *wire.MsgTx, utxos []*scanner.Utxo) error {
+	sigHashes := txscript.NewTxSigHashes(tx)
+
+	for i, utxo := range utxos {
+		var err error
+
+		if isTaprootScript(utxo.Script) {
+			err = verifyTaprootInput(tx, utxos, i)
+		} else {
+			err = verifyScriptInput(tx, sigHashes, utxo, i)
+		}
+
+		if err == nil {
+			continue
+		}
+
+		if *debugScripts {
+			printScriptTrace(tx, sigHashes, utxos, i, err)
+			return fmt.Errorf("input %d doesn't validate: %s", i, describeScriptError(err))
+		}
+
+		return fmt.Errorf("input %d doesn't validate: %s (run with --debug-scripts for details)", i, describeScriptError(err))
+	}
+
+	return nil
+}
+
+// describeScriptError names the check of the script engine that failed, along with its description.
+func describeScriptError(err error) string {
+	var scriptErr txscript.Error
+	if errors.As(err, &scriptErr) {
+		return fmt.Sprintf("%s (%v)", scriptErr.Description, scriptErr.ErrorCode)
+	}
+
+	return err.Error()
+}
+
+func verifyScriptInput(tx *wire.MsgTx, sigHashes *txscript.TxSigHashes, utxo *scanner.Utxo, index int) error {
+	vm, err := txscript.NewEngine(utxo.Script, tx, index, txscript.StandardVerifyFlags, nil, sigHashes, int64(utxo.Amount))
+	if err != nil {
+		return err
+	}
+
+	return vm.Execute()
+}
+
+// verifyTaprootInput checks a key path spend. btcd doesn't run taproot scripts yet, so the
+// signature is checked directly against the output key.
+func verifyTaprootInput(tx *wire.MsgTx, utxos []*scanner.Utxo, index int) error {
+	// The sighash commits to every output spent, so we can't check it without all of them (such as
+	// when the fee input is signed separately):
+	if len(utxos) != len(tx.TxIn) {
+		return nil
+	}
+
+	sigHash, err := taprootSigHash(tx, utxos, index)
+	if err != nil {
+		return err
+	}
+
+	witness := tx.TxIn[index].Witness
+	if len(witness) != 1 || (len(witness[0]) != 64 && len(witness[0]) != 65) {
+		return fmt.Errorf("the witness is not a single schnorr signature")
+	}
+
+	outputKey, err := btcec.ParsePubKey(append([]byte{0x02}, utxos[index].Script[2:]...), btcec.S256())
+	if err != nil {
+		return fmt.Errorf("invalid output key: %w", err)
+	}
+
+	var data [32]byte
+	var signature [64]byte
+	copy(data[:], sigHash)
+	copy(signature[:], witness[0])
+
+	if !musig.VerifySignature(data, signature, outputKey) {
+		return fmt.Errorf("the schnorr signature doesn't match the output key")
+	}
+
+	return nil
+}
+
+func taprootSigHash(tx *wire.MsgTx, utxos []*scanner.Utxo, index int) ([]byte, error) {
+	prevOuts := make([]*wire.TxOut, len(utxos))
+	for i, utxo := range utxos {
+		prevOuts[i] = wire.NewTxOut(int64(utxo.Amount), utxo.Script)
+	}
+
+	return txscriptw.CalcTaprootSigHash(tx, txscriptw.NewTaprootSigHashes(tx, prevOuts), index, txscript.SigHashAll)
+}
+
+// printScriptTrace prints why an input failed to verify.
+func printScriptTrace(tx *wire.MsgTx, sigHashes *txscript.TxSigHashes, utxos []*scanner.Utxo, index int, failure error) {
+	utxo := utxos[index]
+	txIn := tx.TxIn[index]
+
+	sayBlock(`
+		{red Script validation failed} for input %d: %v
+	`, index, failure)
+
+	lines := []string{
+		fmt.Sprintf("spends: %v", txIn.PreviousOutPoint),
+		fmt.Sprintf("amount: %v sats", utxo.Amount),
+	}
+
+	// Outputs from outside the wallet (such as the fee input) have no address of ours:
+	if utxo.Address != nil {
+		lines = append(lines, fmt.Sprintf("address: %s (version %d, %s)", utxo.Address.Address(), utxo.Address.Version(), utxo.Address.DerivationPath()))
+	}
+
+	lines = append(lines,
+		fmt.Sprintf("output script: %s", disassemble(utxo.Script)),
+		fmt.Sprintf("signature script: %s", disassemble(txIn.SignatureScript)),
+	)
+
+	for i, item := range txIn.Witness {
+		lines = append(lines, fmt.Sprintf("witness %d: %x", i, item))
+	}
+
+	printTraceSection("Input", lines)
+
+	if isTaprootScript(utxo.Script) {
+		sigHash, err := taprootSigHash(tx, utxos, index)
+		if err != nil {
+			printTraceSection("Sighash", []string{err.Error()})
+			return
+		}
+
+		// The taproot preimage is hashed as it's built, so only the sighash is shown:
+		printTraceSection("Sighash", []string{
+			fmt.Sprintf("key path spend, SIGHASH_ALL: %x", sigHash),
+			fmt.Sprintf("output key: %x", utxo.Script[2:]),
+		})
+		return
+	}
+
+	spend := parseScriptSpend(utxo.Script, txIn)
+	printTraceSection("Signatures", spend.matchSignatures(tx, sigHashes, index, int64(utxo.Amount)))
+	printTraceSection("Execution", executionTrace(tx, sigHashes, utxo, index))
+}
+
+// scriptSpend is how an input spends its output: the script the signatures commit to, and the
+// signatures and keys it provides.
+type scriptSpend struct {
+	scriptCode []byte // the script signed, for P2PKH and multisig spends
+	witness    bool   // whether it's signed as a segwit v0 input (BIP 143)
+	signatures [][]byte
+	keys       [][]byte
+}
+
+func parseScriptSpend(pkScript []byte, txIn *wire.TxIn) *scriptSpend {
+	spend := &scriptSpend{}
+
+	pushes, _ := txscript.PushedData(txIn.SignatureScript)
+
+	switch {
+	case txscript.IsPayToScriptHash(pkScript) && len(pushes) > 0:
+		redeemScript := pushes[len(pushes)-1]
+
+		if txscript.IsWitnessProgram(redeemScript) {
+			spend.witnessSpend(txIn.Witness)
+		} else {
+			spend.scriptCode = redeemScript
+			spend.addSignatures(pushes[:len(pushes)-1])
+			spend.addKeys(redeemScript)
+		}
+
+	case txscript.IsPayToWitnessScriptHash(pkScript):
+		spend.witnessSpend(txIn.Witness)
+
+	default:
+		// P2PKH: the signature script has the signature and the key:
+		spend.scriptCode = pkScript
+		spend.addSignatures(pushes)
+
+		for _, push := range pushes {
+			if isPublicKey(push) {
+				spend.keys = append(spend.keys, push)
+			}
+		}
+	}
+
+	return spend
+}
+
+func (s *scriptSpend) witnessSpend(witness wire.TxWitness) {
+	if len(witness) == 0 {
+		return
+	}
+
+	s.witness = true
+	s.scriptCode = witness[len(witness)-1]
+	s.addSignatures(witness[:len(witness)-1])
+	s.addKeys(s.scriptCode)
+}
+
+// addSignatures keeps the pushes that look like DER signatures, followed by their hash type.
+func (s *scriptSpend) addSignatures(pushes [][]byte) {
+	for _, push := range pushes {
+		if len(push) > 8 && push[0] == 0x30 {
+			s.signatures = append(s.signatures, push)
+		}
+	}
+}
+
+// addKeys keeps the public keys pushed by a script.
+func (s *scriptSpend) addKeys(script []byte) {
+	pushes, _ := txscript.PushedData(script)
+
+	for _, push := range pushes {
+		if isPublicKey(push) {
+			s.keys = append(s.keys, push)
+		}
+	}
+}
+
+// matchSignatures describes which key each signature is valid for, along with the sighash
+// preimage it should sign.
+func (s *scriptSpend) matchSignatures(tx *wire.MsgTx, sigHashes *txscript.TxSigHashes, index int, amount int64) []string {
+	if s.scriptCode == nil {
+		return []string{"the spend couldn't be parsed, see the execution below"}
+	}
+
+	var lines []string
+	signedKeys := make(map[int]bool)
+	lastKey, ordered := -1, true
+
+	for i, rawSignature := range s.signatures {
+		hashType := txscript.SigHashType(rawSignature[len(rawSignature)-1])
+
+		preimage, sigHash, err := s.sigHash(tx, sigHashes, index, amount, hashType)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("signature %d: no sighash for hash type 0x%02x: %v", i, hashType, err))
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("signature %d: %x", i, rawSignature))
+		lines = append(lines, fmt.Sprintf("  hash type 0x%02x, sighash %x", hashType, sigHash))
+		lines = append(lines, fmt.Sprintf("  preimage %x", preimage))
+
+		signature, err := btcec.ParseDERSignature(rawSignature[:len(rawSignature)-1], btcec.S256())
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("  not a valid DER signature: %v", err))
+			continue
+		}
+
+		matched := false
+
+		for j, rawKey := range s.keys {
+			key, err := btcec.ParsePubKey(rawKey, btcec.S256())
+			if err == nil && signature.Verify(sigHash, key) {
+				lines = append(lines, fmt.Sprintf("  valid for key %d", j))
+				signedKeys[j] = true
+				matched = true
+
+				ordered = ordered && j > lastKey
+				lastKey = j
+			}
+		}
+
+		if !matched {
+			lines = append(lines, "  not valid for any key")
+		}
+	}
+
+	// Multisig checks signatures in the order of the keys, so a missing slot is where it fails:
+	for j, rawKey := range s.keys {
+		status := "signed"
+		if !signedKeys[j] {
+			status = "no valid signature"
+		}
+
+		lines = append(lines, fmt.Sprintf("key %d: %x, %s", j, rawKey, status))
+	}
+
+	if !ordered {
+		lines = append(lines, "the signatures are not in the order of their keys, as multisig requires")
+	}
+
+	return lines
+}
+
+// sigHash returns the preimage signed by a signature with the given hash type, and its hash.
+func (s *scriptSpend) sigHash(tx *wire.MsgTx, sigHashes *txscript.TxSigHashes, index int, amount int64, hashType txscript.SigHashType) ([]byte, []byte, error) {
+	if s.witness {
+		sigHash, err := txscript.CalcWitnessSigHash(s.scriptCode, sigHashes, hashType, tx, index, amount)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return witnessPreimage(tx, sigHashes, s.scriptCode, index, amount, hashType), sigHash, nil
+	}
+
+	sigHash, err := txscript.CalcSignatureHash(s.scriptCode, hashType, tx, index)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	preimage, err := legacyPreimage(tx, s.scriptCode, index, hashType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return preimage, sigHash, nil
+}
+
+// witnessPreimage serializes what a segwit v0 signature commits to (BIP 143). Only SIGHASH_ALL is
+// shown exactly, which is what the Recovery Tool signs with.
+func witnessPreimage(tx *wire.MsgTx, sigHashes *txscript.TxSigHashes, scriptCode []byte, index int, amount int64, hashType txscript.SigHashType) []byte {
+	var buf bytes.Buffer
+	txIn := tx.TxIn[index]
+
+	binary.Write(&buf, binary.LittleEndian, tx.Version)
+	buf.Write(sigHashes.HashPrevOuts[:])
+	buf.Write(sigHashes.HashSequence[:])
+	buf.Write(txIn.PreviousOutPoint.Hash[:])
+	binary.Write(&buf, binary.LittleEndian, txIn.PreviousOutPoint.Index)
+	wire.WriteVarBytes(&buf, 0, scriptCode)
+	binary.Write(&buf, binary.LittleEndian, amount)
+	binary.Write(&buf, binary.LittleEndian, txIn.Sequence)
+	buf.Write(sigHashes.HashOutputs[:])
+	binary.Write(&buf, binary.LittleEndian, tx.LockTime)
+	binary.Write(&buf, binary.LittleEndian, uint32(hashType))
+
+	return buf.Bytes()
+}
+
+// legacyPreimage serializes what a pre-segwit SIGHASH_ALL signature commits to: the transaction
+// with the script signed in place of the input's signature script, and no other.
+func legacyPreimage(tx *wire.MsgTx, scriptCode []byte, index int, hashType txscript.SigHashType) ([]byte, error) {
+	txCopy := tx.Copy()
+
+	for i, txIn := range txCopy.TxIn {
+		txIn.Witness = nil
+		txIn.SignatureScript = nil
+
+		if i == index {
+			txIn.SignatureScript = scriptCode
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := txCopy.SerializeNoWitness(&buf); err != nil {
+		return nil, err
+	}
+
+	binary.Write(&buf, binary.LittleEndian, uint32(hashType))
+
+	return buf.Bytes(), nil
+}
+
+// executionTrace runs the input's scripts one step at a time, recording the stacks after each.
+func executionTrace(tx *wire.MsgTx, sigHashes *txscript.TxSigHashes, utxo *scanner.Utxo, index int) []string {
+	vm, err := txscript.NewEngine(utxo.Script, tx, index, txscript.StandardVerifyFlags, nil, sigHashes, int64(utxo.Amount))
+	if err != nil {
+		return []string{fmt.Sprintf("the engine couldn't start: %v", err)}
+	}
+
+	var lines []string
+
+	for step := 0; ; step++ {
+		opcode, err := vm.DisasmPC()
+		if err != nil {
+			opcode = "?"
+		}
+
+		done, err := vm.Step()
+
+		lines = append(lines, fmt.Sprintf("%d: %s", step, opcode))
+		lines = append(lines, "  stack: "+formatStack(vm.GetStack()))
+
+		if altStack := vm.GetAltStack(); len(altStack) > 0 {
+			lines = append(lines, "  alt stack: "+formatStack(altStack))
+		}
+
+		if err != nil {
+			return append(lines, fmt.Sprintf("failed at step %d: %v", step, err))
+		}
+
+		if done {
+			break
+		}
+	}
+
+	if err := vm.CheckErrorCondition(true); err != nil {
+		return append(lines, fmt.Sprintf("failed after running: %v", err))
+	}
+
+	return append(lines, "succeeded")
+}
+
+func printTraceSection(title string, lines []string) {
+	sayBlock(`
+		{whiteUnderline %s}
+	`, title)
+
+	for _, line := range lines {
+		fmt.Fprintln(userOutput, "  "+line)
+	}
+}
+
+func formatStack(stack [][]byte) string {
+	if len(stack) == 0 {
+		return "(empty)"
+	}
+
+	items := make([]string, len(stack))
+	for i, item := range stack {
+		items[i] = "<" + hex.EncodeToString(item) + ">"
+	}
+
+	return strings.Join(items, " ")
+}
+
+func disassemble(script []byte) string {
+	if len(script) == 0 {
+		return "(empty)"
+	}
+
+	disassembled, err := txscript.DisasmString(script)
+	if err != nil {
+		return fmt.Sprintf("%x (%v)", script, err)
+	}
+
+	return disassembled
+}
+
+func isPublicKey(data []byte) bool {
+	return (len(data) == 33 && (data[0] == 0x02 || data[0] == 0x03)) || (len(data) == 65 && data[0] == 0x04)
+}
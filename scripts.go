@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/muun/libwallet/btcsuitew/btcutilw"
+)
+
+// scriptToAddress returns the address an output script pays to, if it's a standard single-address
+// script. Taproot outputs are handled separately, since btcd doesn't know about them yet.
+func scriptToAddress(script []byte) (string, bool) {
+	if isTaprootScript(script) {
+		addr, err := btcutilw.NewAddressTaprootKey(script[2:], &chainParams)
+		if err != nil {
+			return "", false
+		}
+
+		return addr.EncodeAddress(), true
+	}
+
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(script, &chainParams)
+	if err != nil || len(addrs) != 1 {
+		return "", false
+	}
+
+	return addrs[0].EncodeAddress(), true
+}
+
+// isTaprootScript returns whether a script is a segwit v1 (OP_1 <32 bytes>) output script.
+func isTaprootScript(script []byte) bool {
+	return len(script) == 34 && script[0] == txscript.OP_1 && script[1] == txscript.OP_DATA_32
+}
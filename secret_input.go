@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/muun/recovery/utils"
+)
+
+// maxInjectedSecretSize bounds what we read from a secret file descriptor. A Recovery Code is 39
+// characters, anything much larger is a mistake.
+const maxInjectedSecretSize = 1024
+
+// readInjectedRecoveryCode returns the Recovery Code passed through a file descriptor or an
+// environment variable, if configured. This allows secret managers (systemd credentials, password
+// manager CLIs) to provide it without it appearing in the command line or being typed.
+func readInjectedRecoveryCode() (string, bool) {
+	var source, secret string
+
+	switch {
+	case *recoveryCodeFD >= 0:
+		source = fmt.Sprintf("file descriptor %d", *recoveryCodeFD)
+
+		var err error
+		secret, err = readSecretFromFD(*recoveryCodeFD)
+		if err != nil {
+			exitWithError(fmt.Errorf("failed to read the Recovery Code from %s: %w", source, err))
+		}
+
+	case *recoveryCodeEnv != "":
+		source = fmt.Sprintf("environment variable %s", *recoveryCodeEnv)
+
+		var ok bool
+		secret, ok = os.LookupEnv(*recoveryCodeEnv)
+		if !ok {
+			exitWithError(fmt.Errorf("the %s is not set", source))
+		}
+
+		// Don't leave it around for child processes, or anything dumping our environment:
+		os.Unsetenv(*recoveryCodeEnv)
+
+	default:
+		return "", false
+	}
+
+	// The injected code is used once, for the main kit. Codes for additional kits are asked for:
+	*recoveryCodeFD = -1
+	*recoveryCodeEnv = ""
+
+	code, _ := normalizeRecoveryCode(strings.TrimSpace(secret))
+
+	if strings.Count(code, "-") != 7 || len(code) != 39 {
+		err := fmt.Errorf("the Recovery Code in the %s is not valid", source)
+		exitWithError(utils.WrapError(utils.ErrInvalidRecoveryCode, err))
+	}
+
+	say("\n► {white Using the Recovery Code from the %s}\n", source)
+
+	return code, true
+}
+
+func readSecretFromFD(fd int) (string, error) {
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	if file == nil {
+		return "", fmt.Errorf("invalid file descriptor")
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxInjectedSecretSize+1))
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) > maxInjectedSecretSize {
+		return "", fmt.Errorf("input is too large")
+	}
+
+	return string(data), nil
+}
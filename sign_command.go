@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet"
+	"github.com/muun/libwallet/btcsuitew/btcutilw"
+	"github.com/muun/recovery/payto"
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/scanner"
+)
+
+// Advanced users may build their transaction with other tools (to pay several destinations, pick
+// the outputs to spend, or batch with other wallets' funds signed elsewhere), and only need the
+// Recovery Tool to decrypt their keys and sign:
+//
+//	recovery-tool sign --tx raw.hex --inputs inputs.json
+//
+// The transaction must only spend outputs of the recovered wallet. Signing needs each output's
+// amount and address, which the raw transaction doesn't have: they're in the inputs file, a list
+// of the outputs spent in any order, or the results of a scan saved with `scan --out`. Nothing is
+// broadcast, the signed transaction is printed (or saved with --out).
+//
+// Signing is guarded like in a recovery: approvals, the custodian, the signing delay, the offline
+// window and the sandbox all apply (see signingGuards).
+//
+// The transaction can also be given as a PSBT, such as one from --psbt-out signed elsewhere by the
+// second key (see --cosigner-sigs).
+//
+// The amounts in the inputs file are checked against the transactions that created the outputs,
+// before anything is shown: the fee would be shown wrong otherwise, as it's what the inputs spend
+// minus what the outputs send. Signing stops if any differs. With --from-chain, the amounts and
+// addresses are read from those transactions instead, and the inputs file can be left out. The
+// address, found from the output script, tells how to spend each one: a wallet can hold outputs of
+// several address versions at the same derivation path, and an inputs file that names the wrong one
+// makes signing fail.
+
+// signInput is an output spent by the transaction to sign, as listed in the inputs file. Its fields
+// are named as in the scan results, so their outputs can be copied over.
+type signInput struct {
+	TxID        string      `json:"txId"`
+	OutputIndex int         `json:"outputIndex"`
+	Amount      sats.Amount `json:"amount"`
+	Address     string      `json:"address"`
+}
+
+func runSignCommand(args []string) {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	txPath := flags.String("tx", "", "the unsigned transaction to sign, in hex")
+	inputsPath := flags.String("inputs", "", "the outputs the transaction spends, as a JSON list or the results of scan --out")
+	outPath := flags.String("out", "", "save the signed transaction to this file, in hex, instead of printing it")
+	fromChain := flags.Bool("from-chain", false, "read the amounts and addresses of the outputs spent from the blockchain, instead of the inputs file")
+
+	var cosignerSigs cosignerSigsFlag
+	flags.Var(&cosignerSigs, "cosigner-sigs", "use the signatures of the second key in this PSBT or hex file, and sign with the user key alone (can be repeated)")
+	flags.Parse(args)
+
+	if *txPath == "" || (*inputsPath == "" && !*fromChain) || flags.NArg() > 1 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	// Load the files first, we don't want to find out they're broken after decrypting the keys:
+	tx, err := loadUnsignedTx(*txPath)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	var signatures [][]byte
+
+	if len(cosignerSigs) > 0 {
+		if signatures, err = loadCosignerSignatures(cosignerSigs); err != nil {
+			exitWithError(err)
+		}
+	}
+
+	var inputs []signInput
+
+	if *inputsPath != "" {
+		if inputs, err = loadSignInputs(*inputsPath); err != nil {
+			exitWithError(err)
+		}
+	}
+
+	chainInputs, err := loadSpentOutputs(newUtxoScanner(preferredServers(nil)), tx)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	changed := reportSignInputChanges(inputs, chainInputs)
+
+	if *fromChain {
+		inputs = chainInputs
+	} else if changed {
+		exitWithError(fmt.Errorf("the inputs file doesn't match the blockchain, fix it or sign with --from-chain"))
+	}
+
+	guards := loadSigningGuards()
+
+	say(`
+		{blue Muun Recovery Tool v%s}
+
+		This will sign a transaction you built, spending your funds. {white It won't be broadcast}.
+
+		You will need {yellow your Recovery Code} and {yellow your Emergency Kit PDF}.
+	`, version)
+
+	generations := readGuardedKeys(flags.Arg(0), false, *outPath)
+
+	utxos, err := matchSignInputs(tx, inputs, generations)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	var cosignerSignatures [][]byte
+
+	if signatures != nil {
+		if cosignerSignatures, err = matchCosignerSignatures(tx, utxos, generations, signatures); err != nil {
+			exitWithError(err)
+		}
+
+		say("{green ✓} Every input has a valid signature of the second key, only the user key will sign\n")
+	}
+
+	sent, fee, destination, err := printUnsignedTx(tx, utxos)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if !readYesNo("Sign it?") {
+		stopAtConfirmation()
+	}
+
+	guards.approve(destination, destination, sent, fee, "signing the transaction")
+
+	var rawTx bytes.Buffer
+	if err := tx.Serialize(&rawTx); err != nil {
+		exitWithError(err)
+	}
+
+	sweeper := &Sweeper{Generations: generations, Presence: guards.presence, CosignerSignatures: cosignerSignatures}
+
+	signedTx, err := sweeper.signTx(utxos, rawTx.Bytes())
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to sign the transaction: %w", err))
+	}
+
+	leaveOfflineWindow(false) // nothing is broadcast
+
+	signedHex, err := encodeTxHex(signedTx)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	recordCaseEvent(currentTag(), "sign", "Signed transaction %s, spending %d outputs with a fee of %d sats", signedTx.TxHash(), len(utxos), fee)
+
+	if *outPath != "" {
+		if err := ioutil.WriteFile(*outPath, []byte(signedHex+"\n"), 0600); err != nil {
+			exitWithError(fmt.Errorf("failed to save the signed transaction: %w", err))
+		}
+
+		sayBlock(`
+			{green ✓} Signed transaction {white %s} saved to {white %s}
+			It wasn't broadcast.
+
+		`, signedTx.TxHash(), *outPath)
+		return
+	}
+
+	sayBlock(`
+		{green ✓} Signed transaction {white %s}. It wasn't broadcast:
+
+		%s
+
+	`, signedTx.TxHash(), signedHex)
+}
+
+// loadUnsignedTx reads a transaction in hex, or the one in a PSBT.
+func loadUnsignedTx(path string) (*wire.MsgTx, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transaction: %w", err)
+	}
+
+	packet, isPSBT, err := decodePSBT(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the transaction in %s: %w", path, err)
+	}
+
+	if isPSBT {
+		return packet.UnsignedTx, nil
+	}
+
+	rawTx, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("the transaction in %s is not in hex: %w", path, err)
+	}
+
+	tx := wire.NewMsgTx(0)
+	if err := tx.Deserialize(bytes.NewReader(rawTx)); err != nil {
+		return nil, fmt.Errorf("failed to decode the transaction in %s: %w", path, err)
+	}
+
+	if len(tx.TxIn) == 0 || len(tx.TxOut) == 0 {
+		return nil, fmt.Errorf("the transaction in %s has no inputs or no outputs", path)
+	}
+
+	return tx, nil
+}
+
+// loadSignInputs reads the outputs a transaction spends, listed as signInputs or in scan results.
+func loadSignInputs(path string) ([]signInput, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inputs: %w", err)
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		results, err := loadScanResults(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var inputs []signInput
+		for _, utxo := range results.Utxos {
+			inputs = append(inputs, signInput{utxo.TxID, utxo.OutputIndex, utxo.Amount, utxo.Address})
+		}
+
+		return inputs, nil
+	}
+
+	var inputs []signInput
+	if err := json.Unmarshal(data, &inputs); err != nil {
+		return nil, fmt.Errorf("failed to parse inputs in %s: %w", path, err)
+	}
+
+	return inputs, nil
+}
+
+// loadSpentOutputs returns the outputs a transaction spends, from the transactions that created
+// them. Their addresses come from the scripts in the blockchain, and so the way to spend them.
+func loadSpentOutputs(utxoScanner *scanner.Scanner, tx *wire.MsgTx) ([]signInput, error) {
+	var inputs []signInput
+
+	for _, txIn := range tx.TxIn {
+		outpoint := txIn.PreviousOutPoint
+
+		prevTx, err := utxoScanner.GetTransaction(outpoint.Hash.String())
+		if err != nil {
+			return nil, fmt.Errorf("couldn't find the transaction spent by %s: %w", outpoint, err)
+		}
+
+		if int(outpoint.Index) >= len(prevTx.TxOut) {
+			return nil, fmt.Errorf("transaction %s has no output %d", outpoint.Hash, outpoint.Index)
+		}
+
+		txOut := prevTx.TxOut[outpoint.Index]
+
+		address, ok := scriptToAddress(txOut.PkScript)
+		if !ok {
+			return nil, fmt.Errorf("the output %s is not in an address of your wallet", outpoint)
+		}
+
+		inputs = append(inputs, signInput{outpoint.Hash.String(), int(outpoint.Index), sats.Amount(txOut.Value), address})
+	}
+
+	return inputs, nil
+}
+
+// reportSignInputChanges warns about the outputs the inputs file describes differently than the
+// blockchain, and returns whether there were any.
+func reportSignInputChanges(fileInputs, chainInputs []signInput) bool {
+	changed := false
+
+	byOutpoint := make(map[string]signInput)
+	for _, input := range fileInputs {
+		byOutpoint[fmt.Sprintf("%s:%d", input.TxID, input.OutputIndex)] = input
+	}
+
+	for _, chainInput := range chainInputs {
+		outpoint := fmt.Sprintf("%s:%d", chainInput.TxID, chainInput.OutputIndex)
+
+		fileInput, ok := byOutpoint[outpoint]
+		if !ok || (fileInput.Address == chainInput.Address && fileInput.Amount == chainInput.Amount) {
+			continue
+		}
+
+		say(
+			"{yellow !} The inputs file has %s in %s, with %d sats, but the blockchain has it in %s, with %d sats\n",
+			outpoint, fileInput.Address, fileInput.Amount, chainInput.Address, chainInput.Amount,
+		)
+
+		changed = true
+	}
+
+	return changed
+}
+
+// matchSignInputs returns the UTXOs the transaction spends, in the order of its inputs. Every
+// input must be in the inputs file, in an address of the recovered wallet.
+func matchSignInputs(tx *wire.MsgTx, inputs []signInput, generations []*keyGeneration) ([]*scanner.Utxo, error) {
+	byOutpoint := make(map[string]signInput)
+	for _, input := range inputs {
+		byOutpoint[fmt.Sprintf("%s:%d", input.TxID, input.OutputIndex)] = input
+	}
+
+	// The addresses of the wallet are the ones we'd scan:
+	addresses := make(map[string]libwallet.MuunAddress)
+	for address := range streamGenerations(generations, nil) {
+		addresses[address.Address()] = address
+	}
+
+	var utxos []*scanner.Utxo
+
+	for i, txIn := range tx.TxIn {
+		outpoint := txIn.PreviousOutPoint.String()
+
+		input, ok := byOutpoint[outpoint]
+		if !ok {
+			return nil, fmt.Errorf("input %d of the transaction spends %s, which is not in the inputs file", i, outpoint)
+		}
+
+		address, ok := addresses[input.Address]
+		if !ok {
+			return nil, fmt.Errorf("input %d of the transaction spends %s, in %s, which is not an address of your wallet", i, outpoint, input.Address)
+		}
+
+		if input.Amount <= 0 {
+			return nil, fmt.Errorf("input %d of the transaction spends %s, which has no amount in the inputs file", i, outpoint)
+		}
+
+		decoded, err := btcutilw.DecodeAddress(input.Address, &chainParams)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s: %w", input.Address, err)
+		}
+
+		script, err := payto.Script(decoded)
+		if err != nil {
+			return nil, err
+		}
+
+		utxos = append(utxos, &scanner.Utxo{
+			TxID:        input.TxID,
+			OutputIndex: input.OutputIndex,
+			Amount:      input.Amount,
+			Address:     address,
+			Script:      script,
+		})
+	}
+
+	return utxos, nil
+}
+
+// printUnsignedTx shows what the transaction sends, and returns the amount sent, its fee and the
+// addresses it sends to.
+func printUnsignedTx(tx *wire.MsgTx, utxos []*scanner.Utxo) (sats.Amount, sats.Amount, string, error) {
+	spent, err := scanner.Total(utxos)
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	var sent sats.Amount
+	var outputs, addresses []string
+
+	for _, txOut := range tx.TxOut {
+		sent, err = sent.Add(sats.Amount(txOut.Value))
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("invalid output amount: %w", err)
+		}
+
+		address, ok := scriptToAddress(txOut.PkScript)
+		if !ok {
+			address = fmt.Sprintf("script %x", txOut.PkScript)
+		}
+
+		outputs = append(outputs, fmt.Sprintf("    %s: %v sats", applyColor("white", address), txOut.Value))
+		addresses = append(addresses, address)
+	}
+
+	if sent > spent {
+		return 0, 0, "", fmt.Errorf("the transaction sends %v sats, more than the %v sats it spends", sent, spent)
+	}
+
+	fee := spent - sent
+
+	sayBlock(`
+		{whiteUnderline Transaction to sign}
+		  {white Spends}: %v sats, from %d outputs
+		  {white Fee}: %v sats
+		  {white Sends to}:
+		%s
+	`, spent, len(utxos), fee, strings.Join(outputs, "\n"))
+
+	return sent, fee, strings.Join(addresses, ", "), nil
+}
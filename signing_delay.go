@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+)
+
+// defaultCancelFile is where we look for a cancel trigger during the signing delay, if no other
+// path is given. Creating the file from anywhere (another terminal, a remote session) cancels.
+var defaultCancelFile = filepath.Join(os.TempDir(), "muun-recovery-cancel")
+
+// waitBeforeSigning holds the recovery for a cooling-off period after it was confirmed, showing
+// a countdown. Pressing Ctrl+C or creating the cancel file during this time stops the Recovery
+// Tool before anything is signed.
+//
+// This protects users who are being rushed or coerced: whoever is pressuring them has to stay
+// around for the whole delay, and anyone else who knows about it can cancel the recovery.
+func waitBeforeSigning(delay time.Duration, cancelFile string) {
+	// Remove leftovers from a previous cancellation, they shouldn't cancel this run:
+	os.Remove(cancelFile)
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	sayBlock(`
+		{yellow The transaction will be signed in %v}
+		To cancel, press {white Ctrl+C} or create this file:
+		  %s
+
+	`, delay, cancelFile)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(delay)
+
+	for remaining := delay; remaining > 0; remaining = time.Until(deadline) {
+		say("\r► {white Signing in}: %v   ", remaining.Round(time.Second))
+
+		select {
+		case <-interrupts:
+			cancelSigning("Ctrl+C was pressed")
+
+		case <-ticker.C:
+			if _, err := os.Stat(cancelFile); err == nil {
+				os.Remove(cancelFile)
+				cancelSigning(fmt.Sprintf("%s was created", cancelFile))
+			}
+		}
+	}
+
+	fmt.Fprintln(userOutput)
+}
+
+func cancelSigning(reason string) {
+	fmt.Fprintln(userOutput)
+
+	sayBlock(`
+		{red Recovery cancelled}: %s
+		Nothing was signed or sent
+	`, reason)
+
+	os.Exit(1)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/muun/recovery/sats"
+	"golang.org/x/crypto/ed25519"
+)
+
+// signingGuards are the checks the user asked for before anything is signed: approvals by others
+// (--approval-policy), the custodian's signature (--custodian-key), the presence of a security key
+// (--fido2) and a cooling-off period (--signing-delay). Every command that signs loads them with
+// loadSigningGuards, before asking for anything, and calls approve once the user confirmed.
+type signingGuards struct {
+	policy    *approvalPolicy
+	presence  *fido2Gate
+	custodian ed25519.PublicKey
+}
+
+// loadSigningGuards loads the guards given with the options. It fails early if one is broken.
+func loadSigningGuards() *signingGuards {
+	guards := &signingGuards{}
+
+	if *approvalPolicyPath != "" {
+		policy, err := loadApprovalPolicy(*approvalPolicyPath)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		guards.policy = policy
+	}
+
+	guards.presence = loadFIDO2Gate()
+	guards.custodian = loadCustodianKey()
+
+	return guards
+}
+
+// approve runs the checks between the user's confirmation and signing, and makes sure this computer
+// is offline with --offline-window (see enterOfflineWindow). The caller must leave the window once
+// the transaction is signed. The security key is checked later, by the Sweeper, as it signs.
+//
+// `address` is where the transaction sends to, and `destination` how it was shown to the user.
+func (g *signingGuards) approve(address, destination string, amount, fee sats.Amount, purpose string) {
+	if g.policy != nil {
+		readApprovals(g.policy)
+	}
+
+	if g.custodian != nil {
+		readCustodianApproval(g.custodian, address, destination, amount, fee)
+	}
+
+	if *signingDelay > 0 {
+		waitBeforeSigning(*signingDelay, *cancelFile)
+	}
+
+	enterOfflineWindow(purpose)
+}
+
+// readGuardedKeys reads the keys like readKeyGenerations, offline with --offline-window, and then
+// enters the sandbox (see enterSandbox). `reconnect` tells whether the network is needed afterwards.
+func readGuardedKeys(optionalPDF string, reconnect bool, outputs ...string) []*keyGeneration {
+	enterOfflineWindow("decrypting your keys")
+	generations := readKeyGenerations(optionalPDF)
+	leaveOfflineWindow(reconnect)
+
+	enterSandbox(outputs...)
+
+	return generations
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet"
+	"github.com/muun/libwallet/btcsuitew/btcutilw"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/payto"
+	"github.com/muun/recovery/sats"
+)
+
+// snapshotVersion is the version of the snapshot file format.
+const snapshotVersion = 1
+
+// snapshot is a read-only description of a proposed sweep, with everything needed to verify it and
+// no private material. It can be handed to an auditor before anything is signed.
+type snapshot struct {
+	Version int `json:"version"`
+	caseTag
+	CreatedAt   time.Time    `json:"createdAt"`
+	UserKey     string       `json:"userKey"` // extended public keys at `keys.KitKeyPath`
+	MuunKey     string       `json:"muunKey"`
+	Scan        *scanResults `json:"scan"`
+	Destination string       `json:"destination"`
+	Amount      sats.Amount  `json:"amount"`
+	Fee         sats.Amount  `json:"fee"`
+	UnsignedTx  string       `json:"unsignedTx"`
+}
+
+// snapshotEnvelope wraps a serialized snapshot with a signature made by the user key it contains,
+// so any modification after export is detected.
+type snapshotEnvelope struct {
+	Payload   []byte `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+func newSnapshot(userKey, muunKey keys.PrivateKey, scan *scanResults, tx *wire.MsgTx, destination string, fee sats.Amount) (*snapshot, error) {
+	userPublicKey, muunPublicKey, err := exportableKeys(userKey, muunKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, fmt.Errorf("failed to serialize tx: %w", err)
+	}
+
+	return &snapshot{
+		Version:     snapshotVersion,
+		caseTag:     currentTag(),
+		CreatedAt:   time.Now().UTC(),
+		UserKey:     userPublicKey.String(),
+		MuunKey:     muunPublicKey.String(),
+		Scan:        scan,
+		Destination: destination,
+		Amount:      sats.Amount(tx.TxOut[0].Value),
+		Fee:         fee,
+		UnsignedTx:  hex.EncodeToString(buf.Bytes()),
+	}, nil
+}
+
+// exportableKeys returns the public keys at `keys.KitKeyPath`.
+func exportableKeys(userKey, muunKey keys.PrivateKey) (keys.PublicKey, keys.PublicKey, error) {
+	derivedUserKey, err := userKey.DeriveTo(keys.KitKeyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive user key: %w", err)
+	}
+
+	derivedMuunKey, err := muunKey.DeriveTo(keys.KitKeyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive muun key: %w", err)
+	}
+
+	return derivedUserKey.PublicKey(), derivedMuunKey.PublicKey(), nil
+}
+
+// save signs the snapshot with the user key, and writes it to a file.
+func (s *snapshot) save(path string, userKey keys.PrivateKey) error {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	signingKey, err := userKey.DeriveTo(keys.KitKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to derive signing key: %w", err)
+	}
+
+	signature, err := signingKey.Sign(payload)
+	if err != nil {
+		return fmt.Errorf("failed to sign snapshot: %w", err)
+	}
+
+	data, err := json.Marshal(&snapshotEnvelope{payload, hex.EncodeToString(signature)})
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// loadSnapshot reads a snapshot file and verifies its signature.
+func loadSnapshot(path string) (*snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var envelope snapshotEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(envelope.Payload, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+
+	userKey, _, err := s.publicKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignature(userKey, envelope.Payload, envelope.Signature); err != nil {
+		return nil, fmt.Errorf("snapshot signature is invalid, the file was modified: %w", err)
+	}
+
+	return &s, nil
+}
+
+func (s *snapshot) publicKeys() (keys.PublicKey, keys.PublicKey, error) {
+	userKey, err := keyBackend.ParsePublicKey(s.UserKey, keys.KitKeyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid user key in snapshot: %w", err)
+	}
+
+	muunKey, err := keyBackend.ParsePublicKey(s.MuunKey, keys.KitKeyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid muun key in snapshot: %w", err)
+	}
+
+	return userKey, muunKey, nil
+}
+
+func verifySignature(key keys.PublicKey, payload []byte, signatureHex string) error {
+	rawSignature, err := hex.DecodeString(signatureHex)
+	if err != nil {
+		return err
+	}
+
+	signature, err := btcec.ParseDERSignature(rawSignature, btcec.S256())
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := btcec.ParsePubKey(key.Raw(), btcec.S256())
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(payload)
+	if !signature.Verify(hash[:], publicKey) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	return nil
+}
+
+// verify checks, using only public information, that every UTXO in the snapshot belongs to the
+// wallet described by its keys, and that the transaction spends exactly those UTXOs to the
+// destination, with the stated amount and fee. It returns the verified addresses.
+func (s *snapshot) verify() ([]libwallet.MuunAddress, error) {
+	userKey, muunKey, err := s.publicKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	// Every UTXO must be in an address derived from our keys:
+	var addresses []libwallet.MuunAddress
+	inputs := make(map[wire.OutPoint]sats.Amount)
+
+	for _, utxo := range s.Scan.Utxos {
+		addr, err := deriveAddress(userKey, muunKey, utxo.AddressVersion, utxo.DerivationPath)
+		if err != nil {
+			return nil, fmt.Errorf("can't derive address for %s: %w", utxo.outpoint(), err)
+		}
+
+		if addr.Address() != utxo.Address {
+			return nil, fmt.Errorf("address %s doesn't belong to this wallet", utxo.Address)
+		}
+
+		outpoint, err := utxoOutpoint(utxo.TxID, utxo.OutputIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses = append(addresses, addr)
+		inputs[*outpoint] = utxo.Amount
+	}
+
+	// The transaction must spend all of them, and nothing else:
+	rawTx, err := hex.DecodeString(s.UnsignedTx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction: %w", err)
+	}
+
+	tx := wire.NewMsgTx(0)
+	if err := tx.Deserialize(bytes.NewReader(rawTx)); err != nil {
+		return nil, fmt.Errorf("invalid transaction: %w", err)
+	}
+
+	if len(tx.TxIn) != len(inputs) {
+		return nil, fmt.Errorf("transaction spends %d outputs, %d were found", len(tx.TxIn), len(inputs))
+	}
+
+	var inputTotal sats.Amount
+	for _, txIn := range tx.TxIn {
+		amount, ok := inputs[txIn.PreviousOutPoint]
+		if !ok {
+			return nil, fmt.Errorf("transaction spends unknown output %v", txIn.PreviousOutPoint)
+		}
+
+		if inputTotal, err = inputTotal.Add(amount); err != nil {
+			return nil, err
+		}
+	}
+
+	// And pay the stated amount to the destination:
+	destination, err := btcutilw.DecodeAddress(s.Destination, &chainParams)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination: %w", err)
+	}
+
+	destinationScript, err := payto.Script(destination)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination: %w", err)
+	}
+
+	if len(tx.TxOut) != 1 || !bytes.Equal(tx.TxOut[0].PkScript, destinationScript) {
+		return nil, fmt.Errorf("transaction doesn't pay to the destination alone")
+	}
+
+	fee, err := inputTotal.Sub(s.Amount)
+	if tx.TxOut[0].Value != int64(s.Amount) || err != nil || fee != s.Fee {
+		return nil, fmt.Errorf("transaction amounts don't match the stated amount and fee")
+	}
+
+	return addresses, nil
+}
+
+// deriveAddress creates the address of a given version at a derivation path.
+func deriveAddress(userKey, muunKey keys.PublicKey, version int, path string) (libwallet.MuunAddress, error) {
+	derivedUserKey, err := userKey.DeriveTo(path)
+	if err != nil {
+		return nil, err
+	}
+
+	derivedMuunKey, err := muunKey.DeriveTo(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyBackend.CreateAddress(version, derivedUserKey, derivedMuunKey)
+}
+
+func utxoOutpoint(txID string, index int) (*wire.OutPoint, error) {
+	hash, err := chainhash.NewHashFromStr(txID)
+	if err != nil {
+		return nil, err
+	}
+
+	return wire.NewOutPoint(hash, uint32(index)), nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/statedb"
+	"github.com/muun/recovery/utils"
+)
+
+// The Recovery Tool keeps its state in files of their own: scan checkpoints with --state-file,
+// downloaded transactions in the user's cache, case journals in the config directory. With --db,
+// all of it goes into a single SQLite database instead, encrypted with a passphrase, together with
+// an archive of every transaction sent:
+//
+//	recovery-tool --db recovery.db
+//	recovery-tool --db recovery.db db info
+//
+// The database can be moved to another computer to carry on a recovery there (see db export), and
+// removed at the end without leaving anything behind. See the statedb package for what it holds and
+// how.
+
+// stateDB is the database given with --db, or nil.
+var stateDB *statedb.DB
+
+// openStateDB opens the database given with --db, asking for its passphrase, or for a new one if
+// it doesn't exist yet.
+func openStateDB() {
+	if *stateDBPath == "" {
+		return
+	}
+
+	if *stateFile != "" {
+		exitWithError(fmt.Errorf("--db keeps the progress of the scan, it can't be combined with --state-file"))
+	}
+
+	var passphrase string
+
+	if statedb.Exists(*stateDBPath) {
+		sayBlock(`
+			{yellow Enter the passphrase} of the state database %s
+		`, *stateDBPath)
+
+		passphrase = readPassphrase()
+
+	} else {
+		sayBlock(`
+			Creating the state database {white %s}. Choose a passphrase to encrypt it
+		`, *stateDBPath)
+
+		passphrase = readNewPassphrase()
+	}
+
+	db, err := statedb.Open(*stateDBPath, passphrase)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	stateDB = db
+}
+
+// archiveSentTx keeps a transaction in the database, once sent. Failing to archive it is reported,
+// but the transaction is already out.
+func archiveSentTx(tx *wire.MsgTx, label string) {
+	if stateDB == nil {
+		return
+	}
+
+	if err := stateDB.ArchiveTx(tx, label); err != nil {
+		say("{yellow Couldn't archive transaction %s}: %v\n", tx.TxHash(), err)
+	}
+}
+
+// runDBCommand inspects, maintains and moves the database given with --db. Keys to move it to this
+// computer are made, and it's imported, without one.
+func runDBCommand(args []string) {
+	if len(args) == 0 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	switch args[0] {
+	case "keygen":
+		runDBKeygen(args[1:])
+		return
+	case "import":
+		runDBImport(args[1:])
+		return
+	}
+
+	if stateDB == nil {
+		printUsage()
+		os.Exit(0)
+	}
+
+	switch args[0] {
+	case "info":
+		printStateDBInfo()
+	case "archive":
+		printStateDBArchive()
+	case "compact":
+		runDBCompact(args[1:])
+	case "export":
+		runDBExport(args[1:])
+	default:
+		printUsage()
+		os.Exit(0)
+	}
+}
+
+func runDBCompact(args []string) {
+	flags := flag.NewFlagSet("db compact", flag.ExitOnError)
+	maxCache := flags.Int64("max-cache", statedb.DefaultMaxCacheBytes, "the size limit of the cache of downloaded transactions, in bytes")
+	flags.Parse(args)
+
+	before, err := stateDB.Stats()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	evicted, err := stateDB.Compact(*maxCache)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	after, err := stateDB.Stats()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	sayBlock(`
+		{green ✓ Compacted} %s: evicted %d cached transactions, from %s to %s
+
+	`, stateDB.Path(), evicted, formatBytes(before.FileBytes), formatBytes(after.FileBytes))
+}
+
+func printStateDBInfo() {
+	stats, err := stateDB.Stats()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	sayBlock(`
+		{whiteUnderline State database %s}
+		  {white Size}: %s
+		  {white Scan checkpoints}: %d, with %d lines
+		  {white Cached transactions}: %d, %s
+		  {white Archived transactions}: %d (see db archive)
+		  {white Case journals}: %d, with %d events
+
+	`,
+		stateDB.Path(),
+		formatBytes(stats.FileBytes),
+		stats.Checkpoints, stats.CheckpointLines,
+		stats.CachedTxs, formatBytes(stats.CachedTxBytes),
+		stats.ArchivedTxs,
+		stats.Cases, stats.CaseEvents,
+	)
+}
+
+func printStateDBArchive() {
+	archived, err := stateDB.ArchivedTxs()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if len(archived) == 0 {
+		sayBlock("No transactions were sent with %s yet\n\n", stateDB.Path())
+		return
+	}
+
+	for _, tx := range archived {
+		say("%s  {white %s}  %s\n", utils.FormatTime(tx.ArchivedAt), tx.TxID, tx.Label)
+	}
+
+	fmt.Fprintln(userOutput)
+}
+
+// formatBytes returns a size for users, in the largest unit that fits.
+func formatBytes(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return strconv.FormatFloat(float64(size)/(1<<20), 'f', 1, 64) + " MiB"
+	case size >= 1<<10:
+		return strconv.FormatFloat(float64(size)/(1<<10), 'f', 1, 64) + " KiB"
+	}
+
+	return strconv.FormatInt(size, 10) + " bytes"
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/muun/recovery/statedb"
+	"github.com/muun/recovery/utils"
+)
+
+// A recovery can move between computers along with its state database: one prepared offline that
+// continues online, or one that continues on a new computer when the first breaks down. The new
+// computer makes a transfer key, and the database is exported encrypted to it:
+//
+//	recovery-tool db keygen                                    (on the new computer)
+//	recovery-tool --db recovery.db db export --encrypt-to <public key>
+//	recovery-tool db import recovery.export recovery.db        (on the new computer)
+//
+// The export is a copy of the whole database, still encrypted with its passphrase, and encrypted
+// once more to the transfer key (ECIES, over secp256k1). Whoever gets hold of it on the way needs
+// both to read it. The imported database opens with the same passphrase.
+
+// stateDBExportVersion is the version of the export file format.
+const stateDBExportVersion = 1
+
+// transferKeyVersion is the version of the transfer key file format.
+const transferKeyVersion = 1
+
+// stateDBExport is an exported database, encrypted to a transfer key.
+type stateDBExport struct {
+	Version int `json:"version"`
+	caseTag
+	ExportedAt time.Time `json:"exportedAt"`
+	Recipient  string    `json:"recipient"` // the transfer public key, in hex
+	Database   []byte    `json:"database"`  // encrypted to the recipient
+}
+
+// transferKeyFile keeps a transfer key pair, made with `db keygen`.
+type transferKeyFile struct {
+	Version    int    `json:"version"`
+	PublicKey  string `json:"publicKey"`  // hex, compressed
+	PrivateKey string `json:"privateKey"` // hex
+}
+
+func runDBKeygen(args []string) {
+	flags := flag.NewFlagSet("db keygen", flag.ExitOnError)
+	outPath := flags.String("out", "transfer.key", "save the key pair to this file")
+	flags.Parse(args)
+
+	if _, err := os.Stat(*outPath); err == nil {
+		exitWithError(fmt.Errorf("%s already exists, it won't be overwritten", *outPath))
+	}
+
+	privateKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		exitWithError(err)
+	}
+
+	keyFile := &transferKeyFile{
+		Version:    transferKeyVersion,
+		PublicKey:  hex.EncodeToString(privateKey.PubKey().SerializeCompressed()),
+		PrivateKey: hex.EncodeToString(privateKey.Serialize()),
+	}
+
+	data, err := json.MarshalIndent(keyFile, "", "  ")
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if err := ioutil.WriteFile(*outPath, data, 0600); err != nil {
+		exitWithError(fmt.Errorf("failed to save the key: %w", err))
+	}
+
+	say(`
+		{blue Muun Recovery Tool v%s}
+
+		{green ✓} Transfer key saved to {white %s}. Export the state database to this computer with:
+		  recovery-tool --db <database> db export --encrypt-to %s
+
+	`, version, *outPath, keyFile.PublicKey)
+}
+
+func runDBExport(args []string) {
+	flags := flag.NewFlagSet("db export", flag.ExitOnError)
+	recipientHex := flags.String("encrypt-to", "", "the public key made with db keygen on the computer to import the database in")
+	outPath := flags.String("out", "recovery.export", "save the export to this file")
+	flags.Parse(args)
+
+	if *recipientHex == "" || flags.NArg() != 0 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	recipientBytes, err := hex.DecodeString(*recipientHex)
+	if err != nil {
+		exitWithError(fmt.Errorf("invalid --encrypt-to key, it must be in hex: %w", err))
+	}
+
+	recipient, err := btcec.ParsePubKey(recipientBytes, btcec.S256())
+	if err != nil {
+		exitWithError(fmt.Errorf("invalid --encrypt-to key: %w", err))
+	}
+
+	if _, err := os.Stat(*outPath); err == nil {
+		exitWithError(fmt.Errorf("%s already exists, it won't be overwritten", *outPath))
+	}
+
+	snapshot, err := stateDB.Snapshot()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	encrypted, err := btcec.Encrypt(recipient, snapshot)
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to encrypt the export: %w", err))
+	}
+
+	export := &stateDBExport{
+		Version:    stateDBExportVersion,
+		caseTag:    currentTag(),
+		ExportedAt: time.Now().UTC(),
+		Recipient:  hex.EncodeToString(recipient.SerializeCompressed()),
+		Database:   encrypted,
+	}
+
+	data, err := json.Marshal(export)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if err := ioutil.WriteFile(*outPath, data, 0600); err != nil {
+		exitWithError(fmt.Errorf("failed to save the export: %w", err))
+	}
+
+	recordCaseEvent(export.caseTag, "db-export", "Exported the state database %s to %s, for the transfer key %s", stateDB.Path(), *outPath, export.Recipient)
+
+	sayBlock(`
+		{green ✓} State database exported to {white %s} (%s), only the transfer key can read it.
+		Import it on the other computer with:
+		  recovery-tool db import %s <new database>
+
+	`, *outPath, formatBytes(int64(len(data))), *outPath)
+}
+
+func runDBImport(args []string) {
+	flags := flag.NewFlagSet("db import", flag.ExitOnError)
+	keyPath := flags.String("key", "transfer.key", "the key pair made with db keygen")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	exportPath, dbPath := flags.Arg(0), flags.Arg(1)
+
+	privateKey, err := loadTransferKeyFile(*keyPath)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	export, err := loadStateDBExport(exportPath)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if export.Recipient != hex.EncodeToString(privateKey.PubKey().SerializeCompressed()) {
+		exitWithError(fmt.Errorf("%s was exported for another transfer key (%s)", exportPath, export.Recipient))
+	}
+
+	snapshot, err := btcec.Decrypt(privateKey, export.Database)
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to decrypt %s, it may be corrupted: %w", exportPath, err))
+	}
+
+	if err := statedb.Restore(dbPath, snapshot); err != nil {
+		exitWithError(err)
+	}
+
+	recordCaseEvent(export.caseTag, "db-import", "Imported the state database exported at %s to %s", export.ExportedAt.UTC().Format(time.RFC3339), dbPath)
+
+	sayBlock(`
+		{green ✓} State database imported to {white %s}, as exported at %s. Continue the recovery with:
+		  recovery-tool --db %s
+		It opens with the passphrase it had on the other computer.
+
+	`, dbPath, utils.FormatTime(export.ExportedAt), dbPath)
+}
+
+func loadTransferKeyFile(path string) (*btcec.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transfer key: %w", err)
+	}
+
+	var keyFile transferKeyFile
+	if err := json.Unmarshal(data, &keyFile); err != nil {
+		return nil, fmt.Errorf("failed to parse transfer key in %s: %w", path, err)
+	}
+
+	if keyFile.Version != transferKeyVersion {
+		return nil, fmt.Errorf("unsupported transfer key version %d in %s", keyFile.Version, path)
+	}
+
+	keyBytes, err := hex.DecodeString(keyFile.PrivateKey)
+	if err != nil || len(keyBytes) != btcec.PrivKeyBytesLen {
+		return nil, fmt.Errorf("invalid transfer key in %s", path)
+	}
+
+	privateKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), keyBytes)
+
+	return privateKey, nil
+}
+
+func loadStateDBExport(path string) (*stateDBExport, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read export: %w", err)
+	}
+
+	var export stateDBExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, fmt.Errorf("%s is not a state database export: %w", path, err)
+	}
+
+	if export.Version != stateDBExportVersion {
+		return nil, fmt.Errorf("unsupported export version %d in %s", export.Version, path)
+	}
+
+	return &export, nil
+}
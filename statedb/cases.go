@@ -0,0 +1,48 @@
+package statedb
+
+import (
+	"fmt"
+)
+
+// caseEvent is an event of a case journal, in the order they were appended.
+type caseEvent struct {
+	ID     uint   `gorm:"primary_key"`
+	CaseID string `gorm:"index"` // see lookup
+	Box    []byte
+}
+
+// AppendCaseEvent adds an event, encoded by the caller, to the journal of a case.
+func (d *DB) AppendCaseEvent(caseID string, event []byte) error {
+	box, err := d.seal(event)
+	if err != nil {
+		return err
+	}
+
+	if err := d.db.Create(&caseEvent{CaseID: d.lookup("case", caseID), Box: box}).Error; err != nil {
+		return fmt.Errorf("failed to write case journal: %w", err)
+	}
+
+	return nil
+}
+
+// CaseEvents returns the events of a case, in order. A case with no events has no journal.
+func (d *DB) CaseEvents(caseID string) ([][]byte, error) {
+	var rows []caseEvent
+
+	if err := d.db.Where("case_id = ?", d.lookup("case", caseID)).Order("id").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read case journal: %w", err)
+	}
+
+	var events [][]byte
+
+	for _, row := range rows {
+		event, err := d.open(row.Box)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
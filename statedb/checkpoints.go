@@ -0,0 +1,62 @@
+package statedb
+
+import (
+	"fmt"
+)
+
+// checkpointLine is a line of a checkpoint, in the order they were appended.
+type checkpointLine struct {
+	ID         uint   `gorm:"primary_key"`
+	Checkpoint string `gorm:"index"`
+	Box        []byte
+}
+
+// CheckpointLines returns the lines of a checkpoint, in order. A checkpoint that was never
+// written has none.
+func (d *DB) CheckpointLines(name string) ([][]byte, error) {
+	var rows []checkpointLine
+
+	err := d.db.Where("checkpoint = ?", d.lookup("checkpoint", name)).Order("id").Find(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	var lines [][]byte
+
+	for _, row := range rows {
+		line, err := d.open(row.Box)
+		if err != nil {
+			return nil, err
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// AppendCheckpoint adds a line to a checkpoint.
+func (d *DB) AppendCheckpoint(name string, line []byte) error {
+	box, err := d.seal(line)
+	if err != nil {
+		return err
+	}
+
+	row := &checkpointLine{Checkpoint: d.lookup("checkpoint", name), Box: box}
+
+	if err := d.db.Create(row).Error; err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// ClearCheckpoint removes all the lines of a checkpoint.
+func (d *DB) ClearCheckpoint(name string) error {
+	err := d.db.Where("checkpoint = ?", d.lookup("checkpoint", name)).Delete(&checkpointLine{}).Error
+	if err != nil {
+		return fmt.Errorf("failed to remove checkpoint: %w", err)
+	}
+
+	return nil
+}
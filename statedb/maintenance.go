@@ -0,0 +1,85 @@
+package statedb
+
+import (
+	"fmt"
+	"os"
+)
+
+// Stats describes what's in the database.
+type Stats struct {
+	FileBytes       int64
+	CheckpointLines int
+	Checkpoints     int
+	CachedTxs       int
+	CachedTxBytes   int64
+	ArchivedTxs     int
+	CaseEvents      int
+	Cases           int
+}
+
+// Stats counts what's in the database. Names are hashed, so it can tell how many checkpoints and
+// cases there are, but not which.
+func (d *DB) Stats() (*Stats, error) {
+	stats := &Stats{}
+
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state database: %w", err)
+	}
+
+	stats.FileBytes = info.Size()
+
+	cached := d.db.Model(&transaction{}).Where("archived = ?", false)
+
+	errs := []error{
+		d.db.Model(&checkpointLine{}).Count(&stats.CheckpointLines).Error,
+		d.db.Model(&checkpointLine{}).Select("count(distinct checkpoint)").Row().Scan(&stats.Checkpoints),
+		cached.Count(&stats.CachedTxs).Error,
+		cached.Select("coalesce(sum(size), 0)").Row().Scan(&stats.CachedTxBytes),
+		d.db.Model(&transaction{}).Where("archived = ?", true).Count(&stats.ArchivedTxs).Error,
+		d.db.Model(&caseEvent{}).Count(&stats.CaseEvents).Error,
+		d.db.Model(&caseEvent{}).Select("count(distinct case_id)").Row().Scan(&stats.Cases),
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("failed to read state database: %w", err)
+		}
+	}
+
+	return stats, nil
+}
+
+// Compact evicts the least recently used transactions from the cache, until it's within the size
+// limit, and reclaims the space they and removed checkpoints took. Archived transactions are kept.
+// It returns how many transactions were evicted.
+func (d *DB) Compact(maxCacheBytes int64) (int, error) {
+	var rows []transaction
+
+	err := d.db.Select("id, size").Where("archived = ?", false).Order("used_at desc").Find(&rows).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the cache: %w", err)
+	}
+
+	var total int64
+	var evict []string
+
+	for _, row := range rows {
+		total += int64(row.Size)
+		if total > maxCacheBytes {
+			evict = append(evict, row.ID)
+		}
+	}
+
+	if len(evict) > 0 {
+		if err := d.db.Where("id in (?)", evict).Delete(&transaction{}).Error; err != nil {
+			return 0, fmt.Errorf("failed to evict transactions: %w", err)
+		}
+	}
+
+	if err := d.db.Exec("VACUUM").Error; err != nil {
+		return 0, fmt.Errorf("failed to compact state database: %w", err)
+	}
+
+	return len(evict), nil
+}
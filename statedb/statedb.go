@@ -0,0 +1,221 @@
+// Package statedb keeps the state of the Recovery Tool in a single SQLite database, instead of
+// files scattered around: scan checkpoints, the cache of downloaded transactions, an archive of
+// the transactions sent, and case journals.
+//
+// Everything in it is encrypted with a key derived from a passphrase. Rows are found by a keyed
+// hash of their name (a transaction ID, a case ID), so the file reveals nothing but how much is
+// in it.
+package statedb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	gormigrate "gopkg.in/gormigrate.v1"
+)
+
+// Parameters for deriving the encryption key from the passphrase, as for profiles.
+const (
+	scryptN    = 1 << 15
+	scryptR    = 8
+	scryptP    = 1
+	saltLength = 16
+)
+
+// passphraseCheck is sealed when the database is created, to tell a wrong passphrase apart from
+// missing data when it's opened again.
+const passphraseCheck = "muun-recovery statedb"
+
+// ErrWrongPassphrase means the database couldn't be opened, most likely due to a wrong passphrase.
+var ErrWrongPassphrase = errors.New("wrong passphrase, or the database is corrupted")
+
+// DB is an open state database.
+type DB struct {
+	db   *gorm.DB
+	path string
+	key  *[32]byte
+}
+
+// meta holds the parameters of the database itself: the salt and the passphrase check.
+type meta struct {
+	Key   string `gorm:"primary_key"`
+	Value []byte
+}
+
+// Exists tells whether there's a database at the path, to know whether to choose a passphrase.
+func Exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Open opens the database at the path, creating it if it doesn't exist.
+func Open(path string, passphrase string) (*DB, error) {
+	// The file is created by SQLite, we make sure only the user can read it first:
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database: %w", err)
+	}
+	file.Close()
+
+	db, err := gorm.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database: %w", err)
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to prepare state database: %w", err)
+	}
+
+	d := &DB{db: db, path: path}
+
+	if err := d.unlock(passphrase); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func migrate(db *gorm.DB) error {
+	opts := gormigrate.Options{
+		UseTransaction: true,
+	}
+
+	m := gormigrate.New(db, &opts, []*gormigrate.Migration{
+		{
+			ID: "initial",
+			Migrate: func(tx *gorm.DB) error {
+				return tx.CreateTable(&meta{}, &checkpointLine{}, &transaction{}, &caseEvent{}).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.DropTable(&meta{}, &checkpointLine{}, &transaction{}, &caseEvent{}).Error
+			},
+		},
+	})
+
+	return m.Migrate()
+}
+
+// unlock derives the key from the passphrase. A new database gets a new salt, and the check
+// value sealed with it.
+func (d *DB) unlock(passphrase string) error {
+	var salt, check meta
+
+	err := d.db.Where("key = ?", "salt").First(&salt).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return d.initialize(passphrase)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to read state database: %w", err)
+	}
+
+	if err := d.db.Where("key = ?", "check").First(&check).Error; err != nil {
+		return fmt.Errorf("failed to read state database: %w", err)
+	}
+
+	if d.key, err = deriveKey(passphrase, salt.Value); err != nil {
+		return err
+	}
+
+	plaintext, err := d.open(check.Value)
+	if err != nil || string(plaintext) != passphraseCheck {
+		return ErrWrongPassphrase
+	}
+
+	return nil
+}
+
+func (d *DB) initialize(passphrase string) error {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	var err error
+	if d.key, err = deriveKey(passphrase, salt); err != nil {
+		return err
+	}
+
+	check, err := d.seal([]byte(passphraseCheck))
+	if err != nil {
+		return err
+	}
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&meta{Key: "salt", Value: salt}).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&meta{Key: "check", Value: check}).Error
+	})
+}
+
+// Close closes the database.
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// Path returns where the database is.
+func (d *DB) Path() string {
+	return d.path
+}
+
+// lookup returns the keyed hash a row is found by, for a kind of row and its name.
+func (d *DB) lookup(kind string, name string) string {
+	mac := hmac.New(sha256.New, d.key[:])
+	mac.Write([]byte(kind))
+	mac.Write([]byte{0})
+	mac.Write([]byte(name))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts a value, with a random nonce stored in front of it.
+func (d *DB) seal(plaintext []byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return secretbox.Seal(nonce[:], plaintext, &nonce, d.key), nil
+}
+
+// open decrypts a value sealed with seal.
+func (d *DB) open(box []byte) ([]byte, error) {
+	if len(box) < 24 {
+		return nil, ErrWrongPassphrase
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], box)
+
+	plaintext, ok := secretbox.Open(nil, box[24:], &nonce, d.key)
+	if !ok {
+		return nil, ErrWrongPassphrase
+	}
+
+	return plaintext, nil
+}
+
+func deriveKey(passphrase string, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive state database key: %w", err)
+	}
+
+	var key [32]byte
+	copy(key[:], derived)
+
+	return &key, nil
+}
@@ -0,0 +1,179 @@
+package statedb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/txcache"
+)
+
+// DefaultMaxCacheBytes is the default size limit of the cache, as for the on-disk one.
+const DefaultMaxCacheBytes = txcache.DefaultMaxBytes
+
+// transaction is a cached or archived transaction. Cached ones were downloaded, and are evicted
+// when the cache grows too large (see Compact). Archived ones were sent, and are kept.
+type transaction struct {
+	ID       string `gorm:"primary_key"` // see lookup
+	Box      []byte
+	Size     int
+	Archived bool
+	UsedAt   time.Time
+}
+
+// transactionRecord is what's sealed in a transaction's box.
+type transactionRecord struct {
+	TxID       string    `json:"txId"`
+	Raw        []byte    `json:"raw"`
+	Label      string    `json:"label,omitempty"`
+	ArchivedAt time.Time `json:"archivedAt,omitempty"`
+}
+
+// ArchivedTx is a transaction in the archive.
+type ArchivedTx struct {
+	TxID       string
+	Label      string
+	ArchivedAt time.Time
+	Tx         *wire.MsgTx
+}
+
+// TxCache is the cache of downloaded transactions, with the same guarantees as txcache.Store:
+// transactions are verified against their ID on the way in and out.
+type TxCache struct {
+	db *DB
+}
+
+// TxCache returns the cache of downloaded transactions.
+func (d *DB) TxCache() *TxCache {
+	return &TxCache{d}
+}
+
+// Get returns the transaction with the given ID, if it's cached or archived, and intact.
+func (c *TxCache) Get(txID string) (*wire.MsgTx, bool) {
+	var row transaction
+
+	if err := c.db.db.Where("id = ?", c.db.lookup("tx", txID)).First(&row).Error; err != nil {
+		return nil, false
+	}
+
+	record, err := c.db.openTransaction(&row)
+	if err != nil {
+		return nil, false
+	}
+
+	tx, err := txcache.Verify(txID, record.Raw)
+	if err != nil {
+		c.db.db.Delete(&row)
+		return nil, false
+	}
+
+	c.db.db.Model(&row).Update("used_at", time.Now().UTC())
+
+	return tx, true
+}
+
+// Put caches a transaction. Archived transactions are left as they are.
+func (c *TxCache) Put(tx *wire.MsgTx) error {
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return err
+	}
+
+	txID := tx.TxHash().String()
+
+	var existing transaction
+	if err := c.db.db.Where("id = ?", c.db.lookup("tx", txID)).First(&existing).Error; err == nil {
+		return nil
+	}
+
+	return c.db.saveTransaction(&transactionRecord{TxID: txID, Raw: buf.Bytes()}, false)
+}
+
+// ArchiveTx keeps a transaction sent, with a label to tell what it was.
+func (d *DB) ArchiveTx(tx *wire.MsgTx, label string) error {
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return err
+	}
+
+	record := &transactionRecord{
+		TxID:       tx.TxHash().String(),
+		Raw:        buf.Bytes(),
+		Label:      label,
+		ArchivedAt: time.Now().UTC(),
+	}
+
+	return d.saveTransaction(record, true)
+}
+
+// ArchivedTxs returns the archived transactions, the oldest first.
+func (d *DB) ArchivedTxs() ([]*ArchivedTx, error) {
+	var rows []transaction
+
+	if err := d.db.Where("archived = ?", true).Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read archived transactions: %w", err)
+	}
+
+	var archived []*ArchivedTx
+
+	for i := range rows {
+		record, err := d.openTransaction(&rows[i])
+		if err != nil {
+			return nil, err
+		}
+
+		tx, err := txcache.Verify(record.TxID, record.Raw)
+		if err != nil {
+			return nil, err
+		}
+
+		archived = append(archived, &ArchivedTx{TxID: record.TxID, Label: record.Label, ArchivedAt: record.ArchivedAt, Tx: tx})
+	}
+
+	sort.Slice(archived, func(i, j int) bool { return archived[i].ArchivedAt.Before(archived[j].ArchivedAt) })
+
+	return archived, nil
+}
+
+func (d *DB) saveTransaction(record *transactionRecord, archived bool) error {
+	plaintext, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	box, err := d.seal(plaintext)
+	if err != nil {
+		return err
+	}
+
+	row := &transaction{
+		ID:       d.lookup("tx", record.TxID),
+		Box:      box,
+		Size:     len(record.Raw),
+		Archived: archived,
+		UsedAt:   time.Now().UTC(),
+	}
+
+	if err := d.db.Save(row).Error; err != nil {
+		return fmt.Errorf("failed to save transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DB) openTransaction(row *transaction) (*transactionRecord, error) {
+	plaintext, err := d.open(row.Box)
+	if err != nil {
+		return nil, err
+	}
+
+	var record transactionRecord
+	if err := json.Unmarshal(plaintext, &record); err != nil {
+		return nil, fmt.Errorf("invalid transaction in state database: %w", err)
+	}
+
+	return &record, nil
+}
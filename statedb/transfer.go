@@ -0,0 +1,62 @@
+package statedb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// sqliteHeader starts every SQLite database file.
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// Snapshot returns a copy of the whole database as it is now, to move it to another computer. It's
+// still encrypted with the passphrase, as the database itself.
+func (d *DB) Snapshot() ([]byte, error) {
+	dir, err := ioutil.TempDir("", "statedb")
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy state database: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.db")
+
+	if err := d.db.Exec("VACUUM INTO ?", path).Error; err != nil {
+		return nil, fmt.Errorf("failed to copy state database: %w", err)
+	}
+
+	snapshot, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy state database: %w", err)
+	}
+
+	return snapshot, nil
+}
+
+// Restore saves a snapshot as a new database at the path. It opens with the passphrase of the
+// database the snapshot was taken from. An existing file is never overwritten.
+func Restore(path string, snapshot []byte) error {
+	if !bytes.HasPrefix(snapshot, sqliteHeader) {
+		return fmt.Errorf("the snapshot is not a state database")
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists, it won't be overwritten", path)
+	} else if err != nil {
+		return fmt.Errorf("failed to create state database: %w", err)
+	}
+
+	_, err = file.Write(snapshot)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to save state database: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/libwallet/btcsuitew/btcutilw"
+	"github.com/muun/recovery/payto"
+	"github.com/muun/recovery/sats"
+)
+
+// Users recovering large balances often want to split them, say between cold storage and a wallet
+// to spend from. Each --output pays a fixed amount to an address, in the same transaction:
+//
+//	recovery-tool --output bc1q...:500000 --output bc1q...:2000000
+//
+// The rest, after the fee, goes to the destination address asked for as always. Fixed amounts
+// aren't compatible with options that decide what the sweep pays on their own (a swap, a peg-in,
+// a test sweep), nor with a fee input or a snapshot, which describe a single output.
+
+// payments are the outputs given with --output.
+var payments paymentsFlag
+
+func init() {
+	flag.Var(&payments, "output", "also pay this amount to this address, as address:amount in sats, with the rest going to the destination (can be repeated)")
+}
+
+// payment is an output given with --output.
+type payment struct {
+	address btcutil.Address
+	amount  sats.Amount
+	script  []byte
+}
+
+// paymentsFlag collects the repeated --output options.
+type paymentsFlag []*payment
+
+func (f *paymentsFlag) String() string {
+	var outputs []string
+	for _, p := range *f {
+		outputs = append(outputs, fmt.Sprintf("%s:%d", p.address, p.amount))
+	}
+
+	return strings.Join(outputs, ",")
+}
+
+func (f *paymentsFlag) Set(value string) error {
+	p, err := parsePayment(value)
+	if err != nil {
+		return err
+	}
+
+	*f = append(*f, p)
+	return nil
+}
+
+// parsePayment reads an output in the form address:amount, the amount in sats.
+func parsePayment(value string) (*payment, error) {
+	separator := strings.LastIndex(value, ":")
+	if separator < 0 {
+		return nil, fmt.Errorf("%q must be an address and an amount in sats, as in address:amount", value)
+	}
+
+	rawAddress, rawAmount := strings.TrimSpace(value[:separator]), strings.TrimSpace(value[separator+1:])
+
+	if chain := foreignChainOf(rawAddress); chain != "" {
+		return nil, fmt.Errorf("%s is a %s address, not a bitcoin one", rawAddress, chain)
+	}
+
+	address, err := btcutilw.DecodeAddress(rawAddress, &chainParams)
+	if err != nil || !address.IsForNet(&chainParams) {
+		return nil, fmt.Errorf("%s is not a valid bitcoin address", rawAddress)
+	}
+
+	script, err := payto.Script(address)
+	if err != nil {
+		return nil, fmt.Errorf("the Recovery Tool can't send to %s, it's not a supported type of address", rawAddress)
+	}
+
+	units, err := strconv.ParseInt(rawAmount, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount %q for %s, it must be a whole number of sats", rawAmount, rawAddress)
+	}
+
+	amount, err := sats.New(units)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount for %s: %w", rawAddress, err)
+	}
+
+	if err := checkNotDust(amount, script, "the output to "+rawAddress); err != nil {
+		return nil, err
+	}
+
+	return &payment{address, amount, script}, nil
+}
+
+// checkPaymentOptions fails early on options that can't be combined with --output.
+func checkPaymentOptions() {
+	if len(payments) == 0 {
+		return
+	}
+
+	conflicts := []struct {
+		option string
+		set    bool
+	}{
+		{"--lightning", *lightning},
+		{"--liquid", *liquid},
+		{"--test-sweep", *testSweep > 0},
+		{"--fee-input", *feeFromExternalInput},
+		{"--migrate", *migrate},
+		{"--export-snapshot", *exportSnapshot != ""},
+	}
+
+	for _, conflict := range conflicts {
+		if conflict.set {
+			exitWithError(fmt.Errorf("--output can't be combined with %s", conflict.option))
+		}
+	}
+}
+
+// paymentsTotal returns what the payments add up to.
+func paymentsTotal(payments []*payment) (sats.Amount, error) {
+	var amounts []sats.Amount
+	for _, p := range payments {
+		amounts = append(amounts, p.amount)
+	}
+
+	return sats.Sum(amounts...)
+}
+
+// addPayments adds an output for each payment to the transaction, and returns their total.
+func addPayments(tx *wire.MsgTx, payments []*payment) (sats.Amount, error) {
+	for _, p := range payments {
+		tx.AddTxOut(wire.NewTxOut(int64(p.amount), p.script))
+	}
+
+	return paymentsTotal(payments)
+}
+
+// describePayments lists where the sweep sends its funds, for the confirmation: the payments, and
+// the rest to the destination.
+func describePayments(payments []*payment, destination string, rest sats.Amount) string {
+	lines := []string{fmt.Sprintf("%s (%d sats, the rest)", destination, rest)}
+
+	for _, p := range payments {
+		lines = append(lines, fmt.Sprintf("%s (%d sats)", p.address, p.amount))
+	}
+
+	return strings.Join(lines, "\n    ")
+}
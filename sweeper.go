@@ -4,15 +4,19 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/keys"
+	"github.com/muun/recovery/sats"
 	"github.com/muun/recovery/scanner"
+	"github.com/muun/recovery/utils"
 
 	"github.com/btcsuite/btcd/chaincfg"
 
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
-	"github.com/muun/libwallet"
 )
 
 var (
@@ -20,47 +24,171 @@ var (
 )
 
 type Sweeper struct {
-	UserKey      *libwallet.HDPrivateKey
-	MuunKey      *libwallet.HDPrivateKey
-	Birthday     int
+	Generations  []*keyGeneration
 	SweepAddress btcutil.Address
+	FeeInput     *feeInput  // optional, pays the fee from another wallet
+	LockTime     uint32     // optional, the block height to lock the sweep at (see withLockTime)
+	Presence     *fido2Gate // optional, a security key to touch before signing
+	Payments     []*payment // optional, fixed amounts to other addresses (see --output)
+
+	// CosignerSignatures, if given, are the signatures of the second key for each input, made
+	// elsewhere. Only the user key signs then (see --cosigner-sigs).
+	CosignerSignatures [][]byte
 }
 
-func (s *Sweeper) GetSweepTxAmountAndWeightInBytes(utxos []*scanner.Utxo) (outputAmount int64, weightInBytes int64, err error) {
-	// we build a sweep tx with 0 fee with the only purpose of checking its signed size
-	zeroFeeSweepTx, err := s.BuildSweepTx(utxos, 0)
+// PreviewSweepTx returns the amount the sweep transaction sends to the sweep address with no fee,
+// after any payments, and its size once signed, in virtual bytes. It's sized with placeholder
+// signatures, without using the keys.
+func (s *Sweeper) PreviewSweepTx(utxos []*scanner.Utxo) (outputAmount sats.Amount, vsize int64, err error) {
+	rawTx, inputs, err := s.buildUnsignedSweepTx(utxos, 0)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	outputAmount = zeroFeeSweepTx.TxOut[0].Value
-	weightInBytes = int64(zeroFeeSweepTx.SerializeSize())
+	placeholderTx, err := withPlaceholderSignatures(rawTx, inputs)
+	if err != nil {
+		return 0, 0, err
+	}
 
-	return outputAmount, weightInBytes, nil
+	return sats.Amount(placeholderTx.TxOut[0].Value), virtualSize(placeholderTx), nil
 }
 
-func (s *Sweeper) BuildSweepTx(utxos []*scanner.Utxo, fee int64) (*wire.MsgTx, error) {
-	derivedMuunKey, err := s.MuunKey.DeriveTo("m/1'/1'")
+func (s *Sweeper) BuildSweepTx(utxos []*scanner.Utxo, fee sats.Amount) (*wire.MsgTx, error) {
+	rawTx, inputs, err := s.buildUnsignedSweepTx(utxos, fee)
+	if err != nil {
+		return nil, err
+	}
+
+	rawTx, err = withLockTime(rawTx, s.LockTime)
+	if err != nil {
+		return nil, err
+	}
+
+	placeholderTx, err := withPlaceholderSignatures(rawTx, inputs)
 	if err != nil {
 		return nil, err
 	}
-	sweepTx, err := buildSweepTx(utxos, s.SweepAddress, fee)
+
+	signedTx, err := s.signTx(utxos, rawTx)
 	if err != nil {
 		return nil, err
 	}
 
-	return buildSignedTx(utxos, sweepTx, s.UserKey, derivedMuunKey)
+	if s.FeeInput != nil {
+		if err := s.FeeInput.sign(signedTx); err != nil {
+			return nil, err
+		}
+	}
+
+	return signedTx, checkSignedSize(signedTx, placeholderTx)
 }
 
-func (s *Sweeper) BroadcastTx(tx *wire.MsgTx) error {
-	// Connect to an Electurm server using a fresh client and provider pair:
-	sp := electrum.NewServerProvider() // TODO create servers module, for provider and pool
-	client := electrum.NewClient()
+// buildUnsignedSweepTx builds the sweep transaction, paying the fee from the recovered funds or
+// the fee input. It returns the outputs it spends along with it, in order.
+func (s *Sweeper) buildUnsignedSweepTx(utxos []*scanner.Utxo, fee sats.Amount) ([]byte, []*scanner.Utxo, error) {
+	if s.FeeInput != nil {
+		rawTx, err := s.buildFundedSweepTx(utxos, fee)
+		return rawTx, append(append([]*scanner.Utxo{}, utxos...), s.FeeInput.Utxo), err
+	}
 
-	for !client.IsConnected() {
-		client.Connect(sp.NextServer())
+	rawTx, err := buildSweepTx(utxos, s.SweepAddress, s.Payments, fee)
+	return rawTx, utxos, err
+}
+
+// signTx signs a transaction spending the given UTXOs.
+func (s *Sweeper) signTx(utxos []*scanner.Utxo, sweepTx []byte) (*wire.MsgTx, error) {
+	if s.Presence != nil {
+		if err := s.Presence.require(); err != nil {
+			return nil, err
+		}
 	}
 
+	// Each generation of keys signs the whole transaction, but only the signatures for the inputs
+	// it controls are kept:
+	var signedTx *wire.MsgTx
+	signedInputs := 0
+
+	for _, generation := range s.Generations {
+		var controlled []int
+		for i, utxo := range utxos {
+			if generation.controls(utxo) {
+				controlled = append(controlled, i)
+			}
+		}
+
+		if len(controlled) == 0 {
+			continue
+		}
+
+		derivedMuunKey, err := generation.MuunKey.DeriveTo(keys.KitKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		var tx *wire.MsgTx
+		if s.CosignerSignatures != nil {
+			tx, err = buildCosignedTx(utxos, sweepTx, generation.UserKey, derivedMuunKey.PublicKey(), s.CosignerSignatures)
+		} else {
+			tx, err = buildSignedTx(utxos, sweepTx, generation.UserKey, derivedMuunKey)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign with %s: %w", generation.Name, err)
+		}
+
+		if signedTx == nil {
+			signedTx = tx
+		}
+
+		for _, i := range controlled {
+			signedTx.TxIn[i].SignatureScript = tx.TxIn[i].SignatureScript
+			signedTx.TxIn[i].Witness = tx.TxIn[i].Witness
+		}
+
+		signedInputs += len(controlled)
+	}
+
+	if signedInputs != len(utxos) {
+		return nil, fmt.Errorf("%d of the outputs to spend are not controlled by any kit", len(utxos)-signedInputs)
+	}
+
+	if err := verifySignedInputs(signedTx, utxos); err != nil {
+		return nil, err
+	}
+
+	return signedTx, nil
+}
+
+// BuildUnsignedSweepTx builds the sweep transaction without signing it.
+func (s *Sweeper) BuildUnsignedSweepTx(utxos []*scanner.Utxo, fee sats.Amount) (*wire.MsgTx, error) {
+	rawTx, err := buildSweepTx(utxos, s.SweepAddress, s.Payments, fee)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := wire.NewMsgTx(0)
+	if err := tx.Deserialize(bytes.NewReader(rawTx)); err != nil {
+		return nil, fmt.Errorf("failed to decode sweep tx: %w", err)
+	}
+
+	return tx, nil
+}
+
+func (s *Sweeper) BroadcastTx(tx *wire.MsgTx) error {
+	return broadcastTx(tx)
+}
+
+// broadcastFanout is how many Electrum servers we send the transaction to, all at once. Reaching
+// several of them at the same moment leaves little time for a conflicting transaction to spread.
+const broadcastFanout = 4
+
+// broadcastWindow is how long we wait for the servers to connect, and then to answer.
+const broadcastWindow = 20 * time.Second
+
+// broadcastTx sends a signed transaction to several Electrum servers, the preferred ones (see
+// --servers) first. We connect to all of them before sending, so the transaction reaches them
+// within a moment. It succeeds if any server accepts it.
+func broadcastTx(tx *wire.MsgTx) error {
 	// Encode the transaction for broadcast:
 	txBytes := new(bytes.Buffer)
 
@@ -71,11 +199,78 @@ func (s *Sweeper) BroadcastTx(tx *wire.MsgTx) error {
 
 	txHex := hex.EncodeToString(txBytes.Bytes())
 
-	// Do the thing!
-	_, err = client.Broadcast(txHex)
-	if err != nil {
-		return fmt.Errorf("error while broadcasting: %w", err)
+	sp := electrum.NewServerProviderFrom(preferredServers(nil))
+
+	start := make(chan struct{})
+	ready := make(chan struct{}, broadcastFanout)
+	results := make(chan error, broadcastFanout)
+
+	for i := 0; i < broadcastFanout; i++ {
+		go func(server string) {
+			client := electrum.NewClient()
+			err := client.Connect(server)
+			ready <- struct{}{}
+
+			if err != nil {
+				results <- fmt.Errorf("%s: %w", server, err)
+				return
+			}
+			defer client.Disconnect()
+
+			<-start
+
+			if _, err := client.Broadcast(txHex); err != nil {
+				results <- fmt.Errorf("%s: %w", server, err)
+				return
+			}
+
+			results <- nil
+		}(sp.NextServer())
 	}
 
+	// Wait for every server to connect (or fail to), unless it takes too long, then send to all at once:
+	waitFor(ready, broadcastFanout, broadcastWindow)
+	close(start)
+
+	accepted := 0
+	var errs []string
+
+	deadline := time.After(broadcastWindow)
+
+collect:
+	for i := 0; i < broadcastFanout; i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				errs = append(errs, err.Error())
+			} else {
+				accepted++
+			}
+
+		case <-deadline:
+			errs = append(errs, "some servers didn't answer in time")
+			break collect
+		}
+	}
+
+	if accepted == 0 {
+		return utils.WrapError(utils.ErrBroadcastFailed, fmt.Errorf("error while broadcasting: %s", strings.Join(errs, "; ")))
+	}
+
+	say("{green ✓} Sent to %d of %d servers\n", accepted, broadcastFanout)
+
 	return nil
 }
+
+// waitFor receives `count` signals from a channel, or stops waiting after `timeout`.
+func waitFor(signals chan struct{}, count int, timeout time.Duration) {
+	deadline := time.After(timeout)
+
+	for i := 0; i < count; i++ {
+		select {
+		case <-signals:
+		case <-deadline:
+			return
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet"
+	"github.com/muun/libwallet/btcsuitew/btcutilw"
+	"github.com/muun/recovery/payto"
+	"github.com/muun/recovery/sats"
+	"github.com/muun/recovery/scanner"
+	"github.com/muun/recovery/utils"
+)
+
+// testSweepChangePath is where the funds left after a test sweep wait, until the rest is sent. It's
+// an address of the wallet, so a new scan finds them if the tool is stopped in between.
+const testSweepChangePath = "m/1'/1'/1/0"
+
+// runTestSweep sends a small amount to the destination first, with the rest going back to the
+// wallet, and waits for the user to confirm it arrived. This protects the bulk of the funds from
+// mistakes in the destination. It returns the UTXO with the rest of the funds, or nil if the user
+// didn't see the test amount arrive.
+func runTestSweep(sweeper *Sweeper, utxoScanner *scanner.Scanner, utxos []*scanner.Utxo, amount sats.Amount, transports []string, guards *signingGuards, clusters *clusterAnalysis) *scanner.Utxo {
+	total, err := scanner.Total(utxos)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	changeAddress, err := testSweepChangeAddress(sweeper.Generations[0])
+	if err != nil {
+		exitWithError(err)
+	}
+
+	destinationScript, err := payto.Script(sweeper.SweepAddress)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	changeScript, err := getChangeScript(changeAddress)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	// Each side of the split must be relayable, by the threshold of its own script:
+	minAmount := dustThresholdFor(destinationScript)
+	minRest := dustThresholdFor(changeScript)
+
+	rest, err := total.Sub(amount)
+	if amount < minAmount || err != nil || rest < minRest {
+		exitWithError(fmt.Errorf(
+			"the test amount must be between %d and %d sats, for nodes to relay it: smaller %s outputs (the destination) or %s outputs (the change) would be dust",
+			minAmount, total-minRest, describeScriptType(destinationScript), describeScriptType(changeScript),
+		))
+	}
+
+	sayBlock(`
+		{whiteUnderline Test transaction}
+		First, we'll send {white %d} sats to your destination. The rest will wait in your wallet, until
+		you confirm they arrived.
+	`, amount)
+
+	// We size it with 0 fee first, to calculate the fee:
+	zeroFeeTx, err := sweeper.buildTestSweepTx(utxos, amount, changeAddress, 0)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	placeholderTx, err := withPlaceholderSignatures(zeroFeeTx, utxos)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fee := readFee(rest, virtualSize(placeholderTx), minRest)
+
+	readConfirmation(amount, fee, sweeper.SweepAddress.String(), clusters.describe())
+
+	// Locked at the latest block, like the sweep (see withLockTime):
+	sweeper.LockTime = lockTimeAtTip(utxoScanner)
+
+	guards.approve(sweeper.SweepAddress.String(), sweeper.SweepAddress.String(), amount, fee, "signing the test transaction")
+
+	testTx, err := sweeper.BuildTestSweepTx(utxos, amount, changeAddress, fee)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	leaveOfflineWindow(true)
+
+	if err := validateTx(testTx, utxos); err != nil {
+		exitWithError(err)
+	}
+
+	emitSignedTx(testTx)
+
+	checkBeforeBroadcast(utxoScanner, utxos, sweeper.LockTime)
+
+	sayBlock("Sending test transaction...")
+
+	if err := broadcastWithFallback(testTx, transports); err != nil {
+		exitWithError(err)
+	}
+
+	recordCaseEvent(currentTag(), "test-sweep", "Sent test transaction %s", testTx.TxHash())
+	archiveSentTx(testTx, "test sweep")
+
+	change := &scanner.Utxo{
+		TxID:        testTx.TxHash().String(),
+		OutputIndex: 1,
+		Amount:      sats.Amount(testTx.TxOut[1].Value),
+		Address:     changeAddress,
+		Script:      testTx.TxOut[1].PkScript,
+	}
+
+	sayBlock(`
+		Test transaction sent: https://blockstream.info/tx/%v
+		Check your destination wallet. The payment should appear in a few minutes, even if unconfirmed.
+	`, testTx.TxHash())
+
+	if !readYesNo(fmt.Sprintf("Did the %d sats arrive?", amount)) {
+		sayBlock(`
+			{yellow Your remaining %d sats were not sent.} They are safe in your wallet, at %s.
+			Check your destination address, and run the Recovery Tool again.
+
+		`, change.Amount, changeAddress.Address())
+
+		return nil
+	}
+
+	return change
+}
+
+// testSweepChangeAddress returns the wallet address where the rest of the funds wait.
+func testSweepChangeAddress(generation *keyGeneration) (libwallet.MuunAddress, error) {
+	for _, details := range generation.generator.Addresses() {
+		address := details.Address
+
+		if address.Version() == libwallet.AddressVersionV4 && address.DerivationPath() == testSweepChangePath {
+			return address, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failed to find an address to keep the rest of the funds")
+}
+
+// BuildTestSweepTx builds and signs a transaction that sends an amount to the sweep address, and
+// the rest, minus the fee, to a change address of the wallet.
+func (s *Sweeper) BuildTestSweepTx(utxos []*scanner.Utxo, amount sats.Amount, change libwallet.MuunAddress, fee sats.Amount) (*wire.MsgTx, error) {
+	rawTx, err := s.buildTestSweepTx(utxos, amount, change, fee)
+	if err != nil {
+		return nil, err
+	}
+
+	rawTx, err = withLockTime(rawTx, s.LockTime)
+	if err != nil {
+		return nil, err
+	}
+
+	placeholderTx, err := withPlaceholderSignatures(rawTx, utxos)
+	if err != nil {
+		return nil, err
+	}
+
+	signedTx, err := s.signTx(utxos, rawTx)
+	if err != nil {
+		return nil, err
+	}
+
+	return signedTx, checkSignedSize(signedTx, placeholderTx)
+}
+
+func (s *Sweeper) buildTestSweepTx(utxos []*scanner.Utxo, amount sats.Amount, change libwallet.MuunAddress, fee sats.Amount) ([]byte, error) {
+	tx := wire.NewMsgTx(2)
+
+	for _, utxo := range utxos {
+		chainHash, err := chainhash.NewHashFromStr(utxo.TxID)
+		if err != nil {
+			return nil, err
+		}
+
+		outpoint := wire.OutPoint{
+			Hash:  *chainHash,
+			Index: uint32(utxo.OutputIndex),
+		}
+
+		tx.AddTxIn(wire.NewTxIn(&outpoint, []byte{}, [][]byte{}))
+	}
+
+	value, err := scanner.Total(utxos)
+	if err != nil {
+		return nil, err
+	}
+
+	spent, err := amount.Add(fee)
+	if err != nil {
+		return nil, err
+	}
+
+	destinationScript, err := payto.Script(s.SweepAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	changeScript, err := getChangeScript(change)
+	if err != nil {
+		return nil, err
+	}
+
+	changeValue, err := value.Sub(spent)
+	if err != nil || changeValue < dustThresholdFor(changeScript) {
+		return nil, utils.WrapError(
+			utils.ErrInsufficientFunds,
+			fmt.Errorf("change of %d sats after a %d sats fee is below the dust threshold", changeValue, fee),
+		)
+	}
+
+	tx.AddTxOut(wire.NewTxOut(int64(amount), destinationScript))
+	tx.AddTxOut(wire.NewTxOut(int64(changeValue), changeScript))
+
+	writer := &bytes.Buffer{}
+	if err := tx.Serialize(writer); err != nil {
+		return nil, err
+	}
+
+	return writer.Bytes(), nil
+}
+
+func getChangeScript(address libwallet.MuunAddress) ([]byte, error) {
+	decoded, err := btcutilw.DecodeAddress(address.Address(), &chainParams)
+	if err != nil {
+		return nil, fmt.Errorf("invalid change address: %w", err)
+	}
+
+	return payto.Script(decoded)
+}
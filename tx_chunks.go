@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// A signed transaction can be exported as a series of short text chunks, for users who can't
+// broadcast it themselves and must relay it over constrained channels (SMS, satellite messengers).
+// Anyone receiving the chunks can rebuild and broadcast the transaction.
+//
+// Each chunk is one line:
+//
+//	MRT <index>/<total> <tx id prefix> <payload> <checksum>
+//
+// The payload is a slice of the raw transaction in base32, which survives case changes and
+// contains no symbols that messaging apps like to mangle. The checksum covers the rest of the line,
+// so damaged chunks are detected individually and can be re-sent. The whole transaction is checked
+// against the tx ID prefix once rebuilt.
+const (
+	txChunkPrefix        = "MRT"
+	txChunkIDLength      = 8
+	txChunkChecksumBytes = 4
+)
+
+// defaultTxChunkSize keeps each chunk, with its header, within a single 160-character SMS.
+const defaultTxChunkSize = 120
+
+var txChunkEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// encodeTxChunks splits a transaction into chunks with payloads of up to `size` characters.
+func encodeTxChunks(tx *wire.MsgTx, size int) ([]string, error) {
+	var buf bytes.Buffer
+	if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		return nil, fmt.Errorf("failed to encode tx: %w", err)
+	}
+
+	encoded := txChunkEncoding.EncodeToString(buf.Bytes())
+	txID := tx.TxHash().String()[:txChunkIDLength]
+
+	total := (len(encoded) + size - 1) / size
+	var chunks []string
+
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+
+		body := fmt.Sprintf("%s %d/%d %s %s", txChunkPrefix, i+1, total, txID, encoded[i*size:end])
+		chunks = append(chunks, body+" "+txChunkChecksum(body))
+	}
+
+	return chunks, nil
+}
+
+func txChunkChecksum(body string) string {
+	hash := sha256.Sum256([]byte(body))
+	return txChunkEncoding.EncodeToString(hash[:txChunkChecksumBytes])
+}
+
+// txChunk is a parsed chunk.
+type txChunk struct {
+	index   int
+	total   int
+	txID    string
+	payload string
+}
+
+// parseTxChunk parses a line with a chunk, verifying its checksum. Lines are upper-cased first,
+// since some channels change the case of messages.
+func parseTxChunk(line string) (*txChunk, error) {
+	fields := strings.Fields(strings.ToUpper(line))
+
+	if len(fields) != 5 || fields[0] != txChunkPrefix {
+		return nil, fmt.Errorf("not a transaction chunk")
+	}
+
+	// The tx ID prefix is hex, and was lower-case originally:
+	fields[2] = strings.ToLower(fields[2])
+
+	body := strings.Join(fields[:4], " ")
+	if txChunkChecksum(body) != fields[4] {
+		return nil, fmt.Errorf("chunk %s is damaged (checksum mismatch)", fields[1])
+	}
+
+	position := strings.Split(fields[1], "/")
+	if len(position) != 2 {
+		return nil, fmt.Errorf("invalid chunk position %s", fields[1])
+	}
+
+	index, err1 := strconv.Atoi(position[0])
+	total, err2 := strconv.Atoi(position[1])
+
+	if err1 != nil || err2 != nil || index < 1 || index > total {
+		return nil, fmt.Errorf("invalid chunk position %s", fields[1])
+	}
+
+	return &txChunk{index, total, fields[2], fields[3]}, nil
+}
+
+// decodeTxChunks rebuilds a transaction from its chunks, in any order. Lines that aren't chunks are
+// ignored, so whole conversations can be pasted. Missing or damaged chunks are reported by index.
+func decodeTxChunks(lines []string) (*wire.MsgTx, error) {
+	chunks := make(map[int]*txChunk)
+	var damaged []string
+	var total int
+	var txID string
+
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(line)), txChunkPrefix+" ") {
+			continue
+		}
+
+		chunk, err := parseTxChunk(line)
+		if err != nil {
+			damaged = append(damaged, err.Error())
+			continue
+		}
+
+		if txID == "" {
+			txID, total = chunk.txID, chunk.total
+
+		} else if chunk.txID != txID || chunk.total != total {
+			return nil, fmt.Errorf("chunks from different transactions were mixed (%s and %s)", txID, chunk.txID)
+		}
+
+		chunks[chunk.index] = chunk
+	}
+
+	if txID == "" {
+		return nil, fmt.Errorf("no transaction chunks found")
+	}
+
+	var missing []string
+	for i := 1; i <= total; i++ {
+		if _, ok := chunks[i]; !ok {
+			missing = append(missing, strconv.Itoa(i))
+		}
+	}
+
+	if len(missing) > 0 {
+		err := fmt.Errorf("missing chunks %s of %d", strings.Join(missing, ", "), total)
+
+		if len(damaged) > 0 {
+			sort.Strings(damaged)
+			err = fmt.Errorf("%w: %s", err, strings.Join(damaged, "; "))
+		}
+
+		return nil, err
+	}
+
+	var encoded strings.Builder
+	for i := 1; i <= total; i++ {
+		encoded.WriteString(chunks[i].payload)
+	}
+
+	raw, err := txChunkEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode transaction: %w", err)
+	}
+
+	tx := wire.NewMsgTx(0)
+	if err := tx.BtcDecode(bytes.NewReader(raw), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		return nil, fmt.Errorf("failed to decode transaction: %w", err)
+	}
+
+	if !strings.HasPrefix(tx.TxHash().String(), txID) {
+		return nil, fmt.Errorf("rebuilt transaction doesn't match its ID %s", txID)
+	}
+
+	return tx, nil
+}
+
+// writeTxChunks saves the chunks of a transaction to a file, or prints them if the path is "-".
+func writeTxChunks(path string, tx *wire.MsgTx) error {
+	chunks, err := encodeTxChunks(tx, defaultTxChunkSize)
+	if err != nil {
+		return err
+	}
+
+	text := strings.Join(chunks, "\n") + "\n"
+
+	if path == "-" {
+		fmt.Fprint(userOutput, text)
+		return nil
+	}
+
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		return fmt.Errorf("failed to save chunks: %w", err)
+	}
+
+	return nil
+}
+
+// runRebroadcastFromChunksCommand rebuilds a transaction from chunks in a file (or pasted in the
+// terminal), and broadcasts it.
+func runRebroadcastFromChunksCommand(args []string) {
+	if len(args) > 1 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	var input io.Reader = os.Stdin
+
+	if len(args) == 1 {
+		file, err := os.Open(args[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		defer file.Close()
+
+		input = file
+
+	} else {
+		sayBlock(`
+			{yellow Paste the transaction chunks}, in any order, and then an empty line
+		`)
+	}
+
+	var lines []string
+	lineScanner := bufio.NewScanner(input)
+
+	for lineScanner.Scan() {
+		line := lineScanner.Text()
+		if len(args) == 0 && strings.TrimSpace(line) == "" && len(lines) > 0 {
+			break
+		}
+
+		lines = append(lines, line)
+	}
+
+	transports, err := parseBroadcastTransports(*broadcastVia)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	tx, err := decodeTxChunks(lines)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	sayBlock("Sending transaction {white %s}...\n", tx.TxHash())
+
+	if err := broadcastWithFallback(tx, transports); err != nil {
+		exitWithError(err)
+	}
+
+	recordCaseEvent(currentTag(), "sent", "Sent transaction %s from chunks", tx.TxHash())
+
+	sayBlock(`
+		Transaction sent! You can check the status here: https://blockstream.info/tx/%v
+		(it will appear in Blockstream after a short delay)
+
+	`, tx.TxHash())
+}
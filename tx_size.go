@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/scanner"
+)
+
+// Transactions are sized before signing them, with placeholder signatures and scripts as large as
+// the real ones can be. Sizing a signed transaction instead needed the keys, and the fee drifted
+// from the chosen rate, since signatures vary in size from one signing to the next.
+//
+// Real signatures can be smaller than the placeholders, but never larger: the fee rate paid is
+// the chosen one, or a hair above.
+const (
+	maxSignatureSize     = 72 // ECDSA, DER-encoded with a low S, plus the sighash type
+	schnorrSignatureSize = 65 // plus the sighash type, which libwallet always includes
+	pubKeySize           = 33 // compressed
+	multisigScriptSize   = 71 // OP_2 <user key> <muun key> OP_2 OP_CHECKMULTISIG
+	nestedScriptSize     = 34 // OP_0 <witness script hash>
+)
+
+// withPlaceholderSignatures decodes an unsigned transaction spending the given outputs, and fills
+// its inputs with placeholders the size of their signatures.
+func withPlaceholderSignatures(rawTx []byte, utxos []*scanner.Utxo) (*wire.MsgTx, error) {
+	tx := wire.NewMsgTx(0)
+	if err := tx.Deserialize(bytes.NewReader(rawTx)); err != nil {
+		return nil, fmt.Errorf("failed to decode unsigned tx: %w", err)
+	}
+
+	if len(tx.TxIn) != len(utxos) {
+		return nil, fmt.Errorf("the transaction has %d inputs, expected %d", len(tx.TxIn), len(utxos))
+	}
+
+	for i, utxo := range utxos {
+		if err := addPlaceholderSignatures(tx.TxIn[i], utxo); err != nil {
+			return nil, err
+		}
+	}
+
+	return tx, nil
+}
+
+func addPlaceholderSignatures(txIn *wire.TxIn, utxo *scanner.Utxo) error {
+	signature := make([]byte, maxSignatureSize)
+	multisigScript := make([]byte, multisigScriptSize)
+
+	// Outputs from another wallet, with no Muun address, are native segwit single-key outputs
+	// (see feeInput):
+	if utxo.Address == nil {
+		txIn.Witness = wire.TxWitness{signature, make([]byte, pubKeySize)}
+		return nil
+	}
+
+	switch utxo.Address.Version() {
+	case libwallet.AddressVersionV1:
+		script, err := txscript.NewScriptBuilder().AddData(signature).AddData(make([]byte, pubKeySize)).Script()
+		if err != nil {
+			return err
+		}
+
+		txIn.SignatureScript = script
+
+	case libwallet.AddressVersionV2:
+		script, err := txscript.NewScriptBuilder().
+			AddOp(txscript.OP_0).
+			AddData(signature).
+			AddData(signature).
+			AddData(multisigScript).
+			Script()
+
+		if err != nil {
+			return err
+		}
+
+		txIn.SignatureScript = script
+
+	case libwallet.AddressVersionV3:
+		script, err := txscript.NewScriptBuilder().AddData(make([]byte, nestedScriptSize)).Script()
+		if err != nil {
+			return err
+		}
+
+		txIn.SignatureScript = script
+		txIn.Witness = wire.TxWitness{[]byte{}, signature, signature, multisigScript}
+
+	case libwallet.AddressVersionV4:
+		txIn.Witness = wire.TxWitness{[]byte{}, signature, signature, multisigScript}
+
+	case libwallet.AddressVersionV5:
+		txIn.Witness = wire.TxWitness{make([]byte, schnorrSignatureSize)}
+
+	default:
+		return fmt.Errorf("can't size inputs from version %d addresses", utxo.Address.Version())
+	}
+
+	return nil
+}
+
+// virtualSize returns the size of a transaction in virtual bytes, the unit fee rates are given in.
+func virtualSize(tx *wire.MsgTx) int64 {
+	weight := blockchain.GetTransactionWeight(btcutil.NewTx(tx))
+	return (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor
+}
+
+// checkSignedSize makes sure the signed transaction is no larger than its placeholder version,
+// which would pay a lower fee rate than the user chose.
+func checkSignedSize(signedTx, placeholderTx *wire.MsgTx) error {
+	signed, expected := virtualSize(signedTx), virtualSize(placeholderTx)
+
+	if signed > expected {
+		return fmt.Errorf("the signed transaction is %d vbytes, larger than the expected %d", signed, expected)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package txcache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/utils"
+)
+
+// DefaultMaxBytes is the default size limit for the on-disk store.
+const DefaultMaxBytes = 64 * 1024 * 1024
+
+// Store is a content-addressed, on-disk cache of raw transactions, keyed by transaction ID.
+//
+// Entries are verified on the way in and on the way out: a transaction is only returned if its
+// contents hash to the requested ID, so a corrupted (or tampered) cache can cost us a download,
+// but never feed us the wrong transaction. Corrupted entries are removed.
+//
+// When the store grows beyond its size limit, the least recently used entries are evicted.
+// It's thread-safe.
+type Store struct {
+	dir      string
+	maxBytes int64
+	mu       sync.Mutex
+	log      utils.Logger
+}
+
+// DefaultDir returns the location of the store in the user's cache directory.
+func DefaultDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(cacheDir, "muun-recovery", "txs"), nil
+}
+
+// Open creates a Store in the given directory, creating it if needed.
+func Open(dir string, maxBytes int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create tx cache: %w", err)
+	}
+
+	return &Store{
+		dir:      dir,
+		maxBytes: maxBytes,
+		log:      utils.NewLogger("TxCache"),
+	}, nil
+}
+
+// Get returns the cached transaction with the given ID, if present and intact.
+func (s *Store) Get(txID string) (*wire.MsgTx, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, ok := s.pathFor(txID)
+	if !ok {
+		return nil, false
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	tx, err := Verify(txID, raw)
+	if err != nil {
+		s.log.Printf("Removing corrupted entry %s: %v", txID, err)
+		os.Remove(path)
+		return nil, false
+	}
+
+	// Touch the file, to keep track of recent usage for eviction:
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	return tx, true
+}
+
+// Put stores a transaction under its own ID.
+func (s *Store) Put(tx *wire.MsgTx) error {
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return fmt.Errorf("failed to serialize tx: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, _ := s.pathFor(tx.TxHash().String())
+
+	// Write to a temporary file and rename, so readers never see a partial entry:
+	tmpPath := path + ".tmp"
+
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write tx: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write tx: %w", err)
+	}
+
+	return s.evict()
+}
+
+// Verify decodes a raw transaction and checks that it hashes to the expected ID.
+func Verify(txID string, raw []byte) (*wire.MsgTx, error) {
+	expected, err := chainhash.NewHashFromStr(txID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tx id %s: %w", txID, err)
+	}
+
+	tx := wire.NewMsgTx(0)
+	if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("failed to decode tx %s: %w", txID, err)
+	}
+
+	if actual := tx.TxHash(); !actual.IsEqual(expected) {
+		return nil, fmt.Errorf("tx hash mismatch: expected %s, got %s", txID, actual)
+	}
+
+	return tx, nil
+}
+
+// pathFor returns the file path for a transaction ID, refusing anything that isn't a hash.
+func (s *Store) pathFor(txID string) (string, bool) {
+	hash, err := chainhash.NewHashFromStr(txID)
+	if err != nil || hash.String() != txID {
+		return "", false
+	}
+
+	return filepath.Join(s.dir, txID), true
+}
+
+// evict removes the least recently used entries until the store fits its size limit.
+func (s *Store) evict() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list tx cache: %w", err)
+	}
+
+	var totalBytes int64
+	for _, file := range files {
+		totalBytes += file.Size()
+	}
+
+	if totalBytes <= s.maxBytes {
+		return nil
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	for _, file := range files {
+		if totalBytes <= s.maxBytes {
+			break
+		}
+
+		if err := os.Remove(filepath.Join(s.dir, file.Name())); err != nil {
+			return fmt.Errorf("failed to evict %s: %w", file.Name(), err)
+		}
+
+		totalBytes -= file.Size()
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/recovery/sats"
+)
+
+// typedAmountTolerance is how far the amount typed by the user can be from the real one, as a
+// fraction of it. It only needs to catch misunderstandings, such as an extra zero, not rounding.
+const typedAmountTolerance = 0.05
+
+// readTypedAmount asks the user to type the amount about to be sent, in BTC, before sending large
+// amounts. Converting it from the sats in the summary makes them read it, instead of just
+// confirming it.
+func readTypedAmount(value sats.Amount) {
+	sayBlock(`
+		{yellow You're about to send a large amount}
+		To make sure it's what you expect, type the amount in the summary, in BTC (such as 1.25)
+	`)
+
+	typed, ok := parseBTC(askLine())
+	if ok && math.Abs(float64(typed-int64(value))) <= typedAmountTolerance*float64(value) {
+		return
+	}
+
+	sayBlock(`
+		{red That's not the amount to send.} The transaction sends %v sats, that is %s.
+		If you expected a different amount, don't send it: check your wallet first.
+	`, value, btcutil.Amount(value).String())
+
+	if !readYesNo("Type the amount again?") {
+		stopAtConfirmation()
+	}
+
+	readTypedAmount(value)
+}
+
+// parseBTC parses an amount in BTC, with either a point or a comma as decimal separator, and
+// returns it in sats.
+func parseBTC(input string) (int64, bool) {
+	input = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(input)), "btc")
+	input = strings.Replace(strings.TrimSpace(input), ",", ".", 1)
+
+	btc, err := strconv.ParseFloat(input, 64)
+	if err != nil || btc <= 0 || math.IsInf(btc, 0) {
+		return 0, false
+	}
+
+	amount, err := btcutil.NewAmount(btc)
+	if err != nil {
+		return 0, false
+	}
+
+	return int64(amount), true
+}
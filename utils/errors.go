@@ -0,0 +1,78 @@
+package utils
+
+import "errors"
+
+// Sentinel errors for the failure conditions callers may want to handle specifically. Match them
+// with `errors.Is`, since they're usually wrapped with more details (see `WrapError`).
+var (
+	// ErrInvalidRecoveryCode means the Recovery Code is malformed, couldn't produce a key, or is
+	// likely not the one the keys were encrypted with.
+	ErrInvalidRecoveryCode = errors.New("invalid recovery code")
+
+	// ErrInvalidKey means an encrypted key is malformed, and couldn't be decoded.
+	ErrInvalidKey = errors.New("invalid encrypted key")
+
+	// ErrKeyVersionUnsupported means an encrypted key or kit uses a format we don't know.
+	ErrKeyVersionUnsupported = errors.New("unsupported key version")
+
+	// ErrDecryptionFailed means the keys couldn't be decrypted, usually due to a wrong Recovery Code.
+	ErrDecryptionFailed = errors.New("key decryption failed")
+
+	// ErrKeyAuthFailed means a key couldn't be authenticated once decrypted. Kits encrypt keys
+	// without a tag or signature, so this is a well-formed ciphertext that doesn't decrypt to a key.
+	ErrKeyAuthFailed = errors.New("key authentication failed")
+
+	// ErrKeyMismatch means a key was decrypted, but it isn't the one the Emergency Kit describes.
+	ErrKeyMismatch = errors.New("decrypted key doesn't match the kit")
+
+	// ErrWrongDerivationPath means the Emergency Kit describes a key at a derivation path other than
+	// the one Muun wallets use.
+	ErrWrongDerivationPath = errors.New("wrong derivation path")
+
+	// ErrBackendUnavailable means no server could fulfill a request after retrying.
+	ErrBackendUnavailable = errors.New("backend unavailable")
+
+	// ErrInsufficientFunds means the funds can't cover the fee and still leave a spendable output.
+	ErrInsufficientFunds = errors.New("insufficient funds")
+
+	// ErrFundsSpent means the outputs to send were spent, or are being spent, by another
+	// transaction.
+	ErrFundsSpent = errors.New("funds already spent")
+
+	// ErrBroadcastFailed means the transaction was rejected or couldn't be sent.
+	ErrBroadcastFailed = errors.New("broadcast failed")
+
+	// ErrWrongNetwork means a server or address belongs to a chain other than Bitcoin mainnet.
+	ErrWrongNetwork = errors.New("wrong network")
+
+	// ErrNetworkBlocked means a connection was attempted while the network was blocked (see
+	// `BlockNetwork`).
+	ErrNetworkBlocked = errors.New("network blocked")
+)
+
+// WrapError tags an error with a sentinel, so that `errors.Is` matches both the sentinel and
+// anything in the original error chain. The message is that of the original error.
+func WrapError(sentinel error, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &wrappedError{sentinel, err}
+}
+
+type wrappedError struct {
+	sentinel error
+	err      error
+}
+
+func (e *wrappedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *wrappedError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.err
+}
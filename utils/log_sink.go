@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel tells debugging details apart from errors.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	if l == LevelError {
+		return "error"
+	}
+
+	return "debug"
+}
+
+// LogEntry is a line logged by a Logger, as a LogSink receives it. The message and the field values
+// are redacted, and the values are formatted as strings.
+type LogEntry struct {
+	Time       time.Time
+	Level      LogLevel
+	Context    string // see SetLogContext
+	Tag        string
+	Message    string
+	Fields     []Field
+	Suppressed int // lines like this one dropped before it by the rate limit
+}
+
+// LogSink receives the lines logged by every Logger, so programs embedding the Recovery Tool can
+// route them into their own logs or telemetry, instead of capturing the console. Log can be
+// called from several goroutines at once.
+type LogSink interface {
+	Log(entry LogEntry)
+}
+
+var logSink struct {
+	sync.RWMutex
+	sink LogSink
+}
+
+// SetLogSink sends every line logged from now on to a sink, whether debugging or not. Passing nil
+// stops it.
+func SetLogSink(sink LogSink) {
+	logSink.Lock()
+	defer logSink.Unlock()
+
+	logSink.sink = sink
+}
+
+func currentLogSink() LogSink {
+	logSink.RLock()
+	defer logSink.RUnlock()
+
+	return logSink.sink
+}
+
+func newLogEntry(level LogLevel, tag string, message string, fields []Field, suppressed int) LogEntry {
+	entry := LogEntry{
+		Time:       time.Now().UTC(),
+		Level:      level,
+		Context:    logContext,
+		Tag:        tag,
+		Message:    Redact(message),
+		Suppressed: suppressed,
+	}
+
+	for _, field := range fields {
+		entry.Fields = append(entry.Fields, Field{field.Key, Redact(fmt.Sprint(field.Value))})
+	}
+
+	return entry
+}
+
+// String formats an entry as a line for the console.
+func (e LogEntry) String() string {
+	var line strings.Builder
+
+	fmt.Fprintf(&line, "%s ", FormatTime(e.Time))
+
+	if e.Context != "" {
+		fmt.Fprintf(&line, "[%s] ", e.Context)
+	}
+
+	fmt.Fprintf(&line, "[%s] %s", e.Tag, e.Message)
+
+	for _, field := range e.Fields {
+		fmt.Fprintf(&line, " %s=%v", field.Key, field.Value)
+	}
+
+	if e.Suppressed > 0 {
+		fmt.Fprintf(&line, " (%d similar lines dropped)", e.Suppressed)
+	}
+
+	return line.String()
+}
+
+// redactedRes match secrets that must never be logged, whatever the code logging them: Recovery
+// Codes, extended private keys, private keys in WIF, and keys encrypted with BIP-38.
+var redactedRes = []*regexp.Regexp{
+	regexp.MustCompile(`\b[A-Z0-9]{4}(-[A-Z0-9]{4}){7}\b`),
+	regexp.MustCompile(`\b[xt]prv[1-9A-HJ-NP-Za-km-z]{100,}\b`),
+	regexp.MustCompile(`\b[5KLc9][1-9A-HJ-NP-Za-km-z]{50,51}\b`),
+	regexp.MustCompile(`\b6P[1-9A-HJ-NP-Za-km-z]{56}\b`),
+}
+
+// Redact replaces the secrets in a text with a placeholder.
+func Redact(text string) string {
+	for _, re := range redactedRes {
+		text = re.ReplaceAllString(text, "[redacted]")
+	}
+
+	return text
+}
@@ -2,52 +2,159 @@ package utils
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 // DebugMode is true when the `DEBUG` environment variable is set to "true".
 var DebugMode bool = os.Getenv("DEBUG") == "true"
 
-// Logger provides logging methods that only print when `DebugMode` is true.
-// This allows callers to log detailed information without displaying it to users during normal
-// execution.
-type Logger struct {
-	tag string
+// DebugOutput is where lines are printed in DebugMode.
+var DebugOutput io.Writer = os.Stdout
+
+// logContext is prepended to the lines of every Logger, see SetLogContext.
+var logContext string
+
+// SetLogContext sets what every Logger prints before its tag, such as the wallet being recovered,
+// so logs of different recoveries can be told apart.
+func SetLogContext(context string) {
+	logContext = context
+}
+
+// Logger is what every part of the Recovery Tool logs through. Lines are printed to the console
+// only when `DebugMode` is true, so callers can log detailed information without displaying it to
+// users during normal execution. Programs embedding the tool can receive every line, whether
+// debugging or not, with SetLogSink.
+//
+// Lines are redacted (see Redact), and rate limited: a line logged in a loop, such as a failing
+// server being retried, is dropped after a few times, and the drops are counted.
+type Logger interface {
+	// Printf logs a line, formatted like fmt.Printf.
+	Printf(format string, v ...interface{})
+
+	// Errorf works like fmt.Errorf, and logs the error too.
+	Errorf(format string, v ...interface{}) error
+
+	// With returns a Logger that adds the given fields to each line.
+	With(fields ...Field) Logger
+
+	// SetTag updates the tag of this Logger.
+	SetTag(newTag string)
+}
+
+// Field is a piece of structured information attached to the lines of a Logger.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F is shorthand for a Field.
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// logBurst is how many lines with the same tag and format are logged in each logWindow. The rest
+// are dropped, and counted in the next line that gets through.
+const logBurst = 20
+
+const logWindow = 10 * time.Second
+
+// limiter is shared by every Logger, so the limits apply to lines logged from anywhere.
+var limiter = &rateLimiter{windows: make(map[string]*rateWindow)}
+
+type tagLogger struct {
+	tag    string
+	fields []Field
 }
 
 // NewLogger returns an initialized Logger instance.
-func NewLogger(tag string) *Logger {
-	return &Logger{tag}
+func NewLogger(tag string) Logger {
+	return &tagLogger{tag: tag}
 }
 
-// SetTag updates the tag of this Logger.
-func (l *Logger) SetTag(newTag string) {
+func (l *tagLogger) SetTag(newTag string) {
 	l.tag = newTag
 }
 
-// Printf works like fmt.Printf, but only prints when `DebugMode` is true.
-func (l *Logger) Printf(format string, v ...interface{}) {
-	if !DebugMode {
-		return
+func (l *tagLogger) With(fields ...Field) Logger {
+	return &tagLogger{
+		tag:    l.tag,
+		fields: append(append([]Field{}, l.fields...), fields...),
 	}
+}
 
-	message := strings.TrimSpace(fmt.Sprintf(format, v...))
+func (l *tagLogger) Printf(format string, v ...interface{}) {
+	if !DebugMode && currentLogSink() == nil {
+		return
+	}
 
-	fmt.Printf("%s %s\n", l.getPrefix(), message)
+	l.log(LevelDebug, format, strings.TrimSpace(fmt.Sprintf(format, v...)))
 }
 
-// Errorf works like fmt.Errorf, but prints the error to the console if `DebugMode` is true.
-func (l *Logger) Errorf(format string, v ...interface{}) error {
+func (l *tagLogger) Errorf(format string, v ...interface{}) error {
 	err := fmt.Errorf(format, v...)
 
-	if DebugMode {
-		fmt.Printf("%s %v\n", l.getPrefix(), err)
+	if DebugMode || currentLogSink() != nil {
+		l.log(LevelError, format, err.Error())
 	}
 
 	return err
 }
 
-func (l *Logger) getPrefix() string {
-	return fmt.Sprintf("[%s]", l.tag)
+func (l *tagLogger) log(level LogLevel, format string, message string) {
+	suppressed, ok := limiter.allow(l.tag+"\x00"+format, time.Now())
+	if !ok {
+		return
+	}
+
+	entry := newLogEntry(level, l.tag, message, l.fields, suppressed)
+
+	if DebugMode {
+		fmt.Fprintln(DebugOutput, entry.String())
+	}
+
+	if sink := currentLogSink(); sink != nil {
+		sink.Log(entry)
+	}
+}
+
+// rateLimiter counts the lines logged with each key, in windows of logWindow.
+type rateLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// allow returns whether a line can be logged now, and how many lines with the same key were
+// dropped before it, in the last window.
+func (r *rateLimiter) allow(key string, now time.Time) (suppressed int, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	window := r.windows[key]
+
+	if window == nil || now.Sub(window.start) >= logWindow {
+		if window != nil {
+			suppressed = window.suppressed
+		}
+
+		r.windows[key] = &rateWindow{start: now, count: 1}
+		return suppressed, true
+	}
+
+	if window.count < logBurst {
+		window.count++
+		return 0, true
+	}
+
+	window.suppressed++
+	return 0, false
 }
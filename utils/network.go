@@ -0,0 +1,26 @@
+package utils
+
+import "sync/atomic"
+
+// networkBlocked is 1 while outgoing connections are forbidden.
+var networkBlocked int32
+
+// BlockNetwork forbids outgoing connections until AllowNetwork is called. Code that connects
+// anywhere must call CheckNetwork first.
+func BlockNetwork() {
+	atomic.StoreInt32(&networkBlocked, 1)
+}
+
+// AllowNetwork lifts the block set by BlockNetwork.
+func AllowNetwork() {
+	atomic.StoreInt32(&networkBlocked, 0)
+}
+
+// CheckNetwork returns ErrNetworkBlocked if outgoing connections are forbidden.
+func CheckNetwork() error {
+	if atomic.LoadInt32(&networkBlocked) == 1 {
+		return ErrNetworkBlocked
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// LibraryMode is set by applications that embed the recovery packages. When true, panics raised
+// while processing untrusted input (or by dependencies that panic instead of returning errors)
+// are converted to `ErrInternal` at the API boundary, instead of crashing the host application.
+//
+// The command-line tool leaves it unset, so that bugs produce a full stack trace for reports.
+var LibraryMode = false
+
+// ErrInternal means an unexpected condition was caught while in `LibraryMode`.
+var ErrInternal = errors.New("internal error")
+
+// RecoverPanic converts a panic into an error assigned to `errp`, when in `LibraryMode`. It must be
+// called directly with defer:
+//
+//	defer utils.RecoverPanic(&err)
+func RecoverPanic(errp *error) {
+	if !LibraryMode {
+		return
+	}
+
+	if r := recover(); r != nil {
+		*errp = fmt.Errorf("%w: %v", ErrInternal, r)
+	}
+}
+
+// CheckRandomness verifies that the system's secure random source works. Some of our dependencies
+// panic when it doesn't, so we check before calling them.
+func CheckRandomness() error {
+	buf := make([]byte, 32)
+
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Errorf("%w: secure random source unavailable: %v", ErrInternal, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyDialer connects through the proxy given to UseProxy, or is nil to connect directly.
+var proxyDialer proxy.ContextDialer
+
+// UseProxy sends outgoing connections through a SOCKS5 proxy, such as Tor's, from now on: those
+// made with Dial, and those of HTTP clients using the default transport. Host names are resolved
+// by the proxy, so .onion addresses can be reached, and no DNS query leaves from here. Connections
+// to this same computer (a local node, say) don't go through the proxy, as Tor would refuse them.
+func UseProxy(rawURL string) error {
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil || (proxyURL.Scheme != "socks5" && proxyURL.Scheme != "socks5h") || proxyURL.Hostname() == "" {
+		return fmt.Errorf("invalid proxy %q, it must be a SOCKS5 proxy, as in socks5://127.0.0.1:9050", rawURL)
+	}
+
+	dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
+	if err != nil {
+		return fmt.Errorf("invalid proxy %q: %w", rawURL, err)
+	}
+
+	perHost := proxy.NewPerHost(dialer, proxy.Direct)
+	perHost.AddFromString("localhost,127.0.0.0/8,::1/128")
+
+	proxyDialer = perHost
+
+	transport := http.DefaultTransport.(*http.Transport)
+	transport.Proxy = nil
+	transport.DialContext = proxyDialer.DialContext
+
+	return nil
+}
+
+// UsingProxy tells whether connections go through a proxy (see UseProxy).
+func UsingProxy() bool {
+	return proxyDialer != nil
+}
+
+// Dial connects to an address, through the proxy if there's one, giving up after timeout.
+func Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	if proxyDialer == nil {
+		return net.DialTimeout(network, address, timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return proxyDialer.DialContext(ctx, network, address)
+}
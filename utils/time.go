@@ -0,0 +1,16 @@
+package utils
+
+import "time"
+
+// Recovery reports are often kept as evidence, and a time that could be read as two different
+// moments leads to disputes. Times are recorded in UTC, and shown to users in their own timezone
+// (from TZ, or the system's), always with its offset from UTC. The order is ISO 8601's, the same
+// whatever the locale, as Go has no locale data to format dates with.
+
+// TimeLayout is how times are shown to users.
+const TimeLayout = "2006-01-02 15:04:05 -07:00"
+
+// FormatTime returns a time as shown to users: in their timezone, with its offset from UTC.
+func FormatTime(t time.Time) string {
+	return t.Local().Format(TimeLayout)
+}
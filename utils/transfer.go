@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Bytes sent and received through the connections wrapped with CountTransfer, updated atomically.
+var bytesSent, bytesReceived int64
+
+// countingConn is a connection that adds what goes through it to the totals.
+type countingConn struct {
+	net.Conn
+}
+
+// CountTransfer wraps a connection, to count what goes through it in the totals returned by
+// TransferredBytes. Wrap the plain connection, under TLS, to count the whole transfer.
+func CountTransfer(conn net.Conn) net.Conn {
+	return &countingConn{conn}
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&bytesReceived, int64(n))
+
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&bytesSent, int64(n))
+
+	return n, err
+}
+
+// CountHTTPTransfers counts what HTTP clients using the default transport transfer, from now on.
+func CountHTTPTransfers() {
+	transport := http.DefaultTransport.(*http.Transport)
+	dial := transport.DialContext
+
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		return CountTransfer(conn), nil
+	}
+}
+
+// TransferredBytes returns the bytes sent and received through the counted connections so far.
+func TransferredBytes() (sent, received int64) {
+	return atomic.LoadInt64(&bytesSent), atomic.LoadInt64(&bytesReceived)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/scanner"
+)
+
+// Two scans with different servers can disagree: an output only one of them found, or found by
+// both with a different amount or height. Merging them as they come would let a single faulty
+// server add an output that doesn't exist, which makes the whole sweep invalid. reconcileScans
+// settles each disagreement with evidence that needs no trust in the servers, fetched from the
+// other side: the funding transaction, checked against its ID, and the merkle proof of the block
+// it was mined in.
+//
+// What the servers agree on is kept as it is. An output only one side found is kept if the
+// evidence backs it (the proof, if it's confirmed, or the transaction, if it's not), and left out
+// otherwise: if it does exist, it stays in the wallet for a later sweep.
+
+// evidenceSource fetches what's needed to settle a disagreement. A Scanner is one.
+type evidenceSource interface {
+	GetTransaction(txID string) (*wire.MsgTx, error)
+	GetInputEvidence(utxo *scanner.Utxo) (*scanner.InputEvidence, error)
+}
+
+// reconciliation is the result of reconciling two scans.
+type reconciliation struct {
+	Utxos         []*scanner.Utxo
+	Discrepancies []*utxoDiscrepancy
+}
+
+// utxoDiscrepancy is an output the scans disagreed about, and how it was settled.
+type utxoDiscrepancy struct {
+	Outpoint   string
+	Problem    string
+	Resolution string
+	Kept       bool
+}
+
+// utxoReports are the versions of an output each scan reported.
+type utxoReports struct {
+	first  *scanner.Utxo
+	second *scanner.Utxo
+}
+
+// reconcileScans combines the outputs found by two scans. Evidence for outputs only the first scan
+// found is fetched from the second scan's servers, and the other way around.
+func reconcileScans(first, second []*scanner.Utxo, firstSource, secondSource evidenceSource) *reconciliation {
+	var order []string
+	reports := make(map[string]*utxoReports)
+
+	add := func(utxo *scanner.Utxo, isFirst bool) {
+		outpoint := outpointOf(utxo)
+
+		r, ok := reports[outpoint]
+		if !ok {
+			r = &utxoReports{}
+			reports[outpoint] = r
+			order = append(order, outpoint)
+		}
+
+		// Duplicates within the same scan are the same report, the first one is kept:
+		if isFirst && r.first == nil {
+			r.first = utxo
+		} else if !isFirst && r.second == nil {
+			r.second = utxo
+		}
+	}
+
+	for _, utxo := range first {
+		add(utxo, true)
+	}
+
+	for _, utxo := range second {
+		add(utxo, false)
+	}
+
+	result := &reconciliation{}
+
+	for _, outpoint := range order {
+		r := reports[outpoint]
+
+		var utxo *scanner.Utxo
+		var discrepancy *utxoDiscrepancy
+
+		switch {
+		case r.second == nil:
+			utxo, discrepancy = reconcileOneSided(r.first, "only the first scan found it", secondSource)
+
+		case r.first == nil:
+			utxo, discrepancy = reconcileOneSided(r.second, "only the second scan found it", firstSource)
+
+		case r.first.Amount != r.second.Amount || !bytes.Equal(r.first.Script, r.second.Script):
+			utxo, discrepancy = reconcileContents(r, firstSource)
+
+		case r.first.Height != r.second.Height:
+			utxo, discrepancy = reconcileHeights(r, firstSource, secondSource)
+
+		default:
+			utxo = r.first
+		}
+
+		if discrepancy != nil {
+			discrepancy.Outpoint = outpoint
+			discrepancy.Kept = utxo != nil
+			result.Discrepancies = append(result.Discrepancies, discrepancy)
+		}
+
+		if utxo != nil {
+			result.Utxos = append(result.Utxos, utxo)
+		}
+	}
+
+	return result
+}
+
+// reconcileOneSided checks an output only one scan found, with the other side's servers.
+func reconcileOneSided(utxo *scanner.Utxo, problem string, source evidenceSource) (*scanner.Utxo, *utxoDiscrepancy) {
+	discrepancy := &utxoDiscrepancy{Problem: problem}
+
+	if utxo.Height > 0 {
+		evidence, err := source.GetInputEvidence(utxo)
+		if err != nil {
+			discrepancy.Resolution = fmt.Sprintf("left out, there's no proof it was mined in block %d: %v", utxo.Height, err)
+			return nil, discrepancy
+		}
+
+		discrepancy.Resolution = fmt.Sprintf("kept, proven to be in block %s", evidence.Header.BlockHash())
+		return utxo, discrepancy
+	}
+
+	// Unconfirmed outputs have no proof yet, but their transaction must exist:
+	if err := checkOutputInTx(utxo, source); err != nil {
+		discrepancy.Resolution = fmt.Sprintf("left out, its transaction couldn't be checked: %v", err)
+		return nil, discrepancy
+	}
+
+	discrepancy.Resolution = "kept, its transaction checks out, but it's unconfirmed"
+	return utxo, discrepancy
+}
+
+// reconcileContents settles a disagreement on the amount or script of an output, which are in the
+// transaction that made it.
+func reconcileContents(r *utxoReports, source evidenceSource) (*scanner.Utxo, *utxoDiscrepancy) {
+	discrepancy := &utxoDiscrepancy{
+		Problem: fmt.Sprintf("the scans reported different outputs (%v and %v sats)", r.first.Amount, r.second.Amount),
+	}
+
+	for _, utxo := range []*scanner.Utxo{r.first, r.second} {
+		err := checkOutputInTx(utxo, source)
+		if err == nil {
+			discrepancy.Resolution = fmt.Sprintf("kept the %v sats its transaction has", utxo.Amount)
+			return utxo, discrepancy
+		}
+	}
+
+	discrepancy.Resolution = "left out, its transaction matches neither"
+	return nil, discrepancy
+}
+
+// reconcileHeights settles a disagreement on when an output was mined, with the proof each side
+// can give. A confirmed height that can't be proven gives way to the other report.
+func reconcileHeights(r *utxoReports, firstSource, secondSource evidenceSource) (*scanner.Utxo, *utxoDiscrepancy) {
+	discrepancy := &utxoDiscrepancy{
+		Problem: fmt.Sprintf("the scans reported it at different heights (%d and %d)", r.first.Height, r.second.Height),
+	}
+
+	candidates := []struct {
+		utxo   *scanner.Utxo
+		source evidenceSource
+	}{
+		{r.first, secondSource},
+		{r.second, firstSource},
+	}
+
+	for _, candidate := range candidates {
+		if candidate.utxo.Height <= 0 {
+			continue
+		}
+
+		if evidence, err := candidate.source.GetInputEvidence(candidate.utxo); err == nil {
+			discrepancy.Resolution = fmt.Sprintf("kept at height %d, proven to be in block %s", candidate.utxo.Height, evidence.Header.BlockHash())
+			return candidate.utxo, discrepancy
+		}
+	}
+
+	// Neither height could be proven. Both scans found it, so it's kept, as unconfirmed:
+	utxo := *r.first
+	utxo.Height = 0
+
+	discrepancy.Resolution = "kept as unconfirmed, neither height could be proven"
+	return &utxo, discrepancy
+}
+
+// checkOutputInTx fetches the transaction that made an output, and checks it has the output.
+func checkOutputInTx(utxo *scanner.Utxo, source evidenceSource) error {
+	tx, err := source.GetTransaction(utxo.TxID)
+	if err != nil {
+		return err
+	}
+
+	if utxo.OutputIndex < 0 || utxo.OutputIndex >= len(tx.TxOut) {
+		return fmt.Errorf("transaction %s has no output %d", utxo.TxID, utxo.OutputIndex)
+	}
+
+	output := tx.TxOut[utxo.OutputIndex]
+	if output.Value != int64(utxo.Amount) || !bytes.Equal(output.PkScript, utxo.Script) {
+		return fmt.Errorf("output %s:%d doesn't match the transaction", utxo.TxID, utxo.OutputIndex)
+	}
+
+	return nil
+}
+
+// print reports the discrepancies, and how each one was settled.
+func (r *reconciliation) print() {
+	for _, d := range r.Discrepancies {
+		if d.Kept {
+			say("{yellow !} %s: %s, %s\n", d.Outpoint, d.Problem, d.Resolution)
+		} else {
+			say("{red ✗} %s: %s, %s\n", d.Outpoint, d.Problem, d.Resolution)
+		}
+	}
+}
+
+// dropped returns how many outputs were left out.
+func (r *reconciliation) dropped() int {
+	dropped := 0
+	for _, d := range r.Discrepancies {
+		if !d.Kept {
+			dropped++
+		}
+	}
+
+	return dropped
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/muun/recovery/utils"
+)
+
+// webhookTimeout bounds the time we wait for user-provided services. Notifying them is a courtesy,
+// it shouldn't keep the user waiting.
+const webhookTimeout = 30 * time.Second
+
+// watchRegistration is the body we POST to the watch service. The service is expected to alert
+// the user about any transaction spending from the address, other than `sweepTxID` itself.
+type watchRegistration struct {
+	Address   string `json:"address"`
+	SweepTxID string `json:"sweepTxId"`
+	Network   string `json:"network"`
+}
+
+// registerWatch asks a (usually self-hosted) watch service to monitor the destination address.
+// If the recovery keys were exposed during the process, this gives the user a chance to react to
+// an unexpected spend.
+func registerWatch(watchURL string, address string, sweepTxID string) error {
+	return postJSON(watchURL, &watchRegistration{address, sweepTxID, chainParams.Name})
+}
+
+// postJSON sends a JSON body to a user-provided HTTP endpoint, expecting a successful status.
+func postJSON(targetURL string, v interface{}) error {
+	parsedURL, err := url.Parse(targetURL)
+	if err != nil || (parsedURL.Scheme != "https" && parsedURL.Scheme != "http") || parsedURL.Host == "" {
+		return fmt.Errorf("invalid URL %q", targetURL)
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	if err := utils.CheckNetwork(); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+
+	res, err := client.Post(parsedURL.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to reach %s: %w", parsedURL.Host, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s responded with status %s", parsedURL.Host, res.Status)
+	}
+
+	return nil
+}